@@ -35,52 +35,267 @@ package e4
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	miscreant "github.com/miscreant/miscreant.go"
 	"golang.org/x/crypto/ed25519"
 
 	e4crypto "github.com/teserakt-io/e4go/crypto"
 	"github.com/teserakt-io/e4go/keys"
 )
 
-const (
-	idTopicPrefix = "e4/"
-)
-
 var (
 	// ErrTopicKeyNotFound occurs when a topic key is missing when encryption/decrypting
 	ErrTopicKeyNotFound = errors.New("topic key not found")
+	// ErrUnknownTopicKeyAge occurs when the install time of a topic key is unknown,
+	// such as for keys loaded from a client file written by a previous version
+	ErrUnknownTopicKeyAge = errors.New("topic key age is unknown")
 	// ErrUnsupportedOperation occurs when trying to manipulate client public keys with a ClientKey not supporting it
 	ErrUnsupportedOperation = errors.New("this operation is not supported")
+	// ErrUnauthenticatedCommand occurs when receiving a command not authenticated by the C2 key pair,
+	// on a client created with WithSignedCommandsOnly
+	ErrUnauthenticatedCommand = errors.New("command is not authenticated by the c2")
+	// ErrClientWiped occurs when using a client after it has been wiped
+	ErrClientWiped = errors.New("client has been wiped")
+	// ErrClientClosed occurs when using a client after it has been closed
+	ErrClientClosed = errors.New("client has been closed")
+	// ErrDuplicateCommand occurs when receiving a command which has already been applied
+	// less than crypto.MaxDelayKeyTransition ago
+	ErrDuplicateCommand = errors.New("command has already been applied")
+	// ErrCommandRateLimited occurs when receiving commands faster than the rate set with WithCommandRateLimit
+	ErrCommandRateLimited = errors.New("command rate limit exceeded")
+	// ErrPayloadTooLarge occurs when protecting a payload larger than the limit set with WithMaxPayloadBytes
+	ErrPayloadTooLarge = errors.New("payload too large")
+	// ErrInvalidTopicKey occurs when protecting a message with an invalid topic key, such as one loaded
+	// from a tampered client file. The returned error wraps it, and can be unwrapped with errors.Is or errors.Unwrap.
+	ErrInvalidTopicKey = errors.New("invalid topic key")
+	// ErrUnflushedChanges occurs when reloading a client created with WithDeferredPersistence which holds
+	// changes not flushed yet, as they would be lost
+	ErrUnflushedChanges = errors.New("client has changes which haven't been flushed")
+	// ErrInvalidKEK occurs when loading a client file which can't be decrypted with the key given with WithKEK
+	ErrInvalidKEK = errors.New("client file can't be decrypted with the key encryption key")
 )
 
+// invalidTopicKeyError describes why a topic key is invalid, and wraps ErrInvalidTopicKey
+type invalidTopicKeyError struct {
+	err error
+}
+
+// Error returns the error message, including the validation failure
+func (e invalidTopicKeyError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrInvalidTopicKey, e.err)
+}
+
+// Unwrap returns ErrInvalidTopicKey
+func (e invalidTopicKeyError) Unwrap() error {
+	return ErrInvalidTopicKey
+}
+
+// missingTopicKeysError lists the topics the client holds no key for, and wraps ErrTopicKeyNotFound
+type missingTopicKeysError struct {
+	topics []string
+}
+
+// Error returns the error message, including the topics without key
+func (e missingTopicKeysError) Error() string {
+	return fmt.Sprintf("%v for topics: %s", ErrTopicKeyNotFound, strings.Join(e.topics, ", "))
+}
+
+// Unwrap returns ErrTopicKeyNotFound
+func (e missingTopicKeysError) Unwrap() error {
+	return ErrTopicKeyNotFound
+}
+
+// errorCause returns the innermost error wrapped by err, following the Unwrap methods of the errors
+// wrapping a sentinel, such as ErrInvalidTopicKey or ErrTopicKeyNotFound, so it can be compared to it.
+func errorCause(err error) error {
+	for {
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return err
+		}
+		err = wrapper.Unwrap()
+	}
+}
+
+// validateTopicKey checks the topic key before it is used for encryption, returning an error wrapping ErrInvalidTopicKey
+func validateTopicKey(topicKey keys.TopicKey) error {
+	if err := e4crypto.ValidateSymKey(topicKey); err != nil {
+		return invalidTopicKeyError{err: err}
+	}
+
+	return nil
+}
+
 // Client defines interface for protecting and unprotecting E4 messages and commands
 type Client interface {
 	// ProtectMessage will encrypt the given payload using the key associated to topic.
+	// Empty payloads are allowed, and can be used to send keep-alive messages.
 	// When the client doesn't have a key for this topic, ErrTopicKeyNotFound will be returned.
+	// When the payload exceeds the limit set with WithMaxPayloadBytes, ErrPayloadTooLarge will be returned.
 	// When no errors, the protected cipher bytes are returned
 	ProtectMessage(payload []byte, topic string) ([]byte, error)
+	// ProtectMessageMulti will encrypt the given payload for each of the given topics, and returns the
+	// protected messages indexed by topic. Topics sharing the same key share the same protected message.
+	// When the client is missing a key for any of the topics, an error listing them is returned.
+	ProtectMessageMulti(payload []byte, topics []string) (map[string][]byte, error)
+	// ProtectMessageByTopicHash works like ProtectMessage, but takes the topic hash (see crypto.HashTopic)
+	// instead of the topic, for callers only knowing the hash or avoiding to hash the topic again.
+	ProtectMessageByTopicHash(payload []byte, topicHash []byte) ([]byte, error)
 	// Unprotect attempts to decrypt the given cipher using the topic key.
 	// When the client doesn't have a key for this topic, ErrTopicKeyNotFound will be returned.
 	// When no errors, the clear payload bytes are returned, unless the protected message was a client command.
 	// Message are client commands when received on the client receiving topic. The command will be processed
-	// when unprotecting it, making a nil,nil response indicating a success
+	// when unprotecting it, making a nil,nil response indicating a success. A command already applied
+	// less than crypto.MaxDelayKeyTransition ago is not processed again, and ErrDuplicateCommand is returned.
 	Unprotect(protected []byte, topic string) ([]byte, error)
+	// UnprotectBatch unprotects a batch of messages received on the same topic, looking up the topic key only once.
+	// It returns the clear messages, and a slice of the same length holding the error of each message, or nil on success.
+	UnprotectBatch(topic string, protected [][]byte) ([][]byte, []error)
+	// UnprotectMessageByTopicHash attempts to decrypt the given message using the key of the given topic hash
+	// (see crypto.HashTopic). Unlike Unprotect, it never processes commands.
+	UnprotectMessageByTopicHash(protected []byte, topicHash []byte) ([]byte, error)
+	// UnprotectMessageWithTime works like Unprotect, but also returns the time at which the message has been protected,
+	// allowing for example to compute the delay between the message emission and reception.
+	UnprotectMessageWithTime(protected []byte, topic string) ([]byte, time.Time, error)
+	// UnprotectMessageWithSigner unprotects the given message like Unprotect, and returns it along with
+	// the ID of the signer it has been verified against, allowing to attribute each received message.
+	// The signer ID is empty for symmetric key clients, unsigned messages and commands.
+	UnprotectMessageWithSigner(protected []byte, topic string) ([]byte, []byte, error)
+	// ProcessCommandStream reads length prefixed protected commands from r (see WriteCommandFrame),
+	// and unprotects and applies each of them. It stops at the first failure, and returns how many commands were applied.
+	ProcessCommandStream(r io.Reader) (applied int, err error)
+	// SetTopicKeyByName sets the key for the given topic, retaining the topic name
+	// so it can be listed by TopicNames.
+	SetTopicKeyByName(key []byte, topic string) error
+	// GenerateTopicKey creates a random key for the given topic from the client random source, sets it
+	// like SetTopicKeyByName, and returns it so it can be registered on the C2 by the topic owner.
+	GenerateTopicKey(topic string) ([]byte, error)
+	// ReplaceAllTopicKeys replaces every topic key held by the client by the given ones,
+	// indexed by topic name, in a single persisted operation.
+	// Nothing changes if any of the topics or keys is invalid.
+	ReplaceAllTopicKeys(topicKeys map[string][]byte) error
+	// Reload reads back the client state from its persisted file, replacing the in memory one.
+	// The current state is left untouched on error, and ErrUnflushedChanges is returned when the client
+	// holds changes not flushed yet (see WithDeferredPersistence).
+	Reload() error
+	// Watch reloads the client state each time its persisted file changes, until the context is cancelled.
+	// Reload errors, such as ErrUnflushedChanges, are sent on the returned channel.
+	Watch(ctx context.Context) (<-chan error, error)
+	// TopicKeyAge returns for how long the client holds the current key of the given topic.
+	// ErrTopicKeyNotFound is returned when the client doesn't have a key for this topic,
+	// and ErrUnknownTopicKeyAge when the key install time hasn't been recorded.
+	TopicKeyAge(topic string) (time.Duration, error)
+	// TopicKeyLastUsed returns when the key of the given topic has last been used to protect or unprotect
+	// a message, allowing to identify stale topics. It returns the zero time when the key hasn't been used since
+	// it has been set or the client has been loaded, as it isn't persisted. ErrTopicKeyNotFound is returned
+	// when the client has no key for this topic.
+	TopicKeyLastUsed(topic string) (time.Time, error)
+	// PruneExpiredTopicKeys removes the topic keys installed for longer than maxAge, persisting the client once,
+	// and returns how many have been removed. Keys of unknown age are kept.
+	PruneExpiredTopicKeys(maxAge time.Duration) (int, error)
+	// TopicNames returns the sorted names of the topics the client holds a key for, when known.
+	// Topics whose keys have been received from C2 commands are only known by their hash, and are omitted.
+	TopicNames() []string
+	// HasTopicKey returns true when the client holds a key for the given topic,
+	// meaning it can protect and unprotect messages on it.
+	HasTopicKey(topic string) bool
 	// IsReceivingTopic returns true when the given topic is the client receiving topics.
 	// Message received from this topics will be protected commands, meant to update the client state
 	IsReceivingTopic(topic string) bool
 	// GetReceivingTopic returns the receiving topic for this client, which will be used to transmit commands
 	// allowing to update the client state, like setting a new private key or adding a new topic key.
 	GetReceivingTopic() string
+	// IsCommandTopic returns true when the given topic is the client command topic, allowing to route
+	// received messages to either the commands processing or the messages unprotection.
+	// It is the same as IsReceivingTopic.
+	IsCommandTopic(topic string) bool
+	// CommandTopic returns the client command topic, on which it receives commands from the C2.
+	// It is the same as GetReceivingTopic.
+	CommandTopic() string
+	// C2KeyMatches returns true when the given curve25519 public key is the C2 public key stored on the client,
+	// meaning the client will be able to unprotect commands from this C2. It always returns false
+	// when the client key material doesn't hold a C2 public key.
+	C2KeyMatches(expectedC2PubKey e4crypto.Curve25519PublicKey) bool
+	// AddC2Key adds a failover C2 public key to a public key client, allowing it to accept commands
+	// from several C2 instances. Commands are accepted when they verify under any of the C2 keys.
+	// Otherwise, ErrUnsupportedOperation is returned.
+	AddC2Key(c2PubKey e4crypto.Curve25519PublicKey) error
+	// RemoveC2Key removes a C2 public key from a public key client, which then rejects
+	// the commands protected with it. The last C2 key can't be removed.
+	// Otherwise, ErrUnsupportedOperation is returned.
+	RemoveC2Key(c2PubKey e4crypto.Curve25519PublicKey) error
+	// ExportPubKeyBundle serializes the public keys held by a public key client into a bundle, signed by
+	// the client when it holds a private key, which can be imported by another client with ImportPubKeyBundle.
+	// Otherwise, ErrUnsupportedOperation is returned.
+	ExportPubKeyBundle() ([]byte, error)
+	// ImportPubKeyBundle validates the given pubkey bundle, and merges its public keys into the client ones.
+	// It returns how many public keys have been imported. Otherwise, ErrUnsupportedOperation is returned.
+	ImportPubKeyBundle(bundle []byte) (int, error)
+	// DropPrivateKey zeroes and removes the private key of a public key client, turning it into a verifier only one,
+	// and persists it. It can still unprotect messages from its trusted public keys, but protecting messages and
+	// unprotecting commands then fail with keys.ErrNoPrivateKey. Otherwise, ErrUnsupportedOperation is returned.
+	DropPrivateKey() error
+	// RotateSigningKey validates and replaces the ed25519 private key of a public key client, and persists it.
+	// Its trusted public keys and C2 public keys are left untouched, so the client keeps its trust relationships.
+	// It returns the new public key, which must be registered again with the C2 and the peers, as the commands
+	// and messages it receives are protected for the previous one until then. Otherwise, ErrUnsupportedOperation
+	// is returned.
+	RotateSigningKey(newPrivateKey ed25519.PrivateKey) (ed25519.PublicKey, error)
+	// CommandKey returns the symmetric key protecting the commands sent by the primary C2 to a public key client,
+	// allowing to manually decrypt a captured command with crypto.UnprotectSymKey when diagnosing it.
+	// The key is sensitive, as it allows to forge commands: it must never be logged or persisted.
+	// Otherwise, ErrUnsupportedOperation is returned.
+	CommandKey() ([]byte, error)
+	// Wipe zeroes all the secret material held in memory by the client, such as its private or symmetric key
+	// and its topic keys, and clears its public keys, when decommissioning a device. The persisted client file
+	// is removed when deleteFile is true. All the client operations fail with ErrClientWiped afterwards.
+	Wipe(deleteFile bool) error
+	// SignMessage returns the detached ed25519 signature a public key client appends to a protected message,
+	// given the message timestamp followed by its encrypted payload. The signature covers the timestamp,
+	// the client signer ID and the encrypted payload (see crypto.SignedData), allowing to build custom envelopes.
+	// Otherwise, ErrUnsupportedOperation is returned.
+	SignMessage(payload []byte) ([]byte, error)
+	// ProvisioningStatus summarizes in one call the material held by the client, such as whether it holds
+	// its private key and a C2 public key, and how many topic keys and trusted signer public keys it has.
+	ProvisioningStatus() ProvisioningStatus
+	// Validate checks that the client is well formed: its ID, its private or symmetric key, its C2 public keys,
+	// its trusted public keys and its topic keys must all be valid. It returns an error describing the first
+	// problem found, allowing provisioning pipelines to reject a bad client before the device goes live.
+	// ErrStagingC2Key is returned as a warning for an otherwise valid client trusting the staging C2 public key,
+	// which staging pipelines can tolerate.
+	Validate() error
+	// HasDefaultC2Key returns true when a public key client trusts the staging C2 public key (see StagingC2PubKey),
+	// a placeholder anyone can send commands with, so it isn't deployed to production by accident.
+	HasDefaultC2Key() bool
+	// Flush writes the client changes which haven't been persisted yet, on a client created with
+	// WithDeferredPersistence. It does nothing when there is no pending change, or on other clients,
+	// which persist every change as it is made.
+	Flush() error
+	// Close releases the client: it flushes its pending changes (see Flush), stops its Watch goroutines,
+	// and wipes the topic keys copies held in its caches. All the client operations fail with ErrClientClosed
+	// afterwards, except Wipe, which can still erase its secrets. The client is left open when the flush fails.
+	Close() error
+	// ProtectDirect protects the payload for a single peer of a public key client, identified by its curve25519
+	// public key (see crypto.PublicEd25519KeyToCurve25519), with a key derived from a key exchange between the client
+	// private key and the peer public key. Only this peer can unprotect it, with UnprotectDirect.
+	// Otherwise, ErrUnsupportedOperation is returned.
+	ProtectDirect(payload []byte, recipientCurvePubKey []byte) ([]byte, error)
+	// UnprotectDirect unprotects a message protected with ProtectDirect by the peer owning the given curve25519
+	// public key, which authenticates it. Otherwise, ErrUnsupportedOperation is returned.
+	UnprotectDirect(protected []byte, senderCurvePubKey []byte) ([]byte, error)
 
 	// setIDKey will set the client's key material private key to the given key
 	setIDKey(key []byte) error
@@ -99,6 +314,8 @@ type Client interface {
 	// setTopicKey set the key for the given topic hash (see crypto.HashTopic to obtain topic hashes).
 	// Setting topic keys is required prior being able to communicate over this topic.
 	setTopicKey(key, topicHash []byte) error
+	// setWrappedTopicKey unwraps the given key with the client command key, and sets it for the given topic hash.
+	setWrappedTopicKey(wrappedKey, topicHash []byte) error
 	// removeTopic will remove the topic key from the client for the given topic hash (see crypto.HashTopic to obtain topic hashes).
 	removeTopic(topicHash []byte) error
 	// resetTopics will remove all previously set topics from the client.
@@ -112,20 +329,44 @@ type client struct {
 	// TopicKeys maps a topic hash to a key
 	// (slices []byte can't be map keys, converting to strings)
 	TopicKeys map[string]keys.TopicKey
+	// Topics maps a topic hash to its topic name, for topics set by name
+	Topics map[string]string
+	// TopicKeysInstalledAt maps a topic hash to the time its current key has been installed at
+	TopicKeysInstalledAt map[string]time.Time
+	// AppliedCommands maps the fingerprint of the recently applied commands to the time they have been applied at
+	AppliedCommands map[string]time.Time
 
 	Key keys.KeyMaterial
 
 	FilePath       string
 	ReceivingTopic string
 
-	lock sync.RWMutex
+	clock                Clock
+	unknownSignerHandler func(signerID []byte)
+	topicHashes          *topicHashCache
+	topicCiphers         *topicCipherCache
+	topicUsage           *topicUsage
+	rand                 io.Reader
+	metrics              Metrics
+	maxPayloadBytes      int
+	signedCommandsOnly   bool
+	strictPubKeyBundles  bool
+	commandRateLimiter   *tokenBucket
+	deferredPersistence  bool
+	kek                  []byte
+	dirty                bool
+	wiped                bool
+	closed               bool
+	watchCancels         []context.CancelFunc
+	options              *clientOptions
+	lock                 sync.RWMutex
 }
 
 var _ Client = (*client)(nil)
 
 // ClientConfig defines an interface for client configuration
 type ClientConfig interface {
-	genNewClient(persistStatePath string) (Client, error)
+	genNewClient(persistStatePath string, rand io.Reader) (*client, error)
 }
 
 // SymIDAndKey defines a configuration to create an E4 client in symmetric key mode
@@ -145,6 +386,8 @@ type SymNameAndPassword struct {
 
 // PubIDAndKey defines a configuration to create an E4 client in public key mode
 // from an ID, an ed25519 private key, and a curve25519 public key.
+// The C2 public key can be left empty for peer to peer deployments without C2,
+// in which case receiving commands fails with keys.ErrNoC2Configured.
 type PubIDAndKey struct {
 	ID       []byte
 	Key      e4crypto.Ed25519PrivateKey
@@ -153,6 +396,7 @@ type PubIDAndKey struct {
 
 // PubNameAndPassword defines a configuration to create an E4 client in public key mode
 // from a name, a password and a curve25519 public key.
+// As for PubIDAndKey, the C2 public key can be left empty when there is no C2.
 // The password must contains at least 16 characters.
 type PubNameAndPassword struct {
 	Name     string
@@ -165,10 +409,14 @@ var _ ClientConfig = (*SymNameAndPassword)(nil)
 var _ ClientConfig = (*PubIDAndKey)(nil)
 var _ ClientConfig = (*PubNameAndPassword)(nil)
 
-func (ik *SymIDAndKey) genNewClient(persistStatePath string) (Client, error) {
+func (ik *SymIDAndKey) genNewClient(persistStatePath string, rand io.Reader) (*client, error) {
 	var newID []byte
 	if len(ik.ID) == 0 {
-		newID = e4crypto.RandomID()
+		var err error
+		newID, err = e4crypto.RandomIDFrom(rand)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		newID = make([]byte, len(ik.ID))
 		copy(newID, ik.ID)
@@ -182,7 +430,7 @@ func (ik *SymIDAndKey) genNewClient(persistStatePath string) (Client, error) {
 	return newClient(newID, symKeyMaterial, persistStatePath)
 }
 
-func (np *SymNameAndPassword) genNewClient(persistStatePath string) (Client, error) {
+func (np *SymNameAndPassword) genNewClient(persistStatePath string, rand io.Reader) (*client, error) {
 	id := e4crypto.HashIDAlias(np.Name)
 
 	key, err := e4crypto.DeriveSymKey(np.Password)
@@ -194,14 +442,19 @@ func (np *SymNameAndPassword) genNewClient(persistStatePath string) (Client, err
 	if err != nil {
 		return nil, fmt.Errorf("failed to created symkey from key: %v", err)
 	}
+	symKeyMaterial.SetKDFProvenance(keys.NewArgon2Provenance(e4crypto.DefaultArgon2Params))
 
 	return newClient(id, symKeyMaterial, persistStatePath)
 }
 
-func (ik *PubIDAndKey) genNewClient(persistStatePath string) (Client, error) {
+func (ik *PubIDAndKey) genNewClient(persistStatePath string, rand io.Reader) (*client, error) {
 	var newID []byte
 	if len(ik.ID) == 0 {
-		newID = e4crypto.RandomID()
+		var err error
+		newID, err = e4crypto.RandomIDFrom(rand)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		newID = make([]byte, len(ik.ID))
 		copy(newID, ik.ID)
@@ -215,7 +468,7 @@ func (ik *PubIDAndKey) genNewClient(persistStatePath string) (Client, error) {
 	return newClient(newID, pubKeyMaterialKey, persistStatePath)
 }
 
-func (np *PubNameAndPassword) genNewClient(persistStatePath string) (Client, error) {
+func (np *PubNameAndPassword) genNewClient(persistStatePath string, rand io.Reader) (*client, error) {
 	id := e4crypto.HashIDAlias(np.Name)
 
 	key, err := e4crypto.Ed25519PrivateKeyFromPassword(np.Password)
@@ -227,6 +480,7 @@ func (np *PubNameAndPassword) genNewClient(persistStatePath string) (Client, err
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ed25519key from key: %v", err)
 	}
+	pubKeyMaterialKey.SetKDFProvenance(keys.NewArgon2Provenance(e4crypto.DefaultArgon2Params))
 
 	return newClient(id, pubKeyMaterialKey, persistStatePath)
 }
@@ -251,21 +505,101 @@ func (np *PubNameAndPassword) PubKey() (e4crypto.Ed25519PublicKey, error) {
 //
 // config is a ClientConfig, either SymIDAndKey, SymNameAndPassword, PubIDAndKey or PubNameAndPassword
 // persistStatePath is the file system path to the file to read and persist the client's state.
-func NewClient(config ClientConfig, persistStatePath string) (Client, error) {
-	return config.genNewClient(persistStatePath)
+// opts are optional ClientOption allowing to customize the client behavior.
+func NewClient(config ClientConfig, persistStatePath string, opts ...ClientOption) (Client, error) {
+	o, err := newClientOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if symConfig, ok := config.(*SymIDAndKey); ok && o.keyEntropyCheck {
+		if err := e4crypto.ValidateKeyEntropy(symConfig.Key); err != nil {
+			return nil, fmt.Errorf("invalid symmetric key: %v", err)
+		}
+	}
+
+	c, err := config.genNewClient(persistStatePath, o.rand)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.applyOptions(o); err != nil {
+		return nil, err
+	}
+
+	if err := c.provisionTopicKeys(o); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewClientFromKeyMaterial creates a new E4 client from an existing KeyMaterial,
+// such as a custom or test-injected one, instead of building it from a ClientConfig.
+//
+// The client takes ownership of km, which is used as is rather than copied: options (such as WithClock)
+// and commands (such as SetIDKey or SetPubKey) update it in place, and Wipe zeroes it.
+// The caller must not use or modify km once given to the client.
+//
+// id is the client identifier, and must not be empty.
+// persistStatePath is the file system path to the file to read and persist the client's state.
+// opts are optional ClientOption allowing to customize the client behavior.
+func NewClientFromKeyMaterial(id []byte, km keys.KeyMaterial, persistStatePath string, opts ...ClientOption) (Client, error) {
+	if km == nil {
+		return nil, errors.New("key material must not be nil")
+	}
+
+	o, err := newClientOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newClient(id, km, persistStatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.applyOptions(o); err != nil {
+		return nil, err
+	}
+
+	if err := c.provisionTopicKeys(o); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// provisionTopicKeys sets the initial topic keys of a new client, when given with WithInitialTopicKeys
+func (c *client) provisionTopicKeys(o *clientOptions) error {
+	if len(o.initialTopicKeys) == 0 {
+		return nil
+	}
+
+	if err := c.ReplaceAllTopicKeys(o.initialTopicKeys); err != nil {
+		return fmt.Errorf("failed to set initial topic keys: %v", err)
+	}
+
+	return nil
 }
 
 // newClient creates a new client, generating a random ID if they are empty
-func newClient(id []byte, clientKey keys.KeyMaterial, persistStatePath string) (Client, error) {
+func newClient(id []byte, clientKey keys.KeyMaterial, persistStatePath string) (*client, error) {
 	if len(id) == 0 {
 		return nil, errors.New("client id must not be empty")
 	}
 
 	c := &client{
-		Key:            clientKey,
-		TopicKeys:      make(map[string]keys.TopicKey),
-		FilePath:       persistStatePath,
-		ReceivingTopic: TopicForID(id),
+		Key:                  clientKey,
+		TopicKeys:            make(map[string]keys.TopicKey),
+		Topics:               make(map[string]string),
+		TopicKeysInstalledAt: make(map[string]time.Time),
+		AppliedCommands:      make(map[string]time.Time),
+		FilePath:             persistStatePath,
+		ReceivingTopic:       TopicForID(id),
+		topicHashes:          newTopicHashCache(topicHashCacheSize),
+		topicCiphers:         newTopicCipherCache(),
+		topicUsage:           newTopicUsage(),
 	}
 
 	c.ID = make([]byte, len(id))
@@ -277,18 +611,190 @@ func newClient(id []byte, clientKey keys.KeyMaterial, persistStatePath string) (
 }
 
 // LoadClient loads a client state from the file system
-func LoadClient(persistStatePath string) (Client, error) {
-	c := &client{}
-	err := readJSON(persistStatePath, c)
+// opts are optional ClientOption allowing to customize the client behavior.
+func LoadClient(persistStatePath string, opts ...ClientOption) (Client, error) {
+	o, err := newClientOptions(opts...)
 	if err != nil {
 		return nil, err
 	}
 
+	c := &client{
+		topicHashes:  newTopicHashCache(topicHashCacheSize),
+		topicCiphers: newTopicCipherCache(),
+		topicUsage:   newTopicUsage(),
+	}
+	if err := readClientFile(persistStatePath, c, o.kek); err != nil {
+		return nil, err
+	}
+
+	if err := c.applyOptions(o); err != nil {
+		return nil, err
+	}
+
 	return c, nil
 }
 
+// applyOptions applies given options settings on the client, and propagates
+// them to the client key material
+func (c *client) applyOptions(o *clientOptions) error {
+	if o.unsignedPubKeyMessages {
+		pk, ok := c.Key.(keys.PubKeyMaterial)
+		if !ok {
+			return ErrUnsupportedOperation
+		}
+
+		pk.SetUnsignedMessages(true)
+	}
+
+	if o.appendOnlyPubKeys {
+		pk, ok := c.Key.(keys.PubKeyMaterial)
+		if !ok {
+			return ErrUnsupportedOperation
+		}
+
+		pk.SetAppendOnlyPubKeys(true)
+	}
+
+	c.clock = o.clock
+	c.unknownSignerHandler = o.unknownSignerHandler
+	c.rand = o.rand
+	c.metrics = o.metrics
+	c.maxPayloadBytes = o.maxPayloadBytes
+	c.signedCommandsOnly = o.signedCommandsOnly
+	c.strictPubKeyBundles = o.strictPubKeyBundles
+	c.deferredPersistence = o.deferredPersistence
+	c.kek = o.kek
+	if o.commandRateLimit > 0 {
+		c.commandRateLimiter = newTokenBucket(o.commandRateLimit, o.commandRatePeriod, o.clock)
+	}
+	c.topicHashes.SetHasher(o.topicHasher)
+	c.Key.SetClock(c.clock)
+	c.options = o
+
+	return nil
+}
+
+// Reload reads back the client state from its persisted file, replacing the in memory one.
+// It allows to pick up changes made to the file by another process, such as a C2 agent.
+// The client options are applied again on the reloaded key material. On any error,
+// such as a corrupted file, the current state is left untouched.
+// On a client created with WithDeferredPersistence, ErrUnflushedChanges is returned while it holds changes
+// which haven't been flushed, instead of discarding them: they must be flushed first.
+func (c *client) Reload() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	if c.dirty {
+		return ErrUnflushedChanges
+	}
+
+	loaded := &client{
+		topicHashes: c.topicHashes,
+	}
+	if err := readClientFile(c.FilePath, loaded, c.kek); err != nil {
+		return fmt.Errorf("failed to reload client: %v", err)
+	}
+
+	if loaded.Key == nil {
+		return errors.New("failed to reload client: missing key material")
+	}
+
+	if err := loaded.applyOptions(c.options); err != nil {
+		return fmt.Errorf("failed to reload client: %v", err)
+	}
+
+	c.ID = loaded.ID
+	c.TopicKeys = loaded.TopicKeys
+	c.Topics = loaded.Topics
+	c.TopicKeysInstalledAt = loaded.TopicKeysInstalledAt
+	c.AppliedCommands = loaded.AppliedCommands
+	c.Key = loaded.Key
+	c.ReceivingTopic = loaded.ReceivingTopic
+	c.topicCiphers.Reset()
+
+	return nil
+}
+
+// watchPollInterval is the interval at which Watch checks the client file for changes
+var watchPollInterval = time.Second
+
+// Watch polls the client persisted file, and calls Reload when it changes.
+// Reload and file access errors are sent on the returned channel, which must be drained by the caller.
+// With WithDeferredPersistence, a change of the file while the client holds unflushed changes is reported
+// with ErrUnflushedChanges, and the file is not reloaded until it changes again.
+// Watching stops, and the channel is closed, when the given context is cancelled.
+func (c *client) Watch(ctx context.Context) (<-chan error, error) {
+	info, err := os.Stat(c.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch client file: %v", err)
+	}
+
+	c.lock.Lock()
+	if err := c.stateErr(); err != nil {
+		c.lock.Unlock()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.watchCancels = append(c.watchCancels, cancel)
+	c.lock.Unlock()
+
+	errC := make(chan error)
+	go func() {
+		defer close(errC)
+		defer cancel()
+
+		ticker := time.NewTicker(watchPollInterval)
+		defer ticker.Stop()
+
+		lastModTime, lastSize := info.ModTime(), info.Size()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			var err error
+			info, statErr := os.Stat(c.FilePath)
+			switch {
+			case statErr != nil:
+				err = fmt.Errorf("failed to watch client file: %v", statErr)
+			case info.ModTime().Equal(lastModTime) && info.Size() == lastSize:
+				continue
+			default:
+				lastModTime, lastSize = info.ModTime(), info.Size()
+				err = c.Reload()
+			}
+
+			if err != nil {
+				select {
+				case errC <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return errC, nil
+}
+
 func (c *client) save() error {
-	err := writeJSON(c.FilePath, c)
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	// Only mark the state to be written on the next Flush
+	if c.deferredPersistence {
+		c.dirty = true
+		return nil
+	}
+
+	err := c.writeFile()
 	if err != nil {
 		log.Printf("failed to save client: %v", err)
 		return err
@@ -296,6 +802,59 @@ func (c *client) save() error {
 	return nil
 }
 
+// Flush persists the client changes not written yet, when created with WithDeferredPersistence
+func (c *client) Flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	return c.flush()
+}
+
+// flush writes the client when it has pending changes.
+// The client lock must be held by the caller.
+func (c *client) flush() error {
+	if !c.dirty {
+		return nil
+	}
+
+	if err := c.writeFile(); err != nil {
+		log.Printf("failed to flush client: %v", err)
+		return err
+	}
+	c.dirty = false
+
+	return nil
+}
+
+// Close flushes the pending changes, stops the watchers and wipes the caches of the client
+func (c *client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return ErrClientClosed
+	}
+
+	if !c.wiped {
+		if err := c.flush(); err != nil {
+			return fmt.Errorf("failed to close client: %v", err)
+		}
+	}
+
+	for _, cancel := range c.watchCancels {
+		cancel()
+	}
+	c.watchCancels = nil
+	c.topicCiphers.Wipe()
+	c.closed = true
+
+	return nil
+}
+
 func writeJSON(filePath string, object interface{}) error {
 	file, err := os.Create(filePath)
 	if err != nil {
@@ -320,6 +879,71 @@ func readJSON(filePath string, object interface{}) error {
 	return decoder.Decode(object)
 }
 
+// writeFile persists the client to its file, encrypted with its key encryption key when set with WithKEK
+func (c *client) writeFile() error {
+	if c.kek == nil {
+		return writeJSON(c.FilePath, c)
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	// The file header is built like ProtectSymKey would, with the persisted timestamp encoding
+	timestamp := encodeStoredTimestamp(c.clock.Now())
+	ct, err := e4crypto.Encrypt(c.kek, timestamp, data)
+	if err != nil {
+		return err
+	}
+	protected := append(timestamp, ct...)
+
+	if err := ioutil.WriteFile(c.FilePath, protected, 0600); err != nil {
+		return fmt.Errorf("failed to write file at %s: %v", c.FilePath, err)
+	}
+
+	return nil
+}
+
+// readClientFile loads the client persisted at filePath into c, decrypting it with kek when not nil.
+// ErrInvalidKEK is returned when the file can't be decrypted with kek.
+func readClientFile(filePath string, c *client, kek []byte) error {
+	if kek == nil {
+		return readJSON(filePath, c)
+	}
+
+	protected, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	if len(protected) < e4crypto.TimestampLen+e4crypto.TagLen {
+		return ErrInvalidKEK
+	}
+
+	// The timestamp is only authenticated, not checked for freshness, as the file may have been written long ago
+	data, err := e4crypto.Decrypt(kek, protected[:e4crypto.TimestampLen], protected[e4crypto.TimestampLen:])
+	if err != nil {
+		return ErrInvalidKEK
+	}
+
+	return json.Unmarshal(data, c)
+}
+
+// encodeStoredTimestamp returns the timestamp of t as persisted by the client. Unlike e4crypto.EncodeTimestamp,
+// it always uses binary.LittleEndian, so the client files don't depend on e4crypto.SetTimestampByteOrder.
+func encodeStoredTimestamp(t time.Time) []byte {
+	timestamp := make([]byte, e4crypto.TimestampLen)
+	binary.LittleEndian.PutUint64(timestamp, uint64(t.Unix()))
+
+	return timestamp
+}
+
+// decodeStoredTimestamp returns the time from a timestamp encoded with encodeStoredTimestamp
+func decodeStoredTimestamp(timestamp []byte) time.Time {
+	return time.Unix(int64(binary.LittleEndian.Uint64(timestamp)), 0)
+}
+
 func (c *client) UnmarshalJSON(data []byte) error {
 	m := make(map[string]json.RawMessage)
 	if err := json.Unmarshal(data, &m); err != nil {
@@ -353,6 +977,24 @@ func (c *client) UnmarshalJSON(data []byte) error {
 		}
 	}
 
+	if rawTopicNames, ok := m["Topics"]; ok {
+		if err := json.Unmarshal(rawTopicNames, &c.Topics); err != nil {
+			return fmt.Errorf("failed to unmarshal client topics: %v", err)
+		}
+	}
+
+	if rawTopicKeysInstalledAt, ok := m["TopicKeysInstalledAt"]; ok {
+		if err := json.Unmarshal(rawTopicKeysInstalledAt, &c.TopicKeysInstalledAt); err != nil {
+			return fmt.Errorf("failed to unmarshal client topic keys install times: %v", err)
+		}
+	}
+
+	if rawAppliedCommands, ok := m["AppliedCommands"]; ok {
+		if err := json.Unmarshal(rawAppliedCommands, &c.AppliedCommands); err != nil {
+			return fmt.Errorf("failed to unmarshal client applied commands: %v", err)
+		}
+	}
+
 	if rawID, ok := m["ID"]; ok {
 		if err := json.Unmarshal(rawID, &c.ID); err != nil {
 			return fmt.Errorf("failed to unmarshal client ID: %v", err)
@@ -366,92 +1008,735 @@ func (c *client) UnmarshalJSON(data []byte) error {
 // the client holds a key for the given topic, otherwise
 // ErrTopicKeyNotFound will be returned
 func (c *client) ProtectMessage(payload []byte, topic string) ([]byte, error) {
-	topicHash := hex.EncodeToString(e4crypto.HashTopic(topic))
-
-	c.lock.RLock()
-	topicKey, ok := c.TopicKeys[topicHash]
-	c.lock.RUnlock()
-	if !ok {
-		return nil, ErrTopicKeyNotFound
-	}
+	return c.protectMessage(payload, c.topicHashes.Hash(topic))
+}
 
-	protected, err := c.Key.ProtectMessage(payload, topicKey)
-	if err != nil {
-		return nil, err
+// ProtectMessageByTopicHash will protect given payload, given the client holds
+// a key for the given topic hash, otherwise ErrTopicKeyNotFound will be returned
+func (c *client) ProtectMessageByTopicHash(payload []byte, topicHash []byte) ([]byte, error) {
+	if err := e4crypto.ValidateTopicHash(topicHash); err != nil {
+		return nil, fmt.Errorf("invalid topic hash: %v", err)
 	}
 
-	return protected, nil
+	return c.protectMessage(payload, topicHash)
 }
 
-// Unprotect will attempt to unprotect the given payload and return the clear message
-// The client holds a key for the given topic, otherwise a ErrTopicKeyNotFound error will be returned
-//
-// In case the protected message is a command (when the topic is identical to the client control topic),
-// Unprotect will also process it, returning errors when it is invalid or missing required
-// arguments. On success, Unprotecting a command will return nil, nil
-func (c *client) Unprotect(protected []byte, topic string) ([]byte, error) {
-	if topic == c.ReceivingTopic {
-		command, err := c.Key.UnprotectCommand(protected)
-		if err != nil {
-			return nil, err
-		}
+// protectMessage protects the given payload with the key of the given topic hash,
+// and reports the outcome to the client metrics
+func (c *client) protectMessage(payload []byte, rawTopicHash []byte) ([]byte, error) {
+	protected, err := c.protectMessageWithTopicKey(payload, rawTopicHash)
+	c.recordProtect(err)
 
-		err = processCommand(c, command)
-		if err != nil {
-			return nil, err
-		}
+	return protected, err
+}
 
-		return nil, nil
+// protectMessageWithTopicKey protects the given payload with the key of the given topic hash
+func (c *client) protectMessageWithTopicKey(payload []byte, rawTopicHash []byte) ([]byte, error) {
+	if err := c.checkPayloadSize(payload); err != nil {
+		return nil, err
 	}
 
-	topicHash := e4crypto.HashTopic(topic)
+	topicHash := hex.EncodeToString(rawTopicHash)
+
 	c.lock.RLock()
-	key, ok := c.TopicKeys[hex.EncodeToString(topicHash)]
+	storedKey, ok := c.TopicKeys[topicHash]
+	topicKey := cloneTopicKey(storedKey)
+	clientKey := c.Key
+	stateErr := c.stateErr()
 	c.lock.RUnlock()
+	if stateErr != nil {
+		return nil, stateErr
+	}
 	if !ok {
 		return nil, ErrTopicKeyNotFound
 	}
 
-	message, err := c.Key.UnprotectMessage(protected, key)
-
-	if err == nil {
-		return message, nil
+	if err := validateTopicKey(topicKey); err != nil {
+		return nil, err
 	}
 
-	if err != miscreant.ErrNotAuthentic {
+	topicCipher, err := c.topicCiphers.Cipher(topicHash, topicKey)
+	if err != nil {
 		return nil, err
 	}
 
-	// Since decryption failed, try the previous key if it exists and not too old.
-	hashOfHash := hex.EncodeToString(e4crypto.HashTopic(string(topicHash)))
-	topicKeyTs, ok := c.TopicKeys[hashOfHash]
-	if !ok {
-		return nil, miscreant.ErrNotAuthentic
-	}
-	if len(topicKeyTs) != e4crypto.KeyLen+e4crypto.TimestampLen {
-		return nil, errors.New("invalid old topic key length")
-	}
-	topicKey := make([]byte, e4crypto.KeyLen)
-	copy(topicKey, topicKeyTs[:e4crypto.KeyLen])
-	timestamp := topicKeyTs[e4crypto.KeyLen:]
-	if err := e4crypto.ValidateTimestampKey(timestamp); err != nil {
+	protected, err := clientKey.ProtectMessageWithCipher(payload, topicCipher)
+	if err != nil {
 		return nil, err
 	}
+	c.topicUsage.Touch(topicHash, c.clock.Now().UTC())
 
-	return c.Key.UnprotectMessage(protected, topicKey)
+	return protected, nil
 }
 
-// IsReceivingTopic indicate when the given topic is the receiving topic of the client.
-// This means message received on this topic are client commands
-func (c *client) IsReceivingTopic(topic string) bool {
-	return topic == c.ReceivingTopic
+// checkPayloadSize returns ErrPayloadTooLarge when the payload exceeds the client maximum payload size
+func (c *client) checkPayloadSize(payload []byte) error {
+	if c.maxPayloadBytes > 0 && len(payload) > c.maxPayloadBytes {
+		return ErrPayloadTooLarge
+	}
+
+	return nil
 }
 
-// GetReceivingTopic returns the client receiving topic.
-func (c *client) GetReceivingTopic() string {
+// ProtectMessageMulti will protect the given payload for each of the given topics,
+// encrypting it only once per distinct topic key.
+func (c *client) ProtectMessageMulti(payload []byte, topics []string) (map[string][]byte, error) {
+	if err := c.checkPayloadSize(payload); err != nil {
+		c.recordProtect(err)
+		return nil, err
+	}
+
+	topicKeys := make(map[string]keys.TopicKey, len(topics))
+	var missingTopics []string
+
+	c.lock.RLock()
+	if err := c.stateErr(); err != nil {
+		c.lock.RUnlock()
+		c.recordProtect(err)
+		return nil, err
+	}
+	clientKey := c.Key
+	for _, topic := range topics {
+		topicKey, ok := c.TopicKeys[hex.EncodeToString(c.topicHashes.Hash(topic))]
+		if !ok {
+			missingTopics = append(missingTopics, topic)
+			continue
+		}
+
+		topicKeys[topic] = cloneTopicKey(topicKey)
+	}
+	c.lock.RUnlock()
+
+	if len(missingTopics) > 0 {
+		err := missingTopicKeysError{topics: missingTopics}
+		c.recordProtect(err)
+		return nil, err
+	}
+
+	// protected messages indexed by their topic key
+	protectedByKey := make(map[string][]byte, len(topicKeys))
+	protectedByTopic := make(map[string][]byte, len(topicKeys))
+	for topic, topicKey := range topicKeys {
+		protected, ok := protectedByKey[string(topicKey)]
+		if !ok {
+			if err := validateTopicKey(topicKey); err != nil {
+				c.recordProtect(err)
+				return nil, err
+			}
+
+			var err error
+			protected, err = clientKey.ProtectMessage(payload, topicKey)
+			if err != nil {
+				c.recordProtect(err)
+				return nil, err
+			}
+
+			protectedByKey[string(topicKey)] = protected
+		}
+
+		protectedByTopic[topic] = protected
+	}
+
+	now := c.clock.Now().UTC()
+	for topic := range protectedByTopic {
+		c.topicUsage.Touch(hex.EncodeToString(c.topicHashes.Hash(topic)), now)
+	}
+	c.recordProtect(nil)
+
+	return protectedByTopic, nil
+}
+
+// Unprotect will attempt to unprotect the given payload and return the clear message
+// The client holds a key for the given topic, otherwise a ErrTopicKeyNotFound error will be returned
+//
+// In case the protected message is a command (when the topic is identical to the client control topic),
+// Unprotect will also process it, returning errors when it is invalid or missing required
+// arguments. On success, Unprotecting a command will return nil, nil
+func (c *client) Unprotect(protected []byte, topic string) ([]byte, error) {
+	message, err := c.unprotect(protected, topic)
+	c.recordUnprotect(err)
+
+	return message, err
+}
+
+// unprotect unprotects the given message or command, without reporting the outcome to the client metrics
+func (c *client) unprotect(protected []byte, topic string) ([]byte, error) {
+	c.lock.RLock()
+	clientKey, receivingTopic := c.Key, c.ReceivingTopic
+	stateErr := c.stateErr()
+	c.lock.RUnlock()
+
+	if topic == receivingTopic {
+		if stateErr != nil {
+			return nil, stateErr
+		}
+
+		// Only the public key materials authenticate commands with the C2 key pair
+		if _, ok := clientKey.(keys.PubKeyMaterial); c.signedCommandsOnly && !ok {
+			return nil, ErrUnauthenticatedCommand
+		}
+
+		command, err := clientKey.UnprotectCommand(protected)
+		if err != nil {
+			return nil, err
+		}
+
+		fingerprint := hex.EncodeToString(e4crypto.Sha3Sum256(protected))
+		if err := c.recordAppliedCommand(fingerprint); err != nil {
+			return nil, err
+		}
+
+		if c.commandRateLimiter != nil && !c.commandRateLimiter.allow() {
+			c.forgetAppliedCommand(fingerprint)
+			return nil, ErrCommandRateLimited
+		}
+
+		err = processCommand(c, command)
+		if err != nil {
+			c.forgetAppliedCommand(fingerprint)
+			return nil, err
+		}
+
+		if err := c.saveAppliedCommands(); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+
+	topicHash := c.topicHashes.Hash(topic)
+	key, previousKeyTs, err := c.getTopicKeys(topicHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.unprotectMessage(protected, topicHash, key, previousKeyTs)
+}
+
+// UnprotectMessageByTopicHash will attempt to unprotect the given message using the key of the given topic hash.
+// The client must hold a key for the topic hash, otherwise a ErrTopicKeyNotFound error will be returned
+func (c *client) UnprotectMessageByTopicHash(protected []byte, topicHash []byte) ([]byte, error) {
+	if err := e4crypto.ValidateTopicHash(topicHash); err != nil {
+		return nil, fmt.Errorf("invalid topic hash: %v", err)
+	}
+
+	key, previousKeyTs, err := c.getTopicKeys(topicHash)
+	if err != nil {
+		c.recordUnprotect(err)
+		return nil, err
+	}
+
+	message, err := c.unprotectMessage(protected, topicHash, key, previousKeyTs)
+	c.recordUnprotect(err)
+
+	return message, err
+}
+
+// UnprotectMessageWithTime unprotects the given message, and returns it along with the time it has been protected at
+func (c *client) UnprotectMessageWithTime(protected []byte, topic string) ([]byte, time.Time, error) {
+	message, err := c.Unprotect(protected, topic)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// Public key protected messages start with their scheme tag, while symmetric ones start with their timestamp
+	if _, ok := c.keyMaterial().(keys.PubKeyMaterial); ok && topic != c.GetReceivingTopic() {
+		info, err := e4crypto.InspectProtected(protected)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		return message, info.Timestamp, nil
+	}
+
+	ts, err := e4crypto.DecodeTimestamp(protected[:e4crypto.TimestampLen])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return message, ts, nil
+}
+
+// UnprotectMessageWithSigner unprotects the given message, and returns it along with the ID of its verified signer
+func (c *client) UnprotectMessageWithSigner(protected []byte, topic string) ([]byte, []byte, error) {
+	message, err := c.Unprotect(protected, topic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if topic == c.GetReceivingTopic() {
+		return message, nil, nil
+	}
+
+	if _, ok := c.keyMaterial().(keys.PubKeyMaterial); !ok {
+		return message, nil, nil
+	}
+
+	return message, keys.MessageSignerID(protected), nil
+}
+
+// UnprotectBatch unprotects a batch of messages received on the same topic.
+// The topic key is looked up once for the whole batch. It returns the clear messages
+// and a slice of errors, where a non nil error at index i means protected[i] failed to be unprotected.
+// When topic is the client receiving topic, each message is processed as a command.
+func (c *client) UnprotectBatch(topic string, protected [][]byte) ([][]byte, []error) {
+	messages := make([][]byte, len(protected))
+	errs := make([]error, len(protected))
+
+	if topic == c.GetReceivingTopic() {
+		for i, p := range protected {
+			messages[i], errs[i] = c.Unprotect(p, topic)
+		}
+
+		return messages, errs
+	}
+
+	topicHash := c.topicHashes.Hash(topic)
+	key, previousKeyTs, err := c.getTopicKeys(topicHash)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+			c.recordUnprotect(err)
+		}
+
+		return messages, errs
+	}
+
+	for i, p := range protected {
+		messages[i], errs[i] = c.unprotectMessage(p, topicHash, key, previousKeyTs)
+		c.recordUnprotect(errs[i])
+	}
+
+	return messages, errs
+}
+
+// getTopicKeys returns a copy of the key of the given topic hash, along with the previous key of this topic
+// and its timestamp when a key transition is in progress (or nil otherwise).
+// ErrTopicKeyNotFound is returned when the client has no key for the topic hash.
+func (c *client) getTopicKeys(topicHash []byte) (keys.TopicKey, keys.TopicKey, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if err := c.stateErr(); err != nil {
+		return nil, nil, err
+	}
+
+	key, ok := c.TopicKeys[hex.EncodeToString(topicHash)]
+	if !ok {
+		return nil, nil, ErrTopicKeyNotFound
+	}
+
+	hashOfHash := hex.EncodeToString(e4crypto.HashTopic(string(topicHash)))
+	previousKeyTs := c.TopicKeys[hashOfHash]
+
+	return cloneTopicKey(key), cloneTopicKey(previousKeyTs), nil
+}
+
+// cloneTopicKey returns a copy of the given topic key, or nil when it is nil.
+// The stored topic keys are zeroed in place by ReplaceAllTopicKeys and Wipe, so they must be copied
+// while holding the client lock when they are used after releasing it.
+func cloneTopicKey(key keys.TopicKey) keys.TopicKey {
+	if key == nil {
+		return nil
+	}
+
+	clone := make(keys.TopicKey, len(key))
+	copy(clone, key)
+
+	return clone
+}
+
+// unprotectMessage attempts to unprotect the given message with the keys of the given topic hash,
+// recording the topic usage when it succeeds
+func (c *client) unprotectMessage(protected, topicHash []byte, key, previousKeyTs keys.TopicKey) ([]byte, error) {
+	message, err := c.unprotectMessageWithKeys(protected, key, previousKeyTs)
+	if err != nil {
+		return nil, err
+	}
+	c.topicUsage.Touch(hex.EncodeToString(topicHash), c.clock.Now().UTC())
+
+	return message, nil
+}
+
+// unprotectMessageWithKeys attempts to unprotect the given message using key, and falls back on the previous
+// topic key, when provided and not too old.
+func (c *client) unprotectMessageWithKeys(protected []byte, key, previousKeyTs keys.TopicKey) ([]byte, error) {
+	clientKey := c.keyMaterial()
+
+	message, err := clientKey.UnprotectMessage(protected, key)
+
+	if err == nil {
+		return message, nil
+	}
+
+	if err == keys.ErrPubKeyNotFound && c.unknownSignerHandler != nil {
+		if signerID := keys.MessageSignerID(protected); signerID != nil {
+			c.unknownSignerHandler(signerID)
+		}
+	}
+
+	if err != e4crypto.ErrNotAuthentic {
+		return nil, err
+	}
+
+	// Since decryption failed, try the previous key if it exists and not too old.
+	if previousKeyTs == nil {
+		return nil, e4crypto.ErrNotAuthentic
+	}
+	if len(previousKeyTs) != e4crypto.KeyLen+e4crypto.TimestampLen {
+		return nil, errors.New("invalid old topic key length")
+	}
+	topicKey := make([]byte, e4crypto.KeyLen)
+	copy(topicKey, previousKeyTs[:e4crypto.KeyLen])
+	timestamp := decodeStoredTimestamp(previousKeyTs[e4crypto.KeyLen:])
+	now := c.clock.Now()
+	if now.Before(timestamp) {
+		return nil, e4crypto.ErrTimestampInFuture
+	}
+	if now.Add(-e4crypto.MaxDelayKeyTransition).After(timestamp) {
+		return nil, e4crypto.ErrTimestampTooOld
+	}
+
+	return clientKey.UnprotectMessage(protected, topicKey)
+}
+
+// HasTopicKey returns true when the client holds a key for the given topic
+func (c *client) HasTopicKey(topic string) bool {
+	topicHash := hex.EncodeToString(c.topicHashes.Hash(topic))
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	_, ok := c.TopicKeys[topicHash]
+
+	return ok
+}
+
+// IsReceivingTopic indicate when the given topic is the receiving topic of the client.
+// This means message received on this topic are client commands
+func (c *client) IsReceivingTopic(topic string) bool {
+	return topic == c.GetReceivingTopic()
+}
+
+// IsCommandTopic returns true when the given topic is the client command topic.
+// Messages received on it are C2 commands, protected with the client key,
+// while messages received on any other topic are protected with a topic key.
+// It is the same as IsReceivingTopic.
+func (c *client) IsCommandTopic(topic string) bool {
+	return c.IsReceivingTopic(topic)
+}
+
+// CommandTopic returns the client command topic. It is the same as GetReceivingTopic:
+// the receiving topic is derived from the client ID with TopicForID when the client is created,
+// as "e4/" followed by the hex encoded ID (see e4crypto.CommandTopicFor).
+func (c *client) CommandTopic() string {
+	return c.GetReceivingTopic()
+}
+
+// GetReceivingTopic returns the client receiving topic.
+func (c *client) GetReceivingTopic() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
 	return c.ReceivingTopic
 }
 
+// keyMaterial returns the client key material. As Reload can replace it at any time,
+// it must be read with this method, or while holding the lock, before being used.
+func (c *client) keyMaterial() keys.KeyMaterial {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Key
+}
+
+// C2KeyMatches returns true when the client holds the given C2 public key
+func (c *client) C2KeyMatches(expectedC2PubKey e4crypto.Curve25519PublicKey) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial)
+	if !ok {
+		return false
+	}
+
+	return pubKeyMaterial.C2KeyMatches(expectedC2PubKey)
+}
+
+// AddC2Key adds a failover C2 public key to the client key material
+func (c *client) AddC2Key(c2PubKey e4crypto.Curve25519PublicKey) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial)
+	if !ok {
+		return ErrUnsupportedOperation
+	}
+
+	if err := pubKeyMaterial.AddC2PubKey(c2PubKey); err != nil {
+		return err
+	}
+
+	return c.save()
+}
+
+// RemoveC2Key removes a C2 public key from the client key material
+func (c *client) RemoveC2Key(c2PubKey e4crypto.Curve25519PublicKey) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial)
+	if !ok {
+		return ErrUnsupportedOperation
+	}
+
+	if err := pubKeyMaterial.RemoveC2PubKey(c2PubKey); err != nil {
+		return err
+	}
+
+	return c.save()
+}
+
+// DropPrivateKey removes the client key material private key, making the client verifier only
+func (c *client) DropPrivateKey() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial)
+	if !ok {
+		return ErrUnsupportedOperation
+	}
+
+	pubKeyMaterial.DropPrivateKey()
+
+	return c.save()
+}
+
+// RotateSigningKey replaces the client key material private key, keeping its public keys and C2 public keys
+func (c *client) RotateSigningKey(newPrivateKey ed25519.PrivateKey) (ed25519.PublicKey, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return nil, err
+	}
+
+	pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial)
+	if !ok {
+		return nil, ErrUnsupportedOperation
+	}
+
+	if err := pubKeyMaterial.SetKey(newPrivateKey); err != nil {
+		return nil, fmt.Errorf("invalid ed25519 private key: %v", err)
+	}
+
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+
+	return pubKeyMaterial.PublicKey(), nil
+}
+
+// Wipe zeroes the client secrets, and removes its persisted file when deleteFile is true
+func (c *client) Wipe(deleteFile bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.wiped {
+		return ErrClientWiped
+	}
+
+	for topicHashHex, topicKey := range c.TopicKeys {
+		for i := range topicKey {
+			topicKey[i] = 0
+		}
+		delete(c.TopicKeys, topicHashHex)
+	}
+	for topicHashHex := range c.Topics {
+		delete(c.Topics, topicHashHex)
+	}
+	for topicHashHex := range c.TopicKeysInstalledAt {
+		delete(c.TopicKeysInstalledAt, topicHashHex)
+	}
+	for fingerprint := range c.AppliedCommands {
+		delete(c.AppliedCommands, fingerprint)
+	}
+	c.topicCiphers.Wipe()
+	c.topicUsage.Reset()
+
+	c.Key.Wipe()
+	c.wiped = true
+
+	if deleteFile {
+		if err := os.Remove(c.FilePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove client file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// SignMessage returns the signature of the given timestamp and encrypted payload
+func (c *client) SignMessage(payload []byte) ([]byte, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if err := c.stateErr(); err != nil {
+		return nil, err
+	}
+
+	pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial)
+	if !ok {
+		return nil, ErrUnsupportedOperation
+	}
+
+	return pubKeyMaterial.SignMessage(payload)
+}
+
+// stateErr returns ErrClientWiped or ErrClientClosed when the client can't be used anymore.
+// The client lock must be held by the caller.
+func (c *client) stateErr() error {
+	if c.wiped {
+		return ErrClientWiped
+	}
+	if c.closed {
+		return ErrClientClosed
+	}
+
+	return nil
+}
+
+// checkState returns ErrClientWiped or ErrClientClosed when the client can't be used anymore
+func (c *client) checkState() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.stateErr()
+}
+
+// recordAppliedCommand records the fingerprint of a command about to be applied, so that replaying it
+// can be detected, and forgets about the ones applied more than crypto.MaxDelayKeyTransition ago.
+// The check and the record happen under the same lock, so concurrent deliveries of a command can't both
+// be applied: ErrDuplicateCommand is returned when the fingerprint is already recorded.
+// The record must be removed with forgetAppliedCommand when the command fails to be applied.
+func (c *client) recordAppliedCommand(fingerprint string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	now := c.clock.Now().UTC()
+	for f, appliedAt := range c.AppliedCommands {
+		if now.Sub(appliedAt) >= e4crypto.MaxDelayKeyTransition {
+			delete(c.AppliedCommands, f)
+		}
+	}
+
+	if _, ok := c.AppliedCommands[fingerprint]; ok {
+		return ErrDuplicateCommand
+	}
+
+	if c.AppliedCommands == nil {
+		c.AppliedCommands = make(map[string]time.Time)
+	}
+	c.AppliedCommands[fingerprint] = now
+
+	return nil
+}
+
+// forgetAppliedCommand removes the record of a command which failed to be applied, allowing it to be retried
+func (c *client) forgetAppliedCommand(fingerprint string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.AppliedCommands, fingerprint)
+}
+
+// saveAppliedCommands saves the client once a command got applied.
+// As the fingerprints are persisted along with the client, replays are still detected after a restart.
+func (c *client) saveAppliedCommands() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	return c.save()
+}
+
+// CommandKey returns the symmetric key of the commands protected by the primary C2
+func (c *client) CommandKey() ([]byte, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if err := c.stateErr(); err != nil {
+		return nil, err
+	}
+
+	pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial)
+	if !ok {
+		return nil, ErrUnsupportedOperation
+	}
+
+	return pubKeyMaterial.CommandKey()
+}
+
+// ProtectDirect protects the payload with the key shared with the given recipient
+func (c *client) ProtectDirect(payload []byte, recipientCurvePubKey []byte) ([]byte, error) {
+	if err := c.checkPayloadSize(payload); err != nil {
+		return nil, err
+	}
+
+	key, err := c.directKey(recipientCurvePubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return e4crypto.ProtectSymKeyAt(payload, key, c.clock.Now())
+}
+
+// UnprotectDirect unprotects the message with the key shared with the given sender
+func (c *client) UnprotectDirect(protected []byte, senderCurvePubKey []byte) ([]byte, error) {
+	key, err := c.directKey(senderCurvePubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return e4crypto.UnprotectSymKeyAt(protected, key, c.clock.Now())
+}
+
+// directKey returns the key of the direct messages exchanged with the given peer
+func (c *client) directKey(peerCurvePubKey []byte) ([]byte, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if err := c.stateErr(); err != nil {
+		return nil, err
+	}
+
+	pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial)
+	if !ok {
+		return nil, ErrUnsupportedOperation
+	}
+
+	return pubKeyMaterial.DirectKey(peerCurvePubKey)
+}
+
 // setTopicKey adds a key to the given topic hash, erasing any previous entry
 func (c *client) setTopicKey(key, topicHash []byte) error {
 	if err := e4crypto.ValidateTopicHash(topicHash); err != nil {
@@ -461,17 +1746,164 @@ func (c *client) setTopicKey(key, topicHash []byte) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	c.storeTopicKey(key, topicHash)
+
+	return c.save()
+}
+
+// setWrappedTopicKey unwraps the given key, and adds it to the given topic hash
+func (c *client) setWrappedTopicKey(wrappedKey, topicHash []byte) error {
+	if err := c.checkState(); err != nil {
+		return err
+	}
+
+	key, err := c.keyMaterial().UnwrapKey(wrappedKey)
+	if err != nil {
+		return fmt.Errorf("failed to unwrap topic key: %v", err)
+	}
+
+	err = c.setTopicKey(key, topicHash)
+	for i := range key {
+		key[i] = 0
+	}
+
+	return err
+}
+
+// GenerateTopicKey sets a new random key for the given topic, and returns it
+func (c *client) GenerateTopicKey(topic string) ([]byte, error) {
+	key, err := e4crypto.RandomKeyFrom(c.rand)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate topic key: %v", err)
+	}
+
+	if err := c.SetTopicKeyByName(key, topic); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// SetTopicKeyByName adds a key to the given topic, erasing any previous entry.
+// Unlike keys received from C2 commands, which only know the topic hash, the topic name is retained
+// and returned by TopicNames.
+func (c *client) SetTopicKeyByName(key []byte, topic string) error {
+	if err := e4crypto.ValidateTopic(topic); err != nil {
+		return fmt.Errorf("invalid topic: %v", err)
+	}
+
+	if err := e4crypto.ValidateSymKey(key); err != nil {
+		return fmt.Errorf("invalid topic key: %v", err)
+	}
+
+	topicHash := c.topicHashes.Hash(topic)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	c.storeTopicKey(key, topicHash)
+
+	if c.Topics == nil {
+		c.Topics = make(map[string]string)
+	}
+	c.Topics[hex.EncodeToString(topicHash)] = topic
+
+	return c.save()
+}
+
+// ReplaceAllTopicKeys replaces every topic key held by the client by the given ones, indexed by topic name.
+// All topics and keys are validated first, and nothing changes on any validation failure.
+// Previous keys, including the ones kept for key transition, are dropped and zeroed once the new ones are persisted.
+func (c *client) ReplaceAllTopicKeys(topicKeys map[string][]byte) error {
+	newTopicKeys := make(map[string]keys.TopicKey, len(topicKeys))
+	newTopics := make(map[string]string, len(topicKeys))
+	newInstalledAt := make(map[string]time.Time, len(topicKeys))
+	now := c.clock.Now().UTC()
+	for topic, key := range topicKeys {
+		if err := e4crypto.ValidateTopic(topic); err != nil {
+			return fmt.Errorf("invalid topic %q: %v", topic, err)
+		}
+		if err := e4crypto.ValidateSymKey(key); err != nil {
+			return fmt.Errorf("invalid key for topic %q: %v", topic, err)
+		}
+
+		topicHashHex := hex.EncodeToString(c.topicHashes.Hash(topic))
+
+		newKey := make([]byte, e4crypto.KeyLen)
+		copy(newKey, key)
+		newTopicKeys[topicHashHex] = newKey
+		newTopics[topicHashHex] = topic
+		newInstalledAt[topicHashHex] = now
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	oldTopicKeys, oldTopics, oldInstalledAt := c.TopicKeys, c.Topics, c.TopicKeysInstalledAt
+	c.TopicKeys, c.Topics, c.TopicKeysInstalledAt = newTopicKeys, newTopics, newInstalledAt
+
+	if err := c.save(); err != nil {
+		c.TopicKeys, c.Topics, c.TopicKeysInstalledAt = oldTopicKeys, oldTopics, oldInstalledAt
+		return err
+	}
+
+	c.topicCiphers.Reset()
+	c.topicUsage.Reset()
+	for _, oldKey := range oldTopicKeys {
+		for i := range oldKey {
+			oldKey[i] = 0
+		}
+	}
+
+	return nil
+}
+
+// TopicNames returns the sorted names of the topics the client holds a key for,
+// when known (see SetTopicKeyByName). Topics only known by their hash are omitted.
+func (c *client) TopicNames() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	names := make([]string, 0, len(c.Topics))
+	for _, name := range c.Topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// storeTopicKey adds a key to the given topic hash, erasing any previous entry
+// and keeping the previous key for key transition.
+// The client lock must be held by the caller.
+func (c *client) storeTopicKey(key, topicHash []byte) {
 	topicHashHex := hex.EncodeToString(topicHash)
 
 	// Key transition, if a key already exists for this topic
 	topicKey, ok := c.TopicKeys[topicHashHex]
+	if !ok || !bytes.Equal(topicKey, key) {
+		if c.TopicKeysInstalledAt == nil {
+			c.TopicKeysInstalledAt = make(map[string]time.Time)
+		}
+		c.TopicKeysInstalledAt[topicHashHex] = c.clock.Now().UTC()
+	}
 	if ok {
 		// Only do key transition if the key received is distinct from the current one
 		if !bytes.Equal(topicKey, key) {
 			hashOfHash := e4crypto.HashTopic(string(topicHash))
-			timestamp := make([]byte, e4crypto.TimestampLen)
-			binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().Unix()))
-			topicKey = append(topicKey, timestamp...)
+			topicKey = append(topicKey, encodeStoredTimestamp(c.clock.Now())...)
 			c.TopicKeys[hex.EncodeToString(hashOfHash)] = topicKey
 		}
 	}
@@ -479,7 +1911,8 @@ func (c *client) setTopicKey(key, topicHash []byte) error {
 	newKey := make([]byte, e4crypto.KeyLen)
 	copy(newKey, key)
 	c.TopicKeys[topicHashHex] = newKey
-	return c.save()
+	c.topicCiphers.Invalidate(topicHashHex)
+	c.topicUsage.Forget(topicHashHex)
 }
 
 // removeTopic removes the key of the given topic hash
@@ -491,13 +1924,106 @@ func (c *client) removeTopic(topicHash []byte) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	delete(c.TopicKeys, hex.EncodeToString(topicHash))
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	c.deleteTopicKey(hex.EncodeToString(topicHash))
+
+	return c.save()
+}
+
+// deleteTopicKey removes the key of the given hex encoded topic hash, along with its name,
+// install time and the key kept for key transition, if any.
+// The client lock must be held by the caller.
+func (c *client) deleteTopicKey(topicHashHex string) {
+	delete(c.TopicKeys, topicHashHex)
+	delete(c.Topics, topicHashHex)
+	delete(c.TopicKeysInstalledAt, topicHashHex)
+	c.topicCiphers.Invalidate(topicHashHex)
+	c.topicUsage.Forget(topicHashHex)
 
 	// Delete key kept for key transition, if any
+	topicHash, err := hex.DecodeString(topicHashHex)
+	if err != nil {
+		return
+	}
 	hashOfHash := e4crypto.HashTopic(string(topicHash))
 	delete(c.TopicKeys, hex.EncodeToString(hashOfHash))
+}
 
-	return c.save()
+// TopicKeyAge returns for how long the client holds the current key of the given topic
+func (c *client) TopicKeyAge(topic string) (time.Duration, error) {
+	topicHashHex := hex.EncodeToString(c.topicHashes.Hash(topic))
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if err := c.stateErr(); err != nil {
+		return 0, err
+	}
+
+	if _, ok := c.TopicKeys[topicHashHex]; !ok {
+		return 0, ErrTopicKeyNotFound
+	}
+
+	installedAt, ok := c.TopicKeysInstalledAt[topicHashHex]
+	if !ok {
+		return 0, ErrUnknownTopicKeyAge
+	}
+
+	return c.clock.Now().Sub(installedAt), nil
+}
+
+// TopicKeyLastUsed returns when the key of the given topic has last been used to protect or unprotect a message
+func (c *client) TopicKeyLastUsed(topic string) (time.Time, error) {
+	topicHashHex := hex.EncodeToString(c.topicHashes.Hash(topic))
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if err := c.stateErr(); err != nil {
+		return time.Time{}, err
+	}
+
+	if _, ok := c.TopicKeys[topicHashHex]; !ok {
+		return time.Time{}, ErrTopicKeyNotFound
+	}
+
+	lastUsed, _ := c.topicUsage.LastUsed(topicHashHex)
+
+	return lastUsed, nil
+}
+
+// PruneExpiredTopicKeys removes the topic keys installed for longer than maxAge, and returns how many have been removed.
+// The client is only persisted when keys have been removed. When persisting fails, the keys stay removed
+// from memory, and their count is returned along with the error.
+func (c *client) PruneExpiredTopicKeys(maxAge time.Duration) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return 0, err
+	}
+
+	now := c.clock.Now()
+
+	var expired []string
+	for topicHashHex, installedAt := range c.TopicKeysInstalledAt {
+		if now.Sub(installedAt) > maxAge {
+			expired = append(expired, topicHashHex)
+		}
+	}
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	for _, topicHashHex := range expired {
+		c.deleteTopicKey(topicHashHex)
+	}
+
+	return len(expired), c.save()
 }
 
 // resetTopics removes all topic keys
@@ -505,7 +2031,15 @@ func (c *client) resetTopics() error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
 	c.TopicKeys = make(map[string]keys.TopicKey)
+	c.Topics = make(map[string]string)
+	c.TopicKeysInstalledAt = make(map[string]time.Time)
+	c.topicCiphers.Reset()
+	c.topicUsage.Reset()
 	return c.save()
 }
 
@@ -514,6 +2048,10 @@ func (c *client) getPubKeys() (map[string]ed25519.PublicKey, error) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
+	if err := c.stateErr(); err != nil {
+		return nil, err
+	}
+
 	pkStore, ok := c.Key.(keys.PubKeyStore)
 	if !ok {
 		return nil, ErrUnsupportedOperation
@@ -527,6 +2065,10 @@ func (c *client) setPubKey(key ed25519.PublicKey, clientID []byte) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
 	pkStore, ok := c.Key.(keys.PubKeyStore)
 	if !ok {
 		return ErrUnsupportedOperation
@@ -536,7 +2078,15 @@ func (c *client) setPubKey(key ed25519.PublicKey, clientID []byte) error {
 		return fmt.Errorf("invalid client ID: %v", err)
 	}
 
-	pkStore.AddPubKey(clientID, key)
+	changed, err := pkStore.AddPubKeyIfChanged(clientID, key)
+	if err != nil {
+		return err
+	}
+
+	// Avoid rewriting the client file when the key is already known
+	if !changed {
+		return nil
+	}
 
 	return c.save()
 }
@@ -546,6 +2096,10 @@ func (c *client) removePubKey(clientID []byte) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
 	pkStore, ok := c.Key.(keys.PubKeyStore)
 	if !ok {
 		return ErrUnsupportedOperation
@@ -568,6 +2122,10 @@ func (c *client) resetPubKeys() error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
 	pkStore, ok := c.Key.(keys.PubKeyStore)
 	if !ok {
 		return ErrUnsupportedOperation
@@ -583,6 +2141,10 @@ func (c *client) setIDKey(key []byte) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
 	if err := c.Key.SetKey(key); err != nil {
 		return err
 	}
@@ -590,7 +2152,8 @@ func (c *client) setIDKey(key []byte) error {
 	return c.save()
 }
 
-// TopicForID generate the receiving topic that a client should subscribe to in order to receive commands
+// TopicForID generate the receiving topic that a client should subscribe to in order to receive commands.
+// See e4crypto.CommandTopicFor.
 func TopicForID(id []byte) string {
-	return idTopicPrefix + hex.EncodeToString(id)
+	return e4crypto.CommandTopicFor(id)
 }
@@ -16,10 +16,17 @@ package e4
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -113,10 +120,48 @@ func TestProtectUnprotectMessagePubKey(t *testing.T) {
 		t.Fatalf("SetPubKey failed: %s", err)
 	}
 
-	protectedConstLength := e4crypto.TagLen + e4crypto.TimestampLen + e4crypto.IDLen + ed25519.SignatureSize
+	protectedConstLength := e4crypto.TagLen + e4crypto.TaggedHeaderLen + e4crypto.IDLen + ed25519.SignatureSize
 	testProtectUnprotectMessage(t, client, protectedConstLength)
 }
 
+func TestNewClientFromKeyMaterial(t *testing.T) {
+	clientID := e4crypto.RandomID()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	km, err := keys.NewPubKeyMaterial(clientID, privateKey, generateCurve25519PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	client, err := NewClientFromKeyMaterial(clientID, km, "./test/data/clienttestfromkeymaterial")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if err := client.setPubKey(publicKey, clientID); err != nil {
+		t.Fatalf("SetPubKey failed: %v", err)
+	}
+
+	// The client owns the given material, and updates it in place
+	if _, err := km.GetPubKey(clientID); err != nil {
+		t.Fatalf("Expected the pubkey to be set on the given key material: %v", err)
+	}
+
+	protectedConstLength := e4crypto.TagLen + e4crypto.TaggedHeaderLen + e4crypto.IDLen + ed25519.SignatureSize
+	testProtectUnprotectMessage(t, client, protectedConstLength)
+
+	if _, err := NewClientFromKeyMaterial(clientID, nil, "./test/data/clienttestfromkeymaterial"); err == nil {
+		t.Fatal("Expected an error when creating a client from nil key material")
+	}
+	if _, err := NewClientFromKeyMaterial(nil, km, "./test/data/clienttestfromkeymaterial"); err == nil {
+		t.Fatal("Expected an error when creating a client with an empty id")
+	}
+}
+
 func testProtectUnprotectMessage(t *testing.T, c Client, protectedConstLength int) {
 	topic := "topic"
 	err := c.setTopicKey(e4crypto.RandomKey(), e4crypto.HashTopic(topic))
@@ -191,6 +236,22 @@ func testProtectUnprotectMessage(t *testing.T, c Client, protectedConstLength in
 		}
 	}
 
+	// empty payloads must round-trip
+	protected, err := c.ProtectMessage([]byte{}, topic)
+	if err != nil {
+		t.Fatalf("Protect failed on empty payload: %s", err)
+	}
+	if g, w := len(protected), protectedConstLength; g != w {
+		t.Fatalf("Invalid protected message length: got %v, wanted %v", g, w)
+	}
+	unprotected, err := c.Unprotect(protected, topic)
+	if err != nil {
+		t.Fatalf("Unprotect failed on empty payload: %s", err)
+	}
+	if len(unprotected) != 0 {
+		t.Fatalf("Invalid unprotected message: got %v, wanted empty payload", unprotected)
+	}
+
 	if _, err := c.ProtectMessage([]byte("payload"), "topic-not-existing"); err != ErrTopicKeyNotFound {
 		t.Fatalf("Invalid error from ProtectMessage for an unknown topic, got %v, wanted %v", err, ErrTopicKeyNotFound)
 	}
@@ -233,9 +294,13 @@ func TestKeyTransition(t *testing.T) {
 		t.Fatalf("Unprotect failed: %s", err)
 	}
 
+	// The previous key timestamp is persisted independently of the protocol timestamps byte order
+	e4crypto.SetTimestampByteOrder(binary.BigEndian)
+	defer e4crypto.SetTimestampByteOrder(nil)
 	if err := c.setTopicKey(secondKey, topicHash); err != nil {
 		t.Fatalf("SetTopicKey failed: %s", err)
 	}
+	e4crypto.SetTimestampByteOrder(nil)
 
 	// should succeed, first key still available
 	if _, err := c.Unprotect(protected, topic); err != nil {
@@ -663,7 +728,11 @@ func TestCommandsSymClient(t *testing.T) {
 
 	assertClientTopicKey(t, false, c, topicHash, nil)
 
-	// Add back the topic key
+	// Add back the topic key, with a new command as applied ones can't be replayed
+	protectedSetTopicCmd, err = e4crypto.ProtectSymKeyAt(setTopicCmd, clientKey, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
 	d, err = c.Unprotect(protectedSetTopicCmd, receivingTopic)
 	if err != nil {
 		t.Fatalf("Failed to unprotect command: %v", err)
@@ -887,37 +956,1998 @@ func assertContainsPubKey(t *testing.T, c Client, id []byte, key []byte) {
 	}
 }
 
-func assertSavedClientPubKeysEquals(t *testing.T, filepath string, c Client) {
-	savedClient, err := LoadClient(filepath)
+func TestClientKDFProvenance(t *testing.T) {
+	password := "some password with enough characters"
+	configs := map[string]ClientConfig{
+		"symClient": &SymNameAndPassword{Name: "client", Password: password},
+		"pubClient": &PubNameAndPassword{Name: "client", Password: password, C2PubKey: generateCurve25519PubKey(t)},
+	}
+
+	expectedProvenance := &keys.KDFProvenance{
+		Algorithm: e4crypto.Argon2Algorithm,
+		Params:    e4crypto.DefaultArgon2Params,
+	}
+
+	for name, config := range configs {
+		t.Run(name+" created from password records KDF provenance", func(t *testing.T) {
+			c, err := NewClient(config, "./test/data/clienttestkdfprovenance")
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+
+			jsonClient, err := json.Marshal(c)
+			if err != nil {
+				t.Fatalf("Failed to marshal client: %v", err)
+			}
+			if !bytes.Contains(jsonClient, []byte(`"algorithm":"argon2i"`)) {
+				t.Fatalf("Expected client json to contain KDF provenance, got %s", jsonClient)
+			}
+			if bytes.Contains(jsonClient, []byte(password)) {
+				t.Fatal("Client json must not contain the password")
+			}
+
+			unmarshalledClient := &client{}
+			if err := json.Unmarshal(jsonClient, unmarshalledClient); err != nil {
+				t.Fatalf("Failed to unmarshal client: %v", err)
+			}
+			if g, w := unmarshalledClient.Key.KDFProvenance(), expectedProvenance; !reflect.DeepEqual(g, w) {
+				t.Fatalf("Invalid KDF provenance: got %#v, wanted %#v", g, w)
+			}
+		})
+	}
+
+	t.Run("client created from random key has no KDF provenance", func(t *testing.T) {
+		c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestkdfprovenance")
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		jsonClient, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf("Failed to marshal client: %v", err)
+		}
+		if bytes.Contains(jsonClient, []byte("KDF")) {
+			t.Fatalf("Expected client json to not contain KDF provenance, got %s", jsonClient)
+		}
+
+		if p := c.(*client).Key.KDFProvenance(); p != nil {
+			t.Fatalf("Invalid KDF provenance: got %#v, wanted nil", p)
+		}
+	})
+}
+
+func TestHasTopicKey(t *testing.T) {
+	clientKey := e4crypto.RandomKey()
+	c, err := NewClient(&SymIDAndKey{Key: clientKey}, "./test/data/clienttesthastopickey")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	if c.HasTopicKey(topic) {
+		t.Fatalf("Expected client to not have a key for topic %s", topic)
+	}
+
+	cmd, err := CmdSetTopicKey(e4crypto.RandomKey(), topic)
+	if err != nil {
+		t.Fatalf("CmdSetTopicKey failed: %v", err)
+	}
+	protectedCmd, err := e4crypto.ProtectSymKey(cmd, clientKey)
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+	if _, err := c.Unprotect(protectedCmd, c.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to process command: %v", err)
+	}
+
+	if !c.HasTopicKey(topic) {
+		t.Fatalf("Expected client to have a key for topic %s", topic)
+	}
+
+	if c.HasTopicKey("unknown-topic") {
+		t.Fatal("Expected client to not have a key for an unknown topic")
+	}
+}
+
+func TestTopicNames(t *testing.T) {
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttesttopicnames")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/b"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/a"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+	if err := c.setTopicKey(e4crypto.RandomKey(), e4crypto.HashTopic("topic/hash-only")); err != nil {
+		t.Fatalf("SetTopicKey failed: %v", err)
+	}
+
+	if !c.HasTopicKey("topic/a") || !c.HasTopicKey("topic/b") || !c.HasTopicKey("topic/hash-only") {
+		t.Fatal("Expected client to have keys for all topics")
+	}
+
+	expectedNames := []string{"topic/a", "topic/b"}
+	if g, w := c.TopicNames(), expectedNames; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid topic names: got %v, wanted %v", g, w)
+	}
+
+	loadedClient, err := LoadClient("./test/data/clienttesttopicnames")
 	if err != nil {
 		t.Fatalf("Failed to load client: %v", err)
 	}
+	if g, w := loadedClient.TopicNames(), expectedNames; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid loaded topic names: got %v, wanted %v", g, w)
+	}
 
-	savedPk, err := savedClient.getPubKeys()
+	if err := c.removeTopic(e4crypto.HashTopic("topic/a")); err != nil {
+		t.Fatalf("RemoveTopic failed: %v", err)
+	}
+	if g, w := c.TopicNames(), []string{"topic/b"}; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid topic names: got %v, wanted %v", g, w)
+	}
+
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), ""); err == nil {
+		t.Fatal("Expected an error when setting a key for an empty topic")
+	}
+	if err := c.SetTopicKeyByName([]byte("not a key"), "topic/c"); err == nil {
+		t.Fatal("Expected an error when setting an invalid topic key")
+	}
+}
+
+func TestReplaceAllTopicKeys(t *testing.T) {
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestreplacealltopickeys")
 	if err != nil {
-		t.Fatalf("Failed to get savedClient pubKeys: %v", err)
+		t.Fatalf("Failed to create client: %v", err)
 	}
-	cPk, err := c.getPubKeys()
+
+	oldKey := e4crypto.RandomKey()
+	if err := c.SetTopicKeyByName(oldKey, "topic/old"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/old"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+
+	t.Run("invalid keys leave the client unchanged", func(t *testing.T) {
+		err := c.ReplaceAllTopicKeys(map[string][]byte{
+			"topic/a": e4crypto.RandomKey(),
+			"topic/b": []byte("not a key"),
+		})
+		if err == nil {
+			t.Fatal("Expected an error when replacing topic keys with an invalid key")
+		}
+
+		if !c.HasTopicKey("topic/old") || c.HasTopicKey("topic/a") {
+			t.Fatal("Expected client topic keys to be unchanged")
+		}
+		if g, w := c.TopicNames(), []string{"topic/old"}; !reflect.DeepEqual(g, w) {
+			t.Fatalf("Invalid topic names: got %v, wanted %v", g, w)
+		}
+	})
+
+	t.Run("all keys are replaced", func(t *testing.T) {
+		tc := c.(*client)
+		var previousKeys []keys.TopicKey
+		for _, k := range tc.TopicKeys {
+			previousKeys = append(previousKeys, k)
+		}
+
+		// Keys read before the replacement must not be zeroed while being used
+		oldTopicHash := e4crypto.HashTopic("topic/old")
+		readKey, readPreviousKeyTs, err := tc.getTopicKeys(oldTopicHash)
+		if err != nil {
+			t.Fatalf("Failed to get topic keys: %v", err)
+		}
+		wantReadKey := append(keys.TopicKey{}, readKey...)
+		wantReadPreviousKeyTs := append(keys.TopicKey{}, readPreviousKeyTs...)
+
+		newKeys := map[string][]byte{
+			"topic/a": e4crypto.RandomKey(),
+			"topic/b": e4crypto.RandomKey(),
+		}
+		if err := c.ReplaceAllTopicKeys(newKeys); err != nil {
+			t.Fatalf("ReplaceAllTopicKeys failed: %v", err)
+		}
+
+		if c.HasTopicKey("topic/old") {
+			t.Fatal("Expected old topic key to be removed")
+		}
+		if g, w := len(tc.TopicKeys), len(newKeys); g != w {
+			t.Fatalf("Invalid topic keys count: got %d, wanted %d", g, w)
+		}
+		for topic, key := range newKeys {
+			k, ok := tc.TopicKeys[hex.EncodeToString(e4crypto.HashTopic(topic))]
+			if !ok || !bytes.Equal(k, key) {
+				t.Fatalf("Invalid key for topic %s: got %v, wanted %v", topic, k, key)
+			}
+		}
+		if g, w := c.TopicNames(), []string{"topic/a", "topic/b"}; !reflect.DeepEqual(g, w) {
+			t.Fatalf("Invalid topic names: got %v, wanted %v", g, w)
+		}
+
+		zeroKey := make([]byte, e4crypto.KeyLen)
+		for _, k := range previousKeys {
+			if !bytes.Equal(k[:e4crypto.KeyLen], zeroKey) {
+				t.Fatal("Expected previous keys to be zeroed")
+			}
+		}
+		if !bytes.Equal(readKey, wantReadKey) || !bytes.Equal(readPreviousKeyTs, wantReadPreviousKeyTs) {
+			t.Fatal("Expected the topic keys read before the replacement to be left untouched")
+		}
+
+		loadedClient, err := LoadClient("./test/data/clienttestreplacealltopickeys")
+		if err != nil {
+			t.Fatalf("Failed to load client: %v", err)
+		}
+		if g, w := loadedClient.(*client).TopicKeys, tc.TopicKeys; !reflect.DeepEqual(g, w) {
+			t.Fatalf("Invalid loaded topic keys: got %v, wanted %v", g, w)
+		}
+	})
+}
+
+func TestClientReload(t *testing.T) {
+	filePath := "./test/data/clienttestreload"
+
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath)
 	if err != nil {
-		t.Fatalf("Failed to get client pubKeys: %v", err)
+		t.Fatalf("Failed to create client: %v", err)
 	}
-	if !reflect.DeepEqual(savedPk, cPk) {
-		t.Fatalf("Invalid saved client pubKeys: got %#v, wanted %#v", savedPk, cPk)
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/a"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+
+	// Simulate another process updating the client file
+	otherClient, err := LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	newTopicKey := e4crypto.RandomKey()
+	if err := otherClient.SetTopicKeyByName(newTopicKey, "topic/b"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+	newClientKey := e4crypto.RandomKey()
+	if err := otherClient.setIDKey(newClientKey); err != nil {
+		t.Fatalf("SetIDKey failed: %v", err)
+	}
+
+	if c.HasTopicKey("topic/b") {
+		t.Fatal("Expected client not to have the new topic key before reload")
+	}
+
+	if err := c.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	if !c.HasTopicKey("topic/a") || !c.HasTopicKey("topic/b") {
+		t.Fatal("Expected client to have the new topic key after reload")
+	}
+	if g, w := c.TopicNames(), []string{"topic/a", "topic/b"}; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid topic names: got %v, wanted %v", g, w)
+	}
+
+	// Commands must be unprotected with the reloaded client key
+	protectedCmd, err := e4crypto.ProtectSymKey(append([]byte{RemoveTopic}, e4crypto.HashTopic("topic/a")...), newClientKey)
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+	if _, err := c.Unprotect(protectedCmd, c.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to unprotect command: %v", err)
+	}
+	if c.HasTopicKey("topic/a") {
+		t.Fatal("Expected topic key to have been removed")
+	}
+
+	t.Run("corrupted file leaves the client untouched", func(t *testing.T) {
+		if err := ioutil.WriteFile(filePath, []byte("{not json"), 0600); err != nil {
+			t.Fatalf("Failed to write client file: %v", err)
+		}
+
+		if err := c.Reload(); err == nil {
+			t.Fatal("Expected reload to fail with a corrupted file")
+		}
+
+		if !c.HasTopicKey("topic/b") {
+			t.Fatal("Expected client topic keys to be untouched")
+		}
+	})
+}
+
+func TestClientReloadConcurrentAccess(t *testing.T) {
+	filePath := "./test/data/clienttestreloadconcurrent"
+
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
 	}
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/a"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+
+		for i := 0; i < 50; i++ {
+			if err := c.Reload(); err != nil {
+				t.Errorf("Reload failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				protected, err := c.ProtectMessage([]byte("message"), "topic/a")
+				if err != nil {
+					t.Errorf("ProtectMessage failed: %v", err)
+					return
+				}
+				if _, err := c.Unprotect(protected, "topic/a"); err != nil {
+					t.Errorf("Unprotect failed: %v", err)
+					return
+				}
+				if _, err := c.ProtectMessageMulti([]byte("message"), []string{"topic/a"}); err != nil {
+					t.Errorf("ProtectMessageMulti failed: %v", err)
+					return
+				}
+
+				// Invalid commands must be rejected while the client key gets reloaded
+				if _, err := c.Unprotect([]byte("not a command"), c.GetReceivingTopic()); err == nil {
+					t.Error("Expected an invalid command to be rejected")
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
 }
 
-func generateCurve25519PubKey(t *testing.T) []byte {
-	var c2PubKey [e4crypto.Curve25519PubKeyLen]byte
+func TestClientWatch(t *testing.T) {
+	defer func(interval time.Duration) {
+		watchPollInterval = interval
+	}(watchPollInterval)
+	watchPollInterval = 10 * time.Millisecond
 
-	c2EdPubKey, _, err := ed25519.GenerateKey(nil)
+	filePath := "./test/data/clienttestwatch"
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath)
 	if err != nil {
-		t.Fatalf("Failed to generate c2 public key: %v", err)
+		t.Fatalf("Failed to create client: %v", err)
 	}
 
-	var c2EdPk [ed25519.PublicKeySize]byte
-	copy(c2EdPk[:], c2EdPubKey)
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/initial"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
 
-	extra25519.PublicKeyToCurve25519(&c2PubKey, &c2EdPk)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	return c2PubKey[:]
+	errC, err := c.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	otherClient, err := LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	if err := otherClient.SetTopicKeyByName(e4crypto.RandomKey(), "topic/watched"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for !c.HasTopicKey("topic/watched") {
+		select {
+		case err := <-errC:
+			t.Fatalf("Unexpected watch error: %v", err)
+		case <-timeout:
+			t.Fatal("Timeout waiting for the client to reload")
+		case <-time.After(watchPollInterval):
+		}
+	}
+
+	if err := ioutil.WriteFile(filePath, []byte("{not json"), 0600); err != nil {
+		t.Fatalf("Failed to write client file: %v", err)
+	}
+	select {
+	case err := <-errC:
+		if err == nil {
+			t.Fatal("Expected a reload error")
+		}
+	case <-timeout:
+		t.Fatal("Timeout waiting for the reload error")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-errC:
+		if ok {
+			t.Fatal("Expected error channel to be closed once context is cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for watch to stop")
+	}
+
+	unsavedClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestwatchunsaved")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, err := unsavedClient.Watch(context.Background()); err == nil {
+		t.Fatal("Expected watch to fail when the client file does not exist")
+	}
+}
+
+func TestClientWatchDeferredPersistence(t *testing.T) {
+	defer func(interval time.Duration) {
+		watchPollInterval = interval
+	}(watchPollInterval)
+	watchPollInterval = 10 * time.Millisecond
+
+	filePath := "./test/data/clienttestwatchdeferred"
+	os.Remove(filePath)
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath, WithDeferredPersistence())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/initial"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Failed to flush client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errC, err := c.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/unflushed"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+
+	otherClient, err := LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	if err := otherClient.SetTopicKeyByName(e4crypto.RandomKey(), "topic/watched"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+
+	select {
+	case err := <-errC:
+		if err != ErrUnflushedChanges {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnflushedChanges)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the reload error")
+	}
+
+	if !c.HasTopicKey("topic/unflushed") {
+		t.Fatal("Expected the unflushed topic key to be kept")
+	}
+	if c.HasTopicKey("topic/watched") {
+		t.Fatal("Expected the client to not be reloaded while holding unflushed changes")
+	}
+}
+
+func TestClientWatchConcurrentAccess(t *testing.T) {
+	defer func(interval time.Duration) {
+		watchPollInterval = interval
+	}(watchPollInterval)
+	watchPollInterval = time.Millisecond
+
+	filePath := "./test/data/clienttestwatchconcurrent"
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/initial"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errC, err := c.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	// The other client writes to a temporary file, moved over the watched one,
+	// so the watcher never reads a partially written file.
+	otherClient, err := LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	tmpFilePath := filePath + ".tmp"
+	otherClient.(*client).FilePath = tmpFilePath
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				protected, err := c.ProtectMessage([]byte("message"), "topic/initial")
+				if err != nil {
+					t.Errorf("ProtectMessage failed: %v", err)
+					return
+				}
+				if _, err := c.Unprotect(protected, "topic/initial"); err != nil {
+					t.Errorf("Unprotect failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		topic := fmt.Sprintf("topic/watched/%d", i)
+		if err := otherClient.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != nil {
+			t.Fatalf("SetTopicKeyByName failed: %v", err)
+		}
+		if err := os.Rename(tmpFilePath, filePath); err != nil {
+			t.Fatalf("Failed to move client file: %v", err)
+		}
+
+		timeout := time.After(5 * time.Second)
+		for !c.HasTopicKey(topic) {
+			select {
+			case err := <-errC:
+				t.Fatalf("Unexpected watch error: %v", err)
+			case <-timeout:
+				t.Fatal("Timeout waiting for the client to reload")
+			case <-time.After(watchPollInterval):
+			}
+		}
+	}
+}
+
+func TestIsCommandTopic(t *testing.T) {
+	id := e4crypto.HashIDAlias("client")
+	c, err := NewClient(&SymIDAndKey{ID: id, Key: e4crypto.RandomKey()}, "./test/data/clienttestiscommandtopic")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if !c.IsCommandTopic("e4/" + hex.EncodeToString(id)) {
+		t.Fatal("Expected client command topic to be recognized")
+	}
+	if !c.IsCommandTopic(c.GetReceivingTopic()) {
+		t.Fatal("Expected client receiving topic to be its command topic")
+	}
+	if g, w := c.CommandTopic(), "e4/"+hex.EncodeToString(id); g != w {
+		t.Fatalf("Invalid command topic: got %s, wanted %s", g, w)
+	}
+
+	otherTopics := []string{
+		"random/topic",
+		"",
+		TopicForID(e4crypto.HashIDAlias("other client")),
+		"e4/" + strings.ToUpper(hex.EncodeToString(id)),
+	}
+	for _, topic := range otherTopics {
+		if c.IsCommandTopic(topic) {
+			t.Fatalf("Expected topic %q not to be recognized as the command topic", topic)
+		}
+	}
+
+	// The command topic always is the topic the client routes commands from
+	c.(*client).ReceivingTopic = "custom/topic"
+	if g, w := c.CommandTopic(), "custom/topic"; g != w {
+		t.Fatalf("Invalid command topic: got %s, wanted %s", g, w)
+	}
+	if !c.IsCommandTopic("custom/topic") {
+		t.Fatal("Expected client receiving topic to be its command topic")
+	}
+}
+
+func TestC2KeyMatches(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	c2PubKey := generateCurve25519PubKey(t)
+	pubClient, err := NewClient(&PubIDAndKey{Key: privateKey, C2PubKey: c2PubKey}, "./test/data/clienttestc2keymatches")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if !pubClient.C2KeyMatches(c2PubKey) {
+		t.Fatal("Expected C2 key to match")
+	}
+
+	if pubClient.C2KeyMatches(generateCurve25519PubKey(t)) {
+		t.Fatal("Expected a different C2 key to not match")
+	}
+
+	symClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestc2keymatches")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if symClient.C2KeyMatches(c2PubKey) {
+		t.Fatal("Expected C2 key to never match on a symmetric client")
+	}
+}
+
+func TestProtectMessageMulti(t *testing.T) {
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestprotectmulti")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	sharedKey := e4crypto.RandomKey()
+	topicKeys := map[string][]byte{
+		"raw":        sharedKey,
+		"aggregated": sharedKey,
+		"other":      e4crypto.RandomKey(),
+	}
+	for topic, key := range topicKeys {
+		if err := c.setTopicKey(key, e4crypto.HashTopic(topic)); err != nil {
+			t.Fatalf("SetTopicKey failed: %v", err)
+		}
+	}
+
+	payload := []byte("reading")
+	protected, err := c.ProtectMessageMulti(payload, []string{"raw", "aggregated", "other", "raw"})
+	if err != nil {
+		t.Fatalf("ProtectMessageMulti failed: %v", err)
+	}
+
+	if g, w := len(protected), len(topicKeys); g != w {
+		t.Fatalf("Invalid protected messages count: got %d, wanted %d", g, w)
+	}
+
+	if !bytes.Equal(protected["raw"], protected["aggregated"]) {
+		t.Fatal("Expected topics sharing a key to share the same protected message")
+	}
+
+	for topic := range topicKeys {
+		unprotected, err := c.Unprotect(protected[topic], topic)
+		if err != nil {
+			t.Fatalf("Unprotect failed for topic %s: %v", topic, err)
+		}
+		if !bytes.Equal(unprotected, payload) {
+			t.Fatalf("Invalid unprotected message for topic %s: got %v, wanted %v", topic, unprotected, payload)
+		}
+	}
+
+	_, err = c.ProtectMessageMulti(payload, []string{"raw", "missing1", "missing2"})
+	if err == nil {
+		t.Fatal("Expected an error when protecting for topics without keys")
+	}
+	if !strings.Contains(err.Error(), "missing1, missing2") {
+		t.Fatalf("Expected error to report missing topics, got: %v", err)
+	}
+}
+
+func TestUnprotectBatch(t *testing.T) {
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestunprotectbatch")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	if err := c.setTopicKey(e4crypto.RandomKey(), e4crypto.HashTopic(topic)); err != nil {
+		t.Fatalf("SetTopicKey failed: %v", err)
+	}
+
+	payloads := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	protected := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		protected[i], err = c.ProtectMessage(payload, topic)
+		if err != nil {
+			t.Fatalf("Protect failed: %v", err)
+		}
+	}
+
+	// tamper the second message
+	protected[1][len(protected[1])-1] ^= 0x01
+
+	messages, errs := c.UnprotectBatch(topic, protected)
+	if g, w := len(messages), len(protected); g != w {
+		t.Fatalf("Invalid messages count: got %d, wanted %d", g, w)
+	}
+	if g, w := len(errs), len(protected); g != w {
+		t.Fatalf("Invalid errors count: got %d, wanted %d", g, w)
+	}
+
+	for _, i := range []int{0, 2} {
+		if errs[i] != nil {
+			t.Fatalf("Unprotect failed for message %d: %v", i, errs[i])
+		}
+		if !bytes.Equal(messages[i], payloads[i]) {
+			t.Fatalf("Invalid unprotected message %d: got %v, wanted %v", i, messages[i], payloads[i])
+		}
+	}
+
+	if errs[1] != miscreant.ErrNotAuthentic {
+		t.Fatalf("Invalid error for tampered message: got %v, wanted %v", errs[1], miscreant.ErrNotAuthentic)
+	}
+	if messages[1] != nil {
+		t.Fatalf("Expected tampered message to be nil, got %v", messages[1])
+	}
+
+	_, errs = c.UnprotectBatch("topic-not-existing", protected)
+	for i, err := range errs {
+		if err != ErrTopicKeyNotFound {
+			t.Fatalf("Invalid error for message %d: got %v, wanted %v", i, err, ErrTopicKeyNotFound)
+		}
+	}
+}
+
+func assertSavedClientPubKeysEquals(t *testing.T, filepath string, c Client) {
+	savedClient, err := LoadClient(filepath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+
+	savedPk, err := savedClient.getPubKeys()
+	if err != nil {
+		t.Fatalf("Failed to get savedClient pubKeys: %v", err)
+	}
+	cPk, err := c.getPubKeys()
+	if err != nil {
+		t.Fatalf("Failed to get client pubKeys: %v", err)
+	}
+	if !reflect.DeepEqual(savedPk, cPk) {
+		t.Fatalf("Invalid saved client pubKeys: got %#v, wanted %#v", savedPk, cPk)
+	}
+}
+
+func generateCurve25519PubKey(t *testing.T) []byte {
+	var c2PubKey [e4crypto.Curve25519PubKeyLen]byte
+
+	c2EdPubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate c2 public key: %v", err)
+	}
+
+	var c2EdPk [ed25519.PublicKeySize]byte
+	copy(c2EdPk[:], c2EdPubKey)
+
+	extra25519.PublicKeyToCurve25519(&c2PubKey, &c2EdPk)
+
+	return c2PubKey[:]
+}
+
+func TestProtectMessageByTopicHash(t *testing.T) {
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestprotectbytopichash")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	topicHash := e4crypto.HashTopic(topic)
+	if err := c.setTopicKey(e4crypto.RandomKey(), topicHash); err != nil {
+		t.Fatalf("SetTopicKey failed: %v", err)
+	}
+
+	payload := []byte("payload")
+
+	protectedByHash, err := c.ProtectMessageByTopicHash(payload, topicHash)
+	if err != nil {
+		t.Fatalf("ProtectMessageByTopicHash failed: %v", err)
+	}
+	protectedByName, err := c.ProtectMessage(payload, topic)
+	if err != nil {
+		t.Fatalf("ProtectMessage failed: %v", err)
+	}
+
+	unprotected, err := c.Unprotect(protectedByHash, topic)
+	if err != nil {
+		t.Fatalf("Unprotect failed: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+
+	unprotected, err = c.UnprotectMessageByTopicHash(protectedByName, topicHash)
+	if err != nil {
+		t.Fatalf("UnprotectMessageByTopicHash failed: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+
+	unknownTopicHash := e4crypto.HashTopic("unknown")
+	if _, err := c.ProtectMessageByTopicHash(payload, unknownTopicHash); err != ErrTopicKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTopicKeyNotFound)
+	}
+	if _, err := c.UnprotectMessageByTopicHash(protectedByName, unknownTopicHash); err != ErrTopicKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTopicKeyNotFound)
+	}
+
+	invalidTopicHash := topicHash[:e4crypto.HashLen-1]
+	if _, err := c.ProtectMessageByTopicHash(payload, invalidTopicHash); err == nil {
+		t.Fatal("Expected an error when protecting with an invalid topic hash")
+	}
+	if _, err := c.UnprotectMessageByTopicHash(protectedByName, invalidTopicHash); err == nil {
+		t.Fatal("Expected an error when unprotecting with an invalid topic hash")
+	}
+}
+
+func TestC2KeyFailover(t *testing.T) {
+	clientPubKey, clientPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	newC2Keys := func(t *testing.T) (e4crypto.Curve25519PrivateKey, e4crypto.Curve25519PublicKey) {
+		c2PrivKey := e4crypto.RandomKey()
+		c2PubKey, err := curve25519.X25519(c2PrivKey, curve25519.Basepoint)
+		if err != nil {
+			t.Fatalf("Failed to generate curve25519 keys: %v", err)
+		}
+
+		return c2PrivKey, c2PubKey
+	}
+
+	primaryC2PrivKey, primaryC2PubKey := newC2Keys(t)
+	secondaryC2PrivKey, secondaryC2PubKey := newC2Keys(t)
+
+	filePath := "./test/data/clienttestc2keyfailover"
+	c, err := NewClient(&PubIDAndKey{Key: clientPrivKey, C2PubKey: primaryC2PubKey}, filePath)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	// protectFrom returns a new command protected with the given C2 key, as applied commands can't be replayed
+	protectFrom := func(c2PrivKey e4crypto.Curve25519PrivateKey) []byte {
+		command, err := CmdSetTopicKey(e4crypto.RandomKey(), "topic")
+		if err != nil {
+			t.Fatalf("Failed to create command: %v", err)
+		}
+		protected, err := e4crypto.ProtectCommandPubKey(command, e4crypto.Ed25519PubKey(clientPubKey), c2PrivKey)
+		if err != nil {
+			t.Fatalf("Failed to protect command: %v", err)
+		}
+
+		return protected
+	}
+
+	if _, err := c.Unprotect(protectFrom(secondaryC2PrivKey), c.GetReceivingTopic()); err == nil {
+		t.Fatal("Expected a command from an untrusted C2 key to be rejected")
+	}
+
+	if err := c.AddC2Key(secondaryC2PubKey); err != nil {
+		t.Fatalf("Failed to add C2 key: %v", err)
+	}
+
+	// The failover keys must be persisted
+	c, err = LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+
+	if !c.C2KeyMatches(secondaryC2PubKey) {
+		t.Fatal("Expected the secondary C2 key to match")
+	}
+	if _, err := c.Unprotect(protectFrom(secondaryC2PrivKey), c.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to unprotect command from the secondary C2 key: %v", err)
+	}
+	if _, err := c.Unprotect(protectFrom(primaryC2PrivKey), c.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to unprotect command from the primary C2 key: %v", err)
+	}
+
+	if err := c.RemoveC2Key(primaryC2PubKey); err != nil {
+		t.Fatalf("Failed to remove C2 key: %v", err)
+	}
+	if _, err := c.Unprotect(protectFrom(primaryC2PrivKey), c.GetReceivingTopic()); err == nil {
+		t.Fatal("Expected a command from a removed C2 key to be rejected")
+	}
+	if _, err := c.Unprotect(protectFrom(secondaryC2PrivKey), c.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to unprotect command from the secondary C2 key: %v", err)
+	}
+
+	if err := c.RemoveC2Key(secondaryC2PubKey); err != keys.ErrLastC2PubKey {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, keys.ErrLastC2PubKey)
+	}
+
+	symClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestc2keyfailoversym")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := symClient.AddC2Key(secondaryC2PubKey); err != ErrUnsupportedOperation {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+	}
+	if err := symClient.RemoveC2Key(secondaryC2PubKey); err != ErrUnsupportedOperation {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+	}
+}
+
+func TestDropPrivateKey(t *testing.T) {
+	senderPubKey, senderPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	_, receiverPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	c2PubKey := generateCurve25519PubKey(t)
+	senderID := e4crypto.HashIDAlias("sender")
+	sender, err := NewClient(&PubIDAndKey{ID: senderID, Key: senderPrivKey, C2PubKey: c2PubKey}, "./test/data/clienttestdropprivatekeysender")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	receiverFilePath := "./test/data/clienttestdropprivatekeyreceiver"
+	receiver, err := NewClient(&PubIDAndKey{Key: receiverPrivKey, C2PubKey: c2PubKey}, receiverFilePath)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	topicKey := e4crypto.RandomKey()
+	for _, c := range []Client{sender, receiver} {
+		if err := c.SetTopicKeyByName(topicKey, topic); err != nil {
+			t.Fatalf("Failed to set topic key: %v", err)
+		}
+	}
+	if err := receiver.setPubKey(senderPubKey, senderID); err != nil {
+		t.Fatalf("Failed to set pubkey: %v", err)
+	}
+
+	payload := []byte("archived message")
+	protected, err := sender.ProtectMessage(payload, topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+
+	if err := receiver.DropPrivateKey(); err != nil {
+		t.Fatalf("Failed to drop private key: %v", err)
+	}
+
+	// The verifier only state must be persisted
+	receiver, err = LoadClient(receiverFilePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+
+	if _, err := receiver.ProtectMessage(payload, topic); err != keys.ErrNoPrivateKey {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, keys.ErrNoPrivateKey)
+	}
+
+	unprotected, err := receiver.Unprotect(protected, topic)
+	if err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+
+	symClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestdropprivatekeysym")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := symClient.DropPrivateKey(); err != ErrUnsupportedOperation {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+	}
+}
+
+func TestPubKeyClientWithoutC2(t *testing.T) {
+	alicePubKey, alicePrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	bobPubKey, bobPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	aliceID := e4crypto.HashIDAlias("alice")
+	bobID := e4crypto.HashIDAlias("bob")
+	alice, err := NewClient(&PubIDAndKey{ID: aliceID, Key: alicePrivKey}, "./test/data/clienttestnoc2alice")
+	if err != nil {
+		t.Fatalf("Failed to create client without C2 key: %v", err)
+	}
+	bobFilePath := "./test/data/clienttestnoc2bob"
+	bob, err := NewClient(&PubIDAndKey{ID: bobID, Key: bobPrivKey, C2PubKey: []byte{}}, bobFilePath)
+	if err != nil {
+		t.Fatalf("Failed to create client without C2 key: %v", err)
+	}
+
+	topic := "topic"
+	topicKey := e4crypto.RandomKey()
+	for _, c := range []Client{alice, bob} {
+		if err := c.SetTopicKeyByName(topicKey, topic); err != nil {
+			t.Fatalf("Failed to set topic key: %v", err)
+		}
+	}
+	if err := alice.setPubKey(bobPubKey, bobID); err != nil {
+		t.Fatalf("Failed to set pubkey: %v", err)
+	}
+	if err := bob.setPubKey(alicePubKey, aliceID); err != nil {
+		t.Fatalf("Failed to set pubkey: %v", err)
+	}
+
+	// A client without C2 key must be persisted and loaded back
+	bob, err = LoadClient(bobFilePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+
+	for _, peers := range [][2]Client{{alice, bob}, {bob, alice}} {
+		sender, receiver := peers[0], peers[1]
+
+		payload := []byte("peer to peer")
+		protected, err := sender.ProtectMessage(payload, topic)
+		if err != nil {
+			t.Fatalf("Failed to protect message: %v", err)
+		}
+
+		unprotected, err := receiver.Unprotect(protected, topic)
+		if err != nil {
+			t.Fatalf("Failed to unprotect message: %v", err)
+		}
+		if !bytes.Equal(unprotected, payload) {
+			t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+		}
+	}
+
+	if bob.C2KeyMatches(make([]byte, e4crypto.Curve25519PubKeyLen)) {
+		t.Fatal("Expected no C2 key to match a client without C2")
+	}
+
+	command, err := CmdResetPubKeys()
+	if err != nil {
+		t.Fatalf("Failed to create command: %v", err)
+	}
+	protectedCommand, err := e4crypto.ProtectCommandPubKey(command, e4crypto.Ed25519PubKey(bobPubKey), e4crypto.RandomKey())
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+	if _, err := bob.Unprotect(protectedCommand, bob.GetReceivingTopic()); err != keys.ErrNoC2Configured {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, keys.ErrNoC2Configured)
+	}
+
+	// Adding a C2 key enables the commands
+	c2PrivKey := e4crypto.RandomKey()
+	c2PubKey, err := curve25519.X25519(c2PrivKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("Failed to generate curve25519 keys: %v", err)
+	}
+	if err := bob.AddC2Key(c2PubKey); err != nil {
+		t.Fatalf("Failed to add C2 key: %v", err)
+	}
+	protectedCommand, err = e4crypto.ProtectCommandPubKey(command, e4crypto.Ed25519PubKey(bobPubKey), c2PrivKey)
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+	if _, err := bob.Unprotect(protectedCommand, bob.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to unprotect command: %v", err)
+	}
+}
+
+func TestTopicKeyLastUsed(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttesttopickeylastused", WithClock(clock))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if _, err := c.TopicKeyLastUsed("unknown"); err != ErrTopicKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTopicKeyNotFound)
+	}
+
+	topic := "topic"
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+
+	lastUsed, err := c.TopicKeyLastUsed(topic)
+	if err != nil {
+		t.Fatalf("Failed to get topic key last use: %v", err)
+	}
+	if !lastUsed.IsZero() {
+		t.Fatalf("Invalid last use of an unused key: got %v, wanted zero time", lastUsed)
+	}
+
+	clock.Advance(time.Minute)
+	protected, err := c.ProtectMessage([]byte("payload"), topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+	lastUsed, err = c.TopicKeyLastUsed(topic)
+	if err != nil {
+		t.Fatalf("Failed to get topic key last use: %v", err)
+	}
+	if w := clock.Now(); !lastUsed.Equal(w) {
+		t.Fatalf("Invalid last use: got %v, wanted %v", lastUsed, w)
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := c.Unprotect(protected, topic); err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+	lastUsed, err = c.TopicKeyLastUsed(topic)
+	if err != nil {
+		t.Fatalf("Failed to get topic key last use: %v", err)
+	}
+	if w := clock.Now(); !lastUsed.Equal(w) {
+		t.Fatalf("Invalid last use: got %v, wanted %v", lastUsed, w)
+	}
+
+	// A new key hasn't been used yet
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	lastUsed, err = c.TopicKeyLastUsed(topic)
+	if err != nil {
+		t.Fatalf("Failed to get topic key last use: %v", err)
+	}
+	if !lastUsed.IsZero() {
+		t.Fatalf("Invalid last use of a new key: got %v, wanted zero time", lastUsed)
+	}
+}
+
+func TestPruneExpiredTopicKeys(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	filePath := "./test/data/clienttestpruneexpiredtopickeys"
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if _, err := c.TopicKeyAge("unknown"); err != ErrTopicKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTopicKeyNotFound)
+	}
+
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "old"); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	// Keys received from commands only know the topic hash, and must be pruned as well
+	if err := c.setTopicKey(e4crypto.RandomKey(), e4crypto.HashTopic("old-from-command")); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+
+	clock.Advance(2 * time.Hour)
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "fresh"); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+
+	clock.Advance(30 * time.Minute)
+
+	age, err := c.TopicKeyAge("old")
+	if err != nil {
+		t.Fatalf("Failed to get topic key age: %v", err)
+	}
+	if w := 150 * time.Minute; age != w {
+		t.Fatalf("Invalid topic key age: got %v, wanted %v", age, w)
+	}
+	age, err = c.TopicKeyAge("fresh")
+	if err != nil {
+		t.Fatalf("Failed to get topic key age: %v", err)
+	}
+	if w := 30 * time.Minute; age != w {
+		t.Fatalf("Invalid topic key age: got %v, wanted %v", age, w)
+	}
+
+	pruned, err := c.PruneExpiredTopicKeys(time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to prune expired topic keys: %v", err)
+	}
+	if g, w := pruned, 2; g != w {
+		t.Fatalf("Invalid pruned topic keys count: got %d, wanted %d", g, w)
+	}
+	pruned, err = c.PruneExpiredTopicKeys(time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to prune expired topic keys: %v", err)
+	}
+	if g, w := pruned, 0; g != w {
+		t.Fatalf("Invalid pruned topic keys count: got %d, wanted %d", g, w)
+	}
+
+	// The pruning must be persisted
+	c, err = LoadClient(filePath, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+
+	for _, topic := range []string{"old", "old-from-command"} {
+		if c.HasTopicKey(topic) {
+			t.Fatalf("Expected expired key of topic %s to be pruned", topic)
+		}
+	}
+	if !c.HasTopicKey("fresh") {
+		t.Fatal("Expected fresh topic key to be retained")
+	}
+	if g, w := c.TopicNames(), []string{"fresh"}; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid topic names: got %v, wanted %v", g, w)
+	}
+
+	// Updating a key resets its age
+	clock.Advance(time.Hour)
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "fresh"); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	age, err = c.TopicKeyAge("fresh")
+	if err != nil {
+		t.Fatalf("Failed to get topic key age: %v", err)
+	}
+	if age != 0 {
+		t.Fatalf("Invalid topic key age: got %v, wanted 0", age)
+	}
+
+	if err := c.Wipe(false); err != nil {
+		t.Fatalf("Failed to wipe client: %v", err)
+	}
+	if _, err := c.PruneExpiredTopicKeys(time.Hour); err != ErrClientWiped {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientWiped)
+	}
+}
+
+func TestRotateSigningKey(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	filePath := "./test/data/clienttestrotatesigningkey"
+	c, err := NewClient(&PubIDAndKey{Key: privateKey, C2PubKey: generateCurve25519PubKey(t)}, filePath)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	peerPubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	if err := c.setPubKey(peerPubKey, e4crypto.HashIDAlias("peer")); err != nil {
+		t.Fatalf("Failed to set pubkey: %v", err)
+	}
+
+	topic := "topic"
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+
+	pubKeyMaterial := c.(*client).Key.(keys.PubKeyMaterial)
+	pubKeys := pubKeyMaterial.GetPubKeys()
+	c2PubKeys := pubKeyMaterial.C2PubKeys()
+
+	newPubKey, newPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	if _, err := c.RotateSigningKey(ed25519.PrivateKey(e4crypto.RandomKey())); err == nil {
+		t.Fatal("Expected an error when rotating to an invalid private key")
+	}
+
+	rotatedPubKey, err := c.RotateSigningKey(newPrivateKey)
+	if err != nil {
+		t.Fatalf("Failed to rotate signing key: %v", err)
+	}
+	if !bytes.Equal(rotatedPubKey, newPubKey) {
+		t.Fatalf("Invalid public key: got %v, wanted %v", rotatedPubKey, newPubKey)
+	}
+
+	// The rotation must be persisted, leaving the trust relationships untouched
+	c, err = LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	pubKeyMaterial = c.(*client).Key.(keys.PubKeyMaterial)
+	if g, w := pubKeyMaterial.GetPubKeys(), pubKeys; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid pubkeys: got %v, wanted %v", g, w)
+	}
+	if g, w := pubKeyMaterial.C2PubKeys(), c2PubKeys; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid C2 pubkeys: got %v, wanted %v", g, w)
+	}
+
+	protected, err := c.ProtectMessage([]byte("payload"), topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+	signed := protected[e4crypto.SchemeTagLen : len(protected)-ed25519.SignatureSize]
+	signature := protected[len(protected)-ed25519.SignatureSize:]
+	if !ed25519.Verify(newPubKey, signed, signature) {
+		t.Fatal("Expected the protected message to be signed with the new key")
+	}
+
+	symClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestrotatesigningkeysym")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, err := symClient.RotateSigningKey(newPrivateKey); err != ErrUnsupportedOperation {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	clientPubKey, clientPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	c2PrivKey := e4crypto.RandomKey()
+	c2PubKey, err := curve25519.X25519(c2PrivKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("Failed to generate curve25519 keys: %v", err)
+	}
+
+	c, err := NewClient(&PubIDAndKey{Key: clientPrivKey, C2PubKey: c2PubKey}, "./test/data/clienttestcommandkey")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	command, err := CmdResetTopics()
+	if err != nil {
+		t.Fatalf("Failed to create command: %v", err)
+	}
+	capturedCmd, err := e4crypto.ProtectCommandPubKey(command, e4crypto.Ed25519PubKey(clientPubKey), c2PrivKey)
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+
+	commandKey, err := c.CommandKey()
+	if err != nil {
+		t.Fatalf("Failed to get command key: %v", err)
+	}
+
+	manual, err := e4crypto.UnprotectSymKey(capturedCmd, commandKey)
+	if err != nil {
+		t.Fatalf("Failed to unprotect command with the command key: %v", err)
+	}
+
+	expected, err := c.(*client).Key.UnprotectCommand(capturedCmd)
+	if err != nil {
+		t.Fatalf("Failed to unprotect command: %v", err)
+	}
+
+	if !bytes.Equal(manual, expected) {
+		t.Fatalf("Invalid unprotected command: got %v, wanted %v", manual, expected)
+	}
+
+	symClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestcommandkeysym")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, err := symClient.CommandKey(); err != ErrUnsupportedOperation {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	filePath := "./test/data/clienttestwipe"
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	protected, err := c.ProtectMessage([]byte("payload"), topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+
+	topicKey := c.(*client).TopicKeys[hex.EncodeToString(e4crypto.HashTopic(topic))]
+	readKey, _, err := c.(*client).getTopicKeys(e4crypto.HashTopic(topic))
+	if err != nil {
+		t.Fatalf("Failed to get topic keys: %v", err)
+	}
+	wantReadKey := append(keys.TopicKey{}, readKey...)
+
+	if err := c.Wipe(true); err != nil {
+		t.Fatalf("Failed to wipe client: %v", err)
+	}
+
+	if !bytes.Equal(topicKey, make([]byte, len(topicKey))) {
+		t.Fatal("Expected the topic key to be zeroed")
+	}
+	if !bytes.Equal(readKey, wantReadKey) {
+		t.Fatal("Expected the topic key read before the wipe to be left untouched")
+	}
+	if g, w := len(c.(*client).TopicKeys), 0; g != w {
+		t.Fatalf("Invalid topic keys count: got %d, wanted %d", g, w)
+	}
+	if c.HasTopicKey(topic) {
+		t.Fatal("Expected a wiped client to not have topic keys")
+	}
+
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fatalf("Expected the client file to be removed, got %v", err)
+	}
+
+	if _, err := c.ProtectMessage([]byte("payload"), topic); err != ErrClientWiped {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientWiped)
+	}
+	if _, err := c.Unprotect(protected, topic); err != ErrClientWiped {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientWiped)
+	}
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != ErrClientWiped {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientWiped)
+	}
+	if err := c.Reload(); err != ErrClientWiped {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientWiped)
+	}
+	if err := c.Wipe(true); err != ErrClientWiped {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientWiped)
+	}
+
+	// The file is kept when not asked to delete it
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	filePath = "./test/data/clienttestwipekeepfile"
+	c, err = NewClient(&PubIDAndKey{Key: privateKey, C2PubKey: generateCurve25519PubKey(t)}, filePath)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	if err := c.Wipe(false); err != nil {
+		t.Fatalf("Failed to wipe client: %v", err)
+	}
+
+	if c.(*client).Key.CanProtect() {
+		t.Fatal("Expected the private key to be wiped")
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		t.Fatalf("Expected the client file to be kept, got %v", err)
+	}
+	if _, err := c.ProtectMessage([]byte("payload"), topic); err != ErrClientWiped {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientWiped)
+	}
+	if _, err := c.CommandKey(); err != ErrClientWiped {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientWiped)
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	pubKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	clientID := e4crypto.HashIDAlias("client")
+	c, err := NewClient(&PubIDAndKey{ID: clientID, Key: privateKey, C2PubKey: generateCurve25519PubKey(t)}, "./test/data/clienttestsignmessage")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+
+	protected, err := c.ProtectMessage([]byte("payload"), topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+
+	timestamp := protected[e4crypto.SchemeTagLen:e4crypto.TaggedHeaderLen]
+	ct := protected[e4crypto.TaggedHeaderLen+e4crypto.IDLen : len(protected)-ed25519.SignatureSize]
+	embeddedSig := protected[len(protected)-ed25519.SignatureSize:]
+
+	sig, err := c.SignMessage(append(append([]byte{}, timestamp...), ct...))
+	if err != nil {
+		t.Fatalf("Failed to sign message: %v", err)
+	}
+
+	input := e4crypto.SignedData(clientID, timestamp, ct)
+	if !ed25519.Verify(pubKey, input, sig) {
+		t.Fatal("Expected the signature to verify")
+	}
+	if !bytes.Equal(input, protected[e4crypto.SchemeTagLen:len(protected)-ed25519.SignatureSize]) {
+		t.Fatalf("Invalid signed data: got %v, wanted %v", input, protected[e4crypto.SchemeTagLen:len(protected)-ed25519.SignatureSize])
+	}
+	if !bytes.Equal(sig, embeddedSig) {
+		t.Fatalf("Invalid signature: got %v, wanted %v", sig, embeddedSig)
+	}
+
+	if _, err := c.SignMessage([]byte("short")); err == nil {
+		t.Fatal("Expected an error when signing a message shorter than a timestamp")
+	}
+
+	symClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestsignmessagesym")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, err := symClient.SignMessage(protected); err != ErrUnsupportedOperation {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+	}
+}
+
+func TestSetTopicKeyWrapped(t *testing.T) {
+	clientPubKey, clientPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	c2PrivKey := e4crypto.RandomKey()
+	c2PubKey, err := curve25519.X25519(c2PrivKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("Failed to generate curve25519 keys: %v", err)
+	}
+
+	topic := "topic"
+	topicKey := e4crypto.RandomKey()
+
+	// The C2 wraps the topic key offline, only knowing the client public key
+	kek, err := e4crypto.CommandKeyPubKey(e4crypto.Ed25519PubKey(clientPubKey), c2PrivKey)
+	if err != nil {
+		t.Fatalf("Failed to derive command key: %v", err)
+	}
+	wrappedTopicKey, err := e4crypto.WrapKey(topicKey, kek)
+	if err != nil {
+		t.Fatalf("Failed to wrap topic key: %v", err)
+	}
+
+	command, err := CmdSetTopicKeyWrapped(wrappedTopicKey, topic)
+	if err != nil {
+		t.Fatalf("Failed to create command: %v", err)
+	}
+	protectedCommand, err := e4crypto.ProtectCommandPubKey(command, e4crypto.Ed25519PubKey(clientPubKey), c2PrivKey)
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+
+	c, err := NewClient(&PubIDAndKey{Key: clientPrivKey, C2PubKey: c2PubKey}, "./test/data/clienttestsettopickeywrapped")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if _, err := c.Unprotect(protectedCommand, c.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to process command: %v", err)
+	}
+
+	// A message protected with the topic key can now be unprotected
+	senderPubKey, senderPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	senderID := e4crypto.HashIDAlias("sender")
+	sender, err := NewClient(&PubIDAndKey{ID: senderID, Key: senderPrivKey, C2PubKey: c2PubKey}, "./test/data/clienttestsettopickeywrappedsender")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := sender.SetTopicKeyByName(topicKey, topic); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	if err := c.setPubKey(senderPubKey, senderID); err != nil {
+		t.Fatalf("Failed to set pubkey: %v", err)
+	}
+
+	protected, err := sender.ProtectMessage([]byte("payload"), topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+	unprotected, err := c.Unprotect(protected, topic)
+	if err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+	if !bytes.Equal(unprotected, []byte("payload")) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, []byte("payload"))
+	}
+
+	// Symmetric key clients unwrap with their key
+	symKey := e4crypto.RandomKey()
+	symClient, err := NewClient(&SymIDAndKey{Key: symKey}, "./test/data/clienttestsettopickeywrappedsym")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	symWrappedTopicKey, err := e4crypto.WrapKey(topicKey, symKey)
+	if err != nil {
+		t.Fatalf("Failed to wrap topic key: %v", err)
+	}
+	command, err = CmdSetTopicKeyWrapped(symWrappedTopicKey, topic)
+	if err != nil {
+		t.Fatalf("Failed to create command: %v", err)
+	}
+	protectedCommand, err = e4crypto.ProtectSymKey(command, symKey)
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+	if _, err := symClient.Unprotect(protectedCommand, symClient.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to process command: %v", err)
+	}
+
+	if !symClient.HasTopicKey(topic) {
+		t.Fatal("Expected the wrapped topic key to be set")
+	}
+
+	// A key wrapped for another client is rejected
+	command, err = CmdSetTopicKeyWrapped(wrappedTopicKey, "other")
+	if err != nil {
+		t.Fatalf("Failed to create command: %v", err)
+	}
+	protectedCommand, err = e4crypto.ProtectSymKey(command, symKey)
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+	if _, err := symClient.Unprotect(protectedCommand, symClient.GetReceivingTopic()); err == nil {
+		t.Fatal("Expected an error when processing a key wrapped for another client")
+	}
+	if symClient.HasTopicKey("other") {
+		t.Fatal("Expected the topic key to not be set")
+	}
+}
+
+func TestGenerateTopicKey(t *testing.T) {
+	filePath := "./test/data/clienttestgeneratetopickey"
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	topicKey, err := c.GenerateTopicKey(topic)
+	if err != nil {
+		t.Fatalf("Failed to generate topic key: %v", err)
+	}
+	if err := e4crypto.ValidateSymKey(topicKey); err != nil {
+		t.Fatalf("Invalid topic key: %v", err)
+	}
+
+	payload := []byte("payload")
+	protected, err := c.ProtectMessage(payload, topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+	unprotected, err := c.Unprotect(protected, topic)
+	if err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+
+	// The returned key is the one protecting the topic messages
+	if _, err := e4crypto.UnprotectSymKey(protected, topicKey); err != nil {
+		t.Fatalf("Failed to unprotect message with the returned key: %v", err)
+	}
+
+	// The key is persisted
+	loaded, err := LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	if _, err := loaded.Unprotect(protected, topic); err != nil {
+		t.Fatalf("Failed to unprotect message with the loaded client: %v", err)
+	}
+
+	if _, err := c.GenerateTopicKey(""); err == nil {
+		t.Fatal("Expected an error when generating a key for an invalid topic")
+	}
+}
+
+func TestUnprotectMessageWithSigner(t *testing.T) {
+	senderPubKey, senderPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	_, receiverPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	senderID := e4crypto.HashIDAlias("sender")
+	sender, err := NewClient(&PubIDAndKey{ID: senderID, Key: senderPrivKey, C2PubKey: generateCurve25519PubKey(t)}, "./test/data/clienttestwithsignersender")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	receiver, err := NewClient(&PubIDAndKey{Key: receiverPrivKey, C2PubKey: generateCurve25519PubKey(t)}, "./test/data/clienttestwithsignerreceiver")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := receiver.setPubKey(senderPubKey, senderID); err != nil {
+		t.Fatalf("Failed to set pubkey: %v", err)
+	}
+
+	topic := "topic"
+	topicKey := e4crypto.RandomKey()
+	for _, c := range []Client{sender, receiver} {
+		if err := c.SetTopicKeyByName(topicKey, topic); err != nil {
+			t.Fatalf("Failed to set topic key: %v", err)
+		}
+	}
+
+	payload := []byte("payload")
+	protected, err := sender.ProtectMessage(payload, topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+
+	unprotected, signerID, err := receiver.UnprotectMessageWithSigner(protected, topic)
+	if err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+	if !bytes.Equal(signerID, senderID) {
+		t.Fatalf("Invalid signer ID: got %v, wanted %v", signerID, senderID)
+	}
+
+	// Messages failing verification don't report a signer
+	tampered := make([]byte, len(protected))
+	copy(tampered, protected)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, signerID, err := receiver.UnprotectMessageWithSigner(tampered, topic); err == nil || signerID != nil {
+		t.Fatalf("Expected an error and no signer ID, got %v and %v", err, signerID)
+	}
+
+	symClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestwithsignersym")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := symClient.SetTopicKeyByName(topicKey, topic); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	symProtected, err := symClient.ProtectMessage(payload, topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+	_, signerID, err = symClient.UnprotectMessageWithSigner(symProtected, topic)
+	if err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+	if len(signerID) != 0 {
+		t.Fatalf("Invalid signer ID: got %v, wanted empty", signerID)
+	}
+}
+
+func TestDuplicateCommand(t *testing.T) {
+	clientKey := e4crypto.RandomKey()
+	clock := &fakeClock{now: time.Now()}
+	filePath := "./test/data/clienttestduplicatecommand"
+	c, err := NewClient(&SymIDAndKey{Key: clientKey}, filePath, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	cmd, err := CmdSetTopicKey(e4crypto.RandomKey(), "topic")
+	if err != nil {
+		t.Fatalf("CmdSetTopicKey failed: %v", err)
+	}
+	protectedCmd, err := e4crypto.ProtectSymKey(cmd, clientKey)
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+
+	if _, err := c.Unprotect(protectedCmd, c.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to process command: %v", err)
+	}
+	if _, err := c.Unprotect(protectedCmd, c.GetReceivingTopic()); err != ErrDuplicateCommand {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrDuplicateCommand)
+	}
+
+	// The applied commands survive a restart
+	loaded, err := LoadClient(filePath, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	if _, err := loaded.Unprotect(protectedCmd, loaded.GetReceivingTopic()); err != ErrDuplicateCommand {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrDuplicateCommand)
+	}
+
+	// The same command protected at another time isn't a duplicate
+	clock.Advance(time.Second)
+	otherProtectedCmd, err := e4crypto.ProtectSymKeyAt(cmd, clientKey, clock.Now())
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+	if _, err := c.Unprotect(otherProtectedCmd, c.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to process command: %v", err)
+	}
+
+	// Concurrent deliveries of the same command are applied only once
+	clock.Advance(time.Second)
+	concurrentProtectedCmd, err := e4crypto.ProtectSymKeyAt(cmd, clientKey, clock.Now())
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := c.Unprotect(concurrentProtectedCmd, c.GetReceivingTopic())
+			errs <- err
+		}()
+	}
+
+	var applied int
+	for i := 0; i < cap(errs); i++ {
+		switch err := <-errs; err {
+		case nil:
+			applied++
+		case ErrDuplicateCommand:
+		default:
+			t.Fatalf("Failed to process command: %v", err)
+		}
+	}
+	if applied != 1 {
+		t.Fatalf("Invalid applied commands count: got %d, wanted 1", applied)
+	}
+}
+
+func TestProtectDirect(t *testing.T) {
+	c2PubKey := generateCurve25519PubKey(t)
+
+	newPubClient := func(name string) (Client, e4crypto.Curve25519PublicKey) {
+		pubKey, privKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+
+		c, err := NewClient(&PubIDAndKey{Key: privKey, C2PubKey: c2PubKey}, "./test/data/clienttestprotectdirect"+name)
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		return c, e4crypto.PublicEd25519KeyToCurve25519(pubKey)
+	}
+
+	alice, aliceCurvePubKey := newPubClient("alice")
+	bob, bobCurvePubKey := newPubClient("bob")
+	eve, _ := newPubClient("eve")
+
+	payload := []byte("direct payload")
+	protected, err := alice.ProtectDirect(payload, bobCurvePubKey)
+	if err != nil {
+		t.Fatalf("Failed to protect direct message: %v", err)
+	}
+
+	unprotected, err := bob.UnprotectDirect(protected, aliceCurvePubKey)
+	if err != nil {
+		t.Fatalf("Failed to unprotect direct message: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+
+	if _, err := eve.UnprotectDirect(protected, aliceCurvePubKey); err == nil {
+		t.Fatal("Expected a direct message to not be unprotected by another client")
+	}
+
+	// A direct message doesn't depend on any topic key, and isn't a topic message
+	if _, err := bob.Unprotect(protected, "topic"); err != ErrTopicKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTopicKeyNotFound)
+	}
+
+	symClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestprotectdirectsym")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, err := symClient.ProtectDirect(payload, bobCurvePubKey); err != ErrUnsupportedOperation {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+	}
+	if _, err := symClient.UnprotectDirect(protected, aliceCurvePubKey); err != ErrUnsupportedOperation {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+	}
+}
+
+func TestProtectMessageInvalidTopicKey(t *testing.T) {
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestinvalidtopickey")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	// Such a key can only come from a tampered client file, as setting it is rejected
+	topic := "topic"
+	c.(*client).TopicKeys[hex.EncodeToString(e4crypto.HashTopic(topic))] = make([]byte, 10)
+
+	assertInvalidTopicKey := func(t *testing.T, err error) {
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok || wrapper.Unwrap() != ErrInvalidTopicKey {
+			t.Fatalf("Invalid error: got %v, wanted an error wrapping %v", err, ErrInvalidTopicKey)
+		}
+	}
+
+	_, err = c.ProtectMessage([]byte("payload"), topic)
+	assertInvalidTopicKey(t, err)
+
+	_, err = c.ProtectMessageMulti([]byte("payload"), []string{topic})
+	assertInvalidTopicKey(t, err)
+}
+
+func TestClose(t *testing.T) {
+	defer func(interval time.Duration) {
+		watchPollInterval = interval
+	}(watchPollInterval)
+	watchPollInterval = 10 * time.Millisecond
+
+	filePath := "./test/data/clienttestclose"
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath, WithDeferredPersistence())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/initial"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Failed to flush client: %v", err)
+	}
+
+	errC, err := c.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	// The pending changes are flushed on close
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/pending"); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Failed to close client: %v", err)
+	}
+
+	loaded, err := LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	if !loaded.HasTopicKey("topic/pending") {
+		t.Fatal("Expected the pending changes to have been flushed on close")
+	}
+
+	select {
+	case _, ok := <-errC:
+		if ok {
+			t.Fatal("Expected the watch channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the watch to stop")
+	}
+
+	if _, err := c.ProtectMessage([]byte("payload"), "topic/initial"); err != ErrClientClosed {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientClosed)
+	}
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic/closed"); err != ErrClientClosed {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientClosed)
+	}
+	if err := c.Flush(); err != ErrClientClosed {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientClosed)
+	}
+	if _, err := c.Watch(context.Background()); err != ErrClientClosed {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientClosed)
+	}
+	if err := c.Close(); err != ErrClientClosed {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrClientClosed)
+	}
 }
@@ -27,25 +27,29 @@ import (
 const (
 	// RemoveTopic command allows to remove a topic key from the client.
 	// It expects a topic hash as argument
-	RemoveTopic byte = iota
+	RemoveTopic = byte(e4crypto.CommandRemoveTopic)
 	// ResetTopics allows to clear out all the topics on a client.
 	// It doesn't have any argument
-	ResetTopics
+	ResetTopics = byte(e4crypto.CommandResetTopics)
 	// SetIDKey allows to set the private key of a client.
 	// It expects a key as argument
-	SetIDKey
+	SetIDKey = byte(e4crypto.CommandSetIDKey)
 	// SetTopicKey allows to add a topic key on the client.
 	// It takes a key, followed by a topic hash as arguments.
-	SetTopicKey
+	SetTopicKey = byte(e4crypto.CommandSetTopicKey)
 	// RemovePubKey allows to remove a public key from the client.
 	// It takes the ID to be removed as argument
-	RemovePubKey
+	RemovePubKey = byte(e4crypto.CommandRemovePubKey)
 	// ResetPubKeys removes all public keys stored on the client.
 	// It expects no argument
-	ResetPubKeys
+	ResetPubKeys = byte(e4crypto.CommandResetPubKeys)
 	// SetPubKey allows to set a public key on the client.
 	// It takes a public key, followed by an ID as arguments.
-	SetPubKey
+	SetPubKey = byte(e4crypto.CommandSetPubKey)
+	// SetTopicKeyWrapped allows to add a topic key on the client, wrapped with the client command key
+	// (see crypto.WrapKey), allowing the C2 to prepare the key offline.
+	// It takes a wrapped key, followed by a topic hash as arguments.
+	SetTopicKeyWrapped = byte(e4crypto.CommandSetTopicKeyWrapped)
 
 	// UnknownCommand must stay the last element. It's used to
 	// know if a Command is out of range
@@ -54,60 +58,92 @@ const (
 
 var (
 	// ErrInvalidCommand is returned when trying to process an unsupported command
-	ErrInvalidCommand = errors.New("invalid command")
+	ErrInvalidCommand = e4crypto.ErrInvalidCommand
 )
 
-// processCommand will attempt to parse given command
-// and extract arguments to call expected Client method
-func processCommand(client Client, payload []byte) error {
-	cmd, blob := payload[0], payload[1:]
+// CommandType defines the type of a command, identified by its first byte
+type CommandType = e4crypto.CommandType
 
-	switch cmd {
-	case RemoveTopic:
-		if len(blob) != e4crypto.HashLen {
-			return errors.New("invalid RemoveTopic length")
-		}
-		return client.removeTopic(blob)
+// CommandSpec describes a command supported by the client
+type CommandSpec = e4crypto.CommandSpec
 
-	case ResetTopics:
-		if len(blob) != 0 {
-			return errors.New("invalid ResetTopics length")
-		}
-		return client.resetTopics()
+// commandHandler holds a command specification, and the function applying the command on a client
+type commandHandler struct {
+	spec    CommandSpec
+	process func(client Client, blob []byte) error
+}
 
-	case SetIDKey:
-		if len(blob) != e4crypto.KeyLen {
-			return errors.New("invalid SetIDKey length")
-		}
+// commandProcessors holds the functions applying each of the commands supported by the client,
+// indexed by their type. Command specifications come from e4crypto.SupportedCommands,
+// and every one of them must have its processor here.
+var commandProcessors = map[CommandType]func(client Client, blob []byte) error{
+	CommandType(RemoveTopic): func(client Client, blob []byte) error {
+		return client.removeTopic(blob)
+	},
+	CommandType(ResetTopics): func(client Client, blob []byte) error {
+		return client.resetTopics()
+	},
+	CommandType(SetIDKey): func(client Client, blob []byte) error {
 		return client.setIDKey(blob)
-
-	case SetTopicKey:
-		if len(blob) != e4crypto.KeyLen+e4crypto.HashLen {
-			return errors.New("invalid SetTopicKey length")
-		}
+	},
+	CommandType(SetTopicKey): func(client Client, blob []byte) error {
 		return client.setTopicKey(blob[:e4crypto.KeyLen], blob[e4crypto.KeyLen:])
-
-	case RemovePubKey:
-		if len(blob) != e4crypto.IDLen {
-			return errors.New("invalid RemovePubKey length")
-		}
+	},
+	CommandType(RemovePubKey): func(client Client, blob []byte) error {
 		return client.removePubKey(blob)
-
-	case ResetPubKeys:
-		if len(blob) != 0 {
-			return errors.New("invalid ResetPubKeys length")
-		}
+	},
+	CommandType(ResetPubKeys): func(client Client, blob []byte) error {
 		return client.resetPubKeys()
-
-	case SetPubKey:
-		if len(blob) != ed25519.PublicKeySize+e4crypto.IDLen {
-			return errors.New("invalid SetPubKey length")
-		}
+	},
+	CommandType(SetPubKey): func(client Client, blob []byte) error {
 		return client.setPubKey(blob[:ed25519.PublicKeySize], blob[ed25519.PublicKeySize:])
+	},
+	CommandType(SetTopicKeyWrapped): func(client Client, blob []byte) error {
+		return client.setWrappedTopicKey(blob[:e4crypto.WrappedKeyLen], blob[e4crypto.WrappedKeyLen:])
+	},
+}
+
+// SupportedCommands returns the specifications of all the commands supported by the client, ordered by type
+func SupportedCommands() []CommandSpec {
+	return e4crypto.SupportedCommands()
+}
+
+// parseCommand will attempt to parse given command, returning its handler
+// and its arguments. It returns ErrInvalidCommand when the command is unknown,
+// or e4crypto.ErrInvalidCommandArgs when its arguments don't have the expected length
+func parseCommand(payload []byte) (commandHandler, []byte, error) {
+	if len(payload) == 0 {
+		return commandHandler{}, nil, ErrInvalidCommand
+	}
+
+	cmd, blob := CommandType(payload[0]), payload[1:]
 
-	default:
-		return ErrInvalidCommand
+	spec, ok := e4crypto.LookupCommand(cmd)
+	if !ok {
+		return commandHandler{}, nil, ErrInvalidCommand
 	}
+
+	process, ok := commandProcessors[cmd]
+	if !ok {
+		return commandHandler{}, nil, ErrInvalidCommand
+	}
+
+	if len(blob) != spec.ArgsLen {
+		return commandHandler{}, nil, e4crypto.ErrInvalidCommandArgs
+	}
+
+	return commandHandler{spec: spec, process: process}, blob, nil
+}
+
+// processCommand will attempt to parse given command
+// and extract arguments to call expected Client method
+func processCommand(client Client, payload []byte) error {
+	handler, blob, err := parseCommand(payload)
+	if err != nil {
+		return err
+	}
+
+	return handler.process(client, blob)
 }
 
 // CmdRemoveTopic creates a command to remove the key
@@ -187,3 +223,21 @@ func CmdSetPubKey(pubKey e4crypto.Ed25519PublicKey, name string) ([]byte, error)
 
 	return cmd, nil
 }
+
+// CmdSetTopicKeyWrapped creates a command to set the given wrapped topic key and its corresponding topic,
+// on the client. The topic key must have been wrapped with crypto.WrapKey, using the client command key:
+// its symmetric key, or the key returned by crypto.CommandKeyPubKey for public key clients.
+func CmdSetTopicKeyWrapped(wrappedTopicKey []byte, topic string) ([]byte, error) {
+	if g, w := len(wrappedTopicKey), e4crypto.WrappedKeyLen; g != w {
+		return nil, fmt.Errorf("invalid wrapped key length, got %d, wanted %d", g, w)
+	}
+
+	if len(topic) == 0 {
+		return nil, errors.New("topic must not be empty")
+	}
+
+	cmd := append([]byte{SetTopicKeyWrapped}, wrappedTopicKey...)
+	cmd = append(cmd, e4crypto.HashTopic(topic)...)
+
+	return cmd, nil
+}
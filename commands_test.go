@@ -157,6 +157,49 @@ func TestCmdSetTopicKey(t *testing.T) {
 	})
 }
 
+func TestCmdSetTopicKeyWrapped(t *testing.T) {
+	validWrappedKey, err := e4crypto.WrapKey(e4crypto.RandomKey(), e4crypto.RandomKey())
+	if err != nil {
+		t.Fatalf("failed to wrap key: %v", err)
+	}
+
+	t.Run("invalid keys produce errors", func(t *testing.T) {
+		for _, k := range [][]byte{nil, validWrappedKey[1:], append(validWrappedKey, 0x00)} {
+			_, err := CmdSetTopicKeyWrapped(k, "some-topic")
+			if err == nil {
+				t.Fatalf("got no error with key %v", k)
+			}
+		}
+	})
+
+	t.Run("invalid names produce errors", func(t *testing.T) {
+		for _, name := range invalidNames {
+			_, err := CmdSetTopicKeyWrapped(validWrappedKey, name)
+			if err == nil {
+				t.Fatalf("got no error with name: %s", name)
+			}
+		}
+	})
+
+	t.Run("expected command is created", func(t *testing.T) {
+		expectedTopic := "some-topic"
+		cmd, err := CmdSetTopicKeyWrapped(validWrappedKey, expectedTopic)
+		if err != nil {
+			t.Fatalf("failed to create command: %v", err)
+		}
+
+		if got, want := len(cmd), 1+e4crypto.WrappedKeyLen+e4crypto.HashLen; got != want {
+			t.Fatalf("invalid command length, got %d, wanted %d", got, want)
+		}
+
+		expectedCmd := append([]byte{SetTopicKeyWrapped}, validWrappedKey...)
+		expectedCmd = append(expectedCmd, e4crypto.HashTopic(expectedTopic)...)
+		if !bytes.Equal(cmd, expectedCmd) {
+			t.Fatalf("invalid command, got %v, wanted %v", cmd, expectedCmd)
+		}
+	})
+}
+
 func TestCmdRemovePubKey(t *testing.T) {
 	t.Run("invalid names produce errors", func(t *testing.T) {
 		for _, name := range invalidNames {
@@ -251,6 +294,73 @@ func TestCmdSetPubKey(t *testing.T) {
 	})
 }
 
+func TestSupportedCommands(t *testing.T) {
+	specs := SupportedCommands()
+	if len(specs) == 0 {
+		t.Fatal("Expected supported commands to not be empty")
+	}
+	if g, w := len(commandProcessors), len(specs); g != w {
+		t.Fatalf("Invalid command processors count: got %d, wanted %d", g, w)
+	}
+
+	for i, spec := range specs {
+		if i > 0 && specs[i-1].Type >= spec.Type {
+			t.Fatalf("Expected supported commands to be ordered by type, got %d after %d", spec.Type, specs[i-1].Type)
+		}
+
+		args := make([]byte, spec.ArgsLen)
+		rand.Read(args)
+
+		payload := append([]byte{byte(spec.Type)}, args...)
+		handler, blob, err := parseCommand(payload)
+		if err != nil {
+			t.Fatalf("Failed to parse command %s: %v", spec.Name, err)
+		}
+		if handler.spec != spec {
+			t.Fatalf("Invalid parsed command: got %#v, wanted %#v", handler.spec, spec)
+		}
+		if !bytes.Equal(blob, args) {
+			t.Fatalf("Invalid parsed arguments: got %v, wanted %v", blob, args)
+		}
+
+		if _, _, err := parseCommand(append(payload, 0x00)); err != e4crypto.ErrInvalidCommandArgs {
+			t.Fatalf("Invalid error for command %s with too long arguments: got %v, wanted %v", spec.Name, err, e4crypto.ErrInvalidCommandArgs)
+		}
+
+		// The C2 side validation must agree with the client specs
+		if err := e4crypto.ValidateCommand(payload); err != nil {
+			t.Fatalf("Failed to validate command %s: %v", spec.Name, err)
+		}
+	}
+
+	if _, _, err := parseCommand([]byte{UnknownCommand}); err != ErrInvalidCommand {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrInvalidCommand)
+	}
+
+	if _, _, err := parseCommand(nil); err != ErrInvalidCommand {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrInvalidCommand)
+	}
+}
+
+func TestCommandTypeString(t *testing.T) {
+	expectedNames := map[byte]string{
+		RemoveTopic:    "RemoveTopic",
+		ResetTopics:    "ResetTopics",
+		SetIDKey:       "SetIDKey",
+		SetTopicKey:    "SetTopicKey",
+		RemovePubKey:   "RemovePubKey",
+		ResetPubKeys:   "ResetPubKeys",
+		SetPubKey:      "SetPubKey",
+		UnknownCommand: "unknown(255)",
+	}
+
+	for cmd, expectedName := range expectedNames {
+		if g, w := CommandType(cmd).String(), expectedName; g != w {
+			t.Fatalf("Invalid command name: got %s, wanted %s", g, w)
+		}
+	}
+}
+
 func TestToByte(t *testing.T) {
 	t.Run("ToByte() returns 255 for out of range commands", func(t *testing.T) {
 		if UnknownCommand != 255 {
@@ -0,0 +1,88 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// CommandFrameHeaderLen is the length of the little endian encoded
+	// protected command length prefixing each frame of a command stream
+	CommandFrameHeaderLen = 4
+	// MaxCommandFrameLen is the maximum length of a protected command in a command stream
+	MaxCommandFrameLen = 4096
+)
+
+var (
+	// ErrCommandFrameTooLong occurs when a command stream frame is longer than MaxCommandFrameLen
+	ErrCommandFrameTooLong = errors.New("command frame too long")
+)
+
+// WriteCommandFrame writes the given protected command to w, prefixed by its length,
+// allowing to build a command stream to be processed by Client.ProcessCommandStream
+func WriteCommandFrame(w io.Writer, protectedCommand []byte) error {
+	if len(protectedCommand) > MaxCommandFrameLen {
+		return ErrCommandFrameTooLong
+	}
+
+	header := make([]byte, CommandFrameHeaderLen)
+	binary.LittleEndian.PutUint32(header, uint32(len(protectedCommand)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(protectedCommand)
+
+	return err
+}
+
+// ProcessCommandStream reads protected commands from r, each prefixed by its length
+// (see WriteCommandFrame), and unprotects and applies them in order until r is exhausted.
+// It stops at the first failure, and returns how many commands were successfully applied.
+func (c *client) ProcessCommandStream(r io.Reader) (int, error) {
+	header := make([]byte, CommandFrameHeaderLen)
+
+	var applied int
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return applied, nil
+			}
+
+			return applied, fmt.Errorf("failed to read command frame %d header: %v", applied, err)
+		}
+
+		frameLen := binary.LittleEndian.Uint32(header)
+		if frameLen > MaxCommandFrameLen {
+			return applied, ErrCommandFrameTooLong
+		}
+
+		protected := make([]byte, frameLen)
+		if _, err := io.ReadFull(r, protected); err != nil {
+			return applied, fmt.Errorf("failed to read command frame %d: %v", applied, err)
+		}
+
+		if _, err := c.Unprotect(protected, c.GetReceivingTopic()); err != nil {
+			return applied, fmt.Errorf("failed to process command frame %d: %v", applied, err)
+		}
+
+		applied++
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+func TestProcessCommandStream(t *testing.T) {
+	clientKey := e4crypto.RandomKey()
+	c, err := NewClient(&SymIDAndKey{Key: clientKey}, "./test/data/clienttestcommandstream")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topics := []string{"topic1", "topic2", "topic3"}
+
+	// newStream returns a stream of new commands, as applied commands can't be replayed
+	newStream := func(t *testing.T) *bytes.Buffer {
+		stream := bytes.NewBuffer(nil)
+		for _, topic := range topics {
+			cmd, err := CmdSetTopicKey(e4crypto.RandomKey(), topic)
+			if err != nil {
+				t.Fatalf("CmdSetTopicKey failed: %v", err)
+			}
+
+			protected, err := e4crypto.ProtectSymKey(cmd, clientKey)
+			if err != nil {
+				t.Fatalf("Failed to protect command: %v", err)
+			}
+
+			if err := WriteCommandFrame(stream, protected); err != nil {
+				t.Fatalf("Failed to write command frame: %v", err)
+			}
+		}
+
+		return stream
+	}
+
+	t.Run("well formed stream applies all commands", func(t *testing.T) {
+		stream := newStream(t)
+		applied, err := c.ProcessCommandStream(bytes.NewReader(stream.Bytes()))
+		if err != nil {
+			t.Fatalf("Failed to process command stream: %v", err)
+		}
+		if applied != len(topics) {
+			t.Fatalf("Invalid applied commands count: got %d, wanted %d", applied, len(topics))
+		}
+
+		for _, topic := range topics {
+			if _, ok := c.(*client).TopicKeys[hex.EncodeToString(e4crypto.HashTopic(topic))]; !ok {
+				t.Fatalf("Expected topic key for %s to have been set", topic)
+			}
+		}
+	})
+
+	t.Run("truncated stream reports applied commands", func(t *testing.T) {
+		if err := c.resetTopics(); err != nil {
+			t.Fatalf("Failed to reset topics: %v", err)
+		}
+
+		stream := newStream(t)
+		truncated := stream.Bytes()[:stream.Len()-1]
+		applied, err := c.ProcessCommandStream(bytes.NewReader(truncated))
+		if err == nil {
+			t.Fatal("Expected an error when processing a truncated stream")
+		}
+		if applied != len(topics)-1 {
+			t.Fatalf("Invalid applied commands count: got %d, wanted %d", applied, len(topics)-1)
+		}
+	})
+
+	t.Run("too long frames are rejected", func(t *testing.T) {
+		if err := WriteCommandFrame(bytes.NewBuffer(nil), make([]byte, MaxCommandFrameLen+1)); err != ErrCommandFrameTooLong {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrCommandFrameTooLong)
+		}
+
+		header := []byte{0xff, 0xff, 0xff, 0xff}
+		if _, err := c.ProcessCommandStream(bytes.NewReader(header)); err != ErrCommandFrameTooLong {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrCommandFrameTooLong)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"fmt"
+	"sync"
+
+	miscreant "github.com/miscreant/miscreant.go"
+)
+
+// AEAD defines the interface of the authenticated encryption scheme used by Encrypt and Decrypt.
+// It allows to replace the default software AES-CMAC-SIV implementation, for example by a hardware backed one.
+type AEAD interface {
+	// Seal encrypts and authenticates plaintext, authenticates the given associated data
+	// and appends the result to dst, returning the updated slice.
+	Seal(dst, plaintext []byte, data ...[]byte) ([]byte, error)
+	// Open decrypts and authenticates ciphertext, authenticates the given associated data
+	// and, if successful, appends the resulting plaintext to dst, returning the updated slice.
+	// It must return ErrNotAuthentic when the ciphertext or the associated data fail authentication,
+	// as e4 relies on it to fall back on the previous topic key during a key transition.
+	Open(dst, ciphertext []byte, data ...[]byte) ([]byte, error)
+	// Overhead returns the difference between the lengths of a plaintext and its ciphertext.
+	Overhead() int
+}
+
+// AEADFactory defines a function creating an AEAD from a KeyLen bytes symmetric key
+type AEADFactory func(key []byte) (AEAD, error)
+
+var (
+	aeadFactory      AEADFactory = NewDefaultAEAD
+	aeadFactoryMutex sync.RWMutex
+)
+
+// init ensures the default AEAD overhead is the TagLen the protected messages framing relies on,
+// failing loudly if a library upgrade ever changes it, instead of silently mis-parsing stored ciphertexts.
+func init() {
+	if err := checkAEADOverhead(NewDefaultAEAD); err != nil {
+		panic(err)
+	}
+}
+
+// checkAEADOverhead returns an error when the AEAD created by the given factory has an overhead other than TagLen
+func checkAEADOverhead(factory AEADFactory) error {
+	c, err := factory(make([]byte, KeyLen))
+	if err != nil {
+		return fmt.Errorf("failed to create AEAD: %v", err)
+	}
+
+	if c.Overhead() != TagLen {
+		return fmt.Errorf("AEAD overhead is %d bytes, but the protected messages framing expects %d", c.Overhead(), TagLen)
+	}
+
+	return nil
+}
+
+// NewDefaultAEAD creates the default AEAD, a software AES-CMAC-SIV implementation
+func NewDefaultAEAD(key []byte) (AEAD, error) {
+	return miscreant.NewAESCMACSIV(doubleKey(key))
+}
+
+// SetAEADFactory replaces the factory used by Encrypt and Decrypt to create their AEAD.
+// Passing a nil factory restores the default one.
+func SetAEADFactory(factory AEADFactory) {
+	aeadFactoryMutex.Lock()
+	defer aeadFactoryMutex.Unlock()
+
+	if factory == nil {
+		factory = NewDefaultAEAD
+	}
+
+	aeadFactory = factory
+}
+
+// newAEAD creates a new AEAD from the given key, using the current factory
+func newAEAD(key []byte) (AEAD, error) {
+	aeadFactoryMutex.RLock()
+	factory := aeadFactory
+	aeadFactoryMutex.RUnlock()
+
+	return factory(key)
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// mockAEAD implements AEAD, recording its calls and wrapping the default AEAD
+type mockAEAD struct {
+	AEAD
+
+	sealCalls int
+	openCalls int
+}
+
+func (m *mockAEAD) Seal(dst, plaintext []byte, data ...[]byte) ([]byte, error) {
+	m.sealCalls++
+	return m.AEAD.Seal(dst, plaintext, data...)
+}
+
+func (m *mockAEAD) Open(dst, ciphertext []byte, data ...[]byte) ([]byte, error) {
+	m.openCalls++
+	return m.AEAD.Open(dst, ciphertext, data...)
+}
+
+// overheadAEAD implements AEAD, reporting a custom overhead
+type overheadAEAD struct {
+	AEAD
+	overhead int
+}
+
+func (o *overheadAEAD) Overhead() int {
+	return o.overhead
+}
+
+func TestOverheadInvariant(t *testing.T) {
+	if err := checkAEADOverhead(NewDefaultAEAD); err != nil {
+		t.Fatalf("Default AEAD overhead invariant does not hold: %v", err)
+	}
+
+	c, err := NewDefaultAEAD(RandomKey())
+	if err != nil {
+		t.Fatalf("Failed to create default AEAD: %v", err)
+	}
+	if g, w := c.Overhead(), TagLen; g != w {
+		t.Fatalf("Invalid overhead: got %d, wanted %d", g, w)
+	}
+
+	err = checkAEADOverhead(func(key []byte) (AEAD, error) {
+		aead, err := NewDefaultAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return &overheadAEAD{AEAD: aead, overhead: TagLen + 1}, nil
+	})
+	if err == nil {
+		t.Fatal("Expected an error when the AEAD overhead differs from TagLen")
+	}
+
+	if _, err := Decrypt(RandomKey(), nil, make([]byte, TagLen-1)); err != ErrTooShortCipher {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTooShortCipher)
+	}
+}
+
+func TestSetAEADFactory(t *testing.T) {
+	defer SetAEADFactory(nil)
+
+	mock := &mockAEAD{}
+	SetAEADFactory(func(key []byte) (AEAD, error) {
+		aead, err := NewDefaultAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		mock.AEAD = aead
+
+		return mock, nil
+	})
+
+	key := RandomKey()
+	pt := []byte("plaintext")
+
+	ct, err := Encrypt(key, nil, pt)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if mock.sealCalls != 1 {
+		t.Fatalf("Invalid Seal calls count: got %d, wanted 1", mock.sealCalls)
+	}
+
+	decrypted, err := Decrypt(key, nil, ct)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if mock.openCalls != 1 {
+		t.Fatalf("Invalid Open calls count: got %d, wanted 1", mock.openCalls)
+	}
+
+	if !bytes.Equal(decrypted, pt) {
+		t.Fatalf("Invalid decrypted plaintext: got %v, wanted %v", decrypted, pt)
+	}
+
+	// Restoring the default factory must not call the mock anymore
+	SetAEADFactory(nil)
+	if _, err := Encrypt(key, nil, pt); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if mock.sealCalls != 1 {
+		t.Fatalf("Invalid Seal calls count: got %d, wanted 1", mock.sealCalls)
+	}
+}
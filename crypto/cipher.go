@@ -0,0 +1,81 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"sync"
+	"time"
+)
+
+// Cipher holds an AEAD created once from a symmetric key, allowing to encrypt
+// many messages under the same key without creating a new AEAD for each of them.
+// It is safe for concurrent use.
+type Cipher struct {
+	aead  AEAD
+	mutex sync.Mutex
+}
+
+// NewCipher validates the given symmetric key and creates a new Cipher from it,
+// using the current AEAD factory (see SetAEADFactory)
+func NewCipher(key []byte) (*Cipher, error) {
+	if err := ValidateSymKey(key); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt creates an authenticated ciphertext, like the Encrypt function
+func (c *Cipher) Encrypt(ad, pt []byte) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.aead.Seal(nil, pt, ad)
+}
+
+// Decrypt decrypts and verifies an authenticated ciphertext, like the Decrypt function
+func (c *Cipher) Decrypt(ad, ct []byte) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(ct) < c.aead.Overhead() {
+		return nil, ErrTooShortCipher
+	}
+
+	return c.aead.Open(nil, ct, ad)
+}
+
+// ProtectAt encrypts the payload like ProtectSymKeyAt, stamping the protected message with the given time
+func (c *Cipher) ProtectAt(payload []byte, now time.Time) ([]byte, error) {
+	timestamp := EncodeTimestamp(now)
+
+	ct, err := c.Encrypt(timestamp, payload)
+	if err != nil {
+		return nil, err
+	}
+	protected := append(timestamp, ct...)
+
+	protectedLen := TimestampLen + len(payload) + TagLen
+	if protectedLen != len(protected) {
+		return nil, ErrInvalidProtectedLen
+	}
+
+	return protected, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCipher(t *testing.T) {
+	key := RandomKey()
+
+	c, err := NewCipher(key)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+
+	payload := []byte("payload")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			protected, err := c.ProtectAt(payload, time.Now())
+			if err != nil {
+				t.Errorf("Failed to protect payload: %v", err)
+				return
+			}
+
+			unprotected, err := UnprotectSymKey(protected, key)
+			if err != nil {
+				t.Errorf("Failed to unprotect payload: %v", err)
+				return
+			}
+			if !bytes.Equal(unprotected, payload) {
+				t.Errorf("Invalid unprotected payload: got %v, wanted %v", unprotected, payload)
+			}
+		}()
+	}
+	wg.Wait()
+
+	ct, err := Encrypt(key, []byte("ad"), payload)
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	pt, err := c.Decrypt([]byte("ad"), ct)
+	if err != nil {
+		t.Fatalf("Failed to decrypt: %v", err)
+	}
+	if !bytes.Equal(pt, payload) {
+		t.Fatalf("Invalid decrypted payload: got %v, wanted %v", pt, payload)
+	}
+
+	if _, err := c.Decrypt(nil, make([]byte, TagLen-1)); err != ErrTooShortCipher {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTooShortCipher)
+	}
+
+	if _, err := NewCipher([]byte("not a key")); err == nil {
+		t.Fatal("Expected an error when creating a cipher with an invalid key")
+	}
+}
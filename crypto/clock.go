@@ -0,0 +1,38 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import "time"
+
+// Clock defines an interface providing the current time.
+// It allows to control the time used to stamp and validate protected messages.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock implements Clock using the system time
+type systemClock struct{}
+
+var _ Clock = systemClock{}
+
+// SystemClock returns a Clock using the system time
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+// Now returns the current system time
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
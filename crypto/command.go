@@ -0,0 +1,209 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	// ErrInvalidCommand occurs when a command is empty or its type is unknown
+	ErrInvalidCommand = errors.New("invalid command")
+	// ErrInvalidCommandArgs occurs when a command arguments don't have the length expected by its type
+	ErrInvalidCommandArgs = errors.New("invalid command arguments length")
+)
+
+// commandDigestPrefix prefixes the commands hashed by CommandDigest,
+// so their digest can't be mistaken for the hash of another kind of data
+const commandDigestPrefix = "e4 command digest"
+
+// CommandType defines the type of a command, identified by its first byte
+type CommandType byte
+
+// List of the command types supported by the clients
+const (
+	// CommandRemoveTopic removes a topic key from the client
+	CommandRemoveTopic CommandType = iota
+	// CommandResetTopics removes all the topic keys from the client
+	CommandResetTopics
+	// CommandSetIDKey sets the private key of the client
+	CommandSetIDKey
+	// CommandSetTopicKey adds a topic key on the client
+	CommandSetTopicKey
+	// CommandRemovePubKey removes a public key from the client
+	CommandRemovePubKey
+	// CommandResetPubKeys removes all the public keys from the client
+	CommandResetPubKeys
+	// CommandSetPubKey adds a public key on the client
+	CommandSetPubKey
+	// CommandSetTopicKeyWrapped adds a topic key on the client, wrapped with the client command key
+	CommandSetTopicKeyWrapped
+)
+
+// String returns the name of the command type
+func (t CommandType) String() string {
+	spec, ok := LookupCommand(t)
+	if !ok {
+		return fmt.Sprintf("unknown(%d)", byte(t))
+	}
+
+	return spec.Name
+}
+
+// CommandSpec describes a command supported by the clients
+type CommandSpec struct {
+	// Type is the command type, as the first byte of the command
+	Type CommandType
+	// Name is the command name
+	Name string
+	// ArgsDescription describes the arguments expected by the command
+	ArgsDescription string
+	// ArgsLen is the expected length of the command arguments
+	ArgsLen int
+
+	// withID is true when the command arguments end with a client ID,
+	// whose length in ArgsLen must be adjusted to the one set with SetIDLen
+	withID bool
+}
+
+// current returns the spec, with its arguments length matching the current ID length
+func (s CommandSpec) current() CommandSpec {
+	if s.withID {
+		s.ArgsLen += GetIDLen() - IDLen
+	}
+
+	return s
+}
+
+// commandSpecs lists all the commands supported by the clients, indexed by their type.
+// It is used both by the clients to parse commands, and to validate and advertise them.
+var commandSpecs = map[CommandType]CommandSpec{
+	CommandRemoveTopic: {
+		Type:            CommandRemoveTopic,
+		Name:            "RemoveTopic",
+		ArgsDescription: "topic hash",
+		ArgsLen:         HashLen,
+	},
+	CommandResetTopics: {
+		Type:            CommandResetTopics,
+		Name:            "ResetTopics",
+		ArgsDescription: "none",
+		ArgsLen:         0,
+	},
+	CommandSetIDKey: {
+		Type:            CommandSetIDKey,
+		Name:            "SetIDKey",
+		ArgsDescription: "key",
+		ArgsLen:         KeyLen,
+	},
+	CommandSetTopicKey: {
+		Type:            CommandSetTopicKey,
+		Name:            "SetTopicKey",
+		ArgsDescription: "key, followed by topic hash",
+		ArgsLen:         KeyLen + HashLen,
+	},
+	CommandRemovePubKey: {
+		Type:            CommandRemovePubKey,
+		Name:            "RemovePubKey",
+		ArgsDescription: "client ID",
+		ArgsLen:         IDLen,
+		withID:          true,
+	},
+	CommandResetPubKeys: {
+		Type:            CommandResetPubKeys,
+		Name:            "ResetPubKeys",
+		ArgsDescription: "none",
+		ArgsLen:         0,
+	},
+	CommandSetPubKey: {
+		Type:            CommandSetPubKey,
+		Name:            "SetPubKey",
+		ArgsDescription: "ed25519 public key, followed by client ID",
+		ArgsLen:         ed25519.PublicKeySize + IDLen,
+		withID:          true,
+	},
+	CommandSetTopicKeyWrapped: {
+		Type:            CommandSetTopicKeyWrapped,
+		Name:            "SetTopicKeyWrapped",
+		ArgsDescription: "wrapped key, followed by topic hash",
+		ArgsLen:         WrappedKeyLen + HashLen,
+	},
+}
+
+// LookupCommand returns the specification of the given command type, with its arguments length
+// matching the current ID length. It returns false when the command type is not supported.
+func LookupCommand(t CommandType) (CommandSpec, bool) {
+	spec, ok := commandSpecs[t]
+	if !ok {
+		return CommandSpec{}, false
+	}
+
+	return spec.current(), true
+}
+
+// SupportedCommands returns the specifications of all the commands supported by the clients, ordered by type
+func SupportedCommands() []CommandSpec {
+	specs := make([]CommandSpec, 0, len(commandSpecs))
+	for _, spec := range commandSpecs {
+		specs = append(specs, spec.current())
+	}
+
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Type < specs[j].Type
+	})
+
+	return specs
+}
+
+// ValidateCommand checks that the given command type is supported by the clients,
+// and that its arguments have the expected length. It returns ErrInvalidCommand
+// or ErrInvalidCommandArgs otherwise.
+func ValidateCommand(command []byte) error {
+	if len(command) == 0 {
+		return ErrInvalidCommand
+	}
+
+	spec, ok := LookupCommand(CommandType(command[0]))
+	if !ok {
+		return ErrInvalidCommand
+	}
+
+	if len(command)-1 != spec.ArgsLen {
+		return ErrInvalidCommandArgs
+	}
+
+	return nil
+}
+
+// ValidateAndProtectCommand validates the given command with ValidateCommand before protecting it
+// with ProtectCommandPubKey, so malformed commands are rejected before reaching the client.
+func ValidateAndProtectCommand(command []byte, clientPubKey Ed25519PubKey, c2PrivateKey Curve25519PrivateKey) ([]byte, error) {
+	if err := ValidateCommand(command); err != nil {
+		return nil, err
+	}
+
+	return ProtectCommandPubKey(command, clientPubKey, c2PrivateKey)
+}
+
+// CommandDigest returns the sha3 digest of the given plaintext command. A client can report it once
+// it processed a command, for the C2 to compare it against the digest of the command it sent,
+// acknowledging the command end to end without revealing the key protecting the command channel.
+func CommandDigest(command []byte) []byte {
+	return Sha3Sum256(append([]byte(commandDigestPrefix), command...))
+}
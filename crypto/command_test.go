@@ -0,0 +1,122 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestValidateAndProtectCommand(t *testing.T) {
+	clientPubKey, clientPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	c2PrivKey := RandomKey()
+	c2PubKey, err := curve25519.X25519(c2PrivKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("Failed to generate curve25519 key: %v", err)
+	}
+
+	shared, err := curve25519.X25519(PrivateEd25519KeyToCurve25519(clientPrivKey), c2PubKey)
+	if err != nil {
+		t.Fatalf("curve25519 X25519 failed: %v", err)
+	}
+	clientKey := Sha3Sum256(shared)[:KeyLen]
+
+	testData := []struct {
+		name    string
+		cmdType byte
+		argsLen int
+	}{
+		{name: "RemoveTopic", cmdType: 0x00, argsLen: HashLen},
+		{name: "ResetTopics", cmdType: 0x01, argsLen: 0},
+		{name: "SetIDKey", cmdType: 0x02, argsLen: KeyLen},
+		{name: "SetTopicKey", cmdType: 0x03, argsLen: KeyLen + HashLen},
+		{name: "RemovePubKey", cmdType: 0x04, argsLen: IDLen},
+		{name: "ResetPubKeys", cmdType: 0x05, argsLen: 0},
+		{name: "SetPubKey", cmdType: 0x06, argsLen: ed25519.PublicKeySize + IDLen},
+		{name: "SetTopicKeyWrapped", cmdType: 0x07, argsLen: WrappedKeyLen + HashLen},
+	}
+
+	for _, data := range testData {
+		t.Run(data.name, func(t *testing.T) {
+			command := make([]byte, 1+data.argsLen)
+			command[0] = data.cmdType
+			rand.Read(command[1:])
+
+			protected, err := ValidateAndProtectCommand(command, Ed25519PubKey(clientPubKey), c2PrivKey)
+			if err != nil {
+				t.Fatalf("Failed to protect command: %v", err)
+			}
+
+			unprotected, err := UnprotectSymKey(protected, clientKey)
+			if err != nil {
+				t.Fatalf("Failed to unprotect command: %v", err)
+			}
+			if !bytes.Equal(unprotected, command) {
+				t.Fatalf("Invalid unprotected command: got %v, wanted %v", unprotected, command)
+			}
+
+			if _, err := ValidateAndProtectCommand(append(command, 0x00), Ed25519PubKey(clientPubKey), c2PrivKey); err != ErrInvalidCommandArgs {
+				t.Fatalf("Invalid error for too long command: got %v, wanted %v", err, ErrInvalidCommandArgs)
+			}
+			if data.argsLen > 0 {
+				if _, err := ValidateAndProtectCommand(command[:len(command)-1], Ed25519PubKey(clientPubKey), c2PrivKey); err != ErrInvalidCommandArgs {
+					t.Fatalf("Invalid error for too short command: got %v, wanted %v", err, ErrInvalidCommandArgs)
+				}
+			}
+		})
+	}
+
+	t.Run("malformed commands are rejected before encryption", func(t *testing.T) {
+		// The invalid keys would fail the protection, so an ErrInvalidCommand
+		// proves the command got rejected first.
+		invalidPubKey := make([]byte, ed25519.PublicKeySize)
+		invalidPrivKey := []byte("not a key")
+
+		for _, command := range [][]byte{nil, {}, {0xFF}, {0x08}} {
+			if _, err := ValidateAndProtectCommand(command, invalidPubKey, invalidPrivKey); err != ErrInvalidCommand {
+				t.Fatalf("Invalid error for command %v: got %v, wanted %v", command, err, ErrInvalidCommand)
+			}
+		}
+	})
+}
+
+func TestCommandDigest(t *testing.T) {
+	command := append([]byte{0x03}, make([]byte, KeyLen+HashLen)...)
+
+	digest := CommandDigest(command)
+	if g, w := len(digest), 32; g != w {
+		t.Fatalf("Invalid digest length: got %d, wanted %d", g, w)
+	}
+	if g, w := CommandDigest(command), digest; !bytes.Equal(g, w) {
+		t.Fatalf("Invalid digest: got %x, wanted %x", g, w)
+	}
+
+	otherCommand := append([]byte{0x03}, bytes.Repeat([]byte{0x01}, KeyLen+HashLen)...)
+	if bytes.Equal(CommandDigest(otherCommand), digest) {
+		t.Fatal("Expected different commands to have different digests")
+	}
+
+	if bytes.Equal(Sha3Sum256(command), digest) {
+		t.Fatal("Expected the command digest to differ from the plain command hash")
+	}
+}
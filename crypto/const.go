@@ -18,8 +18,10 @@ import "time"
 
 // List of global e4 constants
 const (
-	// IDLen is the length of an E4 ID
+	// IDLen is the default length of an E4 ID (see SetIDLen)
 	IDLen = 16
+	// MinIDLen is the minimum length of an E4 ID which can be set with SetIDLen
+	MinIDLen = 8
 	// KeyLen is the length of a symmetric key
 	KeyLen = 32
 	// TagLen is the length of the authentication tag appended to the cipher
@@ -39,6 +41,9 @@ const (
 	// KeyLenHex is the length of a hexadecimal encoded key
 	KeyLenHex = KeyLen * 2
 
+	// CommandTopicPrefix is the prefix of the clients command topics
+	CommandTopicPrefix = "e4/"
+
 	// Curve25519PubKeyLen is the length of a curve25519 public key
 	Curve25519PubKeyLen = 32
 	// Curve25519PrivKeyLen is the length of a curve25519 private key
@@ -16,16 +16,22 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/agl/ed25519/extra25519"
 	miscreant "github.com/miscreant/miscreant.go"
 	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/sha3"
 )
 
 var (
@@ -33,6 +39,9 @@ var (
 	ErrInvalidProtectedLen = errors.New("invalid length of protected message")
 	// ErrTooShortCipher occurs when trying to unprotect a cipher shorter than TimestampLen
 	ErrTooShortCipher = errors.New("ciphertext too short")
+	// ErrNotAuthentic occurs when a ciphertext or its associated data fails authentication, such as when
+	// decrypting with a wrong key. Any AEAD set with SetAEADFactory must return it from Open on such failures.
+	ErrNotAuthentic = miscreant.ErrNotAuthentic
 	// ErrTimestampInFuture occurs when the cipher timestamp is in the future
 	ErrTimestampInFuture = errors.New("timestamp received is in the future")
 	// ErrTimestampTooOld occurs when the cipher timestamp is older than MaxDelayDuration from now
@@ -43,6 +52,10 @@ var (
 	ErrInvalidSignerID = errors.New("invalid signer ID")
 	// ErrInvalidTimestamp occurs when trying to sign with an invalid timestamp
 	ErrInvalidTimestamp = errors.New("invalid timestamp")
+	// ErrInvalidTimestampLen occurs when a timestamp, used as associated data, is not TimestampLen bytes
+	ErrInvalidTimestampLen = errors.New("malformed associated data, invalid timestamp length")
+	// ErrIDLenLocked occurs when trying to change the ID length after IDs have been generated or validated
+	ErrIDLenLocked = errors.New("id length can't be changed once ids have been used")
 )
 
 // Ed25519PublicKey defines an alias for Ed25519 public keys
@@ -59,46 +72,60 @@ type Curve25519PrivateKey = []byte
 
 // Encrypt creates an authenticated ciphertext
 func Encrypt(key, ad, pt []byte) ([]byte, error) {
-	if err := ValidateSymKey(key); err != nil {
-		return nil, err
-	}
-
-	// Use same key for CMAC and CTR, negligible security bound difference
-	doublekey := append(key, key...)
-
-	c, err := miscreant.NewAESCMACSIV(doublekey)
+	c, err := NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	ads := make([][]byte, 1)
-	ads[0] = ad
-	return c.Seal(nil, pt, ads...)
+
+	return c.Encrypt(ad, pt)
 }
 
 // Decrypt decrypts and verifies an authenticated ciphertext
 func Decrypt(key, ad, ct []byte) ([]byte, error) {
-	if err := ValidateSymKey(key); err != nil {
+	c, err := NewCipher(key)
+	if err != nil {
 		return nil, err
 	}
 
-	// Use same key for CMAC and CTR, negligible security bound difference
-	doublekey := append(key, key...)
+	return c.Decrypt(ad, ct)
+}
 
-	c, err := miscreant.NewAESCMACSIV(doublekey)
-	if err != nil {
-		return nil, err
-	}
-	if len(ct) < c.Overhead() {
-		return nil, errors.New("too short ciphertext")
+// DecryptWithTimestamp decrypts and verifies an authenticated ciphertext, protected with
+// the given timestamp as associated data. Unlike Decrypt, it ensures the timestamp is TimestampLen bytes
+// before processing, and returns ErrInvalidTimestampLen otherwise.
+func DecryptWithTimestamp(key, timestamp, ct []byte) ([]byte, error) {
+	if len(timestamp) != TimestampLen {
+		return nil, ErrInvalidTimestampLen
 	}
 
-	return c.Open(nil, ct, ad)
+	return Decrypt(key, timestamp, ct)
+}
+
+// doubleKey returns a new KeyLen*2 slice holding key twice.
+// Same key is used for CMAC and CTR, negligible security bound difference.
+// The key is copied to a fresh buffer, as appending to it could write in the caller's slice spare capacity.
+func doubleKey(key []byte) []byte {
+	doublekey := make([]byte, KeyLen*2)
+	copy(doublekey, key)
+	copy(doublekey[KeyLen:], key)
+
+	return doublekey
+}
+
+// SignedData returns the data signed by Sign for the given signer ID, timestamp and payload,
+// composed of: timestamp + signerID + payload
+func SignedData(signerID []byte, timestamp []byte, payload []byte) []byte {
+	signed := make([]byte, 0, len(timestamp)+len(signerID)+len(payload))
+	signed = append(signed, timestamp...)
+	signed = append(signed, signerID...)
+
+	return append(signed, payload...)
 }
 
 // Sign will sign the given payload using the given privateKey,
 // producing an output composed of: timestamp + signedID + payload + signature
 func Sign(signerID []byte, privateKey Ed25519PrivateKey, timestamp []byte, payload []byte) ([]byte, error) {
-	if len(signerID) != IDLen {
+	if len(signerID) != useIDLen() {
 		return nil, ErrInvalidSignerID
 	}
 
@@ -106,8 +133,7 @@ func Sign(signerID []byte, privateKey Ed25519PrivateKey, timestamp []byte, paylo
 		return nil, ErrInvalidTimestamp
 	}
 
-	protected := append(timestamp, signerID...)
-	protected = append(protected, payload...)
+	protected := SignedData(signerID, timestamp, payload)
 
 	// sig should always be ed25519.SignatureSize=64 bytes
 	sig := ed25519.Sign(privateKey, protected)
@@ -119,29 +145,135 @@ func Sign(signerID []byte, privateKey Ed25519PrivateKey, timestamp []byte, paylo
 	return protected, nil
 }
 
+// Argon2Algorithm is the name of the Argon2 variant used by DeriveKey
+const Argon2Algorithm = "argon2i"
+
+// Argon2Params defines the parameters of the Argon2 key derivation function
+type Argon2Params struct {
+	// Time is the number of passes over the memory
+	Time uint32
+	// Memory is the size of the memory, in KiB
+	Memory uint32
+	// Threads is the number of threads used
+	Threads uint8
+}
+
+// DefaultArgon2Params are the Argon2 parameters used to derive keys from passwords
+var DefaultArgon2Params = Argon2Params{
+	Time:    1,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
 // DeriveSymKey derives a symmetric key from a password using Argon2
 // (Replaces HashPwd)
 func DeriveSymKey(pwd string) ([]byte, error) {
+	return DeriveKey(pwd, KeyLen, DefaultArgon2Params)
+}
+
+// DeriveKey derives a key of the given length from a password using Argon2, with the given parameters
+func DeriveKey(pwd string, length int, p Argon2Params) ([]byte, error) {
 	if err := ValidatePassword(pwd); err != nil {
 		return nil, fmt.Errorf("invalid password: %v", err)
 	}
 
-	return argon2.Key([]byte(pwd), nil, 1, 64*1024, 4, KeyLen), nil
+	if length <= 0 {
+		return nil, fmt.Errorf("invalid key length, got %d, expected a positive length", length)
+	}
+
+	if p.Time == 0 || p.Memory == 0 || p.Threads == 0 {
+		return nil, errors.New("invalid argon2 parameters, time, memory and threads must be greater than 0")
+	}
+
+	return argon2.Key([]byte(pwd), nil, p.Time, p.Memory, p.Threads, uint32(length)), nil
 }
 
-// ProtectSymKey attempt to encrypt payload using given symmetric key
+// DeriveContextKey derives a symmetric key from the given master key for the given context, such as "message"
+// or "command", using HKDF with sha3-256 and the context as label. Keys derived for different contexts are unrelated,
+// allowing to provision a single master key per device instead of a key for each use.
+func DeriveContextKey(master []byte, context string) ([]byte, error) {
+	if err := ValidateSymKey(master); err != nil {
+		return nil, fmt.Errorf("invalid master key: %v", err)
+	}
+
+	if len(context) == 0 {
+		return nil, errors.New("invalid context, must not be empty")
+	}
+
+	key := make([]byte, KeyLen)
+	if _, err := io.ReadFull(hkdf.New(sha3.New256, master, nil, []byte(context)), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// ProtectSymKey attempt to encrypt payload using given symmetric key.
+// Empty payloads are allowed, and produce a protected message of TimestampLen+TagLen bytes.
 func ProtectSymKey(payload, key []byte) ([]byte, error) {
-	timestamp := make([]byte, TimestampLen)
-	binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().Unix()))
+	return ProtectSymKeyAt(payload, key, time.Now())
+}
 
-	ct, err := Encrypt(key, timestamp, payload)
+// ProtectSymKeyAt works like ProtectSymKey, but stamps the protected message with the given time
+func ProtectSymKeyAt(payload, key []byte, now time.Time) ([]byte, error) {
+	c, err := NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	protected := append(timestamp, ct...)
 
-	protectedLen := TimestampLen + len(payload) + TagLen
-	if protectedLen != len(protected) {
+	return c.ProtectAt(payload, now)
+}
+
+// ProtectedCommandLen returns the exact length of a command of the given length once protected
+// with ProtectCommandPubKey or ProtectSymKey: timestamp || encrypted command || tag.
+// It allows to preallocate buffers when protecting commands in batch.
+func ProtectedCommandLen(commandLen int) int {
+	return TimestampLen + commandLen + TagLen
+}
+
+// ProtectedEqual returns true when both protected messages are identical, allowing to deduplicate
+// messages without unprotecting them. It is a plain, variable time comparison: protected messages
+// are not secret, as they travel in the clear, so there is nothing to leak through timing.
+// Secret material, such as keys or values derived from them, must be compared in constant time with crypto/subtle instead.
+func ProtectedEqual(a, b []byte) bool {
+	return bytes.Equal(a, b)
+}
+
+// CommandKeyPubKey derives the symmetric key protecting the commands sent by the C2 owning c2PrivateKey
+// to the public key client owning clientPubKey. It is the key used by ProtectCommandPubKey,
+// and the key encryption key of the keys wrapped for this client.
+func CommandKeyPubKey(clientPubKey Ed25519PubKey, c2PrivateKey Curve25519PrivateKey) ([]byte, error) {
+	if err := clientPubKey.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid client public key: %v", err)
+	}
+
+	if err := ValidateCurve25519PrivKey(c2PrivateKey); err != nil {
+		return nil, fmt.Errorf("invalid c2 private key: %v", err)
+	}
+
+	shared, err := curve25519.X25519(c2PrivateKey, clientPubKey.ToCurve25519())
+	if err != nil {
+		return nil, fmt.Errorf("curve25519 X25519 failed: %v", err)
+	}
+
+	return Sha3Sum256(shared)[:KeyLen], nil
+}
+
+// ProtectCommandPubKey protects a command for a public key client, as done by the C2.
+// The command is protected with ProtectSymKey, using a key derived from a curve25519 key exchange
+// between the C2 private key and the client ed25519 public key converted to curve25519.
+func ProtectCommandPubKey(command []byte, clientPubKey Ed25519PubKey, c2PrivateKey Curve25519PrivateKey) ([]byte, error) {
+	key, err := CommandKeyPubKey(clientPubKey, c2PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	protected, err := ProtectSymKey(command, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(protected) != ProtectedCommandLen(len(command)) {
 		return nil, ErrInvalidProtectedLen
 	}
 
@@ -150,18 +282,23 @@ func ProtectSymKey(payload, key []byte) ([]byte, error) {
 
 // UnprotectSymKey attempt to decrypt protected bytes, using given symmetric key
 func UnprotectSymKey(protected, key []byte) ([]byte, error) {
-	if len(protected) <= TimestampLen+TagLen {
+	return UnprotectSymKeyAt(protected, key, time.Now())
+}
+
+// UnprotectSymKeyAt works like UnprotectSymKey, but validates the protected message timestamp against the given time
+func UnprotectSymKeyAt(protected, key []byte, now time.Time) ([]byte, error) {
+	if len(protected) < TimestampLen+TagLen {
 		return nil, ErrTooShortCipher
 	}
 
 	ct := protected[TimestampLen:]
 	timestamp := protected[:TimestampLen]
 
-	if err := ValidateTimestamp(timestamp); err != nil {
+	if err := ValidateTimestampAt(timestamp, now); err != nil {
 		return nil, err
 	}
 
-	pt, err := Decrypt(key, timestamp, ct)
+	pt, err := DecryptWithTimestamp(key, timestamp, ct)
 	if err != nil {
 		return nil, err
 	}
@@ -169,34 +306,231 @@ func UnprotectSymKey(protected, key []byte) ([]byte, error) {
 	return pt, nil
 }
 
+// UnprotectSymKeyStrict works like UnprotectSymKey, for a payload of a known length, such as a fixed size message.
+// Before any decryption, it checks the protected message is exactly TimestampLen + payloadLen + TagLen bytes,
+// as produced by ProtectSymKey, and returns ErrInvalidProtectedLen otherwise, rejecting any trailing data.
+func UnprotectSymKeyStrict(protected, key []byte, payloadLen int) ([]byte, error) {
+	if len(protected) != TimestampLen+payloadLen+TagLen {
+		return nil, ErrInvalidProtectedLen
+	}
+
+	return UnprotectSymKey(protected, key)
+}
+
+// UnprotectSymKeyWithTime works like UnprotectSymKey, but also returns the time embedded in the protected message,
+// which it starts with. Tagged messages carry it after their scheme tag instead (see InspectProtected).
+func UnprotectSymKeyWithTime(protected, key []byte) ([]byte, time.Time, error) {
+	pt, err := UnprotectSymKey(protected, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	ts, err := DecodeTimestamp(protected[:TimestampLen])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return pt, ts, nil
+}
+
+// Reprotect unprotects a message protected with ProtectSymKey under oldKey, and protects it again under newKey,
+// keeping its original timestamp. It allows archival systems to re-encrypt their stored messages when a topic key
+// rotates. As stored messages are usually older than MaxDelayDuration, their timestamp freshness isn't checked,
+// so Reprotect must not be used to accept incoming messages.
+func Reprotect(protected, oldKey, newKey []byte) ([]byte, error) {
+	if len(protected) < TimestampLen {
+		return nil, ErrTooShortCipher
+	}
+
+	timestamp, err := DecodeTimestamp(protected[:TimestampLen])
+	if err != nil {
+		return nil, err
+	}
+
+	// Validating the message at its own time skips the freshness check
+	pt, err := UnprotectSymKeyAt(protected, oldKey, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	return ProtectSymKeyAt(pt, newKey, timestamp)
+}
+
+var (
+	timestampByteOrder      binary.ByteOrder = binary.LittleEndian
+	timestampByteOrderMutex sync.RWMutex
+)
+
+// SetTimestampByteOrder sets the byte order of the timestamps of the protected messages and commands,
+// used both to protect and to validate them. The protocol uses binary.LittleEndian, which is the default,
+// but binary.BigEndian allows to interoperate with implementations encoding them otherwise.
+// All the peers must use the same byte order. A nil order restores the default.
+func SetTimestampByteOrder(order binary.ByteOrder) {
+	timestampByteOrderMutex.Lock()
+	defer timestampByteOrderMutex.Unlock()
+
+	if order == nil {
+		order = binary.LittleEndian
+	}
+
+	timestampByteOrder = order
+}
+
+// GetTimestampByteOrder returns the byte order of the timestamps (see SetTimestampByteOrder)
+func GetTimestampByteOrder() binary.ByteOrder {
+	timestampByteOrderMutex.RLock()
+	defer timestampByteOrderMutex.RUnlock()
+
+	return timestampByteOrder
+}
+
+// EncodeTimestamp returns the TimestampLen bytes timestamp of the given time, in the timestamp byte order
+func EncodeTimestamp(t time.Time) []byte {
+	timestamp := make([]byte, TimestampLen)
+	GetTimestampByteOrder().PutUint64(timestamp, uint64(t.Unix()))
+
+	return timestamp
+}
+
+// DecodeTimestamp returns the time from the given timestamp bytes, encoded in the timestamp byte order
+func DecodeTimestamp(timestamp []byte) (time.Time, error) {
+	if len(timestamp) != TimestampLen {
+		return time.Time{}, ErrInvalidTimestampLen
+	}
+
+	return time.Unix(int64(GetTimestampByteOrder().Uint64(timestamp)), 0), nil
+}
+
+var (
+	idLen       = IDLen
+	idLenLocked bool
+	idLenMutex  sync.RWMutex
+)
+
+// SetIDLen sets the length of the IDs generated and accepted by e4, from MinIDLen to IDLen bytes.
+// Compact IDs save bytes on the wire in constrained deployments, at the cost of a higher collision
+// probability. It must be called once on startup, before any ID is generated or validated, and
+// ErrIDLenLocked is returned afterwards, so keys and IDs of different lengths can't be mixed.
+// All the peers must use the same ID length. Defaults to IDLen.
+func SetIDLen(n int) error {
+	if n < MinIDLen || n > IDLen {
+		return fmt.Errorf("invalid ID length %d, must be between %d and %d", n, MinIDLen, IDLen)
+	}
+
+	idLenMutex.Lock()
+	defer idLenMutex.Unlock()
+
+	if idLenLocked && n != idLen {
+		return ErrIDLenLocked
+	}
+
+	idLen = n
+
+	return nil
+}
+
+// GetIDLen returns the length of the IDs (see SetIDLen)
+func GetIDLen() int {
+	idLenMutex.RLock()
+	defer idLenMutex.RUnlock()
+
+	return idLen
+}
+
+// useIDLen returns the length of the IDs, preventing it from being changed afterwards
+func useIDLen() int {
+	idLenMutex.Lock()
+	defer idLenMutex.Unlock()
+
+	idLenLocked = true
+
+	return idLen
+}
+
 // RandomKey generates a random KeyLen-byte key usable by Encrypt and Decrypt
 func RandomKey() []byte {
-	key := make([]byte, KeyLen)
-	n, err := rand.Read(key)
+	key, err := RandomKeyFrom(rand.Reader)
 	if err != nil {
 		panic(err)
 	}
-	if n != KeyLen {
-		panic(fmt.Errorf("bytes read mismatch in RandomKey: got %d wanted %d", n, KeyLen))
-	}
 
 	return key
 }
 
-// RandomID generates a random IDLen-byte ID
+// RandomKeyFrom generates a KeyLen-byte key usable by Encrypt and Decrypt, reading it from the given source
+func RandomKeyFrom(r io.Reader) ([]byte, error) {
+	key := make([]byte, KeyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, fmt.Errorf("failed to read random key: %v", err)
+	}
+
+	return key, nil
+}
+
+// RandomID generates a random ID, of the length set with SetIDLen
 func RandomID() []byte {
-	id := make([]byte, IDLen)
-	n, err := rand.Read(id)
+	id, err := RandomIDFrom(rand.Reader)
 	if err != nil {
 		panic(err)
 	}
-	if n != IDLen {
-		panic(fmt.Errorf("bytes read mismatch in RandomID: got %d wanted %d", n, IDLen))
-	}
 
 	return id
 }
 
+// RandomIDFrom generates an ID of the length set with SetIDLen, reading it from the given source
+func RandomIDFrom(r io.Reader) ([]byte, error) {
+	id := make([]byte, useIDLen())
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, fmt.Errorf("failed to read random ID: %v", err)
+	}
+
+	return id, nil
+}
+
+// maxRandomIDAttempts bounds the attempts to generate each ID of RandomIDsFrom,
+// so a broken source repeating itself makes it fail instead of looping forever
+const maxRandomIDAttempts = 8
+
+// RandomIDs generates n distinct random IDs, for batch provisioning.
+// Unlike RandomID, it returns an error when the random source fails.
+func RandomIDs(n int) ([][]byte, error) {
+	return RandomIDsFrom(rand.Reader, n)
+}
+
+// RandomIDsFrom generates n distinct IDs, reading them from the given source.
+// An ID colliding with a previous one is generated again.
+func RandomIDsFrom(r io.Reader, n int) ([][]byte, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("invalid IDs count: %d", n)
+	}
+
+	ids := make([][]byte, 0, n)
+	seen := make(map[string]struct{}, n)
+	for len(ids) < n {
+		var id []byte
+		for attempt := 0; ; attempt++ {
+			if attempt == maxRandomIDAttempts {
+				return nil, errors.New("failed to generate distinct random IDs, the random source keeps repeating itself")
+			}
+
+			var err error
+			id, err = RandomIDFrom(r)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, exists := seen[string(id)]; !exists {
+				break
+			}
+		}
+
+		seen[string(id)] = struct{}{}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
 // RandomDelta16 produces a random 16-bit integer to allow us to
 // vary key sizes, plaintext sizes etc
 func RandomDelta16() uint16 {
@@ -211,7 +545,11 @@ func Ed25519PrivateKeyFromPassword(password string) (Ed25519PrivateKey, error) {
 		return nil, fmt.Errorf("invalid password: %v", err)
 	}
 
-	seed := argon2.Key([]byte(password), nil, 1, 64*1024, 4, ed25519.SeedSize)
+	seed, err := DeriveKey(password, ed25519.SeedSize, DefaultArgon2Params)
+	if err != nil {
+		return nil, err
+	}
+
 	return ed25519.NewKeyFromSeed(seed), nil
 }
 
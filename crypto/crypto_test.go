@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/agl/ed25519/extra25519"
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -49,6 +50,54 @@ func TestRandomID(t *testing.T) {
 	}
 }
 
+func TestRandomIDs(t *testing.T) {
+	ids, err := RandomIDs(1000)
+	if err != nil {
+		t.Fatalf("RandomIDs failed: %v", err)
+	}
+
+	if g, w := len(ids), 1000; g != w {
+		t.Fatalf("Invalid IDs count: got %d, wanted %d", g, w)
+	}
+
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if len(id) != IDLen {
+			t.Fatalf("Unexpected ID length, got %d, expected %d", len(id), IDLen)
+		}
+		if seen[string(id)] {
+			t.Fatalf("Duplicate random ID %x", id)
+		}
+		seen[string(id)] = true
+	}
+
+	// A source repeating its first ID must be retried
+	firstID := bytes.Repeat([]byte{0x01}, IDLen)
+	secondID := bytes.Repeat([]byte{0x02}, IDLen)
+	r := bytes.NewReader(append(append(firstID, firstID...), secondID...))
+	ids, err = RandomIDsFrom(r, 2)
+	if err != nil {
+		t.Fatalf("RandomIDsFrom failed: %v", err)
+	}
+	if !bytes.Equal(ids[0], firstID) || !bytes.Equal(ids[1], secondID) {
+		t.Fatalf("Invalid IDs: got %x, wanted %x and %x", ids, firstID, secondID)
+	}
+
+	// A constant source must fail instead of looping forever
+	if _, err := RandomIDsFrom(bytes.NewReader(make([]byte, 100*IDLen)), 2); err == nil {
+		t.Fatal("Expected an error when the random source keeps repeating itself")
+	}
+
+	// Random source errors must be returned
+	if _, err := RandomIDsFrom(bytes.NewReader(firstID[:IDLen-1]), 1); err == nil {
+		t.Fatal("Expected an error when the random source fails")
+	}
+
+	if _, err := RandomIDs(-1); err == nil {
+		t.Fatal("Expected an error when requesting a negative IDs count")
+	}
+}
+
 // Test encrypt tests KATs for the encryption code
 func TestEncrypt(t *testing.T) {
 	ptLen := 64
@@ -184,6 +233,58 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 }
 
+func TestEncryptKeyWithSpareCapacity(t *testing.T) {
+	backing := make([]byte, KeyLen*4)
+	copy(backing, RandomKey())
+	expectedBacking := make([]byte, len(backing))
+	copy(expectedBacking, backing)
+
+	key := backing[:KeyLen]
+
+	ct, err := Encrypt(key, nil, []byte("plaintext"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	if !bytes.Equal(backing, expectedBacking) {
+		t.Fatal("Encrypt modified the key backing array")
+	}
+
+	if _, err := Decrypt(key, nil, ct); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+
+	if !bytes.Equal(backing, expectedBacking) {
+		t.Fatal("Decrypt modified the key backing array")
+	}
+}
+
+func TestDecryptWithTimestamp(t *testing.T) {
+	key := RandomKey()
+	timestamp := make([]byte, TimestampLen)
+	binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().Unix()))
+
+	ct, err := Encrypt(key, timestamp, []byte("plaintext"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	if _, err := DecryptWithTimestamp(key, timestamp, ct); err != nil {
+		t.Fatalf("DecryptWithTimestamp failed: %v", err)
+	}
+
+	badTimestamps := [][]byte{
+		nil,
+		timestamp[:TimestampLen-1],
+		append(timestamp, 0x00),
+	}
+	for _, badTimestamp := range badTimestamps {
+		if _, err := DecryptWithTimestamp(key, badTimestamp, ct); err != ErrInvalidTimestampLen {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrInvalidTimestampLen)
+		}
+	}
+}
+
 func TestEncryptInvalidKeys(t *testing.T) {
 	key := make([]byte, KeyLen)
 	_, err := Encrypt(key, nil, nil)
@@ -243,6 +344,22 @@ func TestProtectUnprotectSymKey(t *testing.T) {
 		t.Fatalf("Invalid error, got: %v, wanted: %v", err, ErrTooShortCipher)
 	}
 
+	// Empty payloads are allowed
+	emptyProtected, err := ProtectSymKey([]byte{}, key)
+	if err != nil {
+		t.Fatalf("ProtectSymKey failed on empty payload: %v", err)
+	}
+	if g, w := len(emptyProtected), TimestampLen+TagLen; g != w {
+		t.Fatalf("Invalid protected length: got %d, wanted %d", g, w)
+	}
+	unprotected, err = UnprotectSymKey(emptyProtected, key)
+	if err != nil {
+		t.Fatalf("UnprotectSymKey failed on empty payload: %v", err)
+	}
+	if len(unprotected) != 0 {
+		t.Fatalf("Invalid unprotected payload: got %v, wanted empty payload", unprotected)
+	}
+
 	if _, err := UnprotectSymKey(protected, []byte("not a key")); err == nil {
 		t.Fatal("Expected unprotectSymKey to fail with an invalid key")
 	}
@@ -252,6 +369,240 @@ func TestProtectUnprotectSymKey(t *testing.T) {
 	}
 }
 
+func TestUnprotectSymKeyStrict(t *testing.T) {
+	key := RandomKey()
+	payload := []byte("payload")
+	protected, err := ProtectSymKey(payload, key)
+	if err != nil {
+		t.Fatalf("Failed to protect payload: %v", err)
+	}
+
+	pt, err := UnprotectSymKeyStrict(protected, key, len(payload))
+	if err != nil {
+		t.Fatalf("Failed to unprotect valid message in strict mode: %v", err)
+	}
+	if !bytes.Equal(pt, payload) {
+		t.Fatalf("Invalid payload: got %v, wanted %v", pt, payload)
+	}
+
+	withTrailingByte := append(protected, 0x01)
+	if _, err := UnprotectSymKeyStrict(withTrailingByte, key, len(payload)); err != ErrInvalidProtectedLen {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrInvalidProtectedLen)
+	}
+	if _, err := UnprotectSymKeyStrict(protected, key, len(payload)+1); err != ErrInvalidProtectedLen {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrInvalidProtectedLen)
+	}
+
+	// The length is checked before decryption, whatever the key
+	if _, err := UnprotectSymKeyStrict(withTrailingByte, RandomKey(), len(payload)); err != ErrInvalidProtectedLen {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrInvalidProtectedLen)
+	}
+
+	// Lax mode behaves as before, failing to authenticate the trailing byte
+	if _, err := UnprotectSymKey(withTrailingByte, key); err == nil || err == ErrInvalidProtectedLen {
+		t.Fatalf("Expected a decryption error, got %v", err)
+	}
+}
+
+func TestProtectCommandPubKey(t *testing.T) {
+	clientPubKey, clientPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	c2PrivKey := RandomKey()
+	c2PubKey, err := curve25519.X25519(c2PrivKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("Failed to generate curve25519 key: %v", err)
+	}
+
+	// Key derived on the client side
+	shared, err := curve25519.X25519(PrivateEd25519KeyToCurve25519(clientPrivKey), c2PubKey)
+	if err != nil {
+		t.Fatalf("curve25519 X25519 failed: %v", err)
+	}
+	clientKey := Sha3Sum256(shared)[:KeyLen]
+
+	for _, commandLen := range []int{0, 1, 17, 33, 512} {
+		command := make([]byte, commandLen)
+		rand.Read(command)
+
+		protected, err := ProtectCommandPubKey(command, Ed25519PubKey(clientPubKey), c2PrivKey)
+		if err != nil {
+			t.Fatalf("Failed to protect command: %v", err)
+		}
+
+		if g, w := len(protected), ProtectedCommandLen(commandLen); g != w {
+			t.Fatalf("Invalid protected command length for a %d bytes command: got %d, wanted %d", commandLen, g, w)
+		}
+
+		unprotected, err := UnprotectSymKey(protected, clientKey)
+		if err != nil {
+			t.Fatalf("Failed to unprotect command: %v", err)
+		}
+		if !bytes.Equal(unprotected, command) {
+			t.Fatalf("Invalid unprotected command: got %v, wanted %v", unprotected, command)
+		}
+	}
+
+	if _, err := ProtectCommandPubKey([]byte{0x01}, make([]byte, ed25519.PublicKeySize), c2PrivKey); err == nil {
+		t.Fatal("Expected an error when protecting a command with an invalid client public key")
+	}
+	if _, err := ProtectCommandPubKey([]byte{0x01}, Ed25519PubKey(clientPubKey), []byte("not a key")); err == nil {
+		t.Fatal("Expected an error when protecting a command with an invalid c2 private key")
+	}
+}
+
+func TestProtectedEqual(t *testing.T) {
+	key := RandomKey()
+	payload := []byte("payload")
+	now := time.Now()
+
+	protected, err := ProtectSymKeyAt(payload, key, now)
+	if err != nil {
+		t.Fatalf("ProtectSymKeyAt failed: %v", err)
+	}
+	sameTimestamp, err := ProtectSymKeyAt([]byte("other payload"), key, now)
+	if err != nil {
+		t.Fatalf("ProtectSymKeyAt failed: %v", err)
+	}
+	otherTimestamp, err := ProtectSymKeyAt(payload, key, now.Add(time.Second))
+	if err != nil {
+		t.Fatalf("ProtectSymKeyAt failed: %v", err)
+	}
+
+	copied := make([]byte, len(protected))
+	copy(copied, protected)
+
+	if !ProtectedEqual(protected, copied) {
+		t.Fatal("Expected identical protected messages to be equal")
+	}
+	if ProtectedEqual(protected, sameTimestamp) {
+		t.Fatal("Expected protected messages with different payloads to not be equal")
+	}
+	if ProtectedEqual(protected, otherTimestamp) {
+		t.Fatal("Expected protected messages with different timestamps to not be equal")
+	}
+	if ProtectedEqual(protected, protected[:len(protected)-1]) {
+		t.Fatal("Expected protected messages with different lengths to not be equal")
+	}
+}
+
+func TestUnprotectSymKeyWithTime(t *testing.T) {
+	payload := []byte("some test payload")
+	key := RandomKey()
+	now := time.Now().Add(-time.Minute)
+
+	protected, err := ProtectSymKeyAt(payload, key, now)
+	if err != nil {
+		t.Fatalf("ProtectSymKeyAt failed: %v", err)
+	}
+
+	unprotected, ts, err := UnprotectSymKeyWithTime(protected, key)
+	if err != nil {
+		t.Fatalf("UnprotectSymKeyWithTime failed: %v", err)
+	}
+
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected payload: got: %v, wanted: %v", unprotected, payload)
+	}
+
+	if g, w := ts, time.Unix(now.Unix(), 0); !g.Equal(w) {
+		t.Fatalf("Invalid timestamp: got %v, wanted %v", g, w)
+	}
+
+	if _, _, err := UnprotectSymKeyWithTime(protected, RandomKey()); err == nil {
+		t.Fatal("Expected UnprotectSymKeyWithTime to fail with a bad key")
+	}
+}
+
+func TestReprotect(t *testing.T) {
+	oldKey := RandomKey()
+	newKey := RandomKey()
+	payload := []byte("archived payload")
+
+	// Archived messages are older than MaxDelayDuration
+	protectedAt := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	protected, err := ProtectSymKeyAt(payload, oldKey, protectedAt)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+
+	reprotected, err := Reprotect(protected, oldKey, newKey)
+	if err != nil {
+		t.Fatalf("Failed to reprotect message: %v", err)
+	}
+
+	if !bytes.Equal(reprotected[:TimestampLen], protected[:TimestampLen]) {
+		t.Fatalf("Invalid timestamp: got %v, wanted %v", reprotected[:TimestampLen], protected[:TimestampLen])
+	}
+
+	unprotected, err := UnprotectSymKeyAt(reprotected, newKey, protectedAt)
+	if err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+
+	if _, err := UnprotectSymKeyAt(reprotected, oldKey, protectedAt); err == nil {
+		t.Fatal("Expected the reprotected message to not be unprotected with the old key")
+	}
+
+	if _, err := Reprotect(protected, RandomKey(), newKey); err == nil {
+		t.Fatal("Expected an error when reprotecting with a wrong old key")
+	}
+	if _, err := Reprotect(protected[:TimestampLen-1], oldKey, newKey); err != ErrTooShortCipher {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTooShortCipher)
+	}
+}
+
+func TestTimestampByteOrder(t *testing.T) {
+	defer SetTimestampByteOrder(nil)
+
+	if GetTimestampByteOrder() != binary.LittleEndian {
+		t.Fatalf("Invalid default timestamp byte order: got %v, wanted %v", GetTimestampByteOrder(), binary.LittleEndian)
+	}
+
+	key := RandomKey()
+	payload := []byte("payload")
+
+	SetTimestampByteOrder(binary.BigEndian)
+	now := time.Now()
+	protected, err := ProtectSymKeyAt(payload, key, now)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+
+	expectedTimestamp := make([]byte, TimestampLen)
+	binary.BigEndian.PutUint64(expectedTimestamp, uint64(now.Unix()))
+	if !bytes.Equal(protected[:TimestampLen], expectedTimestamp) {
+		t.Fatalf("Invalid timestamp: got %v, wanted %v", protected[:TimestampLen], expectedTimestamp)
+	}
+
+	unprotected, err := UnprotectSymKeyAt(protected, key, now)
+	if err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+
+	SetTimestampByteOrder(nil)
+	if _, err := UnprotectSymKeyAt(protected, key, now); err == nil {
+		t.Fatal("Expected a big endian timestamp to be rejected by a little endian unprotect")
+	}
+
+	protected, err = ProtectSymKeyAt(payload, key, now)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+	SetTimestampByteOrder(binary.BigEndian)
+	if _, err := UnprotectSymKeyAt(protected, key, now); err == nil {
+		t.Fatal("Expected a little endian timestamp to be rejected by a big endian unprotect")
+	}
+}
+
 func TestEd25519PrivateKeyFromPassword(t *testing.T) {
 	password := "some random password"
 	expectedKey := []byte{
@@ -290,6 +641,95 @@ func TestDeriveSymKey(t *testing.T) {
 	if len(k) != KeyLen {
 		t.Fatalf("Invalid key length: got: %d, wanted: %d", len(k), KeyLen)
 	}
+
+	expectedKey := []byte{
+		0xa6, 0xc8, 0x4a, 0xb1, 0xea, 0x69, 0x01, 0x4a, 0xd4, 0x61, 0x49, 0x93, 0xfa, 0xec, 0xbb, 0xba,
+		0x89, 0x9d, 0x97, 0xec, 0x39, 0xcc, 0xba, 0x38, 0x8f, 0xc2, 0x51, 0xc1, 0x8c, 0x80, 0xa7, 0x10,
+	}
+	if !bytes.Equal(k, expectedKey) {
+		t.Fatalf("Invalid key: got %v, wanted %v", k, expectedKey)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	password := "testPasswordRandom"
+
+	symKey, err := DeriveSymKey(password)
+	if err != nil {
+		t.Fatalf("DeriveSymKey failed: %v", err)
+	}
+
+	k, err := DeriveKey(password, KeyLen, DefaultArgon2Params)
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+	if !bytes.Equal(k, symKey) {
+		t.Fatalf("Invalid key: got %v, wanted %v", k, symKey)
+	}
+
+	k, err = DeriveKey(password, 64, DefaultArgon2Params)
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+	if len(k) != 64 {
+		t.Fatalf("Invalid key length: got %d, wanted 64", len(k))
+	}
+
+	if _, err := DeriveKey(password, 0, DefaultArgon2Params); err == nil {
+		t.Fatal("Expected an error when deriving a key with a zero length")
+	}
+	if _, err := DeriveKey(password, KeyLen, Argon2Params{}); err == nil {
+		t.Fatal("Expected an error when deriving a key with invalid argon2 parameters")
+	}
+	if _, err := DeriveKey(strings.Repeat("a", PasswordMinLength-1), KeyLen, DefaultArgon2Params); err == nil {
+		t.Fatal("Expected an error with too short password")
+	}
+}
+
+func TestDeriveContextKey(t *testing.T) {
+	master := RandomKey()
+
+	messageKey, err := DeriveContextKey(master, "message")
+	if err != nil {
+		t.Fatalf("DeriveContextKey failed: %v", err)
+	}
+	if err := ValidateSymKey(messageKey); err != nil {
+		t.Fatalf("Invalid derived key: %v", err)
+	}
+
+	k, err := DeriveContextKey(master, "message")
+	if err != nil {
+		t.Fatalf("DeriveContextKey failed: %v", err)
+	}
+	if !bytes.Equal(k, messageKey) {
+		t.Fatalf("Invalid key: got %v, wanted %v", k, messageKey)
+	}
+
+	commandKey, err := DeriveContextKey(master, "command")
+	if err != nil {
+		t.Fatalf("DeriveContextKey failed: %v", err)
+	}
+	if bytes.Equal(commandKey, messageKey) {
+		t.Fatal("Expected keys derived for different contexts to differ")
+	}
+	if bytes.Equal(messageKey, master) || bytes.Equal(commandKey, master) {
+		t.Fatal("Expected derived keys to differ from the master key")
+	}
+
+	otherKey, err := DeriveContextKey(RandomKey(), "message")
+	if err != nil {
+		t.Fatalf("DeriveContextKey failed: %v", err)
+	}
+	if bytes.Equal(otherKey, messageKey) {
+		t.Fatal("Expected keys derived from different master keys to differ")
+	}
+
+	if _, err := DeriveContextKey(master, ""); err == nil {
+		t.Fatal("Expected an error when deriving a key for an empty context")
+	}
+	if _, err := DeriveContextKey(make([]byte, KeyLen), "message"); err == nil {
+		t.Fatal("Expected an error when deriving a key from an all zero master key")
+	}
 }
 
 func TestPublicEd25519KeyToCurve25519(t *testing.T) {
@@ -327,3 +767,53 @@ func TestPrivateEd25519KeyToCurve25519(t *testing.T) {
 		t.Fatalf("Invalid curveKey, got %x, wanted %x", curveKey, expectedCurveKey)
 	}
 }
+
+func TestSetIDLen(t *testing.T) {
+	// IDs have already been used by other tests, unlock the ID length to test it
+	unlockIDLen := func() {
+		idLenMutex.Lock()
+		defer idLenMutex.Unlock()
+
+		idLen = IDLen
+		idLenLocked = false
+	}
+	unlockIDLen()
+	defer unlockIDLen()
+
+	if g, w := GetIDLen(), IDLen; g != w {
+		t.Fatalf("Invalid default ID length: got %d, wanted %d", g, w)
+	}
+
+	for _, n := range []int{MinIDLen - 1, IDLen + 1} {
+		if err := SetIDLen(n); err == nil {
+			t.Fatalf("Expected an error when setting the ID length to %d", n)
+		}
+	}
+
+	compactIDLen := MinIDLen
+	if err := SetIDLen(compactIDLen); err != nil {
+		t.Fatalf("Failed to set ID length: %v", err)
+	}
+
+	id := RandomID()
+	if g, w := len(id), compactIDLen; g != w {
+		t.Fatalf("Invalid random ID length: got %d, wanted %d", g, w)
+	}
+	if g, w := len(HashIDAlias("alias")), compactIDLen; g != w {
+		t.Fatalf("Invalid ID alias hash length: got %d, wanted %d", g, w)
+	}
+	if err := ValidateID(id); err != nil {
+		t.Fatalf("Failed to validate compact ID: %v", err)
+	}
+	if err := ValidateID(make([]byte, IDLen)); err == nil {
+		t.Fatal("Expected an error when validating a default length ID")
+	}
+
+	// The ID length can't change once IDs have been used
+	if err := SetIDLen(IDLen); err != ErrIDLenLocked {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrIDLenLocked)
+	}
+	if err := SetIDLen(compactIDLen); err != nil {
+		t.Fatalf("Expected setting the same ID length to succeed, got %v", err)
+	}
+}
@@ -14,7 +14,37 @@
 
 package crypto
 
-import "golang.org/x/crypto/sha3"
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// topicHasher wraps a sha3 hash, truncating its sum to HashLen
+type topicHasher struct {
+	hash.Hash
+}
+
+var _ hash.Hash = (*topicHasher)(nil)
+
+// NewTopicHasher returns a new hash.Hash computing topic hashes, allowing to
+// stream the topic. Its Sum is the same as HashTopic of all the written data.
+func NewTopicHasher() hash.Hash {
+	return &topicHasher{Hash: sha3.New256()}
+}
+
+// Sum appends the HashLen bytes topic hash to b and returns the resulting slice.
+// It does not change the underlying hash state.
+func (h *topicHasher) Sum(b []byte) []byte {
+	return append(b, h.Hash.Sum(nil)[:HashLen]...)
+}
+
+// Size returns the number of bytes Sum will return
+func (h *topicHasher) Size() int {
+	return HashLen
+}
 
 // Sha3Sum256 returns the sha3 sum of given data
 func Sha3Sum256(data []byte) []byte {
@@ -27,7 +57,42 @@ func HashTopic(topic string) []byte {
 	return Sha3Sum256([]byte(topic))[:HashLen]
 }
 
-// HashIDAlias creates an ID from an ID alias string
+// HashTopics validates the given topics and returns their hashes, in the same order.
+// The hashes share a single allocation. It fails on the first invalid topic, reporting its index.
+func HashTopics(topics []string) ([][]byte, error) {
+	buf := make([]byte, len(topics)*HashLen)
+	hashes := make([][]byte, len(topics))
+	for i, topic := range topics {
+		if err := ValidateTopic(topic); err != nil {
+			return nil, fmt.Errorf("invalid topic at index %d: %v", i, err)
+		}
+
+		h := sha3.Sum256([]byte(topic))
+		hashes[i] = buf[i*HashLen : (i+1)*HashLen : (i+1)*HashLen]
+		copy(hashes[i], h[:HashLen])
+	}
+
+	return hashes, nil
+}
+
+// HashIDAlias creates an ID from an ID alias string, truncating its hash to the length set with SetIDLen
 func HashIDAlias(idalias string) []byte {
-	return Sha3Sum256([]byte(idalias))[:IDLen]
+	return Sha3Sum256([]byte(idalias))[:useIDLen()]
+}
+
+// NameToID returns the ID of the given name, after validating it with ValidateName.
+// This is the canonical name to ID mapping, used by both clients and C2
+// to identify a client from its name.
+func NameToID(name string) ([]byte, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, fmt.Errorf("invalid name: %v", err)
+	}
+
+	return HashIDAlias(name), nil
+}
+
+// CommandTopicFor returns the canonical command topic of the client with the given ID,
+// on which it receives the C2 commands: CommandTopicPrefix followed by the hex encoded ID.
+func CommandTopicFor(id []byte) string {
+	return CommandTopicPrefix + hex.EncodeToString(id)
 }
@@ -15,7 +15,9 @@
 package crypto
 
 import (
+	"bytes"
 	"encoding/hex"
+	"strings"
 	"testing"
 )
 
@@ -45,3 +47,96 @@ func TestHash(t *testing.T) {
 		t.Fatalf("Hash of Topic incorrect, got: %s, wanted: %s", h, expected)
 	}
 }
+
+func TestNewTopicHasher(t *testing.T) {
+	h := NewTopicHasher()
+	if h.Size() != HashLen {
+		t.Fatalf("Invalid hasher size: got %d, wanted %d", h.Size(), HashLen)
+	}
+
+	h.Write([]byte("some/long/"))
+	h.Write([]byte("topic"))
+
+	expected := HashTopic("some/long/topic")
+	if g := h.Sum(nil); !bytes.Equal(g, expected) {
+		t.Fatalf("Invalid topic hash: got %v, wanted %v", g, expected)
+	}
+
+	h.Reset()
+	h.Write([]byte("abc"))
+	if g, w := hex.EncodeToString(h.Sum(nil)), "3a985da74fe225b2045c172d6bd390bd"; g != w {
+		t.Fatalf("Invalid topic hash after reset: got %s, wanted %s", g, w)
+	}
+}
+
+func TestNameToID(t *testing.T) {
+	name := "some-client-name"
+
+	id, err := NameToID(name)
+	if err != nil {
+		t.Fatalf("Failed to get ID from name: %v", err)
+	}
+
+	if g, w := id, HashIDAlias(name); !bytes.Equal(g, w) {
+		t.Fatalf("Invalid ID: got %v, wanted %v", g, w)
+	}
+
+	if err := ValidateID(id); err != nil {
+		t.Fatalf("Expected ID to be valid, got error: %v", err)
+	}
+
+	invalidNames := []string{
+		"",
+		strings.Repeat("a", NameMaxLen+1),
+		string([]byte{0xff, 0xfe, 0xfd}),
+	}
+	for _, invalidName := range invalidNames {
+		if _, err := NameToID(invalidName); err == nil {
+			t.Fatalf("Expected an error when getting ID from name %q", invalidName)
+		}
+	}
+}
+
+func TestCommandTopicFor(t *testing.T) {
+	id, err := hex.DecodeString("c4bdb1a7cc3cc2e8d7fb30fa4ca10ba4")
+	if err != nil {
+		t.Fatalf("Failed to decode id: %v", err)
+	}
+
+	// The command topic derivation must not change, as C2 and clients must agree on it
+	expectedTopic := "e4/c4bdb1a7cc3cc2e8d7fb30fa4ca10ba4"
+	if g, w := CommandTopicFor(id), expectedTopic; g != w {
+		t.Fatalf("Invalid command topic: got %s, wanted %s", g, w)
+	}
+}
+
+func TestHashTopics(t *testing.T) {
+	topics := []string{"topic1", "some/other/topic", "topic3"}
+
+	hashes, err := HashTopics(topics)
+	if err != nil {
+		t.Fatalf("Failed to hash topics: %v", err)
+	}
+	if g, w := len(hashes), len(topics); g != w {
+		t.Fatalf("Invalid hashes count: got %d, wanted %d", g, w)
+	}
+	for i, topic := range topics {
+		if !bytes.Equal(hashes[i], HashTopic(topic)) {
+			t.Fatalf("Invalid hash of topic %s: got %v, wanted %v", topic, hashes[i], HashTopic(topic))
+		}
+	}
+
+	// Appending to a hash must not overwrite the next one
+	_ = append(hashes[0], 0xFF)
+	if !bytes.Equal(hashes[1], HashTopic(topics[1])) {
+		t.Fatal("Expected the hashes to not share their capacity")
+	}
+
+	_, err = HashTopics([]string{"topic1", "topic2", "", "topic4"})
+	if err == nil {
+		t.Fatal("Expected an error when hashing an invalid topic")
+	}
+	if !strings.Contains(err.Error(), "index 2") {
+		t.Fatalf("Invalid error: got %v, wanted the index 2 of the invalid topic", err)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+// Ed25519PubKey is an ed25519 public key, used to verify signatures and identify clients.
+// Unlike the Ed25519PublicKey alias, it is a distinct type from Curve25519PubKey, so the
+// compiler catches an ed25519 key mistakenly used where a curve25519 one is expected.
+type Ed25519PubKey []byte
+
+// Curve25519PubKey is a curve25519 public key, used in key exchanges such as the one
+// protecting the C2 commands. It is a distinct type from Ed25519PubKey.
+type Curve25519PubKey []byte
+
+// Validate checks the key is a valid ed25519 public key, see ValidateEd25519PubKey
+func (k Ed25519PubKey) Validate() error {
+	return ValidateEd25519PubKey(k)
+}
+
+// ToCurve25519 converts the ed25519 public key to its curve25519 form,
+// as done by PublicEd25519KeyToCurve25519
+func (k Ed25519PubKey) ToCurve25519() Curve25519PubKey {
+	return Curve25519PubKey(PublicEd25519KeyToCurve25519(k))
+}
+
+// Validate checks the key is a valid curve25519 public key, see ValidateCurve25519PubKey
+func (k Curve25519PubKey) Validate() error {
+	return ValidateCurve25519PubKey(k)
+}
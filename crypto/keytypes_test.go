@@ -0,0 +1,53 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestEd25519PubKeyToCurve25519(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		pubKey, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+
+		edPubKey := Ed25519PubKey(pubKey)
+		if err := edPubKey.Validate(); err != nil {
+			t.Fatalf("Failed to validate ed25519 public key: %v", err)
+		}
+
+		curvePubKey := edPubKey.ToCurve25519()
+		if err := curvePubKey.Validate(); err != nil {
+			t.Fatalf("Failed to validate curve25519 public key: %v", err)
+		}
+
+		expectedCurvePubKey := PublicEd25519KeyToCurve25519(pubKey)
+		if !bytes.Equal(curvePubKey, expectedCurvePubKey) {
+			t.Fatalf("Invalid curve25519 public key: got %v, wanted %v", curvePubKey, expectedCurvePubKey)
+		}
+	}
+
+	if err := Ed25519PubKey(make([]byte, ed25519.PublicKeySize-1)).Validate(); err == nil {
+		t.Fatal("Expected an error when validating an invalid ed25519 public key")
+	}
+	if err := Curve25519PubKey(make([]byte, Curve25519PubKeyLen)).Validate(); err == nil {
+		t.Fatal("Expected an error when validating an all zero curve25519 public key")
+	}
+}
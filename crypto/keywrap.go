@@ -0,0 +1,52 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"fmt"
+)
+
+// WrappedKeyLen is the length of a key wrapped with WrapKey
+const WrappedKeyLen = KeyLen + TagLen
+
+// wrappedKeyAD is the associated data of wrapped keys, separating them from other ciphertexts
+// produced with the same key encryption key, such as protected commands
+var wrappedKeyAD = []byte("e4 wrapped key")
+
+// WrapKey encrypts the given symmetric key with the key encryption key kek, such as a client command key,
+// allowing to prepare keys offline and ship them encrypted. The wrapping is deterministic and authenticated.
+func WrapKey(key, kek []byte) ([]byte, error) {
+	if err := ValidateSymKey(key); err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	if err := ValidateSymKey(kek); err != nil {
+		return nil, fmt.Errorf("invalid key encryption key: %v", err)
+	}
+
+	return Encrypt(kek, wrappedKeyAD, key)
+}
+
+// UnwrapKey decrypts a key wrapped with WrapKey using the key encryption key kek,
+// and returns an error when the wrapped key isn't authentic.
+func UnwrapKey(wrapped, kek []byte) ([]byte, error) {
+	if g, w := len(wrapped), WrappedKeyLen; g != w {
+		return nil, fmt.Errorf("invalid wrapped key length, got %d, wanted %d", g, w)
+	}
+	if err := ValidateSymKey(kek); err != nil {
+		return nil, fmt.Errorf("invalid key encryption key: %v", err)
+	}
+
+	return Decrypt(kek, wrappedKeyAD, wrapped)
+}
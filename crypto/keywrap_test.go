@@ -0,0 +1,70 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrapUnwrapKey(t *testing.T) {
+	key := RandomKey()
+	kek := RandomKey()
+
+	wrapped, err := WrapKey(key, kek)
+	if err != nil {
+		t.Fatalf("Failed to wrap key: %v", err)
+	}
+	if g, w := len(wrapped), WrappedKeyLen; g != w {
+		t.Fatalf("Invalid wrapped key length: got %d, wanted %d", g, w)
+	}
+	if bytes.Contains(wrapped, key) {
+		t.Fatal("Expected the wrapped key to not contain the key")
+	}
+
+	unwrapped, err := UnwrapKey(wrapped, kek)
+	if err != nil {
+		t.Fatalf("Failed to unwrap key: %v", err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Fatalf("Invalid unwrapped key: got %v, wanted %v", unwrapped, key)
+	}
+
+	if _, err := UnwrapKey(wrapped, RandomKey()); err == nil {
+		t.Fatal("Expected an error when unwrapping with another key encryption key")
+	}
+
+	tampered := make([]byte, len(wrapped))
+	copy(tampered, wrapped)
+	tampered[0] ^= 0x01
+	if _, err := UnwrapKey(tampered, kek); err == nil {
+		t.Fatal("Expected an error when unwrapping a tampered key")
+	}
+
+	// A wrapped key must not be accepted as a protected message with the same key
+	if _, err := Decrypt(kek, nil, wrapped); err == nil {
+		t.Fatal("Expected an error when decrypting a wrapped key without its associated data")
+	}
+
+	if _, err := UnwrapKey(wrapped[1:], kek); err == nil {
+		t.Fatal("Expected an error when unwrapping a too short wrapped key")
+	}
+	if _, err := WrapKey(make([]byte, KeyLen), kek); err == nil {
+		t.Fatal("Expected an error when wrapping an invalid key")
+	}
+	if _, err := WrapKey(key, []byte("short")); err == nil {
+		t.Fatal("Expected an error when wrapping with an invalid key encryption key")
+	}
+}
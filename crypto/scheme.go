@@ -0,0 +1,245 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Scheme identifies the authenticated encryption scheme of a tagged protected message
+type Scheme byte
+
+// List of supported schemes
+const (
+	// SchemeAESCMACSIV is the default, nonce-misuse resistant, AES-CMAC-SIV scheme.
+	// It carries no nonce on the wire.
+	SchemeAESCMACSIV Scheme = 0x00
+	// SchemeXChaCha20Poly1305 is the XChaCha20-Poly1305 scheme.
+	// It carries a random NonceSize bytes nonce on the wire.
+	SchemeXChaCha20Poly1305 Scheme = 0x01
+	// SchemeAESCMACSIVSigned is the AES-CMAC-SIV scheme of the messages signed by public key clients.
+	// The signer ID follows the timestamp, and the ed25519 signature of the timestamp, signer ID and ciphertext
+	// ends the message. It can't be used with the symmetric key functions of this file.
+	SchemeAESCMACSIVSigned Scheme = 0x02
+)
+
+const (
+	// SchemeTagLen is the length of the scheme tag prefixing tagged protected messages
+	SchemeTagLen = 1
+	// TaggedHeaderLen is the length of the header of tagged protected messages: scheme tag || timestamp
+	TaggedHeaderLen = SchemeTagLen + TimestampLen
+)
+
+var (
+	// ErrUnsupportedScheme occurs when a scheme tag is unknown
+	ErrUnsupportedScheme = errors.New("unsupported scheme")
+)
+
+// String returns the scheme name
+func (s Scheme) String() string {
+	switch s {
+	case SchemeAESCMACSIV:
+		return "aes-cmac-siv"
+	case SchemeXChaCha20Poly1305:
+		return "xchacha20-poly1305"
+	case SchemeAESCMACSIVSigned:
+		return "aes-cmac-siv-ed25519"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(s))
+	}
+}
+
+// NonceSize returns the length of the nonce carried on the wire by the scheme,
+// or 0 when it does not need one
+func (s Scheme) NonceSize() int {
+	switch s {
+	case SchemeXChaCha20Poly1305:
+		return chacha20poly1305.NonceSizeX
+	default:
+		return 0
+	}
+}
+
+// EncodeTaggedHeader returns the header of a tagged protected message, made of the scheme tag
+// followed by the timestamp of the given time. It is authenticated as associated data.
+func EncodeTaggedHeader(scheme Scheme, now time.Time) []byte {
+	header := make([]byte, TaggedHeaderLen)
+	header[0] = byte(scheme)
+	copy(header[SchemeTagLen:], EncodeTimestamp(now))
+
+	return header
+}
+
+// ProtectSymKeyTagged protects the payload like ProtectSymKey, using the given scheme.
+// The protected message is self describing, and is built as:
+//
+//	scheme tag || timestamp || nonce (if the scheme requires one) || ciphertext
+//
+// The scheme tag and the timestamp are authenticated as associated data.
+//
+// The tagged framing is distinct from the untagged one of ProtectSymKey, which UnprotectSymKey,
+// the commands and the symmetric key clients keep using to stay compatible with the deployed clients and C2s.
+// Tagged messages must thus be unprotected with UnprotectSymKeyTagged, and their timestamp follows
+// the scheme tag instead of starting the message (see InspectProtected).
+func ProtectSymKeyTagged(payload, key []byte, scheme Scheme) ([]byte, error) {
+	return ProtectSymKeyTaggedAt(payload, key, scheme, time.Now())
+}
+
+// ProtectSymKeyTaggedAt is like ProtectSymKeyTagged, but uses the given time as the protected message timestamp
+func ProtectSymKeyTaggedAt(payload, key []byte, scheme Scheme, now time.Time) ([]byte, error) {
+	return ProtectSymKeyTaggedFrom(rand.Reader, payload, key, scheme, now)
+}
+
+// ProtectSymKeyTaggedFrom is like ProtectSymKeyTaggedAt, but reads the nonce from the given source,
+// such as the one set on a client with WithRand, when the scheme requires one
+func ProtectSymKeyTaggedFrom(r io.Reader, payload, key []byte, scheme Scheme, now time.Time) ([]byte, error) {
+	if err := ValidateSymKey(key); err != nil {
+		return nil, err
+	}
+
+	header := EncodeTaggedHeader(scheme, now)
+
+	switch scheme {
+	case SchemeAESCMACSIV:
+		c, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.Seal(header, payload, header)
+	case SchemeXChaCha20Poly1305:
+		c, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, err
+		}
+
+		nonce := make([]byte, c.NonceSize())
+		if _, err := io.ReadFull(r, nonce); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %v", err)
+		}
+
+		protected := append(header, nonce...)
+		return c.Seal(protected, nonce, payload, header), nil
+	default:
+		return nil, ErrUnsupportedScheme
+	}
+}
+
+// UnprotectSymKeyTagged unprotects a message protected with ProtectSymKeyTagged,
+// using the scheme read from its tag. The nonce is only read when the scheme requires one.
+func UnprotectSymKeyTagged(protected, key []byte) ([]byte, error) {
+	return UnprotectSymKeyTaggedAt(protected, key, time.Now())
+}
+
+// UnprotectSymKeyTaggedAt is like UnprotectSymKeyTagged, but validates the timestamp against the given time
+func UnprotectSymKeyTaggedAt(protected, key []byte, now time.Time) ([]byte, error) {
+	if err := ValidateSymKey(key); err != nil {
+		return nil, err
+	}
+
+	if len(protected) < SchemeTagLen {
+		return nil, ErrTooShortCipher
+	}
+
+	scheme := Scheme(protected[0])
+	headerLen := TaggedHeaderLen
+	nonceSize := scheme.NonceSize()
+	if len(protected) < headerLen+nonceSize+TagLen {
+		return nil, ErrTooShortCipher
+	}
+
+	header := protected[:headerLen]
+	if err := ValidateTimestampAt(header[SchemeTagLen:], now); err != nil {
+		return nil, err
+	}
+
+	switch scheme {
+	case SchemeAESCMACSIV:
+		c, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.Open(nil, protected[headerLen:], header)
+	case SchemeXChaCha20Poly1305:
+		c, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, err
+		}
+
+		nonce := protected[headerLen : headerLen+nonceSize]
+		return c.Open(nil, nonce, protected[headerLen+nonceSize:], header)
+	default:
+		return nil, ErrUnsupportedScheme
+	}
+}
+
+// ProtectedInfo describes the framing of a tagged protected message, as returned by InspectProtected
+type ProtectedInfo struct {
+	// Scheme is the authenticated encryption scheme read from the message tag
+	Scheme Scheme
+	// Timestamp is the time at which the message claims to have been protected
+	Timestamp time.Time
+	// NonceLen is the length of the nonce carried by the message, 0 when the scheme doesn't need one
+	NonceLen int
+	// PayloadLen is the length of the encrypted payload
+	PayloadLen int
+}
+
+// InspectProtected decodes the framing of a message protected with ProtectSymKeyTagged, or by a public key client,
+// without requiring
+// its key, as a diagnostic aid when debugging interoperability issues between peers. Nothing secret is revealed,
+// and nothing is authenticated either: the returned information is only trustworthy once the message has been
+// unprotected. The scheme tag identifies the whole message format, so there is no separate version to report.
+// ErrUnsupportedScheme is returned for unknown scheme tags, and ErrTooShortCipher for truncated messages.
+func InspectProtected(protected []byte) (ProtectedInfo, error) {
+	if len(protected) < SchemeTagLen {
+		return ProtectedInfo{}, ErrTooShortCipher
+	}
+
+	scheme := Scheme(protected[0])
+	var signerIDLen, signatureLen int
+	switch scheme {
+	case SchemeAESCMACSIV, SchemeXChaCha20Poly1305:
+	case SchemeAESCMACSIVSigned:
+		signerIDLen, signatureLen = GetIDLen(), ed25519.SignatureSize
+	default:
+		return ProtectedInfo{}, ErrUnsupportedScheme
+	}
+
+	nonceSize := scheme.NonceSize()
+	if len(protected) < TaggedHeaderLen+nonceSize+signerIDLen+TagLen+signatureLen {
+		return ProtectedInfo{}, ErrTooShortCipher
+	}
+
+	timestamp, err := DecodeTimestamp(protected[SchemeTagLen:TaggedHeaderLen])
+	if err != nil {
+		return ProtectedInfo{}, err
+	}
+
+	return ProtectedInfo{
+		Scheme:     scheme,
+		Timestamp:  timestamp,
+		NonceLen:   nonceSize,
+		PayloadLen: len(protected) - TaggedHeaderLen - nonceSize - signerIDLen - TagLen - signatureLen,
+	}, nil
+}
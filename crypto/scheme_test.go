@@ -0,0 +1,172 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestProtectUnprotectSymKeyTagged(t *testing.T) {
+	payload := []byte("some test payload")
+
+	schemes := []Scheme{SchemeAESCMACSIV, SchemeXChaCha20Poly1305}
+	for _, scheme := range schemes {
+		t.Run(scheme.String(), func(t *testing.T) {
+			key := RandomKey()
+
+			protected, err := ProtectSymKeyTagged(payload, key, scheme)
+			if err != nil {
+				t.Fatalf("Failed to protect payload: %v", err)
+			}
+
+			if g, w := Scheme(protected[0]), scheme; g != w {
+				t.Fatalf("Invalid scheme tag: got %v, wanted %v", g, w)
+			}
+
+			expectedLen := SchemeTagLen + TimestampLen + scheme.NonceSize() + len(payload) + TagLen
+			if g, w := len(protected), expectedLen; g != w {
+				t.Fatalf("Invalid protected length: got %d, wanted %d", g, w)
+			}
+
+			unprotected, err := UnprotectSymKeyTagged(protected, key)
+			if err != nil {
+				t.Fatalf("Failed to unprotect payload: %v", err)
+			}
+			if !bytes.Equal(unprotected, payload) {
+				t.Fatalf("Invalid unprotected payload: got %v, wanted %v", unprotected, payload)
+			}
+
+			if _, err := UnprotectSymKeyTagged(protected, RandomKey()); err == nil {
+				t.Fatal("Expected an error when unprotecting with another key")
+			}
+
+			tampered := make([]byte, len(protected))
+			copy(tampered, protected)
+			tampered[SchemeTagLen] ^= 0x01
+			if _, err := UnprotectSymKeyTagged(tampered, key); err == nil {
+				t.Fatal("Expected an error when unprotecting a message with a tampered timestamp")
+			}
+
+			if _, err := UnprotectSymKeyTaggedAt(protected, key, time.Now().Add(2*MaxDelayDuration)); err == nil {
+				t.Fatal("Expected an error when unprotecting an expired message")
+			}
+		})
+	}
+
+	t.Run("scheme tag is authenticated", func(t *testing.T) {
+		key := RandomKey()
+		protected, err := ProtectSymKeyTagged(payload, key, SchemeXChaCha20Poly1305)
+		if err != nil {
+			t.Fatalf("Failed to protect payload: %v", err)
+		}
+
+		protected[0] = byte(SchemeAESCMACSIV)
+		if _, err := UnprotectSymKeyTagged(protected, key); err == nil {
+			t.Fatal("Expected an error when unprotecting a message with a modified scheme tag")
+		}
+	})
+
+	t.Run("nonce is read from the given source", func(t *testing.T) {
+		key := RandomKey()
+		nonce := bytes.Repeat([]byte{0x42}, SchemeXChaCha20Poly1305.NonceSize())
+
+		protected, err := ProtectSymKeyTaggedFrom(bytes.NewReader(nonce), payload, key, SchemeXChaCha20Poly1305, time.Now())
+		if err != nil {
+			t.Fatalf("Failed to protect payload: %v", err)
+		}
+		if g, w := protected[SchemeTagLen+TimestampLen:SchemeTagLen+TimestampLen+len(nonce)], nonce; !bytes.Equal(g, w) {
+			t.Fatalf("Invalid nonce: got %v, wanted %v", g, w)
+		}
+		if _, err := UnprotectSymKeyTagged(protected, key); err != nil {
+			t.Fatalf("Failed to unprotect payload: %v", err)
+		}
+
+		if _, err := ProtectSymKeyTaggedFrom(bytes.NewReader(nonce[1:]), payload, key, SchemeXChaCha20Poly1305, time.Now()); err == nil {
+			t.Fatal("Expected an error when the source can't provide a full nonce")
+		}
+	})
+
+	t.Run("unsupported or truncated messages are rejected", func(t *testing.T) {
+		key := RandomKey()
+		if _, err := ProtectSymKeyTagged(payload, key, Scheme(0xff)); err != ErrUnsupportedScheme {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedScheme)
+		}
+
+		protected, err := ProtectSymKeyTagged(payload, key, SchemeXChaCha20Poly1305)
+		if err != nil {
+			t.Fatalf("Failed to protect payload: %v", err)
+		}
+
+		protected[0] = 0xff
+		if _, err := UnprotectSymKeyTagged(protected, key); err != ErrUnsupportedScheme {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedScheme)
+		}
+
+		short := protected[:SchemeTagLen+TimestampLen+SchemeXChaCha20Poly1305.NonceSize()]
+		short[0] = byte(SchemeXChaCha20Poly1305)
+		if _, err := UnprotectSymKeyTagged(short, key); err != ErrTooShortCipher {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTooShortCipher)
+		}
+		if _, err := UnprotectSymKeyTagged([]byte{}, key); err != ErrTooShortCipher {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTooShortCipher)
+		}
+	})
+}
+
+func TestInspectProtected(t *testing.T) {
+	payload := []byte("some test payload")
+	now := time.Unix(1577836800, 0)
+
+	schemes := []Scheme{SchemeAESCMACSIV, SchemeXChaCha20Poly1305}
+	for _, scheme := range schemes {
+		t.Run(scheme.String(), func(t *testing.T) {
+			protected, err := ProtectSymKeyTaggedAt(payload, RandomKey(), scheme, now)
+			if err != nil {
+				t.Fatalf("Failed to protect payload: %v", err)
+			}
+
+			info, err := InspectProtected(protected)
+			if err != nil {
+				t.Fatalf("Failed to inspect protected message: %v", err)
+			}
+
+			expected := ProtectedInfo{
+				Scheme:     scheme,
+				Timestamp:  now,
+				NonceLen:   scheme.NonceSize(),
+				PayloadLen: len(payload),
+			}
+			if info != expected {
+				t.Fatalf("Invalid protected info: got %+v, wanted %+v", info, expected)
+			}
+
+			if _, err := InspectProtected(protected[:SchemeTagLen+TimestampLen]); err != ErrTooShortCipher {
+				t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTooShortCipher)
+			}
+		})
+	}
+
+	if _, err := InspectProtected(nil); err != ErrTooShortCipher {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTooShortCipher)
+	}
+
+	unknown := make([]byte, SchemeTagLen+TimestampLen+TagLen)
+	unknown[0] = 0xFF
+	if _, err := InspectProtected(unknown); err != ErrUnsupportedScheme {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedScheme)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Known answers of the SelfTest primitives
+const (
+	selfTestIDAlias     = "abc"
+	selfTestIDAliasHash = "3a985da74fe225b2045c172d6bd390bd"
+	selfTestPassword    = "testRandomPassword"
+	selfTestDerivedKey  = "ae153aa9dad7a10b0aed6d5bcfb407c77066acfbb2eaa702a6a88b6cf1b88c33"
+	selfTestAD          = "e4 self test ad"
+	selfTestPlaintext   = "e4 self test plaintext"
+	selfTestCiphertext  = "95f98dd231bbcebb830665fd5c0881eee6136022325053c584b811d047c8434158678f7e198b"
+)
+
+// SelfTest runs known-answer tests of the hash, the password key derivation, and the authenticated
+// encryption used by e4, and returns an error when any of them doesn't produce the expected output.
+// It allows a power-on cryptographic self-test, ensuring for example that a hardware AEAD
+// set with SetAEADFactory behaves like the default one. It doesn't depend on the ID length.
+func SelfTest() error {
+	// Same as HashIDAlias, on the default ID length
+	if g, w := hex.EncodeToString(Sha3Sum256([]byte(selfTestIDAlias))[:IDLen]), selfTestIDAliasHash; g != w {
+		return fmt.Errorf("hash self test failed, got %s, wanted %s", g, w)
+	}
+
+	derivedKey, err := DeriveSymKey(selfTestPassword)
+	if err != nil {
+		return fmt.Errorf("key derivation self test failed: %v", err)
+	}
+	if g, w := hex.EncodeToString(derivedKey), selfTestDerivedKey; g != w {
+		return fmt.Errorf("key derivation self test failed, got %s, wanted %s", g, w)
+	}
+
+	// The key bytes are 0, 1, ..., KeyLen-1
+	key := make([]byte, KeyLen)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	ct, err := Encrypt(key, []byte(selfTestAD), []byte(selfTestPlaintext))
+	if err != nil {
+		return fmt.Errorf("encryption self test failed: %v", err)
+	}
+	if g, w := hex.EncodeToString(ct), selfTestCiphertext; g != w {
+		return fmt.Errorf("encryption self test failed, got %s, wanted %s", g, w)
+	}
+
+	pt, err := Decrypt(key, []byte(selfTestAD), ct)
+	if err != nil {
+		return fmt.Errorf("decryption self test failed: %v", err)
+	}
+	if !bytes.Equal(pt, []byte(selfTestPlaintext)) {
+		return fmt.Errorf("decryption self test failed, got %x, wanted %x", pt, selfTestPlaintext)
+	}
+
+	ct[0] ^= 0x01
+	if _, err := Decrypt(key, []byte(selfTestAD), ct); err == nil {
+		return errors.New("decryption self test failed, a tampered ciphertext has been accepted")
+	} else if err != ErrNotAuthentic {
+		return fmt.Errorf("decryption self test failed, got %v for a tampered ciphertext, wanted %v", err, ErrNotAuthentic)
+	}
+
+	return nil
+}
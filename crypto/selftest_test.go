@@ -0,0 +1,83 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"errors"
+	"testing"
+)
+
+// brokenAEAD implements AEAD, corrupting the ciphertexts produced by the default AEAD
+type brokenAEAD struct {
+	AEAD
+}
+
+func (b *brokenAEAD) Seal(dst, plaintext []byte, data ...[]byte) ([]byte, error) {
+	ct, err := b.AEAD.Seal(dst, plaintext, data...)
+	if err != nil {
+		return nil, err
+	}
+	ct[len(ct)-1] ^= 0x01
+
+	return ct, nil
+}
+
+// customErrorAEAD implements AEAD, returning its own error instead of ErrNotAuthentic on authentication failures
+type customErrorAEAD struct {
+	AEAD
+}
+
+func (c *customErrorAEAD) Open(dst, ciphertext []byte, data ...[]byte) ([]byte, error) {
+	pt, err := c.AEAD.Open(dst, ciphertext, data...)
+	if err != nil {
+		return nil, errors.New("hardware authentication failure")
+	}
+
+	return pt, nil
+}
+
+func TestSelfTest(t *testing.T) {
+	defer SetAEADFactory(nil)
+
+	if err := SelfTest(); err != nil {
+		t.Fatalf("Self test failed: %v", err)
+	}
+
+	SetAEADFactory(func(key []byte) (AEAD, error) {
+		aead, err := NewDefaultAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return &brokenAEAD{AEAD: aead}, nil
+	})
+
+	if err := SelfTest(); err == nil {
+		t.Fatal("Expected self test to fail with a broken AEAD")
+	}
+
+	SetAEADFactory(func(key []byte) (AEAD, error) {
+		aead, err := NewDefaultAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return &customErrorAEAD{AEAD: aead}, nil
+	})
+
+	if err := SelfTest(); err == nil {
+		t.Fatal("Expected self test to fail with an AEAD not returning ErrNotAuthentic")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"encoding/hex"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// TestVector holds the inputs and output of one E4 operation, allowing other implementations
+// to check they produce the same bytes. Inputs and output are hex encoded.
+type TestVector struct {
+	// Name identifies the operation producing Output from Inputs
+	Name string `json:"name"`
+	// Timestamp is the unix time the output has been protected at, or 0 when not time dependent
+	Timestamp int64 `json:"timestamp"`
+	// Inputs holds the operation inputs, indexed by name
+	Inputs map[string]string `json:"inputs"`
+	// Output is the operation result
+	Output string `json:"output"`
+}
+
+// defaultTestVectorsTime is the time used by TestVectors when given a nil clock
+var defaultTestVectorsTime = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// testVectorsKey returns a fixed KeyLen key derived from the given label
+func testVectorsKey(label string) []byte {
+	return Sha3Sum256([]byte("e4 test vectors " + label))[:KeyLen]
+}
+
+// TestVectors generates the protected outputs of fixed keys and plaintexts, for cross implementation testing.
+// All the operations are deterministic, so the vectors only depend on the time returned by the given clock,
+// which stamps the protected messages. A nil clock uses a fixed time.
+func TestVectors(clock Clock) ([]TestVector, error) {
+	now := defaultTestVectorsTime
+	if clock != nil {
+		now = clock.Now()
+	}
+
+	timestamp := EncodeTimestamp(now)
+
+	topic := "e4/test/vectors"
+	topicKey := testVectorsKey("topic key")
+	payload := []byte("E4 test vector payload")
+	signerID := HashIDAlias("e4 test vectors signer")
+	ed25519Seed := testVectorsKey("ed25519 seed")
+	c2PrivateKey := testVectorsKey("c2 private key")
+	clientPrivateKey := ed25519.NewKeyFromSeed(ed25519Seed)
+	clientPubKey := Ed25519PubKey(clientPrivateKey.Public().(ed25519.PublicKey))
+
+	var vectors []TestVector
+
+	vectors = append(vectors, TestVector{
+		Name:   "HashTopic",
+		Inputs: map[string]string{"topic": hex.EncodeToString([]byte(topic))},
+		Output: hex.EncodeToString(HashTopic(topic)),
+	})
+
+	for _, p := range [][]byte{payload, {}} {
+		protected, err := ProtectSymKeyAt(p, topicKey, now)
+		if err != nil {
+			return nil, err
+		}
+
+		vectors = append(vectors, TestVector{
+			Name:      "ProtectSymKey",
+			Timestamp: now.Unix(),
+			Inputs: map[string]string{
+				"key":     hex.EncodeToString(topicKey),
+				"payload": hex.EncodeToString(p),
+			},
+			Output: hex.EncodeToString(protected),
+		})
+	}
+
+	header := EncodeTaggedHeader(SchemeAESCMACSIVSigned, now)
+	ct, err := Encrypt(topicKey, header, payload)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := Sign(signerID, clientPrivateKey, timestamp, ct)
+	if err != nil {
+		return nil, err
+	}
+	signed = append([]byte{byte(SchemeAESCMACSIVSigned)}, signed...)
+	vectors = append(vectors, TestVector{
+		Name:      "ProtectMessagePubKey",
+		Timestamp: now.Unix(),
+		Inputs: map[string]string{
+			"topicKey":    hex.EncodeToString(topicKey),
+			"signerID":    hex.EncodeToString(signerID),
+			"ed25519Seed": hex.EncodeToString(ed25519Seed),
+			"payload":     hex.EncodeToString(payload),
+		},
+		Output: hex.EncodeToString(signed),
+	})
+
+	command := append([]byte{0x03}, topicKey...)
+	command = append(command, HashTopic(topic)...)
+	commandKey, err := CommandKeyPubKey(clientPubKey, c2PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	protectedCommand, err := ProtectSymKeyAt(command, commandKey, now)
+	if err != nil {
+		return nil, err
+	}
+	vectors = append(vectors, TestVector{
+		Name:      "ProtectCommandPubKey",
+		Timestamp: now.Unix(),
+		Inputs: map[string]string{
+			"clientEd25519PubKey":    hex.EncodeToString(clientPubKey),
+			"c2Curve25519PrivateKey": hex.EncodeToString(c2PrivateKey),
+			"command":                hex.EncodeToString(command),
+		},
+		Output: hex.EncodeToString(protectedCommand),
+	})
+
+	wrapped, err := WrapKey(topicKey, commandKey)
+	if err != nil {
+		return nil, err
+	}
+	vectors = append(vectors, TestVector{
+		Name: "WrapKey",
+		Inputs: map[string]string{
+			"key": hex.EncodeToString(topicKey),
+			"kek": hex.EncodeToString(commandKey),
+		},
+		Output: hex.EncodeToString(wrapped),
+	})
+
+	return vectors, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crypto
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fixedClock implements Clock, always returning the same time
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+func TestTestVectors(t *testing.T) {
+	vectors, err := TestVectors(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate test vectors: %v", err)
+	}
+
+	again, err := TestVectors(fixedClock{now: defaultTestVectorsTime})
+	if err != nil {
+		t.Fatalf("Failed to generate test vectors: %v", err)
+	}
+	if !reflect.DeepEqual(vectors, again) {
+		t.Fatalf("Invalid test vectors: got %v, wanted %v", again, vectors)
+	}
+
+	// Known outputs, which must only change along with the framing, as other implementations are checked against them
+	expectedOutputs := map[string]string{
+		"HashTopic":     "a358e296b6c7aad4e35b6bc5924fea56",
+		"ProtectSymKey": "00e10b5e0000000091d0da8bed5c09a65b60618a9f67e9ac3a93652c759adf1637f534245a1f87d53f006fd834fb",
+		"ProtectMessagePubKey": "0200e10b5e00000000e6813a96fc921833cbd74f1edae8452b6545da8b5566c209f7eec012480e68f1a62ddb82435102e0cbc18dbcded6b2319b5ccfb1dd2c" +
+			"e4001c7532d3fa94d0558091cab639fc8287ed741dca57b53068377dc9d7ac95cbff236d8f64e5e10e3eeedb1a7ef4d16d606ce1847e707565b1008c2ec71d08",
+		"WrapKey": "d4f9efbb549854dbcb5e4079f8d9ac3232b39198796d58208747ddcbee820dc36487d504f6c3cb020402d5a603f9d512",
+	}
+	for _, vector := range vectors {
+		expected, ok := expectedOutputs[vector.Name]
+		if !ok {
+			continue
+		}
+
+		if vector.Output != expected {
+			t.Fatalf("Invalid %s output: got %s, wanted %s", vector.Name, vector.Output, expected)
+		}
+		delete(expectedOutputs, vector.Name)
+	}
+	if len(expectedOutputs) > 0 {
+		t.Fatalf("Missing test vectors: %v", expectedOutputs)
+	}
+
+	// Protected outputs must be stamped with the clock time, and unprotect with their inputs
+	now := time.Now()
+	vectors, err = TestVectors(fixedClock{now: now})
+	if err != nil {
+		t.Fatalf("Failed to generate test vectors: %v", err)
+	}
+	for _, vector := range vectors {
+		if vector.Name != "ProtectSymKey" {
+			continue
+		}
+
+		if g, w := vector.Timestamp, now.Unix(); g != w {
+			t.Fatalf("Invalid timestamp: got %d, wanted %d", g, w)
+		}
+
+		key, err := hex.DecodeString(vector.Inputs["key"])
+		if err != nil {
+			t.Fatalf("Failed to decode key: %v", err)
+		}
+		protected, err := hex.DecodeString(vector.Output)
+		if err != nil {
+			t.Fatalf("Failed to decode output: %v", err)
+		}
+
+		payload, err := UnprotectSymKeyAt(protected, key, now)
+		if err != nil {
+			t.Fatalf("Failed to unprotect output: %v", err)
+		}
+		if g, w := hex.EncodeToString(payload), vector.Inputs["payload"]; g != w {
+			t.Fatalf("Invalid payload: got %s, wanted %s", g, w)
+		}
+	}
+}
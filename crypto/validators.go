@@ -16,10 +16,11 @@ package crypto
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"golang.org/x/crypto/ed25519"
@@ -28,6 +29,8 @@ import (
 const (
 	// PasswordMinLength defines the minimum size accepted for a password
 	PasswordMinLength = 16
+	// maxKeyPatternLen is the longest repeating pattern rejected by ValidateKeyEntropy
+	maxKeyPatternLen = 4
 	// NameMinLen is the minimum length of a name
 	NameMinLen = 1
 	// NameMaxLen is the maximum length of a name
@@ -47,8 +50,52 @@ var (
 
 	blankSymKey [KeyLen]byte
 	zeroSymKey  = blankSymKey[:]
+
+	blankTopicHash [HashLen]byte
+	zeroTopicHash  = blankTopicHash[:]
 )
 
+// PasswordPolicy defines the constraints a password must satisfy to be accepted
+type PasswordPolicy struct {
+	// MinLength is the minimum length of the password, in bytes
+	MinLength int
+	// RequireMixedCase requires the password to contain at least one lower case and one upper case letter
+	RequireMixedCase bool
+}
+
+// DefaultPasswordPolicy is the policy used by ValidatePassword unless replaced with SetPasswordPolicy
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength: PasswordMinLength,
+}
+
+var (
+	passwordPolicy      = DefaultPasswordPolicy
+	passwordPolicyMutex sync.RWMutex
+)
+
+// SetPasswordPolicy replaces the policy used by ValidatePassword, and thus by every
+// password derivation function of this package. It returns an error when the policy is invalid.
+func SetPasswordPolicy(policy PasswordPolicy) error {
+	if policy.MinLength < 1 {
+		return fmt.Errorf("invalid password policy, minimum length must be at least 1, got %d", policy.MinLength)
+	}
+
+	passwordPolicyMutex.Lock()
+	defer passwordPolicyMutex.Unlock()
+
+	passwordPolicy = policy
+
+	return nil
+}
+
+// GetPasswordPolicy returns the policy currently used by ValidatePassword
+func GetPasswordPolicy() PasswordPolicy {
+	passwordPolicyMutex.RLock()
+	defer passwordPolicyMutex.RUnlock()
+
+	return passwordPolicy
+}
+
 // ValidateSymKey checks that a key is of the expected length
 // and not filled with zero
 func ValidateSymKey(key []byte) error {
@@ -63,6 +110,37 @@ func ValidateSymKey(key []byte) error {
 	return nil
 }
 
+// ValidateKeyEntropy rejects the keys with an obviously low entropy, such as the ones filled with the
+// same byte, simple counters whose bytes all increase or decrease by the same step, or the repetition
+// of a short pattern of up to 4 bytes. It is a guardrail against mistakes, not a security boundary:
+// a key passing it isn't guaranteed to be random.
+func ValidateKeyEntropy(key []byte) error {
+	if len(key) < 2 {
+		return fmt.Errorf("invalid key length %d, too short to estimate its entropy", len(key))
+	}
+
+	isCounter := true
+	step := key[1] - key[0]
+	for i := 2; i < len(key) && isCounter; i++ {
+		isCounter = key[i]-key[i-1] == step
+	}
+	if isCounter {
+		if step == 0 {
+			return errors.New("low entropy key, all its bytes are the same")
+		}
+
+		return errors.New("low entropy key, its bytes form a counter")
+	}
+
+	for patternLen := 2; patternLen <= maxKeyPatternLen && 2*patternLen <= len(key); patternLen++ {
+		if bytes.Equal(key[patternLen:], key[:len(key)-patternLen]) {
+			return fmt.Errorf("low entropy key, it repeats a %d bytes pattern", patternLen)
+		}
+	}
+
+	return nil
+}
+
 // ValidateEd25519PrivKey checks that a key is of the expected length and not all zero
 func ValidateEd25519PrivKey(key []byte) error {
 	if g, w := len(key), ed25519.PrivateKeySize; g != w {
@@ -115,9 +193,9 @@ func ValidateCurve25519PrivKey(key []byte) error {
 	return nil
 }
 
-// ValidateID checks that an id is of the expected length
+// ValidateID checks that an id is of the expected length (see SetIDLen)
 func ValidateID(id []byte) error {
-	if g, w := len(id), IDLen; g != w {
+	if g, w := len(id), useIDLen(); g != w {
 		return fmt.Errorf("invalid ID length, got %d, expected %d", g, w)
 	}
 
@@ -153,20 +231,31 @@ func ValidateTopic(topic string) error {
 	return nil
 }
 
-// ValidateTopicHash checks that a topic hash is of the expected length
+// ValidateTopicHash checks that a topic hash is of the expected length and not all zero
 func ValidateTopicHash(topicHash []byte) error {
 	if g, w := len(topicHash), HashLen; g != w {
 		return fmt.Errorf("invalid Topic Hash length, got %d, expected %d", g, w)
 	}
 
+	if bytes.Equal(zeroTopicHash, topicHash) {
+		return errors.New("invalid Topic Hash, all zeros")
+	}
+
 	return nil
 }
 
 // ValidateTimestamp checks that given timestamp bytes are
-// a valid LittleEndian encoded timestamp, not in the future and not older than MaxDelayDuration
+// a valid timestamp (see SetTimestampByteOrder), not in the future and not older than MaxDelayDuration
 func ValidateTimestamp(timestamp []byte) error {
-	now := time.Now()
-	tsTime := time.Unix(int64(binary.LittleEndian.Uint64(timestamp)), 0)
+	return ValidateTimestampAt(timestamp, time.Now())
+}
+
+// ValidateTimestampAt works like ValidateTimestamp, using the given time as the current time
+func ValidateTimestampAt(timestamp []byte, now time.Time) error {
+	tsTime, err := DecodeTimestamp(timestamp)
+	if err != nil {
+		return err
+	}
 
 	if now.Before(tsTime) {
 		return ErrTimestampInFuture
@@ -181,10 +270,17 @@ func ValidateTimestamp(timestamp []byte) error {
 }
 
 // ValidateTimestampKey checks that given timestamp bytes are
-// a valid LittleEndian encoded timestamp, not in the future and not older than MaxDelayKeyTransition
+// a valid timestamp (see SetTimestampByteOrder), not in the future and not older than MaxDelayKeyTransition
 func ValidateTimestampKey(timestamp []byte) error {
-	now := time.Now()
-	tsTime := time.Unix(int64(binary.LittleEndian.Uint64(timestamp)), 0)
+	return ValidateTimestampKeyAt(timestamp, time.Now())
+}
+
+// ValidateTimestampKeyAt works like ValidateTimestampKey, using the given time as the current time
+func ValidateTimestampKeyAt(timestamp []byte, now time.Time) error {
+	tsTime, err := DecodeTimestamp(timestamp)
+	if err != nil {
+		return err
+	}
 	if now.Before(tsTime) {
 		return ErrTimestampInFuture
 	}
@@ -197,14 +293,32 @@ func ValidateTimestampKey(timestamp []byte) error {
 	return nil
 }
 
-// ValidatePassword checks given password is an utf8 string of at least PasswordMinLength characters
+// ValidatePassword checks given password is an utf8 string satisfying the current password policy.
+// By default, it must be at least PasswordMinLength characters (see SetPasswordPolicy)
 func ValidatePassword(password string) error {
+	return ValidatePasswordWith(password, GetPasswordPolicy())
+}
+
+// ValidatePasswordWith checks given password is an utf8 string satisfying the given policy
+func ValidatePasswordWith(password string, policy PasswordPolicy) error {
 	if !utf8.ValidString(password) {
 		return errors.New("password is not a valid UTF-8 string")
 	}
 
-	if len(password) < PasswordMinLength {
-		return fmt.Errorf("password must be at least %d characters", PasswordMinLength)
+	if len(password) < policy.MinLength {
+		return fmt.Errorf("password must be at least %d characters", policy.MinLength)
+	}
+
+	if policy.RequireMixedCase {
+		var hasLower, hasUpper bool
+		for _, r := range password {
+			hasLower = hasLower || unicode.IsLower(r)
+			hasUpper = hasUpper || unicode.IsUpper(r)
+		}
+
+		if !hasLower || !hasUpper {
+			return errors.New("password must contain both lower and upper case letters")
+		}
 	}
 
 	return nil
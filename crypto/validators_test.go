@@ -122,6 +122,49 @@ func TestValidateEd25519PrivKey(t *testing.T) {
 	})
 }
 
+func TestValidateKeyEntropy(t *testing.T) {
+	allFFKey := make([]byte, KeyLen)
+	for i := range allFFKey {
+		allFFKey[i] = 0xFF
+	}
+
+	counterKey := make([]byte, KeyLen)
+	for i := range counterKey {
+		counterKey[i] = byte(i)
+	}
+
+	decreasingCounterKey := make([]byte, KeyLen)
+	for i := range decreasingCounterKey {
+		decreasingCounterKey[i] = byte(250 - 3*i)
+	}
+
+	patternKey := make([]byte, KeyLen)
+	for i := range patternKey {
+		patternKey[i] = []byte{0xDE, 0xAD, 0xBE, 0xEF}[i%4]
+	}
+
+	invalidKeys := map[string][]byte{
+		"nil":                nil,
+		"all 0xFF":           allFFKey,
+		"all zeros":          make([]byte, KeyLen),
+		"counter":            counterKey,
+		"decreasing counter": decreasingCounterKey,
+		"repeating pattern":  patternKey,
+	}
+	for name, invalidKey := range invalidKeys {
+		if err := ValidateKeyEntropy(invalidKey); err == nil {
+			t.Fatalf("Expected %s key '%v' validation to return an error", name, invalidKey)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		validKey := RandomKey()
+		if err := ValidateKeyEntropy(validKey); err != nil {
+			t.Fatalf("Got error %v when validating key '%v', wanted no error", err, validKey)
+		}
+	}
+}
+
 func TestValidEd25519PubKey(t *testing.T) {
 	t.Run("Invalid public keys return an error", func(t *testing.T) {
 		allZeroKey := make(ed25519.PublicKey, ed25519.PublicKeySize)
@@ -194,10 +237,12 @@ func TestValidateTopicHash(t *testing.T) {
 	t.Run("Invalid topic hashes return an error", func(t *testing.T) {
 		tooShortHash := make([]byte, HashLen-1)
 		tooLongHash := make([]byte, HashLen+1)
+		allZeroHash := make([]byte, HashLen)
 
 		invalidTopics := [][]byte{
 			tooShortHash,
 			tooLongHash,
+			allZeroHash,
 		}
 
 		for _, invalidTopic := range invalidTopics {
@@ -208,13 +253,11 @@ func TestValidateTopicHash(t *testing.T) {
 	})
 
 	t.Run("Valid topic hashes return no error", func(t *testing.T) {
-		allZeroHash := make([]byte, HashLen)
-
 		randomHash := make([]byte, HashLen)
 		rand.Read(randomHash)
 
 		validTopics := [][]byte{
-			allZeroHash,
+			HashTopic("some/topic"),
 			randomHash,
 		}
 
@@ -244,6 +287,10 @@ func TestValidateTimestamp(t *testing.T) {
 	if err := ValidateTimestamp(validTimestamp); err != nil {
 		t.Fatalf("Got error %v when validating timestamp %v, wanted no error", err, validTimestamp)
 	}
+
+	if err := ValidateTimestamp(validTimestamp[:TimestampLen-1]); err != ErrInvalidTimestampLen {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrInvalidTimestampLen)
+	}
 }
 
 func TestValidateTimestampKey(t *testing.T) {
@@ -373,3 +420,61 @@ func TestValidatePassword(t *testing.T) {
 		}
 	})
 }
+
+func TestValidatePasswordWith(t *testing.T) {
+	t.Run("Default policy accepts a PasswordMinLength password", func(t *testing.T) {
+		if g, w := GetPasswordPolicy(), DefaultPasswordPolicy; g != w {
+			t.Fatalf("Invalid password policy: got %#v, wanted %#v", g, w)
+		}
+
+		if err := ValidatePasswordWith(strings.Repeat("a", PasswordMinLength), DefaultPasswordPolicy); err != nil {
+			t.Fatalf("Got error %v when validating password with default policy, wanted no error", err)
+		}
+	})
+
+	t.Run("Stricter policy rejects a PasswordMinLength password", func(t *testing.T) {
+		policy := PasswordPolicy{MinLength: 20}
+		if err := ValidatePasswordWith(strings.Repeat("a", PasswordMinLength), policy); err == nil {
+			t.Fatal("Expected password validation to fail with a stricter policy")
+		}
+
+		if err := ValidatePasswordWith(strings.Repeat("a", 20), policy); err != nil {
+			t.Fatalf("Got error %v when validating password, wanted no error", err)
+		}
+	})
+
+	t.Run("Mixed case policy requires lower and upper case letters", func(t *testing.T) {
+		policy := PasswordPolicy{MinLength: PasswordMinLength, RequireMixedCase: true}
+		invalidPasswords := []string{
+			strings.Repeat("a", PasswordMinLength),
+			strings.Repeat("A", PasswordMinLength),
+			strings.Repeat("1", PasswordMinLength),
+		}
+		for _, invalidPassword := range invalidPasswords {
+			if err := ValidatePasswordWith(invalidPassword, policy); err == nil {
+				t.Fatalf("Expected password '%s' validation to return an error", invalidPassword)
+			}
+		}
+
+		validPassword := "A" + strings.Repeat("a", PasswordMinLength-1)
+		if err := ValidatePasswordWith(validPassword, policy); err != nil {
+			t.Fatalf("Got error %v when validating password '%s', wanted no error", err, validPassword)
+		}
+	})
+
+	t.Run("SetPasswordPolicy updates ValidatePassword policy", func(t *testing.T) {
+		defer SetPasswordPolicy(DefaultPasswordPolicy)
+
+		if err := SetPasswordPolicy(PasswordPolicy{MinLength: 0}); err == nil {
+			t.Fatal("Expected an error when setting a policy with an invalid minimum length")
+		}
+
+		if err := SetPasswordPolicy(PasswordPolicy{MinLength: 12}); err != nil {
+			t.Fatalf("Failed to set password policy: %v", err)
+		}
+
+		if err := ValidatePassword(strings.Repeat("a", 12)); err != nil {
+			t.Fatalf("Got error %v when validating password, wanted no error", err)
+		}
+	})
+}
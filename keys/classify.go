@@ -0,0 +1,98 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+import (
+	"golang.org/x/crypto/ed25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+// Kind defines a set of possible kinds for a protected message.
+// It is a bit field, allowing to hold several candidates when a protected message is ambiguous.
+type Kind uint8
+
+// List of protected message kinds
+const (
+	// KindSymMessage is a message protected by a SymKeyMaterial
+	KindSymMessage Kind = 1 << iota
+	// KindPubKeyMessage is a message protected by a PubKeyMaterial, either signed or unsigned
+	KindPubKeyMessage
+	// KindCommand is a client command protected by the C2
+	KindCommand
+)
+
+// commandPayloadLengths returns the set of command payload lengths, made of a command byte followed by its arguments.
+// Commands are protected like symmetric messages, and their payload length is fixed for each command type.
+func commandPayloadLengths() []int {
+	specs := e4crypto.SupportedCommands()
+
+	lengths := make([]int, 0, len(specs))
+	for _, spec := range specs {
+		lengths = append(lengths, 1+spec.ArgsLen)
+	}
+
+	return lengths
+}
+
+// Has returns true when k contains the given kind
+func (k Kind) Has(kind Kind) bool {
+	return k&kind == kind
+}
+
+// Ambiguous returns true when k holds more than one candidate kind
+func (k Kind) Ambiguous() bool {
+	return k&(k-1) != 0
+}
+
+// ClassifyProtected inspects the length and structure of a protected message to guess its kind,
+// without requiring any key. It returns the set of kinds the message is consistent with, allowing the caller
+// to try each of the matching unprotect paths (see Kind.Ambiguous).
+// Symmetric messages and commands share the same untagged framing and symmetric messages have no length
+// constraint, so KindSymMessage is always a candidate: KindCommand is added when the length matches one
+// of the supported commands, and KindPubKeyMessage when the message starts with the scheme tag of a signed
+// message and can hold a signer ID and a valid signature, or with the scheme tag of an unsigned message.
+// An error is only returned when the message is too short to be any kind of protected message.
+func ClassifyProtected(protected []byte) (Kind, error) {
+	protectedLen := len(protected)
+	if protectedLen < e4crypto.TimestampLen+e4crypto.TagLen {
+		return 0, e4crypto.ErrInvalidProtectedLen
+	}
+
+	kind := KindSymMessage
+
+	for _, payloadLen := range commandPayloadLengths() {
+		if protectedLen == e4crypto.TimestampLen+e4crypto.TagLen+payloadLen {
+			kind |= KindCommand
+			break
+		}
+	}
+
+	switch scheme := e4crypto.Scheme(protected[0]); scheme {
+	case e4crypto.SchemeAESCMACSIVSigned:
+		// ed25519 signatures are rejected when the 3 most significant bits of their last byte are set,
+		// so such messages can't be signed messages.
+		if protectedLen >= e4crypto.TaggedHeaderLen+e4crypto.GetIDLen()+e4crypto.TagLen+ed25519.SignatureSize &&
+			protected[protectedLen-1]&0xE0 == 0 {
+			kind |= KindPubKeyMessage
+		}
+	case e4crypto.SchemeAESCMACSIV, e4crypto.SchemeXChaCha20Poly1305:
+		if protectedLen >= e4crypto.TaggedHeaderLen+scheme.NonceSize()+e4crypto.TagLen {
+			kind |= KindPubKeyMessage
+		}
+	}
+
+	return kind, nil
+}
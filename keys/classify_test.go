@@ -0,0 +1,136 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+func TestClassifyProtected(t *testing.T) {
+	topicKey := e4crypto.RandomKey()
+
+	t.Run("symmetric messages are classified", func(t *testing.T) {
+		k, err := NewRandomSymKeyMaterial()
+		if err != nil {
+			t.Fatalf("Failed to create key: %v", err)
+		}
+
+		protected, err := k.ProtectMessage([]byte("some message"), topicKey)
+		if err != nil {
+			t.Fatalf("Failed to protect message: %v", err)
+		}
+
+		kind, err := ClassifyProtected(protected)
+		if err != nil {
+			t.Fatalf("Failed to classify protected message: %v", err)
+		}
+		if kind != KindSymMessage {
+			t.Fatalf("Invalid kind: got %v, wanted %v", kind, KindSymMessage)
+		}
+	})
+
+	t.Run("pubkey messages are classified", func(t *testing.T) {
+		k, err := NewRandomPubKeyMaterial(e4crypto.RandomID(), getTestC2PubKey(t))
+		if err != nil {
+			t.Fatalf("Failed to create key: %v", err)
+		}
+
+		protected, err := k.ProtectMessage([]byte("some message"), topicKey)
+		if err != nil {
+			t.Fatalf("Failed to protect message: %v", err)
+		}
+
+		kind, err := ClassifyProtected(protected)
+		if err != nil {
+			t.Fatalf("Failed to classify protected message: %v", err)
+		}
+		if !kind.Has(KindPubKeyMessage) {
+			t.Fatalf("Expected kind %v to contain %v", kind, KindPubKeyMessage)
+		}
+		if kind.Has(KindCommand) {
+			t.Fatalf("Expected kind %v to not contain %v", kind, KindCommand)
+		}
+	})
+
+	t.Run("unsigned pubkey messages are classified", func(t *testing.T) {
+		k, err := NewRandomPubKeyMaterial(e4crypto.RandomID(), getTestC2PubKey(t))
+		if err != nil {
+			t.Fatalf("Failed to create key: %v", err)
+		}
+		k.SetUnsignedMessages(true)
+
+		protected, err := k.ProtectMessage([]byte("some message"), topicKey)
+		if err != nil {
+			t.Fatalf("Failed to protect message: %v", err)
+		}
+
+		kind, err := ClassifyProtected(protected)
+		if err != nil {
+			t.Fatalf("Failed to classify protected message: %v", err)
+		}
+		// The scheme tag of unsigned messages may also be the first byte of a symmetric message timestamp
+		if g, w := kind, KindSymMessage|KindPubKeyMessage; g != w {
+			t.Fatalf("Invalid kind: got %v, wanted %v", g, w)
+		}
+	})
+
+	t.Run("commands are classified", func(t *testing.T) {
+		command := make([]byte, 1+ed25519.PublicKeySize+e4crypto.IDLen)
+		protected, err := e4crypto.ProtectSymKey(command, e4crypto.RandomKey())
+		if err != nil {
+			t.Fatalf("Failed to protect command: %v", err)
+		}
+
+		kind, err := ClassifyProtected(protected)
+		if err != nil {
+			t.Fatalf("Failed to classify protected command: %v", err)
+		}
+		if !kind.Has(KindCommand) {
+			t.Fatalf("Expected kind %v to contain %v", kind, KindCommand)
+		}
+		if kind.Has(KindPubKeyMessage) {
+			t.Fatalf("Expected kind %v to not contain %v", kind, KindPubKeyMessage)
+		}
+	})
+
+	t.Run("every supported command is classified", func(t *testing.T) {
+		for _, spec := range e4crypto.SupportedCommands() {
+			command := append([]byte{byte(spec.Type)}, make([]byte, spec.ArgsLen)...)
+			protected, err := e4crypto.ProtectSymKey(command, e4crypto.RandomKey())
+			if err != nil {
+				t.Fatalf("Failed to protect command %s: %v", spec.Name, err)
+			}
+
+			kind, err := ClassifyProtected(protected)
+			if err != nil {
+				t.Fatalf("Failed to classify protected command %s: %v", spec.Name, err)
+			}
+			if !kind.Has(KindCommand) || !kind.Ambiguous() {
+				t.Fatalf("Expected kind %v of command %s to contain %v", kind, spec.Name, KindCommand)
+			}
+		}
+	})
+
+	t.Run("too short messages return errors", func(t *testing.T) {
+		tooShort := make([]byte, e4crypto.TimestampLen+e4crypto.TagLen-1)
+		if _, err := ClassifyProtected(tooShort); err != e4crypto.ErrInvalidProtectedLen {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, e4crypto.ErrInvalidProtectedLen)
+		}
+	})
+}
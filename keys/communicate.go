@@ -0,0 +1,50 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+import "bytes"
+
+// canaryPayload is the payload protected by CanCommunicate
+var canaryPayload = []byte("e4 canary")
+
+// CanCommunicate returns true when a message protected on a topic by the sender
+// can be unprotected by the receiver, both using the given topic key.
+// When the sender is a public key material, its public key is temporarily added to a public
+// key receiver not holding it yet, as a C2 would do, and removed afterwards.
+// It is meant for integration diagnostics, checking the interoperability of two key materials.
+func CanCommunicate(sender, receiver KeyMaterial, topicKey TopicKey) bool {
+	protected, err := sender.ProtectMessage(canaryPayload, topicKey)
+	if err != nil {
+		return false
+	}
+
+	pubSender, senderOk := sender.(*pubKeyMaterial)
+	pubReceiver, receiverOk := receiver.(PubKeyStore)
+	if senderOk && receiverOk {
+		if _, err := pubReceiver.GetPubKey(pubSender.SignerID); err == ErrPubKeyNotFound {
+			if err := pubReceiver.AddPubKey(pubSender.SignerID, pubSender.PublicKey()); err != nil {
+				return false
+			}
+			defer pubReceiver.RemovePubKey(pubSender.SignerID)
+		}
+	}
+
+	unprotected, err := receiver.UnprotectMessage(protected, topicKey)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(unprotected, canaryPayload)
+}
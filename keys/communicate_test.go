@@ -0,0 +1,80 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+import (
+	"testing"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+func TestCanCommunicate(t *testing.T) {
+	c2PubKey := getTestC2PubKey(t)
+
+	newSymKey := func(t *testing.T) KeyMaterial {
+		k, err := NewRandomSymKeyMaterial()
+		if err != nil {
+			t.Fatalf("Failed to create symKeyMaterial: %v", err)
+		}
+		return k
+	}
+	newPubKey := func(t *testing.T, name string) PubKeyMaterial {
+		k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias(name), c2PubKey)
+		if err != nil {
+			t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+		}
+		return k
+	}
+
+	topicKey := e4crypto.RandomKey()
+
+	t.Run("matching materials can communicate", func(t *testing.T) {
+		if !CanCommunicate(newSymKey(t), newSymKey(t), topicKey) {
+			t.Fatal("Expected symmetric materials to communicate")
+		}
+
+		receiver := newPubKey(t, "receiver")
+		if !CanCommunicate(newPubKey(t, "sender"), receiver, topicKey) {
+			t.Fatal("Expected public key materials to communicate")
+		}
+		if g, w := len(receiver.GetPubKeys()), 0; g != w {
+			t.Fatalf("Invalid receiver pubkeys count: got %d, wanted %d", g, w)
+		}
+	})
+
+	t.Run("non matching materials can't communicate", func(t *testing.T) {
+		if CanCommunicate(newSymKey(t), newPubKey(t, "receiver"), topicKey) {
+			t.Fatal("Expected symmetric sender and public key receiver not to communicate")
+		}
+		if CanCommunicate(newPubKey(t, "sender"), newSymKey(t), topicKey) {
+			t.Fatal("Expected public key sender and symmetric receiver not to communicate")
+		}
+		if CanCommunicate(newSymKey(t), newSymKey(t), []byte("not a key")) {
+			t.Fatal("Expected materials not to communicate with an invalid topic key")
+		}
+	})
+
+	t.Run("receiver with another key for the sender can't communicate", func(t *testing.T) {
+		sender := newPubKey(t, "sender")
+		receiver := newPubKey(t, "receiver")
+		if err := receiver.AddPubKey(e4crypto.HashIDAlias("sender"), newPubKey(t, "other").PublicKey()); err != nil {
+			t.Fatalf("Failed to add pubKey: %v", err)
+		}
+
+		if CanCommunicate(sender, receiver, topicKey) {
+			t.Fatal("Expected materials not to communicate when the receiver holds another sender key")
+		}
+	})
+}
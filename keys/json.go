@@ -15,8 +15,16 @@
 package keys
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
 )
 
 type keyType int
@@ -29,12 +37,296 @@ const (
 	pubKeyMaterialType
 )
 
+// lastKeyType is the latest keyType known by this version of the library
+const lastKeyType = pubKeyMaterialType
+
+var (
+	// ErrUnsupportedKeyType occurs when unmarshalling a key material of an unknown type,
+	// such as a key written by a newer version of the library.
+	// The returned error wraps it, and can be unwrapped with errors.Is or errors.Unwrap.
+	ErrUnsupportedKeyType = errors.New("unsupported key type")
+)
+
+// unsupportedKeyTypeError describes an unknown key type, and wraps ErrUnsupportedKeyType
+type unsupportedKeyTypeError struct {
+	keyType keyType
+}
+
+// Error returns the error message, hinting at upgrading the library
+func (e unsupportedKeyTypeError) Error() string {
+	return fmt.Sprintf(
+		"%v: %d (latest known key type is %d), the key may have been written by a newer version of e4go, consider upgrading",
+		ErrUnsupportedKeyType, int(e.keyType), int(lastKeyType),
+	)
+}
+
+// Unwrap returns ErrUnsupportedKeyType
+func (e unsupportedKeyTypeError) Unwrap() error {
+	return ErrUnsupportedKeyType
+}
+
+// String returns the name of the keyType
+func (t keyType) String() string {
+	switch t {
+	case symKeyMaterialType:
+		return "symmetric"
+	case pubKeyMaterialType:
+		return "pubkey"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// hexEncoding is the jsonKey encoding of key materials marshalled with MarshalJSONHex
+const hexEncoding = "hex"
+
 // jsonKey defines a wrapper type to json encode a KeyMaterial.
 // It's needed to store the actual key type in the marshalled json
 // thus allowing to decode the key later to the proper type.
+// Encoding is empty for the default base64 encoded byte fields, or hexEncoding.
 type jsonKey struct {
-	KeyType keyType     `json:"keyType"`
-	KeyData interface{} `json:"keyData"`
+	KeyType  keyType     `json:"keyType"`
+	KeyData  interface{} `json:"keyData"`
+	Encoding string      `json:"encoding,omitempty"`
+}
+
+// hexBytes is a byte slice json encoded as a hex string, instead of the default base64
+type hexBytes []byte
+
+// MarshalJSON encodes the bytes as a hex string
+func (b hexBytes) MarshalJSON() ([]byte, error) {
+	if b == nil {
+		return []byte("null"), nil
+	}
+
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+// UnmarshalJSON decodes the bytes from a hex string
+func (b *hexBytes) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("invalid hex value: %v", err)
+	}
+	*b = decoded
+
+	return nil
+}
+
+// isBytesType returns true when t is a byte slice type, such as ed25519.PublicKey
+func isBytesType(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+}
+
+// jsonFieldName returns the name of the given struct field in its json encoding,
+// or false when the field isn't json encoded
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "", false
+	}
+
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name, true
+	}
+
+	return field.Name, true
+}
+
+// hexKeyData returns the json encoded fields of the given key material struct, indexed by their json name,
+// with their byte slices, byte slice maps and byte slice lists encoded as hexBytes.
+// As it is derived from the struct fields, all the persisted fields are part of the hex encoding.
+// Empty fields are kept, even when tagged with omitempty, so nil and empty maps are restored as they were.
+func hexKeyData(k interface{}) map[string]interface{} {
+	v := reflect.ValueOf(k).Elem()
+
+	data := make(map[string]interface{}, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		name, ok := jsonFieldName(v.Type().Field(i))
+		if !ok {
+			continue
+		}
+
+		data[name] = hexValue(v.Field(i))
+	}
+
+	return data
+}
+
+// hexValue returns the given value, converted to hexBytes when it holds byte slices
+func hexValue(v reflect.Value) interface{} {
+	t := v.Type()
+	switch {
+	case isBytesType(t):
+		if v.IsNil() {
+			return hexBytes(nil)
+		}
+
+		return hexBytes(v.Bytes())
+	case t.Kind() == reflect.Map && t.Key().Kind() == reflect.String && isBytesType(t.Elem()):
+		if v.IsNil() {
+			return map[string]hexBytes(nil)
+		}
+
+		m := make(map[string]hexBytes, v.Len())
+		for _, key := range v.MapKeys() {
+			m[key.String()] = hexBytes(v.MapIndex(key).Bytes())
+		}
+
+		return m
+	case t.Kind() == reflect.Slice && isBytesType(t.Elem()):
+		if v.IsNil() {
+			return []hexBytes(nil)
+		}
+
+		s := make([]hexBytes, v.Len())
+		for i := range s {
+			s[i] = hexBytes(v.Index(i).Bytes())
+		}
+
+		return s
+	default:
+		return v.Interface()
+	}
+}
+
+// unmarshalHexFields decodes the json encoded fields produced by hexKeyData into the given key material struct.
+// Like encoding/json, field names are matched case insensitively, and missing fields are left untouched.
+func unmarshalHexFields(data json.RawMessage, k interface{}) error {
+	rawFields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &rawFields); err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(k).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, ok := jsonFieldName(v.Type().Field(i))
+		if !ok {
+			continue
+		}
+
+		rawField, ok := rawFields[name]
+		if !ok {
+			for rawName, raw := range rawFields {
+				if strings.EqualFold(rawName, name) {
+					rawField, ok = raw, true
+					break
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		if err := unmarshalHexValue(rawField, v.Field(i)); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// unmarshalHexValue decodes the given json value into v, from hexBytes when v holds byte slices
+func unmarshalHexValue(data json.RawMessage, v reflect.Value) error {
+	t := v.Type()
+	switch {
+	case isBytesType(t):
+		var b hexBytes
+		if err := json.Unmarshal(data, &b); err != nil {
+			return err
+		}
+
+		if b != nil {
+			v.Set(reflect.ValueOf([]byte(b)).Convert(t))
+		}
+	case t.Kind() == reflect.Map && t.Key().Kind() == reflect.String && isBytesType(t.Elem()):
+		var m map[string]hexBytes
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+
+		if m != nil {
+			mv := reflect.MakeMapWithSize(t, len(m))
+			for key, b := range m {
+				mv.SetMapIndex(reflect.ValueOf(key).Convert(t.Key()), reflect.ValueOf([]byte(b)).Convert(t.Elem()))
+			}
+			v.Set(mv)
+		}
+	case t.Kind() == reflect.Slice && isBytesType(t.Elem()):
+		var s []hexBytes
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+
+		if s != nil {
+			sv := reflect.MakeSlice(t, len(s), len(s))
+			for i, b := range s {
+				sv.Index(i).Set(reflect.ValueOf([]byte(b)).Convert(t.Elem()))
+			}
+			v.Set(sv)
+		}
+	default:
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+
+	return nil
+}
+
+// MarshalJSONHex marshals the key material into json like its MarshalJSON method,
+// but encodes the keys and IDs as hex strings instead of base64, which is easier to read and
+// to handle for some parsers. FromRawJSON accepts both encodings.
+func MarshalJSONHex(k KeyMaterial) ([]byte, error) {
+	switch typedKey := k.(type) {
+	case *symKeyMaterial:
+		return json.Marshal(&jsonKey{
+			KeyType:  symKeyMaterialType,
+			KeyData:  hexKeyData(typedKey),
+			Encoding: hexEncoding,
+		})
+	case *pubKeyMaterial:
+		typedKey.mutex.RLock()
+		defer typedKey.mutex.RUnlock()
+
+		return json.Marshal(&jsonKey{
+			KeyType:  pubKeyMaterialType,
+			KeyData:  hexKeyData(typedKey),
+			Encoding: hexEncoding,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported key material type: %T", k)
+	}
+}
+
+// unmarshalHexKeyData decodes the hex encoded keyData of the given type into a KeyMaterial
+func unmarshalHexKeyData(t keyType, data json.RawMessage) (KeyMaterial, error) {
+	var clientKey KeyMaterial
+	switch t {
+	case symKeyMaterialType:
+		clientKey = &symKeyMaterial{}
+	case pubKeyMaterialType:
+		clientKey = &pubKeyMaterial{}
+	default:
+		return nil, unsupportedKeyTypeError{keyType: t}
+	}
+
+	if err := unmarshalHexFields(data, clientKey); err != nil {
+		return nil, err
+	}
+
+	return clientKey, nil
 }
 
 // FromRawJSON allows to unmarshal a json encoded jsonKey from a json RawMessage
@@ -58,19 +350,94 @@ func FromRawJSON(raw json.RawMessage) (KeyMaterial, error) {
 		return nil, err
 	}
 
+	var encoding string
+	if rawEncoding, ok := m["encoding"]; ok {
+		if err := json.Unmarshal(rawEncoding, &encoding); err != nil {
+			return nil, err
+		}
+	}
+
 	var clientKey KeyMaterial
-	switch t {
-	case symKeyMaterialType:
-		clientKey = &symKeyMaterial{}
-	case pubKeyMaterialType:
-		clientKey = &pubKeyMaterial{}
+	switch encoding {
+	case "":
+		switch t {
+		case symKeyMaterialType:
+			clientKey = &symKeyMaterial{}
+		case pubKeyMaterialType:
+			clientKey = &pubKeyMaterial{}
+		default:
+			return nil, unsupportedKeyTypeError{keyType: t}
+		}
+
+		if err := json.Unmarshal(m["keyData"], clientKey); err != nil {
+			return nil, err
+		}
+	case hexEncoding:
+		clientKey, err = unmarshalHexKeyData(t, m["keyData"])
+		if err != nil {
+			return nil, err
+		}
 	default:
-		return nil, fmt.Errorf("unsupported json key type: %v", t)
+		return nil, fmt.Errorf("unsupported json key encoding: %s", encoding)
 	}
 
-	if err := json.Unmarshal(m["keyData"], clientKey); err != nil {
-		return nil, err
+	// Catch corrupted files on load, rather than on the key first use
+	if err := ValidateKeyMaterial(clientKey); err != nil {
+		return nil, ErrCorruptKeyFile
 	}
 
 	return clientKey, nil
 }
+
+// ReadKeyMaterial reads a json encoded key material from the given reader, until EOF,
+// and decodes it with FromRawJSON. It allows to load a key from any stream, such as a secret held in memory.
+func ReadKeyMaterial(r io.Reader) (KeyMaterial, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key material: %v", err)
+	}
+
+	return FromRawJSON(raw)
+}
+
+// WriteKeyMaterial writes the json encoding of the given key material to the given writer,
+// which can be read back with ReadKeyMaterial.
+func WriteKeyMaterial(w io.Writer, k KeyMaterial) error {
+	raw, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(raw); err != nil {
+		return fmt.Errorf("failed to write key material: %v", err)
+	}
+
+	return nil
+}
+
+// ValidateKeyMaterial validates the keys held by a key material: its symmetric or private key,
+// unless it is verifier only, and its C2 public keys. The public keys of a PubKeyStore are
+// checked by its Validate method.
+func ValidateKeyMaterial(k KeyMaterial) error {
+	switch typedKey := k.(type) {
+	case *symKeyMaterial:
+		return e4crypto.ValidateSymKey(typedKey.Key)
+	case *pubKeyMaterial:
+		// Verifier only materials have no private key
+		if len(typedKey.PrivateKey) > 0 {
+			if err := e4crypto.ValidateEd25519PrivKey(typedKey.PrivateKey); err != nil {
+				return err
+			}
+		}
+
+		for _, c2PubKey := range typedKey.trustedC2PubKeys() {
+			if err := e4crypto.ValidateCurve25519PubKey(c2PubKey); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return nil
+	}
+}
@@ -17,16 +17,26 @@ package keys
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+
+	"golang.org/x/crypto/ed25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
 )
 
 func TestFromRawJSON(t *testing.T) {
 	t.Run("FromRawJSON properly decode json ed25519 keys", func(t *testing.T) {
-		privateKey := []byte("privateKey")
+		_, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
 		signerID := []byte("signerID")
-		c2PubKey := []byte{}
+		c2PubKey := getTestC2PubKey(t)
 		c2PubKeyStr, err := json.Marshal(c2PubKey)
 		if err != nil {
 			t.Fatalf("Failed to encode c2PubKey to string: %v", err)
@@ -91,7 +101,7 @@ func TestFromRawJSON(t *testing.T) {
 	})
 
 	t.Run("FromRawJSON properly decode json symmetric keys", func(t *testing.T) {
-		privateKey := []byte("privateKey")
+		privateKey := e4crypto.RandomKey()
 
 		jsonKey := []byte(fmt.Sprintf(`{
 				"keyType": %d,
@@ -137,3 +147,268 @@ func TestFromRawJSON(t *testing.T) {
 		}
 	})
 }
+
+func TestFromRawJSONCorruptKeys(t *testing.T) {
+	newPubKeyMaterial := func(t *testing.T) *pubKeyMaterial {
+		k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+		if err != nil {
+			t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+		}
+
+		return k.(*pubKeyMaterial)
+	}
+
+	newSymKeyMaterial := func(t *testing.T) *symKeyMaterial {
+		k, err := NewRandomSymKeyMaterial()
+		if err != nil {
+			t.Fatalf("Failed to create symKeyMaterial: %v", err)
+		}
+
+		return k.(*symKeyMaterial)
+	}
+
+	corruptKeys := map[string]func(t *testing.T) KeyMaterial{
+		"truncated c2 public key": func(t *testing.T) KeyMaterial {
+			k := newPubKeyMaterial(t)
+			k.C2PubKey = k.C2PubKey[:e4crypto.Curve25519PubKeyLen-1]
+			return k
+		},
+		"zeroed ed25519 private key": func(t *testing.T) KeyMaterial {
+			k := newPubKeyMaterial(t)
+			k.PrivateKey = make([]byte, ed25519.PrivateKeySize)
+			return k
+		},
+		"wrong length ed25519 private key": func(t *testing.T) KeyMaterial {
+			k := newPubKeyMaterial(t)
+			k.PrivateKey = k.PrivateKey[:ed25519.PrivateKeySize-1]
+			return k
+		},
+		"zeroed symmetric key": func(t *testing.T) KeyMaterial {
+			k := newSymKeyMaterial(t)
+			k.Key = make([]byte, e4crypto.KeyLen)
+			return k
+		},
+		"wrong length symmetric key": func(t *testing.T) KeyMaterial {
+			k := newSymKeyMaterial(t)
+			k.Key = k.Key[:e4crypto.KeyLen-1]
+			return k
+		},
+	}
+
+	for name, corruptKey := range corruptKeys {
+		t.Run(name, func(t *testing.T) {
+			jsonKey, err := json.Marshal(corruptKey(t))
+			if err != nil {
+				t.Fatalf("Failed to marshal key to json: %v", err)
+			}
+
+			if _, err := FromRawJSON(jsonKey); err != ErrCorruptKeyFile {
+				t.Fatalf("Invalid error: got %v, wanted %v", err, ErrCorruptKeyFile)
+			}
+		})
+	}
+}
+
+func TestMarshalJSONHex(t *testing.T) {
+	symKey, err := NewRandomSymKeyMaterial()
+	if err != nil {
+		t.Fatalf("Failed to create symKeyMaterial: %v", err)
+	}
+
+	pubKey, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+	signerPubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	if err := pubKey.AddPubKey(e4crypto.HashIDAlias("signer"), signerPubKey); err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+	pubKey.(*pubKeyMaterial).SetAppendOnlyPubKeys(true)
+
+	testData := map[string]struct {
+		key           KeyMaterial
+		expectedBytes []byte
+	}{
+		"symmetric": {key: symKey, expectedBytes: symKey.(*symKeyMaterial).Key},
+		"pubkey":    {key: pubKey, expectedBytes: pubKey.(*pubKeyMaterial).PrivateKey},
+	}
+
+	for name, data := range testData {
+		t.Run(name, func(t *testing.T) {
+			hexJSON, err := MarshalJSONHex(data.key)
+			if err != nil {
+				t.Fatalf("Failed to marshal key to hex json: %v", err)
+			}
+
+			if !bytes.Contains(hexJSON, []byte(hex.EncodeToString(data.expectedBytes))) {
+				t.Fatalf("Expected hex json to contain the hex encoded key, got %s", hexJSON)
+			}
+			if bytes.Contains(hexJSON, []byte(base64.StdEncoding.EncodeToString(data.expectedBytes))) {
+				t.Fatalf("Expected hex json to not contain the base64 encoded key, got %s", hexJSON)
+			}
+
+			k, err := FromRawJSON(hexJSON)
+			if err != nil {
+				t.Fatalf("Failed to unmarshal hex json key: %v", err)
+			}
+
+			// Compare the default json encoding of both keys, holding all their persisted fields
+			expectedJSON, err := json.Marshal(data.key)
+			if err != nil {
+				t.Fatalf("Failed to marshal key to json: %v", err)
+			}
+			gotJSON, err := json.Marshal(k)
+			if err != nil {
+				t.Fatalf("Failed to marshal key to json: %v", err)
+			}
+
+			if !bytes.Equal(gotJSON, expectedJSON) {
+				t.Fatalf("Invalid unmarshalled key: got %s, wanted %s", gotJSON, expectedJSON)
+			}
+		})
+	}
+
+	t.Run("empty fields round trip", func(t *testing.T) {
+		k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("empty"), getTestC2PubKey(t))
+		if err != nil {
+			t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+		}
+
+		hexJSON, err := MarshalJSONHex(k)
+		if err != nil {
+			t.Fatalf("Failed to marshal key to hex json: %v", err)
+		}
+		loaded, err := FromRawJSON(hexJSON)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal hex json key: %v", err)
+		}
+
+		typedKey := k.(*pubKeyMaterial)
+		typedLoaded := loaded.(*pubKeyMaterial)
+		if !reflect.DeepEqual(typedLoaded.PubKeys, typedKey.PubKeys) {
+			t.Fatalf("Invalid pubKeys: got %#v, wanted %#v", typedLoaded.PubKeys, typedKey.PubKeys)
+		}
+		if !reflect.DeepEqual(typedLoaded.FailoverC2PubKeys, typedKey.FailoverC2PubKeys) {
+			t.Fatalf("Invalid failover C2 pubKeys: got %#v, wanted %#v", typedLoaded.FailoverC2PubKeys, typedKey.FailoverC2PubKeys)
+		}
+
+		signerPubKey, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+		if err := loaded.(PubKeyMaterial).AddPubKey(e4crypto.HashIDAlias("signer"), signerPubKey); err != nil {
+			t.Fatalf("Failed to add pubKey: %v", err)
+		}
+	})
+
+	t.Run("default encoding reads legacy base64 files", func(t *testing.T) {
+		base64JSON, err := json.Marshal(symKey)
+		if err != nil {
+			t.Fatalf("Failed to marshal key to json: %v", err)
+		}
+
+		if bytes.Contains(base64JSON, []byte(`"encoding"`)) {
+			t.Fatalf("Expected default json to not hold an encoding, got %s", base64JSON)
+		}
+
+		k, err := FromRawJSON(base64JSON)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal json key: %v", err)
+		}
+
+		typedKey, ok := k.(*symKeyMaterial)
+		if !ok {
+			t.Fatalf("Wrong key type: got %T, wanted symKeyMaterial", k)
+		}
+		if !bytes.Equal(typedKey.Key, symKey.(*symKeyMaterial).Key) {
+			t.Fatalf("Invalid key: got %v, wanted %v", typedKey.Key, symKey.(*symKeyMaterial).Key)
+		}
+	})
+
+	t.Run("unknown encodings are rejected", func(t *testing.T) {
+		jsonKey := []byte(fmt.Sprintf(`{"keyType": %d, "keyData": {}, "encoding": "base32"}`, symKeyMaterialType))
+		if _, err := FromRawJSON(jsonKey); err == nil {
+			t.Fatal("Expected an error when unmarshalling an unknown encoding")
+		}
+	})
+}
+
+func TestReadWriteKeyMaterial(t *testing.T) {
+	symKey, err := NewRandomSymKeyMaterial()
+	if err != nil {
+		t.Fatalf("Failed to create symKeyMaterial: %v", err)
+	}
+	pubKey, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	for name, key := range map[string]KeyMaterial{"symmetric": symKey, "pubkey": pubKey} {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := WriteKeyMaterial(buf, key); err != nil {
+				t.Fatalf("Failed to write key material: %v", err)
+			}
+
+			k, err := ReadKeyMaterial(buf)
+			if err != nil {
+				t.Fatalf("Failed to read key material: %v", err)
+			}
+
+			expectedJSON, err := json.Marshal(key)
+			if err != nil {
+				t.Fatalf("Failed to marshal key to json: %v", err)
+			}
+			gotJSON, err := json.Marshal(k)
+			if err != nil {
+				t.Fatalf("Failed to marshal key to json: %v", err)
+			}
+			if !bytes.Equal(gotJSON, expectedJSON) {
+				t.Fatalf("Invalid read key: got %s, wanted %s", gotJSON, expectedJSON)
+			}
+		})
+	}
+
+	if _, err := ReadKeyMaterial(strings.NewReader("{}")); err == nil {
+		t.Fatal("Expected an error when reading an invalid key material")
+	}
+}
+
+func TestFromRawJSONUnsupportedKeyType(t *testing.T) {
+	for _, encoding := range []string{"", hexEncoding} {
+		jsonKey := []byte(fmt.Sprintf(`{"keyType": 99, "keyData": {}, "encoding": "%s"}`, encoding))
+
+		_, err := FromRawJSON(jsonKey)
+		if err == nil {
+			t.Fatal("Expected an error when unmarshalling an unsupported key type")
+		}
+
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok || wrapper.Unwrap() != ErrUnsupportedKeyType {
+			t.Fatalf("Invalid error: got %v, wanted it to wrap %v", err, ErrUnsupportedKeyType)
+		}
+
+		for _, expectedHint := range []string{"99", fmt.Sprintf("latest known key type is %d", lastKeyType), "upgrading"} {
+			if !strings.Contains(err.Error(), expectedHint) {
+				t.Fatalf("Expected error %q to contain %q", err.Error(), expectedHint)
+			}
+		}
+	}
+}
+
+func TestKeyTypeString(t *testing.T) {
+	expectedNames := map[keyType]string{
+		symKeyMaterialType: "symmetric",
+		pubKeyMaterialType: "pubkey",
+		keyType(42):        "unknown(42)",
+	}
+
+	for kt, expectedName := range expectedNames {
+		if g, w := kt.String(), expectedName; g != w {
+			t.Fatalf("Invalid key type name: got %s, wanted %s", g, w)
+		}
+	}
+}
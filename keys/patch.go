@@ -0,0 +1,141 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+// ErrUnsupportedPatch occurs when patching a key material with changes it doesn't support,
+// such as public keys on a symmetric key material
+var ErrUnsupportedPatch = errors.New("unsupported patch for this key material")
+
+// KeyPatch describes changes to apply to a serialized key material with PatchStoredJSON.
+// Removals are applied before additions.
+type KeyPatch struct {
+	// AddPubKeys holds the ed25519 public keys to add, indexed by hex encoded ID.
+	// Existing keys with the same ID are replaced.
+	AddPubKeys map[string][]byte
+	// RemovePubKeys holds the hex encoded IDs of the public keys to remove
+	RemovePubKeys []string
+	// SetC2PubKey replaces the primary C2 public key when not empty
+	SetC2PubKey e4crypto.Curve25519PublicKey
+}
+
+// isEmpty returns true when the patch doesn't hold any change
+func (p KeyPatch) isEmpty() bool {
+	return len(p.AddPubKeys) == 0 && len(p.RemovePubKeys) == 0 && len(p.SetC2PubKey) == 0
+}
+
+// PatchStoredJSON applies the given patch to a key material serialized with MarshalJSON or MarshalJSONHex,
+// and returns it serialized again with the same encoding, without having to handle the key material.
+// The patched material is validated, and nothing is returned when any of the changes fail.
+func PatchStoredJSON(raw json.RawMessage, patch KeyPatch) (json.RawMessage, error) {
+	k, err := FromRawJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if !patch.isEmpty() {
+		pk, ok := k.(*pubKeyMaterial)
+		if !ok {
+			return nil, ErrUnsupportedPatch
+		}
+
+		if err := pk.applyPatch(patch); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ValidateKeyMaterial(k); err != nil {
+		return nil, fmt.Errorf("invalid patched key material: %v", err)
+	}
+
+	var encoding struct {
+		Encoding string `json:"encoding"`
+	}
+	if err := json.Unmarshal(raw, &encoding); err != nil {
+		return nil, err
+	}
+
+	if encoding.Encoding == hexEncoding {
+		return MarshalJSONHex(k)
+	}
+
+	return k.MarshalJSON()
+}
+
+// applyPatch applies the patch changes on the material
+func (k *pubKeyMaterial) applyPatch(patch KeyPatch) error {
+	for _, sid := range patch.RemovePubKeys {
+		id, err := hex.DecodeString(sid)
+		if err != nil {
+			return fmt.Errorf("invalid id %s: %v", sid, err)
+		}
+
+		if err := k.RemovePubKey(id); err != nil {
+			return fmt.Errorf("failed to remove public key %s: %v", sid, err)
+		}
+	}
+
+	for sid, pubKey := range patch.AddPubKeys {
+		id, err := hex.DecodeString(sid)
+		if err != nil {
+			return fmt.Errorf("invalid id %s: %v", sid, err)
+		}
+
+		if err := k.AddEd25519PubKey(id, pubKey); err != nil {
+			return fmt.Errorf("failed to add public key %s: %v", sid, err)
+		}
+	}
+
+	if len(patch.SetC2PubKey) > 0 {
+		if err := k.setPrimaryC2PubKey(patch.SetC2PubKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setPrimaryC2PubKey replaces the primary C2 public key, and removes it from the failover keys
+func (k *pubKeyMaterial) setPrimaryC2PubKey(c2PubKey e4crypto.Curve25519PublicKey) error {
+	if err := e4crypto.ValidateCurve25519PubKey(c2PubKey); err != nil {
+		return fmt.Errorf("invalid c2 public key: %v", err)
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	var failoverC2PubKeys []e4crypto.Curve25519PublicKey
+	for _, failoverKey := range k.FailoverC2PubKeys {
+		if subtle.ConstantTimeCompare(failoverKey, c2PubKey) != 1 {
+			failoverC2PubKeys = append(failoverC2PubKeys, failoverKey)
+		}
+	}
+	k.FailoverC2PubKeys = failoverC2PubKeys
+
+	newKey := make(e4crypto.Curve25519PublicKey, len(c2PubKey))
+	copy(newKey, c2PubKey)
+	k.C2PubKey = newKey
+
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+func TestPatchStoredJSON(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	oldID := e4crypto.HashIDAlias("old")
+	if err := k.AddPubKey(oldID, getTestC2PubKey(t)); err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+
+	raw, err := k.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	newID := e4crypto.HashIDAlias("new")
+	newPubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	t.Run("adding a pubkey is equivalent to load-modify-save", func(t *testing.T) {
+		patched, err := PatchStoredJSON(raw, KeyPatch{
+			AddPubKeys: map[string][]byte{hex.EncodeToString(newID): newPubKey},
+		})
+		if err != nil {
+			t.Fatalf("Failed to patch key: %v", err)
+		}
+
+		loaded, err := FromRawJSON(raw)
+		if err != nil {
+			t.Fatalf("Failed to load key: %v", err)
+		}
+		if err := loaded.(PubKeyMaterial).AddPubKey(newID, newPubKey); err != nil {
+			t.Fatalf("Failed to add pubKey: %v", err)
+		}
+		saved, err := loaded.MarshalJSON()
+		if err != nil {
+			t.Fatalf("Failed to marshal key: %v", err)
+		}
+
+		patchedKey, err := FromRawJSON(patched)
+		if err != nil {
+			t.Fatalf("Failed to load patched key: %v", err)
+		}
+		savedKey, err := FromRawJSON(saved)
+		if err != nil {
+			t.Fatalf("Failed to load saved key: %v", err)
+		}
+
+		// Ignore the pubkeys metadata, holding the time they have been added at
+		patchedKey.(*pubKeyMaterial).PubKeysMetadata = nil
+		savedKey.(*pubKeyMaterial).PubKeysMetadata = nil
+		if !reflect.DeepEqual(patchedKey, savedKey) {
+			t.Fatalf("Invalid patched key: got %#v, wanted %#v", patchedKey, savedKey)
+		}
+
+		pubKey, err := patchedKey.(PubKeyMaterial).GetPubKey(newID)
+		if err != nil {
+			t.Fatalf("Failed to get pubKey: %v", err)
+		}
+		if !bytes.Equal(pubKey, newPubKey) {
+			t.Fatalf("Invalid pubKey: got %v, wanted %v", pubKey, newPubKey)
+		}
+	})
+
+	t.Run("removing a pubkey and setting the C2 key", func(t *testing.T) {
+		c2PubKey := getTestC2PubKey(t)
+		patched, err := PatchStoredJSON(raw, KeyPatch{
+			RemovePubKeys: []string{hex.EncodeToString(oldID)},
+			SetC2PubKey:   c2PubKey,
+		})
+		if err != nil {
+			t.Fatalf("Failed to patch key: %v", err)
+		}
+
+		patchedKey, err := FromRawJSON(patched)
+		if err != nil {
+			t.Fatalf("Failed to load patched key: %v", err)
+		}
+		if _, err := patchedKey.(PubKeyMaterial).GetPubKey(oldID); err != ErrPubKeyNotFound {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPubKeyNotFound)
+		}
+		if !patchedKey.(PubKeyMaterial).C2KeyMatches(c2PubKey) {
+			t.Fatal("Expected the C2 public key to be replaced")
+		}
+		if g, w := len(patchedKey.(PubKeyMaterial).C2PubKeys()), 1; g != w {
+			t.Fatalf("Invalid C2 public keys count: got %d, wanted %d", g, w)
+		}
+	})
+
+	t.Run("the hex encoding is kept", func(t *testing.T) {
+		hexRaw, err := MarshalJSONHex(k)
+		if err != nil {
+			t.Fatalf("Failed to marshal key: %v", err)
+		}
+
+		patched, err := PatchStoredJSON(hexRaw, KeyPatch{
+			AddPubKeys: map[string][]byte{hex.EncodeToString(newID): newPubKey},
+		})
+		if err != nil {
+			t.Fatalf("Failed to patch key: %v", err)
+		}
+		if !bytes.Contains(patched, []byte(hex.EncodeToString(newPubKey))) {
+			t.Fatalf("Expected the patched key to be hex encoded, got %s", patched)
+		}
+	})
+
+	t.Run("invalid patches fail", func(t *testing.T) {
+		invalidPatches := []KeyPatch{
+			{AddPubKeys: map[string][]byte{hex.EncodeToString(newID): []byte("not a key")}},
+			{AddPubKeys: map[string][]byte{"not hex": newPubKey}},
+			{RemovePubKeys: []string{hex.EncodeToString(newID)}},
+			{SetC2PubKey: []byte("not a key")},
+		}
+
+		for _, patch := range invalidPatches {
+			if _, err := PatchStoredJSON(raw, patch); err == nil {
+				t.Fatalf("Expected an error when applying patch %#v", patch)
+			}
+		}
+	})
+
+	t.Run("symmetric keys only accept empty patches", func(t *testing.T) {
+		symKey, err := NewRandomSymKeyMaterial()
+		if err != nil {
+			t.Fatalf("Failed to create symKeyMaterial: %v", err)
+		}
+		symRaw, err := symKey.MarshalJSON()
+		if err != nil {
+			t.Fatalf("Failed to marshal key: %v", err)
+		}
+
+		if _, err := PatchStoredJSON(symRaw, KeyPatch{}); err != nil {
+			t.Fatalf("Failed to apply empty patch: %v", err)
+		}
+		if _, err := PatchStoredJSON(symRaw, KeyPatch{SetC2PubKey: getTestC2PubKey(t)}); err != ErrUnsupportedPatch {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedPatch)
+		}
+	})
+}
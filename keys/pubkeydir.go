@@ -0,0 +1,113 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+// ed25519PKIXPrefix is the DER prefix of a PKIX encoded ed25519 public key,
+// followed by the ed25519.PublicKeySize bytes of the key
+var ed25519PKIXPrefix = []byte{0x30, 0x2a, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x03, 0x21, 0x00}
+
+// LoadPubKeysFromDir adds to the given store the public key of each file found in dir.
+// Each file must hold either a raw ed25519 public key, or a PEM encoded "PUBLIC KEY" block
+// holding a PKIX encoded ed25519 public key. Keys are identified by the ID derived from the file name,
+// without its extension (see crypto.HashIDAlias), as C2 does when setting a public key from a name.
+// Files failing to load don't abort the loading of the others. It returns the count of loaded keys,
+// and an error describing every file which failed to load.
+func LoadPubKeysFromDir(store PubKeyStore, dir string) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read directory %s: %v", dir, err)
+	}
+
+	var loaded int
+	var failures []string
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		if err := loadPubKeyFile(store, filepath.Join(dir, file.Name())); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", file.Name(), err))
+			continue
+		}
+
+		loaded++
+	}
+
+	if len(failures) > 0 {
+		return loaded, fmt.Errorf("failed to load %d public key files: %s", len(failures), strings.Join(failures, "; "))
+	}
+
+	return loaded, nil
+}
+
+// loadPubKeyFile reads the public key from given file and adds it to the store
+func loadPubKeyFile(store PubKeyStore, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	pubKey, err := parsePubKey(content)
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if err := e4crypto.ValidateName(name); err != nil {
+		return err
+	}
+
+	return store.AddPubKey(e4crypto.HashIDAlias(name), pubKey)
+}
+
+// parsePubKey decodes an ed25519 public key, either raw or PEM encoded
+func parsePubKey(content []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		if err := e4crypto.ValidateEd25519PubKey(content); err != nil {
+			return nil, err
+		}
+
+		return ed25519.PublicKey(content), nil
+	}
+
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+
+	if len(block.Bytes) != len(ed25519PKIXPrefix)+ed25519.PublicKeySize || !bytes.HasPrefix(block.Bytes, ed25519PKIXPrefix) {
+		return nil, fmt.Errorf("PEM block is not an ed25519 public key")
+	}
+
+	pubKey := block.Bytes[len(ed25519PKIXPrefix):]
+	if err := e4crypto.ValidateEd25519PubKey(pubKey); err != nil {
+		return nil, err
+	}
+
+	return ed25519.PublicKey(pubKey), nil
+}
@@ -15,10 +15,13 @@
 package keys
 
 import (
-	"encoding/binary"
+	"bytes"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -33,6 +36,86 @@ type PubKeyMaterial interface {
 	KeyMaterial
 	PubKeyStore
 	PublicKey() ed25519.PublicKey
+	// C2KeyMatches returns true when the given curve25519 public key is one of the C2 keys used
+	// to unprotect commands. The comparison is done in constant time.
+	C2KeyMatches(c2PubKey e4crypto.Curve25519PublicKey) bool
+	// C2PubKeys returns the trusted C2 public keys, the primary one first,
+	// followed by the failover ones in the order they have been added.
+	C2PubKeys() []e4crypto.Curve25519PublicKey
+	// AddC2PubKey adds a failover C2 public key, allowing to unprotect commands
+	// from several C2 instances. At most MaxC2PubKeys keys can be trusted.
+	AddC2PubKey(c2PubKey e4crypto.Curve25519PublicKey) error
+	// RemoveC2PubKey removes a trusted C2 public key, revoking the commands protected with it.
+	// When removing the primary key, the first failover key becomes the primary one.
+	// The last C2 public key can't be removed.
+	RemoveC2PubKey(c2PubKey e4crypto.Curve25519PublicKey) error
+	// SetStrictIDs enables or disables the validation of ids given to AddPubKey.
+	// When enabled, ids must be valid signer ids (see crypto.ValidateID), as a public key stored under
+	// any other id would never match the signer id of an incoming message.
+	SetStrictIDs(strict bool)
+	// SetAppendOnlyPubKeys enables or disables the append only mode of the public keys. When enabled,
+	// adding a public key for an ID already holding a different one fails with ErrPubKeyExists,
+	// so replacing a trusted key requires removing it explicitly first, leaving an audit trail.
+	SetAppendOnlyPubKeys(enabled bool)
+	// SetUnsignedMessages enables or disables unsigned messages. When enabled, ProtectMessage
+	// omits the ed25519 signature and signer ID, relying on the topic key for integrity, and
+	// UnprotectMessage accepts unsigned messages, told apart from signed ones by their scheme tag.
+	// Otherwise, unsigned messages are rejected with ErrUnsignedMessage. Commands are not affected.
+	SetUnsignedMessages(enabled bool)
+	// DropPrivateKey zeroes and removes the private key, turning the material into a verifier only one.
+	// It can still unprotect messages from the trusted public keys, but protecting messages
+	// and unprotecting commands then fail with ErrNoPrivateKey.
+	DropPrivateKey()
+	// SignData returns the ed25519 signature of the given data with the material private key,
+	// or ErrNoPrivateKey for verifier only materials.
+	SignData(data []byte) ([]byte, error)
+	// SignMessage returns the detached signature ProtectMessage appends to a message, given the timestamp
+	// followed by the encrypted payload, or ErrNoPrivateKey for verifier only materials.
+	SignMessage(message []byte) ([]byte, error)
+	// CommandKey returns the symmetric key protecting the commands from the primary C2,
+	// derived from the material private key and the C2 public key.
+	// It is sensitive, as it allows to decrypt and forge commands, and must not be persisted or logged.
+	CommandKey() ([]byte, error)
+	// DirectKey returns the symmetric key shared with the owner of the given curve25519 public key,
+	// derived from a key exchange with the material private key, protecting the messages sent directly
+	// to or received directly from this peer. It is sensitive, and must not be persisted or logged.
+	DirectKey(peerPubKey e4crypto.Curve25519PublicKey) ([]byte, error)
+}
+
+// directKeyPrefix prefixes the shared secret the direct message keys are derived from,
+// so they differ from the command key derived from the same key exchange with a C2
+const directKeyPrefix = "e4 direct key"
+
+// MaxC2PubKeys is the maximum number of trusted C2 public keys, including the primary one.
+// Each additional key costs an extra key exchange when unprotecting commands not from the primary C2.
+const MaxC2PubKeys = 4
+
+var (
+	// ErrC2PubKeyNotFound occurs when removing a C2 public key which isn't trusted
+	ErrC2PubKeyNotFound = errors.New("c2 public key not found")
+	// ErrLastC2PubKey occurs when removing the last trusted C2 public key
+	ErrLastC2PubKey = errors.New("cannot remove the last c2 public key")
+	// ErrTooManyC2PubKeys occurs when adding more than MaxC2PubKeys C2 public keys
+	ErrTooManyC2PubKeys = errors.New("too many c2 public keys")
+)
+
+// MessageSignerID returns the signer ID of a message protected by a public key material,
+// or nil when the message is unsigned or too short to hold one. The ID is only trustworthy
+// once the message has been successfully unprotected, which verifies its signature.
+func MessageSignerID(protected []byte) []byte {
+	idLen := e4crypto.GetIDLen()
+	if len(protected) < e4crypto.TaggedHeaderLen+idLen+e4crypto.TagLen+ed25519.SignatureSize {
+		return nil
+	}
+
+	if e4crypto.Scheme(protected[0]) != e4crypto.SchemeAESCMACSIVSigned {
+		return nil
+	}
+
+	signerID := make([]byte, idLen)
+	copy(signerID, protected[e4crypto.TaggedHeaderLen:])
+
+	return signerID
 }
 
 // pubKeyMaterial implements PubKeyMaterial to work with public e4 client key
@@ -42,14 +125,37 @@ type pubKeyMaterial struct {
 	SignerID   []byte                       `json:"signerID,omitempty"`
 	C2PubKey   e4crypto.Curve25519PublicKey `json:"c2PubKey,omitempty"`
 	PubKeys    map[string]ed25519.PublicKey `json:"pubKeys,omitempty"`
+	// FailoverC2PubKeys holds the additional trusted C2 public keys, tried in order
+	// after C2PubKey when unprotecting commands
+	FailoverC2PubKeys []e4crypto.Curve25519PublicKey `json:"failoverC2PubKeys,omitempty"`
+	// PubKeysMetadata holds the PubKeys metadata, indexed by the same hex encoded ids
+	PubKeysMetadata map[string]PubKeyMetadata `json:"pubKeysMetadata,omitempty"`
+	// KDF records how the private key has been derived from a password, if it has
+	KDF *KDFProvenance `json:"kdf,omitempty"`
+	// StrictIDs enables the validation of the ids given to AddPubKey
+	StrictIDs bool `json:"strictIDs,omitempty"`
+	// AppendOnlyPubKeys prevents the stored public keys from being replaced
+	AppendOnlyPubKeys bool `json:"appendOnlyPubKeys,omitempty"`
+	// KeyCreatedAt holds when the private key has been created
+	KeyCreatedAt time.Time `json:"createdAt"`
+
+	clock            e4crypto.Clock
+	unsignedMessages bool
+	mutex            sync.RWMutex
+}
 
-	mutex sync.RWMutex
+// PubKeyMetadata holds the metadata of a public key stored on a pubKeyMaterial
+type PubKeyMetadata struct {
+	// AddedAt is the time the key has been added to the store
+	AddedAt time.Time `json:"addedAt"`
 }
 
 var _ PubKeyMaterial = (*pubKeyMaterial)(nil)
 var _ json.Marshaler = (*pubKeyMaterial)(nil)
 
-// NewPubKeyMaterial creates a new KeyMaterial to work with public e4 client key
+// NewPubKeyMaterial creates a new KeyMaterial to work with public e4 client key.
+// The C2 public key can be empty for peer to peer deployments without C2, in which case
+// messages work as usual, but unprotecting commands fails with ErrNoC2Configured.
 func NewPubKeyMaterial(signerID []byte, privateKey ed25519.PrivateKey, c2PubKey e4crypto.Curve25519PublicKey) (PubKeyMaterial, error) {
 	if err := e4crypto.ValidateID(signerID); err != nil {
 		return nil, fmt.Errorf("invalid signerID: %v", err)
@@ -59,16 +165,22 @@ func NewPubKeyMaterial(signerID []byte, privateKey ed25519.PrivateKey, c2PubKey
 		return nil, fmt.Errorf("invalid private key: %v", err)
 	}
 
-	if err := e4crypto.ValidateCurve25519PubKey(c2PubKey); err != nil {
-		return nil, fmt.Errorf("invalid c2 public key: %v", err)
+	if len(c2PubKey) > 0 {
+		if err := e4crypto.ValidateCurve25519PubKey(c2PubKey); err != nil {
+			return nil, fmt.Errorf("invalid c2 public key: %v", err)
+		}
 	}
 
 	e := &pubKeyMaterial{
-		PubKeys: make(map[string]ed25519.PublicKey),
+		PubKeys:         make(map[string]ed25519.PublicKey),
+		PubKeysMetadata: make(map[string]PubKeyMetadata),
+		KeyCreatedAt:    creationTime(nil),
 	}
 
-	e.C2PubKey = make([]byte, len(c2PubKey))
-	copy(e.C2PubKey, c2PubKey)
+	if len(c2PubKey) > 0 {
+		e.C2PubKey = make([]byte, len(c2PubKey))
+		copy(e.C2PubKey, c2PubKey)
+	}
 
 	e.PrivateKey = make([]byte, len(privateKey))
 	copy(e.PrivateKey, privateKey)
@@ -79,6 +191,16 @@ func NewPubKeyMaterial(signerID []byte, privateKey ed25519.PrivateKey, c2PubKey
 	return e, nil
 }
 
+// NewPubKeyMaterialFromSeed creates a new PubKeyMaterial, deriving its ed25519 private key from
+// the given ed25519.SeedSize bytes seed. The same seed always produces the same key.
+func NewPubKeyMaterialFromSeed(signerID []byte, seed []byte, c2PubKey e4crypto.Curve25519PublicKey) (PubKeyMaterial, error) {
+	if g, w := len(seed), ed25519.SeedSize; g != w {
+		return nil, fmt.Errorf("invalid seed length, got %d, expected %d", g, w)
+	}
+
+	return NewPubKeyMaterial(signerID, ed25519.NewKeyFromSeed(seed), c2PubKey)
+}
+
 // NewRandomPubKeyMaterial creates a new PubKeyMaterial key from a random ed25519 key
 func NewRandomPubKeyMaterial(signerID []byte, c2PubKey e4crypto.Curve25519PublicKey) (PubKeyMaterial, error) {
 	_, privateKey, err := ed25519.GenerateKey(nil)
@@ -91,20 +213,43 @@ func NewRandomPubKeyMaterial(signerID []byte, c2PubKey e4crypto.Curve25519Public
 
 // Protect will encrypt and sign the payload with the private key and returns it, or an error if it fail
 func (k *pubKeyMaterial) ProtectMessage(payload []byte, topicKey TopicKey) ([]byte, error) {
-	timestamp := make([]byte, e4crypto.TimestampLen)
-	binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().Unix()))
+	topicCipher, err := e4crypto.NewCipher(topicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.ProtectMessageWithCipher(payload, topicCipher)
+}
 
-	ct, err := e4crypto.Encrypt(topicKey, timestamp, payload)
+// CanProtect returns true when the material holds an ed25519 private key to sign messages
+func (k *pubKeyMaterial) CanProtect() bool {
+	return len(k.PrivateKey) == ed25519.PrivateKeySize
+}
+
+// ProtectMessageWithCipher will encrypt the payload with the given topic cipher, and sign it with the private key
+func (k *pubKeyMaterial) ProtectMessageWithCipher(payload []byte, topicCipher *e4crypto.Cipher) ([]byte, error) {
+	if !k.CanProtect() {
+		return nil, ErrNoPrivateKey
+	}
+
+	if k.unsignedMessages {
+		return k.protectUnsignedMessage(payload, topicCipher)
+	}
+
+	header := e4crypto.EncodeTaggedHeader(e4crypto.SchemeAESCMACSIVSigned, clockNow(k.clock))
+
+	ct, err := topicCipher.Encrypt(header, payload)
 	if err != nil {
 		return nil, err
 	}
 
-	protected, err := e4crypto.Sign(k.SignerID, k.PrivateKey, timestamp, ct)
+	signed, err := e4crypto.Sign(k.SignerID, k.PrivateKey, header[e4crypto.SchemeTagLen:], ct)
 	if err != nil {
 		return nil, err
 	}
+	protected := append([]byte{byte(e4crypto.SchemeAESCMACSIVSigned)}, signed...)
 
-	protectedLen := e4crypto.TimestampLen + e4crypto.IDLen + len(payload) + e4crypto.TagLen + ed25519.SignatureSize
+	protectedLen := e4crypto.TaggedHeaderLen + e4crypto.GetIDLen() + len(payload) + e4crypto.TagLen + ed25519.SignatureSize
 	if protectedLen != len(protected) {
 		return nil, e4crypto.ErrInvalidProtectedLen
 	}
@@ -113,20 +258,44 @@ func (k *pubKeyMaterial) ProtectMessage(payload []byte, topicKey TopicKey) ([]by
 }
 
 // UnprotectMessage attempts to decrypt the given protected cipher using the given topicKey.
+// The message scheme tag tells signed messages apart from unsigned ones (see SetUnsignedMessages).
 func (k *pubKeyMaterial) UnprotectMessage(protected []byte, topicKey TopicKey) ([]byte, error) {
-	if len(protected) <= e4crypto.TimestampLen+ed25519.SignatureSize {
+	if len(protected) < e4crypto.SchemeTagLen {
+		return nil, e4crypto.ErrInvalidProtectedLen
+	}
+
+	switch e4crypto.Scheme(protected[0]) {
+	case e4crypto.SchemeAESCMACSIVSigned:
+		return k.unprotectSignedMessage(protected, topicKey)
+	case e4crypto.SchemeAESCMACSIV, e4crypto.SchemeXChaCha20Poly1305:
+		if !k.unsignedMessages {
+			return nil, ErrUnsignedMessage
+		}
+
+		return e4crypto.UnprotectSymKeyTaggedAt(protected, topicKey, clockNow(k.clock))
+	default:
+		return nil, e4crypto.ErrUnsupportedScheme
+	}
+}
+
+// unprotectSignedMessage verifies the signature of a message protected with ProtectMessage, and decrypts it.
+// The protected message is built as: scheme tag || timestamp || signer ID || ciphertext || signature
+func (k *pubKeyMaterial) unprotectSignedMessage(protected []byte, topicKey TopicKey) ([]byte, error) {
+	idLen := e4crypto.GetIDLen()
+	if len(protected) < e4crypto.TaggedHeaderLen+idLen+e4crypto.TagLen+ed25519.SignatureSize {
 		return nil, e4crypto.ErrInvalidProtectedLen
 	}
 
 	// first check timestamp
-	timestamp := protected[:e4crypto.TimestampLen]
-	if err := e4crypto.ValidateTimestamp(timestamp); err != nil {
+	header := protected[:e4crypto.TaggedHeaderLen]
+	if err := e4crypto.ValidateTimestampAt(header[e4crypto.SchemeTagLen:], clockNow(k.clock)); err != nil {
 		return nil, err
 	}
 
-	// then check signature
-	signerID := protected[e4crypto.TimestampLen : e4crypto.TimestampLen+e4crypto.IDLen]
-	signed := protected[:len(protected)-ed25519.SignatureSize]
+	// then check signature, which covers the timestamp, the signer ID and the ciphertext,
+	// while the scheme tag is authenticated by the ciphertext along with the timestamp
+	signerID := protected[e4crypto.TaggedHeaderLen : e4crypto.TaggedHeaderLen+idLen]
+	signed := protected[e4crypto.SchemeTagLen : len(protected)-ed25519.SignatureSize]
 	sig := protected[len(protected)-ed25519.SignatureSize:]
 
 	pubkey, err := k.GetPubKey(signerID)
@@ -138,10 +307,10 @@ func (k *pubKeyMaterial) UnprotectMessage(protected []byte, topicKey TopicKey) (
 		return nil, e4crypto.ErrInvalidSignature
 	}
 
-	ct := protected[e4crypto.TimestampLen+e4crypto.IDLen : len(protected)-ed25519.SignatureSize]
+	ct := protected[e4crypto.TaggedHeaderLen+idLen : len(protected)-ed25519.SignatureSize]
 
 	// finally decrypt
-	pt, err := e4crypto.Decrypt(topicKey, timestamp, ct)
+	pt, err := e4crypto.Decrypt(topicKey, header, ct)
 	if err != nil {
 		return nil, err
 	}
@@ -149,19 +318,137 @@ func (k *pubKeyMaterial) UnprotectMessage(protected []byte, topicKey TopicKey) (
 	return pt, nil
 }
 
+// protectUnsignedMessage encrypts the payload with the topic cipher, without signing it.
+// The protected message uses the tagged framing of crypto.ProtectSymKeyTagged with the SchemeAESCMACSIV scheme,
+// built as: scheme tag || timestamp || ciphertext
+func (k *pubKeyMaterial) protectUnsignedMessage(payload []byte, topicCipher *e4crypto.Cipher) ([]byte, error) {
+	header := e4crypto.EncodeTaggedHeader(e4crypto.SchemeAESCMACSIV, clockNow(k.clock))
+
+	ct, err := topicCipher.Encrypt(header, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, ct...), nil
+}
+
 // UnprotectCommand attempt to decrypt a client command from the given protected cipher.
 // It will use the material's private key and the c2 public key to create the required symmetric key
+// Each trusted C2 public key is tried in order, and the error obtained with the primary one is returned when all fail.
 func (k *pubKeyMaterial) UnprotectCommand(protected []byte) ([]byte, error) {
+	if !k.CanProtect() {
+		return nil, ErrNoPrivateKey
+	}
+
+	c2PubKeys := k.C2PubKeys()
+	if len(c2PubKeys) == 0 {
+		return nil, ErrNoC2Configured
+	}
+
 	// convert ed key to curve key
 	curvePrivateKey := e4crypto.PrivateEd25519KeyToCurve25519(k.PrivateKey)
-	shared, err := curve25519.X25519(curvePrivateKey, k.C2PubKey)
+
+	var firstErr error
+	for _, c2PubKey := range c2PubKeys {
+		command, err := unprotectCommandFrom(protected, curvePrivateKey, c2PubKey, clockNow(k.clock))
+		if err == nil {
+			return command, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// unprotectCommandFrom decrypts a command protected by the C2 owning the given curve25519 public key
+func unprotectCommandFrom(protected []byte, curvePrivateKey e4crypto.Curve25519PrivateKey, c2PubKey e4crypto.Curve25519PubKey, now time.Time) ([]byte, error) {
+	key, err := commandKey(curvePrivateKey, c2PubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return e4crypto.UnprotectSymKeyAt(protected, key, now)
+}
+
+// UnwrapKey decrypts a key wrapped with the command key of one of the trusted C2 public keys,
+// tried in order like in UnprotectCommand
+func (k *pubKeyMaterial) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if !k.CanProtect() {
+		return nil, ErrNoPrivateKey
+	}
+
+	c2PubKeys := k.C2PubKeys()
+	if len(c2PubKeys) == 0 {
+		return nil, ErrNoC2Configured
+	}
+
+	curvePrivateKey := e4crypto.PrivateEd25519KeyToCurve25519(k.PrivateKey)
+
+	var firstErr error
+	for _, c2PubKey := range c2PubKeys {
+		kek, err := commandKey(curvePrivateKey, c2PubKey)
+		if err == nil {
+			var key []byte
+			key, err = e4crypto.UnwrapKey(wrapped, kek)
+			if err == nil {
+				return key, nil
+			}
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// commandKey derives the symmetric key of the commands exchanged with the C2 owning the given curve25519 public key
+func commandKey(curvePrivateKey e4crypto.Curve25519PrivateKey, c2PubKey e4crypto.Curve25519PubKey) ([]byte, error) {
+	shared, err := curve25519.X25519(curvePrivateKey, c2PubKey)
 	if err != nil {
 		return nil, fmt.Errorf("curve25519 X25519 failed: %v", err)
 	}
 
-	key := e4crypto.Sha3Sum256(shared[:])[:e4crypto.KeyLen]
+	return e4crypto.Sha3Sum256(shared[:])[:e4crypto.KeyLen], nil
+}
+
+// CommandKey returns the symmetric key of the commands protected by the primary C2
+func (k *pubKeyMaterial) CommandKey() ([]byte, error) {
+	if !k.CanProtect() {
+		return nil, ErrNoPrivateKey
+	}
+
+	c2PubKeys := k.C2PubKeys()
+	if len(c2PubKeys) == 0 {
+		return nil, ErrNoC2Configured
+	}
 
-	return e4crypto.UnprotectSymKey(protected, key)
+	curvePrivateKey := e4crypto.PrivateEd25519KeyToCurve25519(k.PrivateKey)
+
+	return commandKey(curvePrivateKey, e4crypto.Curve25519PubKey(c2PubKeys[0]))
+}
+
+// DirectKey returns the symmetric key of the direct messages exchanged with the given peer
+func (k *pubKeyMaterial) DirectKey(peerPubKey e4crypto.Curve25519PublicKey) ([]byte, error) {
+	if !k.CanProtect() {
+		return nil, ErrNoPrivateKey
+	}
+
+	if err := e4crypto.ValidateCurve25519PubKey(peerPubKey); err != nil {
+		return nil, fmt.Errorf("invalid peer public key: %v", err)
+	}
+
+	curvePrivateKey := e4crypto.PrivateEd25519KeyToCurve25519(k.PrivateKey)
+	shared, err := curve25519.X25519(curvePrivateKey, peerPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("curve25519 X25519 failed: %v", err)
+	}
+
+	return e4crypto.Sha3Sum256(append([]byte(directKeyPrefix), shared...))[:e4crypto.KeyLen], nil
 }
 
 // AddPubKey store the given id and key in internal storage
@@ -170,15 +457,83 @@ func (k *pubKeyMaterial) AddPubKey(id []byte, pubKey ed25519.PublicKey) error {
 	k.mutex.Lock()
 	defer k.mutex.Unlock()
 
+	if k.StrictIDs {
+		if err := e4crypto.ValidateID(id); err != nil {
+			return fmt.Errorf("invalid id: %v", err)
+		}
+	}
+
 	if err := e4crypto.ValidateEd25519PubKey(pubKey); err != nil {
 		return err
 	}
 
-	k.PubKeys[hex.EncodeToString(id)] = pubKey
+	sid := hex.EncodeToString(id)
+	if k.AppendOnlyPubKeys && k.replacesPubKey(sid, pubKey) {
+		return ErrPubKeyExists
+	}
+
+	k.storePubKey(sid, pubKey)
 
 	return nil
 }
 
+// AddPubKeyIfChanged adds a copy of the given public key under the given id,
+// unless the same key is already stored with this id
+// It is safe for concurrent access
+func (k *pubKeyMaterial) AddPubKeyIfChanged(id, key []byte) (bool, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.StrictIDs {
+		if err := e4crypto.ValidateID(id); err != nil {
+			return false, fmt.Errorf("invalid id: %v", err)
+		}
+	}
+
+	if err := e4crypto.ValidateEd25519PubKey(key); err != nil {
+		return false, fmt.Errorf("invalid ed25519 public key: %v", err)
+	}
+
+	sid := hex.EncodeToString(id)
+	if current, ok := k.PubKeys[sid]; ok && subtle.ConstantTimeCompare(current, key) == 1 {
+		return false, nil
+	}
+	if k.AppendOnlyPubKeys && k.replacesPubKey(sid, key) {
+		return false, ErrPubKeyExists
+	}
+
+	pubKey := make(ed25519.PublicKey, len(key))
+	copy(pubKey, key)
+	k.storePubKey(sid, pubKey)
+
+	return true, nil
+}
+
+// storePubKey stores the public key and its metadata under the given hex encoded id.
+// It must be called with the mutex held.
+func (k *pubKeyMaterial) storePubKey(sid string, pubKey ed25519.PublicKey) {
+	k.PubKeys[sid] = pubKey
+
+	if k.PubKeysMetadata == nil {
+		k.PubKeysMetadata = make(map[string]PubKeyMetadata)
+	}
+	k.PubKeysMetadata[sid] = PubKeyMetadata{
+		AddedAt: clockNow(k.clock).UTC().Truncate(time.Second),
+	}
+}
+
+// AddEd25519PubKey validates the given ed25519 public key, and stores a copy of it under the given ID
+func (k *pubKeyMaterial) AddEd25519PubKey(id []byte, key ed25519.PublicKey) error {
+	if err := e4crypto.ValidateEd25519PubKey(key); err != nil {
+		return fmt.Errorf("invalid ed25519 public key: %v", err)
+	}
+
+	pubKey := make(ed25519.PublicKey, len(key))
+	copy(pubKey, key)
+
+	return k.AddPubKey(id, pubKey)
+}
+
 // removePubKey removes the key associated to id on the pubKeyMateriel
 // It returns an error if no key can be found with the given id
 func (k *pubKeyMaterial) RemovePubKey(id []byte) error {
@@ -192,6 +547,7 @@ func (k *pubKeyMaterial) RemovePubKey(id []byte) error {
 	}
 
 	delete(k.PubKeys, sid)
+	delete(k.PubKeysMetadata, sid)
 
 	return nil
 }
@@ -207,6 +563,203 @@ func (k *pubKeyMaterial) ResetPubKeys() {
 	for key := range k.PubKeys {
 		delete(k.PubKeys, key)
 	}
+	for key := range k.PubKeysMetadata {
+		delete(k.PubKeysMetadata, key)
+	}
+}
+
+// SetPubKeys replaces all the stored public keys by the given ones, indexed by hex encoded ID.
+// Nothing is changed when any of the given IDs or keys is invalid, or in append only mode,
+// when any of them would replace a different stored key.
+func (k *pubKeyMaterial) SetPubKeys(pubKeys map[string][]byte) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	addedAt := clockNow(k.clock).UTC().Truncate(time.Second)
+
+	newPubKeys := make(map[string]ed25519.PublicKey, len(pubKeys))
+	newMetadata := make(map[string]PubKeyMetadata, len(pubKeys))
+	for sid, pubKey := range pubKeys {
+		id, err := hex.DecodeString(sid)
+		if err != nil {
+			return fmt.Errorf("invalid id %s: %v", sid, err)
+		}
+
+		if k.StrictIDs {
+			if err := e4crypto.ValidateID(id); err != nil {
+				return fmt.Errorf("invalid id %s: %v", sid, err)
+			}
+		}
+
+		if err := e4crypto.ValidateEd25519PubKey(pubKey); err != nil {
+			return fmt.Errorf("invalid public key for id %s: %v", sid, err)
+		}
+
+		pk := make(ed25519.PublicKey, len(pubKey))
+		copy(pk, pubKey)
+
+		// Normalize the id encoding, as used by AddPubKey
+		sid = hex.EncodeToString(id)
+		if k.AppendOnlyPubKeys && k.replacesPubKey(sid, pk) {
+			return fmt.Errorf("invalid public key for id %s: %v", sid, ErrPubKeyExists)
+		}
+		newPubKeys[sid] = pk
+		newMetadata[sid] = PubKeyMetadata{AddedAt: addedAt}
+	}
+
+	k.PubKeys = newPubKeys
+	k.PubKeysMetadata = newMetadata
+
+	return nil
+}
+
+// MergePubKeys adds copies of the given public keys, indexed by hex encoded ID, to the stored ones,
+// and reports whether the store changed. Nothing is changed when any of the given IDs or keys is invalid,
+// or in append only mode, when any of them would replace a different stored key, returning ErrPubKeyExists.
+func (k *pubKeyMaterial) MergePubKeys(pubKeys map[string][]byte) (bool, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	changedPubKeys := make(map[string]ed25519.PublicKey, len(pubKeys))
+	for sid, pubKey := range pubKeys {
+		id, err := hex.DecodeString(sid)
+		if err != nil {
+			return false, fmt.Errorf("invalid id %s: %v", sid, err)
+		}
+
+		if k.StrictIDs {
+			if err := e4crypto.ValidateID(id); err != nil {
+				return false, fmt.Errorf("invalid id %s: %v", sid, err)
+			}
+		}
+
+		if err := e4crypto.ValidateEd25519PubKey(pubKey); err != nil {
+			return false, fmt.Errorf("invalid public key for id %s: %v", sid, err)
+		}
+
+		// Normalize the id encoding, as used by AddPubKey
+		sid = hex.EncodeToString(id)
+		if current, ok := k.PubKeys[sid]; ok && subtle.ConstantTimeCompare(current, pubKey) == 1 {
+			continue
+		}
+		if k.AppendOnlyPubKeys && k.replacesPubKey(sid, pubKey) {
+			return false, ErrPubKeyExists
+		}
+
+		pk := make(ed25519.PublicKey, len(pubKey))
+		copy(pk, pubKey)
+		changedPubKeys[sid] = pk
+	}
+
+	for sid, pk := range changedPubKeys {
+		k.storePubKey(sid, pk)
+	}
+
+	return len(changedPubKeys) > 0, nil
+}
+
+// VerifyChallenge verifies the signature of the challenge under the public key stored for the given ID
+func (k *pubKeyMaterial) VerifyChallenge(id, challenge, signature []byte) error {
+	k.mutex.RLock()
+	pubKey, ok := k.PubKeys[hex.EncodeToString(id)]
+	k.mutex.RUnlock()
+	if !ok {
+		return ErrPubKeyNotFound
+	}
+
+	if !ed25519.Verify(pubKey, challenge, signature) {
+		return e4crypto.ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// Diff returns the desired public keys which aren't stored or differ from the stored ones,
+// and the stored public keys which aren't desired, indexed by hex encoded ID.
+// The desired IDs encoding is normalized like SetPubKeys, but they aren't validated.
+func (k *pubKeyMaterial) Diff(desired map[string][]byte) (map[string][]byte, map[string][]byte) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	toAdd := make(map[string][]byte)
+	desiredIDs := make(map[string]struct{}, len(desired))
+	for sid, pubKey := range desired {
+		// Normalize the id encoding, as used by AddPubKey
+		if id, err := hex.DecodeString(sid); err == nil {
+			sid = hex.EncodeToString(id)
+		}
+		desiredIDs[sid] = struct{}{}
+
+		if current, ok := k.PubKeys[sid]; ok && subtle.ConstantTimeCompare(current, pubKey) == 1 {
+			continue
+		}
+
+		toAdd[sid] = pubKey
+	}
+
+	toRemove := make(map[string][]byte)
+	for sid, pubKey := range k.PubKeys {
+		if _, ok := desiredIDs[sid]; ok {
+			continue
+		}
+
+		current := make([]byte, len(pubKey))
+		copy(current, pubKey)
+		toRemove[sid] = current
+	}
+
+	return toAdd, toRemove
+}
+
+// Validate checks that every stored ID is valid hex, and valid if StrictIDs is enabled,
+// that every stored public key is a valid ed25519 key, and that no IDs only differ by trailing bytes.
+// Entries are checked in ID order, and the first inconsistency is returned along its ID.
+func (k *pubKeyMaterial) Validate() error {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	sids := make([]string, 0, len(k.PubKeys))
+	for sid := range k.PubKeys {
+		sids = append(sids, sid)
+	}
+	sort.Strings(sids)
+
+	// seenIDs holds the already checked ids, truncated to the ID length, to detect
+	// duplicates only differing by trailing bytes
+	seenIDs := make(map[string]string, len(sids))
+	for _, sid := range sids {
+		id, err := hex.DecodeString(sid)
+		if err != nil {
+			return fmt.Errorf("invalid id %s: %v", sid, err)
+		}
+
+		if k.StrictIDs {
+			if err := e4crypto.ValidateID(id); err != nil {
+				return fmt.Errorf("invalid id %s: %v", sid, err)
+			}
+		}
+
+		if err := e4crypto.ValidateEd25519PubKey(k.PubKeys[sid]); err != nil {
+			return fmt.Errorf("invalid public key for id %s: %v", sid, err)
+		}
+
+		if idLen := e4crypto.GetIDLen(); len(id) > idLen {
+			id = id[:idLen]
+		}
+		truncatedID := hex.EncodeToString(id)
+		if otherSID, ok := seenIDs[truncatedID]; ok {
+			return fmt.Errorf("duplicate id %s, only differing from %s by trailing bytes", sid, otherSID)
+		}
+		seenIDs[truncatedID] = sid
+	}
+
+	return nil
+}
+
+// LoadPubKeysFromDir adds the public keys of each file found in dir.
+// See the LoadPubKeysFromDir function for details.
+func (k *pubKeyMaterial) LoadPubKeysFromDir(dir string) (int, error) {
+	return LoadPubKeysFromDir(k, dir)
 }
 
 // GetPubKeys return a map of stored pubKeys, indexed by their hex encoded ids
@@ -230,6 +783,27 @@ func (k *pubKeyMaterial) GetPubKey(id []byte) (ed25519.PublicKey, error) {
 	return key, nil
 }
 
+// GetPubKeyInfo return a pubKey associated to given ID along with its metadata,
+// or ErrPubKeyNotFound when it doesn't exists
+func (k *pubKeyMaterial) GetPubKeyInfo(id []byte) (PubKeyInfo, error) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	sid := hex.EncodeToString(id)
+
+	key, ok := k.PubKeys[sid]
+	if !ok {
+		return PubKeyInfo{}, ErrPubKeyNotFound
+	}
+
+	metadata := k.PubKeysMetadata[sid]
+
+	return PubKeyInfo{
+		Key:     key,
+		AddedAt: metadata.AddedAt,
+	}, nil
+}
+
 // SetKey will validate the given key and copy it into the pubKeyMaterial key when valid
 func (k *pubKeyMaterial) SetKey(key []byte) error {
 	if err := e4crypto.ValidateEd25519PrivKey(key); err != nil {
@@ -240,10 +814,144 @@ func (k *pubKeyMaterial) SetKey(key []byte) error {
 	copy(sk, key)
 
 	k.PrivateKey = sk
+	k.KDF = nil
+	k.KeyCreatedAt = creationTime(k.clock)
 
 	return nil
 }
 
+// SignData signs the given data with the material private key
+func (k *pubKeyMaterial) SignData(data []byte) ([]byte, error) {
+	if !k.CanProtect() {
+		return nil, ErrNoPrivateKey
+	}
+
+	return ed25519.Sign(k.PrivateKey, data), nil
+}
+
+// DropPrivateKey zeroes and removes the material private key, along with its KDF provenance
+func (k *pubKeyMaterial) DropPrivateKey() {
+	for i := range k.PrivateKey {
+		k.PrivateKey[i] = 0
+	}
+
+	k.PrivateKey = nil
+	k.KDF = nil
+}
+
+// SignMessage returns the signature of the given timestamp and encrypted payload, along with the material signer ID
+func (k *pubKeyMaterial) SignMessage(message []byte) ([]byte, error) {
+	if len(message) < e4crypto.TimestampLen {
+		return nil, e4crypto.ErrInvalidProtectedLen
+	}
+
+	return k.SignData(e4crypto.SignedData(k.SignerID, message[:e4crypto.TimestampLen], message[e4crypto.TimestampLen:]))
+}
+
+// Wipe zeroes and removes the material private key, and clears the public keys and C2 public keys
+func (k *pubKeyMaterial) Wipe() {
+	k.DropPrivateKey()
+	k.ResetPubKeys()
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.C2PubKey = nil
+	k.FailoverC2PubKeys = nil
+}
+
+// EqualCrypto returns true when the other material is a public key material holding the same private key,
+// signer ID, C2 public keys, in the same order, and trusted public keys, ignoring their metadata
+func (k *pubKeyMaterial) EqualCrypto(other KeyMaterial) bool {
+	o, ok := other.(*pubKeyMaterial)
+	if !ok {
+		return false
+	}
+	if k == o {
+		return true
+	}
+
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	if subtle.ConstantTimeCompare(k.PrivateKey, o.PrivateKey) != 1 || !bytes.Equal(k.SignerID, o.SignerID) {
+		return false
+	}
+
+	c2PubKeys, otherC2PubKeys := k.trustedC2PubKeys(), o.trustedC2PubKeys()
+	if len(c2PubKeys) != len(otherC2PubKeys) {
+		return false
+	}
+	for i := range c2PubKeys {
+		if !bytes.Equal(c2PubKeys[i], otherC2PubKeys[i]) {
+			return false
+		}
+	}
+
+	if len(k.PubKeys) != len(o.PubKeys) {
+		return false
+	}
+	for sid, pubKey := range k.PubKeys {
+		otherPubKey, ok := o.PubKeys[sid]
+		if !ok || !bytes.Equal(pubKey, otherPubKey) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetKDFProvenance records how the material private key has been derived from a password
+func (k *pubKeyMaterial) SetKDFProvenance(provenance *KDFProvenance) {
+	k.KDF = provenance
+}
+
+// KDFProvenance returns how the material private key has been derived from a password, or nil
+func (k *pubKeyMaterial) KDFProvenance() *KDFProvenance {
+	return k.KDF
+}
+
+// CreatedAt returns when the material private key has been created, or the zero time when unknown
+func (k *pubKeyMaterial) CreatedAt() time.Time {
+	return k.KeyCreatedAt
+}
+
+// SetStrictIDs enables or disables the validation of the ids given to AddPubKey
+func (k *pubKeyMaterial) SetStrictIDs(strict bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.StrictIDs = strict
+}
+
+// SetAppendOnlyPubKeys enables or disables the append only mode of the public keys
+func (k *pubKeyMaterial) SetAppendOnlyPubKeys(enabled bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.AppendOnlyPubKeys = enabled
+}
+
+// replacesPubKey returns true when storing the given public key under the given hex encoded id
+// would replace a different key. It must be called with the mutex held.
+func (k *pubKeyMaterial) replacesPubKey(sid string, pubKey []byte) bool {
+	current, ok := k.PubKeys[sid]
+
+	return ok && subtle.ConstantTimeCompare(current, pubKey) != 1
+}
+
+// SetUnsignedMessages enables or disables the protection and reception of unsigned messages
+func (k *pubKeyMaterial) SetUnsignedMessages(enabled bool) {
+	k.unsignedMessages = enabled
+}
+
+// SetClock sets the clock used to stamp and validate protected messages timestamps
+func (k *pubKeyMaterial) SetClock(clock e4crypto.Clock) {
+	k.clock = clock
+}
+
 // MarshalJSON  will infer the key type in the marshalled json data
 // to be able to know which key to instantiate when unmarshalling back
 func (k *pubKeyMaterial) MarshalJSON() ([]byte, error) {
@@ -252,15 +960,27 @@ func (k *pubKeyMaterial) MarshalJSON() ([]byte, error) {
 	jsonKey := &jsonKey{
 		KeyType: pubKeyMaterialType,
 		KeyData: struct {
-			PrivateKey ed25519.PrivateKey
-			SignerID   []byte
-			C2PubKey   []byte
-			PubKeys    map[string]ed25519.PublicKey
+			PrivateKey        ed25519.PrivateKey
+			SignerID          []byte
+			C2PubKey          []byte
+			PubKeys           map[string]ed25519.PublicKey
+			PubKeysMetadata   map[string]PubKeyMetadata
+			FailoverC2PubKeys [][]byte       `json:",omitempty"`
+			KDF               *KDFProvenance `json:",omitempty"`
+			StrictIDs         bool           `json:",omitempty"`
+			AppendOnlyPubKeys bool           `json:",omitempty"`
+			CreatedAt         time.Time
 		}{
-			PrivateKey: k.PrivateKey,
-			SignerID:   k.SignerID,
-			C2PubKey:   k.C2PubKey,
-			PubKeys:    k.PubKeys,
+			PrivateKey:        k.PrivateKey,
+			SignerID:          k.SignerID,
+			C2PubKey:          k.C2PubKey,
+			PubKeys:           k.PubKeys,
+			PubKeysMetadata:   k.PubKeysMetadata,
+			FailoverC2PubKeys: k.FailoverC2PubKeys,
+			KDF:               k.KDF,
+			StrictIDs:         k.StrictIDs,
+			AppendOnlyPubKeys: k.AppendOnlyPubKeys,
+			CreatedAt:         k.KeyCreatedAt,
 		},
 	}
 
@@ -268,7 +988,12 @@ func (k *pubKeyMaterial) MarshalJSON() ([]byte, error) {
 }
 
 // PublicKey returns the public key of the keyMaterial
+// It is nil for verifier only materials
 func (k *pubKeyMaterial) PublicKey() ed25519.PublicKey {
+	if !k.CanProtect() {
+		return nil
+	}
+
 	publicPart := k.PrivateKey.Public()
 	publicKey, ok := publicPart.(ed25519.PublicKey)
 	if !ok {
@@ -277,3 +1002,101 @@ func (k *pubKeyMaterial) PublicKey() ed25519.PublicKey {
 
 	return publicKey
 }
+
+// C2KeyMatches returns true when the given curve25519 public key equals the key material C2 public key.
+// The comparison is done in constant time.
+func (k *pubKeyMaterial) C2KeyMatches(c2PubKey e4crypto.Curve25519PublicKey) bool {
+	matches := false
+	for _, trustedKey := range k.C2PubKeys() {
+		// Don't stop on the first match, to not leak which key matched through timing
+		if subtle.ConstantTimeCompare(trustedKey, c2PubKey) == 1 {
+			matches = true
+		}
+	}
+
+	return matches
+}
+
+// C2PubKeys returns the trusted C2 public keys, the primary one first, followed by the failover ones
+func (k *pubKeyMaterial) C2PubKeys() []e4crypto.Curve25519PublicKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	return k.trustedC2PubKeys()
+}
+
+// trustedC2PubKeys returns the trusted C2 public keys, which are none when no C2 is configured.
+// It must be called with the mutex held.
+func (k *pubKeyMaterial) trustedC2PubKeys() []e4crypto.Curve25519PublicKey {
+	c2PubKeys := make([]e4crypto.Curve25519PublicKey, 0, 1+len(k.FailoverC2PubKeys))
+	if len(k.C2PubKey) > 0 {
+		c2PubKeys = append(c2PubKeys, k.C2PubKey)
+	}
+
+	return append(c2PubKeys, k.FailoverC2PubKeys...)
+}
+
+// AddC2PubKey adds a failover C2 public key, tried after the already trusted ones when unprotecting commands.
+// Adding an already trusted key is a no-op.
+func (k *pubKeyMaterial) AddC2PubKey(c2PubKey e4crypto.Curve25519PublicKey) error {
+	if err := e4crypto.ValidateCurve25519PubKey(c2PubKey); err != nil {
+		return fmt.Errorf("invalid c2 public key: %v", err)
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	for _, trustedKey := range k.trustedC2PubKeys() {
+		if subtle.ConstantTimeCompare(trustedKey, c2PubKey) == 1 {
+			return nil
+		}
+	}
+
+	if 1+len(k.FailoverC2PubKeys) >= MaxC2PubKeys {
+		return ErrTooManyC2PubKeys
+	}
+
+	newKey := make(e4crypto.Curve25519PublicKey, len(c2PubKey))
+	copy(newKey, c2PubKey)
+
+	// Without C2 configured yet, the added key becomes the primary one
+	if len(k.C2PubKey) == 0 {
+		k.C2PubKey = newKey
+		return nil
+	}
+
+	k.FailoverC2PubKeys = append(k.FailoverC2PubKeys, newKey)
+
+	return nil
+}
+
+// RemoveC2PubKey removes the given trusted C2 public key. The first failover key replaces
+// the primary one when it is removed. It returns ErrC2PubKeyNotFound when the key isn't trusted,
+// and ErrLastC2PubKey when it is the only trusted key.
+func (k *pubKeyMaterial) RemoveC2PubKey(c2PubKey e4crypto.Curve25519PublicKey) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if subtle.ConstantTimeCompare(k.C2PubKey, c2PubKey) == 1 {
+		if len(k.FailoverC2PubKeys) == 0 {
+			return ErrLastC2PubKey
+		}
+
+		k.C2PubKey = k.FailoverC2PubKeys[0]
+		k.FailoverC2PubKeys = k.FailoverC2PubKeys[1:]
+
+		return nil
+	}
+
+	for i, failoverKey := range k.FailoverC2PubKeys {
+		if subtle.ConstantTimeCompare(failoverKey, c2PubKey) == 1 {
+			remaining := make([]e4crypto.Curve25519PublicKey, 0, len(k.FailoverC2PubKeys)-1)
+			remaining = append(remaining, k.FailoverC2PubKeys[:i]...)
+			k.FailoverC2PubKeys = append(remaining, k.FailoverC2PubKeys[i+1:]...)
+
+			return nil
+		}
+	}
+
+	return ErrC2PubKeyNotFound
+}
@@ -16,7 +16,9 @@ package keys
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"reflect"
 	"testing"
@@ -118,6 +120,60 @@ func TestNewRandomPubKeyMaterial(t *testing.T) {
 	}
 }
 
+func TestNewPubKeyMaterialFromSeed(t *testing.T) {
+	signerID := e4crypto.HashIDAlias("test")
+	c2PubKey := getTestC2PubKey(t)
+
+	seed := make([]byte, ed25519.SeedSize)
+	rand.Read(seed)
+
+	k1, err := NewPubKeyMaterialFromSeed(signerID, seed, c2PubKey)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	k2, err := NewPubKeyMaterialFromSeed(signerID, seed, c2PubKey)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	if !bytes.Equal(k1.PublicKey(), k2.PublicKey()) {
+		t.Fatalf("Expected same seed to produce same public key, got %v and %v", k1.PublicKey(), k2.PublicKey())
+	}
+
+	if g, w := k1.PublicKey(), ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey); !bytes.Equal(g, w) {
+		t.Fatalf("Invalid public key: got %v, wanted %v", g, w)
+	}
+
+	badSeeds := [][]byte{
+		nil,
+		seed[:ed25519.SeedSize-1],
+		append(seed, 0x00),
+	}
+	for _, badSeed := range badSeeds {
+		if _, err := NewPubKeyMaterialFromSeed(signerID, badSeed, c2PubKey); err == nil {
+			t.Fatalf("Expected an error when creating a key from a seed of %d bytes", len(badSeed))
+		}
+	}
+}
+
+func TestPubKeyMaterialCanProtect(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	if !k.CanProtect() {
+		t.Fatal("Expected pubKeyMaterial to be able to protect messages")
+	}
+
+	// A material without private key can only verify messages
+	verifier := &pubKeyMaterial{C2PubKey: getTestC2PubKey(t)}
+	if verifier.CanProtect() {
+		t.Fatal("Expected pubKeyMaterial without private key not to be able to protect messages")
+	}
+}
+
 func TestPubKeyMaterialProtectUnprotectMessage(t *testing.T) {
 	clientID := e4crypto.HashIDAlias("test")
 	pubKey, privKey, err := ed25519.GenerateKey(nil)
@@ -179,6 +235,103 @@ func TestPubKeyMaterialProtectUnprotectMessage(t *testing.T) {
 	}
 }
 
+func TestPubKeyMaterialUnsignedMessages(t *testing.T) {
+	clientID := e4crypto.HashIDAlias("test")
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 keys: %v", err)
+	}
+
+	k, err := NewPubKeyMaterial(clientID, privKey, getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	k.AddPubKey(clientID, pubKey)
+
+	payload := []byte("some message")
+	topicKey := e4crypto.RandomKey()
+
+	signed, err := k.ProtectMessage(payload, topicKey)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+
+	k.SetUnsignedMessages(true)
+
+	unsigned, err := k.ProtectMessage(payload, topicKey)
+	if err != nil {
+		t.Fatalf("Failed to protect unsigned message: %v", err)
+	}
+
+	if g, w := len(unsigned), len(signed)-e4crypto.IDLen-ed25519.SignatureSize; g != w {
+		t.Fatalf("Invalid unsigned message length: got %d, wanted %d", g, w)
+	}
+
+	// Signed and unsigned messages are told apart by their scheme tag
+	testData := []struct {
+		protected []byte
+		scheme    e4crypto.Scheme
+	}{
+		{protected: signed, scheme: e4crypto.SchemeAESCMACSIVSigned},
+		{protected: unsigned, scheme: e4crypto.SchemeAESCMACSIV},
+	}
+	for _, testCase := range testData {
+		info, err := e4crypto.InspectProtected(testCase.protected)
+		if err != nil {
+			t.Fatalf("Failed to inspect protected message: %v", err)
+		}
+		if info.Scheme != testCase.scheme || info.PayloadLen != len(payload) {
+			t.Fatalf("Invalid protected info: got %+v, wanted scheme %v and payload length %d", info, testCase.scheme, len(payload))
+		}
+	}
+	if g, w := MessageSignerID(signed), clientID; !bytes.Equal(g, w) {
+		t.Fatalf("Invalid signer ID: got %v, wanted %v", g, w)
+	}
+	if g := MessageSignerID(unsigned); g != nil {
+		t.Fatalf("Expected unsigned message to have no signer ID, got %v", g)
+	}
+	if _, err := e4crypto.UnprotectSymKeyTagged(unsigned, topicKey); err != nil {
+		t.Fatalf("Expected unsigned message to use the tagged framing, got error: %v", err)
+	}
+
+	for name, protected := range map[string][]byte{"unsigned": unsigned, "signed": signed} {
+		unprotected, err := k.UnprotectMessage(protected, topicKey)
+		if err != nil {
+			t.Fatalf("Failed to unprotect %s message: %v", name, err)
+		}
+		if !bytes.Equal(unprotected, payload) {
+			t.Fatalf("Invalid unprotected %s message: got %v, wanted %v", name, unprotected, payload)
+		}
+	}
+
+	if _, err := k.UnprotectMessage(unsigned, e4crypto.RandomKey()); err == nil {
+		t.Fatal("Expected unprotect to fail without the proper topic key")
+	}
+
+	tampered := make([]byte, len(unsigned))
+	copy(tampered, unsigned)
+	tampered[e4crypto.SchemeTagLen] ^= 0x01
+	if _, err := k.UnprotectMessage(tampered, topicKey); err == nil {
+		t.Fatal("Expected unprotect to fail with a tampered timestamp")
+	}
+
+	copy(tampered, unsigned)
+	tampered[0] = byte(e4crypto.SchemeAESCMACSIVSigned)
+	if _, err := k.UnprotectMessage(tampered, topicKey); err == nil {
+		t.Fatal("Expected unprotect to fail with a tampered scheme tag")
+	}
+
+	tampered[0] = 0xff
+	if _, err := k.UnprotectMessage(tampered, topicKey); err != e4crypto.ErrUnsupportedScheme {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, e4crypto.ErrUnsupportedScheme)
+	}
+
+	k.SetUnsignedMessages(false)
+	if _, err := k.UnprotectMessage(unsigned, topicKey); err != ErrUnsignedMessage {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsignedMessage)
+	}
+}
+
 func TestPubKeyMaterialUnprotectCommand(t *testing.T) {
 	clientID := e4crypto.HashIDAlias("test")
 	pubKey, privKey, err := ed25519.GenerateKey(nil)
@@ -336,6 +489,756 @@ func TestPubKeyMaterialPubKeys(t *testing.T) {
 	}
 }
 
+func TestPubKeyMaterialAddEd25519PubKey(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	pk, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	id := e4crypto.HashIDAlias("id1")
+	if err := k.AddEd25519PubKey(id, pk); err != nil {
+		t.Fatalf("Failed to add ed25519 pubKey: %v", err)
+	}
+
+	storedKey, err := k.GetPubKey(id)
+	if err != nil {
+		t.Fatalf("Failed to get pubKey: %v", err)
+	}
+	if !bytes.Equal(storedKey, pk) {
+		t.Fatalf("Invalid pubKey: got %v, wanted %v", storedKey, pk)
+	}
+
+	pk[0]++
+	if bytes.Equal(storedKey, pk) {
+		t.Fatal("Expected pubKey to have been copied")
+	}
+
+	zeroKey := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	if err := k.AddEd25519PubKey(e4crypto.HashIDAlias("id2"), zeroKey); err == nil {
+		t.Fatal("Expected an error when adding a zero ed25519 pubKey")
+	}
+	if _, err := k.GetPubKey(e4crypto.HashIDAlias("id2")); err != ErrPubKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPubKeyNotFound)
+	}
+}
+
+func TestPubKeyMaterialSetPubKeys(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	generatePubKey := func(t *testing.T) ed25519.PublicKey {
+		pk, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+		return pk
+	}
+
+	oldID := e4crypto.HashIDAlias("old")
+	oldKey := generatePubKey(t)
+	if err := k.AddPubKey(oldID, oldKey); err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+
+	t.Run("invalid keys leave the store untouched", func(t *testing.T) {
+		invalidSets := []map[string][]byte{
+			{
+				hex.EncodeToString(e4crypto.HashIDAlias("id1")): generatePubKey(t),
+				hex.EncodeToString(e4crypto.HashIDAlias("id2")): []byte("not a key"),
+			},
+			{
+				"not hex": generatePubKey(t),
+			},
+		}
+
+		for _, invalidSet := range invalidSets {
+			if err := k.SetPubKeys(invalidSet); err == nil {
+				t.Fatal("Expected an error when setting an invalid pubkeys set")
+			}
+
+			if g, w := len(k.GetPubKeys()), 1; g != w {
+				t.Fatalf("Invalid pubkeys count: got %d, wanted %d", g, w)
+			}
+			pk, err := k.GetPubKey(oldID)
+			if err != nil {
+				t.Fatalf("Failed to get pubKey: %v", err)
+			}
+			if !bytes.Equal(pk, oldKey) {
+				t.Fatalf("Invalid pubKey: got %v, wanted %v", pk, oldKey)
+			}
+		}
+	})
+
+	t.Run("valid keys replace the store", func(t *testing.T) {
+		newKeys := map[string][]byte{
+			hex.EncodeToString(e4crypto.HashIDAlias("id1")): generatePubKey(t),
+			hex.EncodeToString(e4crypto.HashIDAlias("id2")): generatePubKey(t),
+		}
+
+		if err := k.SetPubKeys(newKeys); err != nil {
+			t.Fatalf("Failed to set pubkeys: %v", err)
+		}
+
+		if _, err := k.GetPubKey(oldID); err != ErrPubKeyNotFound {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPubKeyNotFound)
+		}
+		if g, w := len(k.GetPubKeys()), len(newKeys); g != w {
+			t.Fatalf("Invalid pubkeys count: got %d, wanted %d", g, w)
+		}
+		for sid, expectedKey := range newKeys {
+			id, _ := hex.DecodeString(sid)
+			info, err := k.GetPubKeyInfo(id)
+			if err != nil {
+				t.Fatalf("Failed to get pubKey info: %v", err)
+			}
+			if !bytes.Equal(info.Key, expectedKey) {
+				t.Fatalf("Invalid pubKey: got %v, wanted %v", info.Key, expectedKey)
+			}
+			if info.AddedAt.IsZero() {
+				t.Fatal("Expected pubKey added time to be set")
+			}
+		}
+	})
+}
+
+func TestPubKeyMaterialAddPubKeyIfChanged(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	id := e4crypto.HashIDAlias("id")
+	pubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	otherPubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	changed, err := k.AddPubKeyIfChanged(id, pubKey)
+	if err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+	if !changed {
+		t.Fatal("Expected adding a new key to report a change")
+	}
+
+	changed, err = k.AddPubKeyIfChanged(id, append([]byte{}, pubKey...))
+	if err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+	if changed {
+		t.Fatal("Expected adding the same key again to report no change")
+	}
+
+	changed, err = k.AddPubKeyIfChanged(id, otherPubKey)
+	if err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+	if !changed {
+		t.Fatal("Expected replacing the key to report a change")
+	}
+
+	stored, err := k.GetPubKey(id)
+	if err != nil {
+		t.Fatalf("Failed to get pubKey: %v", err)
+	}
+	if !bytes.Equal(stored, otherPubKey) {
+		t.Fatalf("Invalid pubKey: got %v, wanted %v", stored, otherPubKey)
+	}
+
+	// The stored key must be a copy of the given one
+	otherPubKey[0] ^= 0xFF
+	if bytes.Equal(stored, otherPubKey) {
+		t.Fatal("Expected the stored key to not be affected by changes to the given one")
+	}
+
+	if _, err := k.AddPubKeyIfChanged(id, []byte("not a key")); err == nil {
+		t.Fatal("Expected an error when adding an invalid key")
+	}
+}
+
+func TestPubKeyMaterialMergePubKeys(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	id1 := e4crypto.HashIDAlias("id1")
+	id2 := e4crypto.HashIDAlias("id2")
+	pk1, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	pk2, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	if err := k.AddPubKey(id1, pk1); err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+
+	changed, err := k.MergePubKeys(map[string][]byte{hex.EncodeToString(id1): pk1})
+	if err != nil {
+		t.Fatalf("Failed to merge pubKeys: %v", err)
+	}
+	if changed {
+		t.Fatal("Expected merging an already stored key to report no change")
+	}
+
+	changed, err = k.MergePubKeys(map[string][]byte{
+		hex.EncodeToString(id1): pk1,
+		hex.EncodeToString(id2): pk2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to merge pubKeys: %v", err)
+	}
+	if !changed {
+		t.Fatal("Expected merging a new key to report a change")
+	}
+
+	expectedPubKeys := map[string]ed25519.PublicKey{
+		hex.EncodeToString(id1): pk1,
+		hex.EncodeToString(id2): pk2,
+	}
+	if g, w := k.GetPubKeys(), expectedPubKeys; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid pubKeys: got %v, wanted %v", g, w)
+	}
+
+	// Nothing is merged when any key is invalid
+	id3 := e4crypto.HashIDAlias("id3")
+	if _, err := k.MergePubKeys(map[string][]byte{
+		hex.EncodeToString(id3): pk1,
+		hex.EncodeToString(id1): []byte("not a key"),
+	}); err == nil {
+		t.Fatal("Expected an error when merging an invalid key")
+	}
+	if _, err := k.GetPubKey(id3); err != ErrPubKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPubKeyNotFound)
+	}
+}
+
+func TestPubKeyMaterialDiff(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	newPubKey := func() []byte {
+		pubKey, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+
+		return pubKey
+	}
+
+	keptID := hex.EncodeToString(e4crypto.HashIDAlias("kept"))
+	changedID := hex.EncodeToString(e4crypto.HashIDAlias("changed"))
+	removedID := hex.EncodeToString(e4crypto.HashIDAlias("removed"))
+	addedID := hex.EncodeToString(e4crypto.HashIDAlias("added"))
+
+	current := map[string][]byte{
+		keptID:    newPubKey(),
+		changedID: newPubKey(),
+		removedID: newPubKey(),
+	}
+	if err := k.SetPubKeys(current); err != nil {
+		t.Fatalf("Failed to set pubKeys: %v", err)
+	}
+
+	toAdd, toRemove := k.Diff(current)
+	if len(toAdd) != 0 || len(toRemove) != 0 {
+		t.Fatalf("Invalid diff of the current keys: got %v and %v, wanted no changes", toAdd, toRemove)
+	}
+
+	desired := map[string][]byte{
+		keptID:    current[keptID],
+		changedID: newPubKey(),
+		addedID:   newPubKey(),
+	}
+
+	toAdd, toRemove = k.Diff(desired)
+	expectedToAdd := map[string][]byte{
+		changedID: desired[changedID],
+		addedID:   desired[addedID],
+	}
+	if !reflect.DeepEqual(toAdd, expectedToAdd) {
+		t.Fatalf("Invalid keys to add: got %v, wanted %v", toAdd, expectedToAdd)
+	}
+	expectedToRemove := map[string][]byte{
+		removedID: current[removedID],
+	}
+	if !reflect.DeepEqual(toRemove, expectedToRemove) {
+		t.Fatalf("Invalid keys to remove: got %v, wanted %v", toRemove, expectedToRemove)
+	}
+
+	// Applying the diff brings the store in sync
+	for sid, pubKey := range toAdd {
+		id, err := hex.DecodeString(sid)
+		if err != nil {
+			t.Fatalf("Failed to decode id: %v", err)
+		}
+		if err := k.AddPubKey(id, pubKey); err != nil {
+			t.Fatalf("Failed to add pubKey: %v", err)
+		}
+	}
+	for sid := range toRemove {
+		id, err := hex.DecodeString(sid)
+		if err != nil {
+			t.Fatalf("Failed to decode id: %v", err)
+		}
+		if err := k.RemovePubKey(id); err != nil {
+			t.Fatalf("Failed to remove pubKey: %v", err)
+		}
+	}
+
+	toAdd, toRemove = k.Diff(desired)
+	if len(toAdd) != 0 || len(toRemove) != 0 {
+		t.Fatalf("Invalid diff after applying it: got %v and %v, wanted no changes", toAdd, toRemove)
+	}
+}
+
+func TestPubKeyMaterialVerifyChallenge(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	signerID := e4crypto.HashIDAlias("signer")
+	signerPubKey, signerPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	if err := k.AddPubKey(signerID, signerPubKey); err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+
+	challenge := e4crypto.RandomKey()
+
+	if err := k.VerifyChallenge(signerID, challenge, ed25519.Sign(signerPrivKey, challenge)); err != nil {
+		t.Fatalf("Failed to verify challenge: %v", err)
+	}
+
+	_, otherPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	err = k.VerifyChallenge(signerID, challenge, ed25519.Sign(otherPrivKey, challenge))
+	if err != e4crypto.ErrInvalidSignature {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, e4crypto.ErrInvalidSignature)
+	}
+
+	err = k.VerifyChallenge(e4crypto.HashIDAlias("unknown"), challenge, ed25519.Sign(signerPrivKey, challenge))
+	if err != ErrPubKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPubKeyNotFound)
+	}
+}
+
+func TestPubKeyMaterialValidate(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	id := e4crypto.HashIDAlias("valid")
+	pubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	if err := k.AddPubKey(id, pubKey); err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+
+	if err := k.Validate(); err != nil {
+		t.Fatalf("Expected a valid store, got error: %v", err)
+	}
+
+	jsonKey, err := json.Marshal(k)
+	if err != nil {
+		t.Fatalf("Failed to marshal key to json: %v", err)
+	}
+
+	corruptions := map[string]func(pubKeys map[string]interface{}){
+		"truncated key": func(pubKeys map[string]interface{}) {
+			pubKeys[hex.EncodeToString(e4crypto.HashIDAlias("corrupt"))] = pubKey[:ed25519.PublicKeySize-1]
+		},
+		"empty key": func(pubKeys map[string]interface{}) {
+			pubKeys[hex.EncodeToString(e4crypto.HashIDAlias("corrupt"))] = []byte{}
+		},
+		"invalid hex id": func(pubKeys map[string]interface{}) {
+			pubKeys["not hex"] = pubKey
+		},
+		"duplicate id with trailing bytes": func(pubKeys map[string]interface{}) {
+			pubKeys[hex.EncodeToString(append(id, 0x00))] = pubKey
+		},
+	}
+
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			raw := make(map[string]interface{})
+			if err := json.Unmarshal(jsonKey, &raw); err != nil {
+				t.Fatalf("Failed to unmarshal json key: %v", err)
+			}
+
+			keyData := raw["keyData"].(map[string]interface{})
+			pubKeys := keyData["PubKeys"].(map[string]interface{})
+			corrupt(pubKeys)
+
+			corruptJSON, err := json.Marshal(raw)
+			if err != nil {
+				t.Fatalf("Failed to marshal corrupt json key: %v", err)
+			}
+
+			corruptKey, err := FromRawJSON(corruptJSON)
+			if err != nil {
+				t.Fatalf("Failed to unmarshal corrupt json key: %v", err)
+			}
+
+			if err := corruptKey.(PubKeyMaterial).Validate(); err == nil {
+				t.Fatal("Expected an error when validating a corrupt store")
+			}
+		})
+	}
+}
+
+func TestPubKeyMaterialC2PubKeys(t *testing.T) {
+	primaryC2PubKey := getTestC2PubKey(t)
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), primaryC2PubKey)
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	failoverC2PubKeys := make([][]byte, MaxC2PubKeys-1)
+	for i := range failoverC2PubKeys {
+		failoverC2PubKeys[i] = getTestC2PubKey(t)
+		if err := k.AddC2PubKey(failoverC2PubKeys[i]); err != nil {
+			t.Fatalf("Failed to add C2 public key: %v", err)
+		}
+	}
+
+	// Adding a trusted key is a no-op
+	if err := k.AddC2PubKey(failoverC2PubKeys[0]); err != nil {
+		t.Fatalf("Failed to add C2 public key: %v", err)
+	}
+	if err := k.AddC2PubKey(getTestC2PubKey(t)); err != ErrTooManyC2PubKeys {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTooManyC2PubKeys)
+	}
+	if err := k.AddC2PubKey([]byte("not a key")); err == nil {
+		t.Fatal("Expected an error when adding an invalid C2 public key")
+	}
+
+	expectedC2PubKeys := append([][]byte{primaryC2PubKey}, failoverC2PubKeys...)
+	if g, w := k.C2PubKeys(), expectedC2PubKeys; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid C2 public keys: got %v, wanted %v", g, w)
+	}
+
+	jsonKey, err := json.Marshal(k)
+	if err != nil {
+		t.Fatalf("Failed to marshal key to json: %v", err)
+	}
+	hexJSONKey, err := MarshalJSONHex(k)
+	if err != nil {
+		t.Fatalf("Failed to marshal key to hex json: %v", err)
+	}
+	for _, data := range [][]byte{jsonKey, hexJSONKey} {
+		loadedKey, err := FromRawJSON(data)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal json key: %v", err)
+		}
+
+		if g, w := loadedKey.(PubKeyMaterial).C2PubKeys(), expectedC2PubKeys; !reflect.DeepEqual(g, w) {
+			t.Fatalf("Invalid unmarshalled C2 public keys: got %v, wanted %v", g, w)
+		}
+	}
+
+	// Removing the primary key promotes the first failover key
+	if err := k.RemoveC2PubKey(primaryC2PubKey); err != nil {
+		t.Fatalf("Failed to remove C2 public key: %v", err)
+	}
+	if k.C2KeyMatches(primaryC2PubKey) {
+		t.Fatal("Expected the removed C2 public key to not match")
+	}
+	if g, w := k.C2PubKeys(), failoverC2PubKeys; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid C2 public keys: got %v, wanted %v", g, w)
+	}
+
+	if err := k.RemoveC2PubKey(primaryC2PubKey); err != ErrC2PubKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrC2PubKeyNotFound)
+	}
+
+	for _, c2PubKey := range failoverC2PubKeys[1:] {
+		if err := k.RemoveC2PubKey(c2PubKey); err != nil {
+			t.Fatalf("Failed to remove C2 public key: %v", err)
+		}
+	}
+	if err := k.RemoveC2PubKey(failoverC2PubKeys[0]); err != ErrLastC2PubKey {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrLastC2PubKey)
+	}
+}
+
+func TestPubKeyMaterialDropPrivateKey(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	privateKey := k.(*pubKeyMaterial).PrivateKey
+	k.DropPrivateKey()
+
+	if !bytes.Equal(privateKey, make([]byte, len(privateKey))) {
+		t.Fatal("Expected the dropped private key to be zeroed")
+	}
+	if k.CanProtect() {
+		t.Fatal("Expected a verifier only material to not be able to protect")
+	}
+	if k.PublicKey() != nil {
+		t.Fatalf("Invalid public key: got %v, wanted nil", k.PublicKey())
+	}
+
+	if _, err := k.ProtectMessage([]byte("payload"), e4crypto.RandomKey()); err != ErrNoPrivateKey {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrNoPrivateKey)
+	}
+	if _, err := k.UnprotectCommand(make([]byte, e4crypto.TimestampLen+e4crypto.TagLen+1)); err != ErrNoPrivateKey {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrNoPrivateKey)
+	}
+}
+
+func TestPubKeyMaterialWipe(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	pubKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	if err := k.AddPubKey(e4crypto.HashIDAlias("id"), pubKey); err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+
+	privateKey := k.(*pubKeyMaterial).PrivateKey
+	k.Wipe()
+
+	if !bytes.Equal(privateKey, make([]byte, len(privateKey))) {
+		t.Fatal("Expected the wiped private key to be zeroed")
+	}
+	if k.CanProtect() {
+		t.Fatal("Expected a wiped material to not be able to protect")
+	}
+	if g, w := len(k.GetPubKeys()), 0; g != w {
+		t.Fatalf("Invalid pubkeys count: got %d, wanted %d", g, w)
+	}
+	if g, w := len(k.C2PubKeys()), 0; g != w {
+		t.Fatalf("Invalid C2 pubkeys count: got %d, wanted %d", g, w)
+	}
+}
+
+func TestPubKeyMaterialStrictIDs(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	pk, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	// Lax mode is the default
+	if err := k.AddPubKey([]byte("id1"), pk); err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+
+	k.SetStrictIDs(true)
+
+	if err := k.AddPubKey([]byte("id2"), pk); err == nil {
+		t.Fatal("Expected an error when adding a pubKey with a short id in strict mode")
+	}
+	if _, err := k.GetPubKey([]byte("id2")); err != ErrPubKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPubKeyNotFound)
+	}
+
+	if err := k.AddPubKey(e4crypto.HashIDAlias("id2"), pk); err != nil {
+		t.Fatalf("Failed to add pubKey in strict mode: %v", err)
+	}
+
+	jsonKey, err := json.Marshal(k)
+	if err != nil {
+		t.Fatalf("Failed to marshal key to json: %v", err)
+	}
+	unmarshalledKey, err := FromRawJSON(jsonKey)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal key from json: %v", err)
+	}
+	if !unmarshalledKey.(*pubKeyMaterial).StrictIDs {
+		t.Fatal("Expected strict mode to be persisted")
+	}
+}
+
+func TestPubKeyMaterialAppendOnlyPubKeys(t *testing.T) {
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	id := e4crypto.HashIDAlias("id1")
+	pk1, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	pk2, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	// Keys can be replaced by default
+	if err := k.AddPubKey(id, pk1); err != nil {
+		t.Fatalf("Failed to add pubKey: %v", err)
+	}
+	if err := k.AddPubKey(id, pk2); err != nil {
+		t.Fatalf("Failed to replace pubKey: %v", err)
+	}
+
+	k.SetAppendOnlyPubKeys(true)
+
+	if err := k.AddPubKey(id, pk1); err != ErrPubKeyExists {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPubKeyExists)
+	}
+	if _, err := k.AddPubKeyIfChanged(id, pk1); err != ErrPubKeyExists {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPubKeyExists)
+	}
+	if err := k.SetPubKeys(map[string][]byte{hex.EncodeToString(id): pk1}); err == nil {
+		t.Fatal("Expected an error when replacing a pubKey with SetPubKeys in append only mode")
+	}
+
+	// Merging keys must not partially apply when one of them is a replacement
+	newID := e4crypto.HashIDAlias("id2")
+	merged := map[string][]byte{
+		hex.EncodeToString(newID): pk1,
+		hex.EncodeToString(id):    pk1,
+	}
+	if _, err := k.MergePubKeys(merged); err != ErrPubKeyExists {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPubKeyExists)
+	}
+	if _, err := k.GetPubKey(newID); err != ErrPubKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPubKeyNotFound)
+	}
+	if g, err := k.GetPubKey(id); err != nil || !bytes.Equal(g, pk2) {
+		t.Fatalf("Invalid pubKey: got %v (err: %v), wanted %v", g, err, pk2)
+	}
+
+	// Adding the same key again is not a replacement
+	if err := k.AddPubKey(id, pk2); err != nil {
+		t.Fatalf("Failed to add the same pubKey: %v", err)
+	}
+	if changed, err := k.AddPubKeyIfChanged(id, pk2); err != nil || changed {
+		t.Fatalf("Invalid AddPubKeyIfChanged result: got %v (err: %v), wanted false", changed, err)
+	}
+
+	// The key can be replaced once explicitly removed
+	if err := k.RemovePubKey(id); err != nil {
+		t.Fatalf("Failed to remove pubKey: %v", err)
+	}
+	if err := k.AddPubKey(id, pk1); err != nil {
+		t.Fatalf("Failed to add pubKey after removal: %v", err)
+	}
+
+	jsonKey, err := json.Marshal(k)
+	if err != nil {
+		t.Fatalf("Failed to marshal key to json: %v", err)
+	}
+	unmarshalledKey, err := FromRawJSON(jsonKey)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal key from json: %v", err)
+	}
+	if !unmarshalledKey.(*pubKeyMaterial).AppendOnlyPubKeys {
+		t.Fatal("Expected append only mode to be persisted")
+	}
+}
+
+func TestPubKeyMaterialPubKeyInfo(t *testing.T) {
+	clientID := e4crypto.HashIDAlias("test")
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	k, err := NewPubKeyMaterial(clientID, privateKey, getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	if _, err := k.GetPubKeyInfo([]byte("id1")); err != ErrPubKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPubKeyNotFound)
+	}
+
+	before := time.Now().Truncate(time.Second)
+	if err := k.AddPubKey(clientID, k.PublicKey()); err != nil {
+		t.Fatalf("Failed to add pubkey: %v", err)
+	}
+
+	info, err := k.GetPubKeyInfo(clientID)
+	if err != nil {
+		t.Fatalf("Failed to get pubkey info: %v", err)
+	}
+	if !bytes.Equal(info.Key, k.PublicKey()) {
+		t.Fatalf("Invalid pubkey: got %v, wanted %v", info.Key, k.PublicKey())
+	}
+	if info.AddedAt.Before(before) || info.AddedAt.After(time.Now()) {
+		t.Fatalf("Invalid added time: got %v, wanted between %v and now", info.AddedAt, before)
+	}
+
+	jsonKey, err := json.Marshal(k)
+	if err != nil {
+		t.Fatalf("Failed to marshal key into json: %v", err)
+	}
+	unmarshalledKey, err := FromRawJSON(jsonKey)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal json key: %v", err)
+	}
+
+	unmarshalledInfo, err := unmarshalledKey.(PubKeyStore).GetPubKeyInfo(clientID)
+	if err != nil {
+		t.Fatalf("Failed to get pubkey info: %v", err)
+	}
+	if !reflect.DeepEqual(unmarshalledInfo, info) {
+		t.Fatalf("Invalid unmarshalled pubkey info: got %#v, wanted %#v", unmarshalledInfo, info)
+	}
+}
+
+func TestPubKeyMaterialC2KeyMatches(t *testing.T) {
+	c2PubKey := getTestC2PubKey(t)
+
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), c2PubKey)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	if !k.C2KeyMatches(c2PubKey) {
+		t.Fatal("Expected C2 key to match")
+	}
+
+	if k.C2KeyMatches(getTestC2PubKey(t)) {
+		t.Fatal("Expected a different C2 key to not match")
+	}
+
+	if k.C2KeyMatches(c2PubKey[:len(c2PubKey)-1]) {
+		t.Fatal("Expected a truncated C2 key to not match")
+	}
+}
+
 func TestPubKeyMaterialSetKey(t *testing.T) {
 	_, privateKey, err := ed25519.GenerateKey(nil)
 	if err != nil {
@@ -381,6 +1284,109 @@ func TestPubKeyMaterialSetKey(t *testing.T) {
 	}
 }
 
+func TestPubKeyMaterialCreatedAt(t *testing.T) {
+	before := time.Now().Add(-time.Second)
+
+	k, err := NewRandomPubKeyMaterial(e4crypto.HashIDAlias("test"), getTestC2PubKey(t))
+	if err != nil {
+		t.Fatalf("Failed to create pubKeyMaterial: %v", err)
+	}
+
+	createdAt := k.CreatedAt()
+	if createdAt.Before(before) || createdAt.After(time.Now()) {
+		t.Fatalf("Invalid creation time: got %v, wanted a time after %v", createdAt, before)
+	}
+
+	jsonKey, err := json.Marshal(k)
+	if err != nil {
+		t.Fatalf("Failed to marshal key to json: %v", err)
+	}
+	unmarshalledKey, err := FromRawJSON(jsonKey)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal key from json: %v", err)
+	}
+	if g, w := unmarshalledKey.CreatedAt(), createdAt; !g.Equal(w) {
+		t.Fatalf("Invalid unmarshalled creation time: got %v, wanted %v", g, w)
+	}
+
+	now := time.Now().Add(24 * time.Hour)
+	k.SetClock(&testClock{now: now})
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	if err := k.SetKey(privateKey); err != nil {
+		t.Fatalf("Failed to set key: %v", err)
+	}
+	if g, w := k.CreatedAt(), now.UTC().Truncate(time.Second); !g.Equal(w) {
+		t.Fatalf("Invalid creation time after SetKey: got %v, wanted %v", g, w)
+	}
+}
+
+func TestPubKeyMaterialEqualCrypto(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	clientID := e4crypto.HashIDAlias("test")
+	c2Pk := getTestC2PubKey(t)
+
+	newKey := func(t *testing.T) *pubKeyMaterial {
+		k, err := NewPubKeyMaterial(clientID, privateKey, c2Pk)
+		if err != nil {
+			t.Fatalf("Failed to create key: %v", err)
+		}
+
+		return k.(*pubKeyMaterial)
+	}
+
+	pk, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate public key: %v", err)
+	}
+
+	k1 := newKey(t)
+	k2 := newKey(t)
+	for _, k := range []*pubKeyMaterial{k1, k2} {
+		if err := k.AddPubKey(e4crypto.HashIDAlias("signer"), pk); err != nil {
+			t.Fatalf("Failed to add pubkey: %v", err)
+		}
+	}
+	k2.KeyCreatedAt = k1.KeyCreatedAt.Add(-time.Hour)
+
+	if !k1.EqualCrypto(k2) {
+		t.Fatal("Expected materials only differing by creation time to be EqualCrypto")
+	}
+	if reflect.DeepEqual(k1, k2) {
+		t.Fatal("Expected materials with different creation times to not be equal")
+	}
+
+	k3 := newKey(t)
+	if k1.EqualCrypto(k3) {
+		t.Fatal("Expected materials with different public keys to not be EqualCrypto")
+	}
+
+	k4 := newKey(t)
+	if err := k4.AddPubKey(e4crypto.HashIDAlias("signer"), pk); err != nil {
+		t.Fatalf("Failed to add pubkey: %v", err)
+	}
+	if err := k4.AddC2PubKey(getTestC2PubKey(t)); err != nil {
+		t.Fatalf("Failed to add C2 pubkey: %v", err)
+	}
+	if k1.EqualCrypto(k4) {
+		t.Fatal("Expected materials with different C2 public keys to not be EqualCrypto")
+	}
+
+	symKey, err := NewRandomSymKeyMaterial()
+	if err != nil {
+		t.Fatalf("Failed to create symKeyMaterial: %v", err)
+	}
+	if k1.EqualCrypto(symKey) {
+		t.Fatal("Expected materials of different types to not be EqualCrypto")
+	}
+}
+
 func TestPubKeyMaterialMarshalJSON(t *testing.T) {
 	_, privateKey, err := ed25519.GenerateKey(nil)
 	if err != nil {
@@ -15,8 +15,10 @@
 package keys
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	e4crypto "github.com/teserakt-io/e4go/crypto"
 )
@@ -28,7 +30,12 @@ type SymKeyMaterial interface {
 
 // symKeyMaterial implements SymKeyMaterial
 type symKeyMaterial struct {
-	Key []byte `json:"key,omitempty"`
+	Key []byte         `json:"key,omitempty"`
+	KDF *KDFProvenance `json:"kdf,omitempty"`
+	// KeyCreatedAt holds when the key has been created
+	KeyCreatedAt time.Time `json:"createdAt"`
+
+	clock e4crypto.Clock
 }
 
 var _ SymKeyMaterial = (*symKeyMaterial)(nil)
@@ -39,7 +46,9 @@ func NewSymKeyMaterial(key []byte) (SymKeyMaterial, error) {
 		return nil, fmt.Errorf("failed to validate sym key: %v", err)
 	}
 
-	s := &symKeyMaterial{}
+	s := &symKeyMaterial{
+		KeyCreatedAt: creationTime(nil),
+	}
 
 	s.Key = make([]byte, len(key))
 	copy(s.Key, key)
@@ -54,7 +63,22 @@ func NewRandomSymKeyMaterial() (SymKeyMaterial, error) {
 
 // Protect will encrypt payload with the key and returns it, or an error if it fail
 func (k *symKeyMaterial) ProtectMessage(payload []byte, topicKey TopicKey) ([]byte, error) {
-	protected, err := e4crypto.ProtectSymKey(payload, topicKey)
+	topicCipher, err := e4crypto.NewCipher(topicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.ProtectMessageWithCipher(payload, topicCipher)
+}
+
+// CanProtect returns true, as a symmetric material always holds its key
+func (k *symKeyMaterial) CanProtect() bool {
+	return true
+}
+
+// ProtectMessageWithCipher will encrypt payload with the given topic cipher and returns it, or an error if it fail
+func (k *symKeyMaterial) ProtectMessageWithCipher(payload []byte, topicCipher *e4crypto.Cipher) ([]byte, error) {
+	protected, err := topicCipher.ProtectAt(payload, clockNow(k.clock))
 	if err != nil {
 		return nil, err
 	}
@@ -65,13 +89,13 @@ func (k *symKeyMaterial) ProtectMessage(payload []byte, topicKey TopicKey) ([]by
 // UnprotectCommand attempts to decrypt a client command from given protected cipher,
 // using the material's key
 func (k *symKeyMaterial) UnprotectCommand(protected []byte) ([]byte, error) {
-	return e4crypto.UnprotectSymKey(protected, k.Key)
+	return e4crypto.UnprotectSymKeyAt(protected, k.Key, clockNow(k.clock))
 }
 
 // UnprotectMessage attempts to decrypt a message from given protected cipher,
 // using given topic key
 func (k *symKeyMaterial) UnprotectMessage(protected []byte, topicKey TopicKey) ([]byte, error) {
-	return e4crypto.UnprotectSymKey(protected, topicKey)
+	return e4crypto.UnprotectSymKeyAt(protected, topicKey, clockNow(k.clock))
 }
 
 // SetKey will validate the given key and copy it into the SymKeyMaterial private key when valid
@@ -84,10 +108,57 @@ func (k *symKeyMaterial) SetKey(key []byte) error {
 	copy(sk, key)
 
 	k.Key = sk
+	k.KDF = nil
+	k.KeyCreatedAt = creationTime(k.clock)
 
 	return nil
 }
 
+// SetKDFProvenance records how the material key has been derived from a password
+func (k *symKeyMaterial) SetKDFProvenance(provenance *KDFProvenance) {
+	k.KDF = provenance
+}
+
+// KDFProvenance returns how the material key has been derived from a password, or nil
+func (k *symKeyMaterial) KDFProvenance() *KDFProvenance {
+	return k.KDF
+}
+
+// CreatedAt returns when the material key has been created, or the zero time when unknown
+func (k *symKeyMaterial) CreatedAt() time.Time {
+	return k.KeyCreatedAt
+}
+
+// UnwrapKey decrypts a key wrapped with the material key
+func (k *symKeyMaterial) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return e4crypto.UnwrapKey(wrapped, k.Key)
+}
+
+// Wipe zeroes and removes the material key
+func (k *symKeyMaterial) Wipe() {
+	for i := range k.Key {
+		k.Key[i] = 0
+	}
+
+	k.Key = nil
+	k.KDF = nil
+}
+
+// EqualCrypto returns true when the other material is a symmetric material holding the same key
+func (k *symKeyMaterial) EqualCrypto(other KeyMaterial) bool {
+	o, ok := other.(*symKeyMaterial)
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(k.Key, o.Key) == 1
+}
+
+// SetClock sets the clock used to stamp and validate protected messages timestamps
+func (k *symKeyMaterial) SetClock(clock e4crypto.Clock) {
+	k.clock = clock
+}
+
 // MarshalJSON  will infer the key type in the marshalled json data
 // to be able to know which key to instantiate when unmarshalling back
 func (k *symKeyMaterial) MarshalJSON() ([]byte, error) {
@@ -96,9 +167,13 @@ func (k *symKeyMaterial) MarshalJSON() ([]byte, error) {
 	jsonKey := &jsonKey{
 		KeyType: symKeyMaterialType,
 		KeyData: struct {
-			Key []byte
+			Key       []byte
+			KDF       *KDFProvenance `json:",omitempty"`
+			CreatedAt time.Time
 		}{
-			Key: k.Key,
+			Key:       k.Key,
+			KDF:       k.KDF,
+			CreatedAt: k.KeyCreatedAt,
 		},
 	}
 
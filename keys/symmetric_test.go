@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
 
 	e4crypto "github.com/teserakt-io/e4go/crypto"
 )
@@ -85,6 +86,34 @@ func TestNewRandomSymKey(t *testing.T) {
 	}
 }
 
+func TestSymKeyCanProtect(t *testing.T) {
+	k, err := NewRandomSymKeyMaterial()
+	if err != nil {
+		t.Fatalf("Failed to create symKeyMaterial: %v", err)
+	}
+
+	if !k.CanProtect() {
+		t.Fatal("Expected symKeyMaterial to be able to protect messages")
+	}
+}
+
+func TestSymKeyWipe(t *testing.T) {
+	k, err := NewRandomSymKeyMaterial()
+	if err != nil {
+		t.Fatalf("Failed to create symKeyMaterial: %v", err)
+	}
+
+	key := k.(*symKeyMaterial).Key
+	k.Wipe()
+
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Fatal("Expected the wiped key to be zeroed")
+	}
+	if k.(*symKeyMaterial).Key != nil {
+		t.Fatalf("Invalid key: got %v, wanted nil", k.(*symKeyMaterial).Key)
+	}
+}
+
 func TestSymKeyProtectUnprotectMessage(t *testing.T) {
 	key := e4crypto.RandomKey()
 
@@ -195,3 +224,75 @@ func TestSymKeyMarshalJSON(t *testing.T) {
 		t.Fatalf("Invalid unmarshalled key: got %v, wanted %#v", unmarshalledKey, k)
 	}
 }
+
+func TestSymKeyCreatedAt(t *testing.T) {
+	before := time.Now().Add(-time.Second)
+
+	k, err := NewRandomSymKeyMaterial()
+	if err != nil {
+		t.Fatalf("Failed to create symKeyMaterial: %v", err)
+	}
+
+	createdAt := k.CreatedAt()
+	if createdAt.Before(before) || createdAt.After(time.Now()) {
+		t.Fatalf("Invalid creation time: got %v, wanted a time after %v", createdAt, before)
+	}
+
+	jsonKey, err := json.Marshal(k)
+	if err != nil {
+		t.Fatalf("Failed to marshal key to json: %v", err)
+	}
+	unmarshalledKey, err := FromRawJSON(jsonKey)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal key from json: %v", err)
+	}
+	if g, w := unmarshalledKey.CreatedAt(), createdAt; !g.Equal(w) {
+		t.Fatalf("Invalid unmarshalled creation time: got %v, wanted %v", g, w)
+	}
+
+	now := time.Now().Add(24 * time.Hour)
+	k.SetClock(&testClock{now: now})
+	if err := k.SetKey(e4crypto.RandomKey()); err != nil {
+		t.Fatalf("Failed to set key: %v", err)
+	}
+	if g, w := k.CreatedAt(), now.UTC().Truncate(time.Second); !g.Equal(w) {
+		t.Fatalf("Invalid creation time after SetKey: got %v, wanted %v", g, w)
+	}
+}
+
+// testClock implements e4crypto.Clock, always returning the same time
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestSymKeyEqualCrypto(t *testing.T) {
+	key := e4crypto.RandomKey()
+	k1, err := NewSymKeyMaterial(key)
+	if err != nil {
+		t.Fatalf("Failed to create symKeyMaterial: %v", err)
+	}
+	k2, err := NewSymKeyMaterial(key)
+	if err != nil {
+		t.Fatalf("Failed to create symKeyMaterial: %v", err)
+	}
+	k2.(*symKeyMaterial).KeyCreatedAt = k1.CreatedAt().Add(-time.Hour)
+
+	if !k1.EqualCrypto(k2) {
+		t.Fatal("Expected materials only differing by creation time to be EqualCrypto")
+	}
+	if reflect.DeepEqual(k1, k2) {
+		t.Fatal("Expected materials with different creation times to not be equal")
+	}
+
+	k3, err := NewRandomSymKeyMaterial()
+	if err != nil {
+		t.Fatalf("Failed to create symKeyMaterial: %v", err)
+	}
+	if k1.EqualCrypto(k3) {
+		t.Fatal("Expected materials with different keys to not be EqualCrypto")
+	}
+}
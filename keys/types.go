@@ -17,14 +17,29 @@ package keys
 
 import (
 	"errors"
+	"time"
 
 	"golang.org/x/crypto/ed25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
 )
 
 var (
 
 	// ErrPubKeyNotFound occurs when a public key is missing when verifying a signature
 	ErrPubKeyNotFound = errors.New("signer public key not found")
+	// ErrPubKeyExists occurs when replacing a public key in an append only store
+	ErrPubKeyExists = errors.New("a different public key is already stored for this id")
+	// ErrUnsignedMessage occurs when receiving an unsigned message while unsigned messages are not enabled
+	ErrUnsignedMessage = errors.New("unsigned message")
+	// ErrNoPrivateKey occurs when protecting a message or unprotecting a command
+	// with a verifier only material, not holding a private key
+	ErrNoPrivateKey = errors.New("no private key, the key material is verifier only")
+	// ErrNoC2Configured occurs when unprotecting a command with a public key material
+	// created without C2 public key, for peer to peer deployments
+	ErrNoC2Configured = errors.New("no c2 public key configured, commands are not supported")
+	// ErrCorruptKeyFile occurs when loading a key material holding invalid keys
+	ErrCorruptKeyFile = errors.New("corrupted key file, invalid key")
 )
 
 // TopicKey defines a custom type for topic keys, avoiding mixing them
@@ -40,14 +55,42 @@ type KeyMaterial interface {
 	// ProtectMessage encrypt given payload using the topicKey
 	// and returns the protected cipher, or an error
 	ProtectMessage(payload []byte, topicKey TopicKey) ([]byte, error)
+	// CanProtect returns true when the material holds the private key needed to protect messages.
+	// It is false for verifier only materials, which can only unprotect them.
+	CanProtect() bool
+	// ProtectMessageWithCipher works like ProtectMessage, but encrypts the payload with the given
+	// cipher, created from the topic key. It allows to reuse the cipher for many messages.
+	ProtectMessageWithCipher(payload []byte, topicCipher *e4crypto.Cipher) ([]byte, error)
 	// UnprotectMessage decrypt the given cipher using the topicKey
 	// and returns the clear payload, or an error
 	UnprotectMessage(protected []byte, topicKey TopicKey) ([]byte, error)
 	// UnprotectCommand decrypt the given protected command using the key material private key
 	// and returns the command, or an error
 	UnprotectCommand(protected []byte) ([]byte, error)
+	// UnwrapKey decrypts a key wrapped with crypto.WrapKey under the key protecting the material commands,
+	// and returns it, or an error when it isn't authentic
+	UnwrapKey(wrapped []byte) ([]byte, error)
 	// SetKey sets the material private key, or return an error when the key is invalid
 	SetKey(key []byte) error
+	// SetKDFProvenance records how the material private key has been derived from a password.
+	// It is persisted along with the key, and cleared when the key is replaced with SetKey.
+	SetKDFProvenance(provenance *KDFProvenance)
+	// KDFProvenance returns how the material private key has been derived from a password,
+	// or nil when it hasn't been derived from a password, or it is unknown.
+	KDFProvenance() *KDFProvenance
+	// SetClock sets the clock used to stamp and validate protected messages timestamps.
+	// When not set, the system time is used.
+	SetClock(clock e4crypto.Clock)
+	// CreatedAt returns when the material private key has been created, or replaced with SetKey.
+	// It returns the zero time when unknown, such as for materials persisted before it was recorded.
+	CreatedAt() time.Time
+	// Wipe zeroes the material secret keys, and clears its public keys when it holds some.
+	// The material can't be used anymore afterwards.
+	Wipe()
+	// EqualCrypto returns true when the other material is of the same type and holds the same keys,
+	// such as its private or symmetric key, C2 public keys and trusted public keys. Metadata, such as
+	// the keys creation time, is ignored, allowing to compare a material with a reloaded copy.
+	EqualCrypto(other KeyMaterial) bool
 	// MarshalJSON marshal the key material into json
 	MarshalJSON() ([]byte, error)
 }
@@ -58,11 +101,23 @@ type KeyMaterial interface {
 // a ErrUnsupportedOperation error.
 type PubKeyStore interface {
 	// AddPubKey allows to add a public key to the store, identified by ID.
-	// If a key already exists with this ID, it will be replaced.
+	// If a key already exists with this ID, it will be replaced, unless the store
+	// is append only, where ErrPubKeyExists is returned instead.
 	AddPubKey(id []byte, key ed25519.PublicKey) error
+	// AddEd25519PubKey adds a copy of the given ed25519 public key to the store, identified by ID,
+	// after validating it. If a key already exists with this ID, it will be replaced.
+	AddEd25519PubKey(id []byte, key ed25519.PublicKey) error
+	// AddPubKeyIfChanged adds a copy of the given public key to the store, identified by ID,
+	// and reports whether the store changed. When the same key is already stored
+	// with this ID, it is left untouched and false is returned. ErrPubKeyExists is returned
+	// when a different key is stored with this ID and the store is append only.
+	AddPubKeyIfChanged(id, key []byte) (changed bool, err error)
 	// GetPubKey returns the public key associated to the ID.
 	// ErrPubKeyNotFound is returned when it cannot be found.
 	GetPubKey(id []byte) (ed25519.PublicKey, error)
+	// GetPubKeyInfo returns the public key associated to the ID, along with its metadata.
+	// ErrPubKeyNotFound is returned when it cannot be found.
+	GetPubKeyInfo(id []byte) (PubKeyInfo, error)
 	// GetPubKeys returns all stored public keys, in a ID indexed map.
 	GetPubKeys() map[string]ed25519.PublicKey
 	// RemovePubKey removes a public key from the store by its ID, or returns
@@ -70,4 +125,69 @@ type PubKeyStore interface {
 	RemovePubKey(id []byte) error
 	// ResetPubKeys removes all public keys stored.
 	ResetPubKeys()
+	// SetPubKeys replaces all the stored public keys by the given ones, indexed by hex encoded ID.
+	// All keys and IDs are validated first, and the stored keys are left untouched on any error.
+	SetPubKeys(pubKeys map[string][]byte) error
+	// MergePubKeys adds the given public keys, indexed by hex encoded ID, to the stored ones, and reports whether
+	// the store changed. All keys and IDs are validated first, as well as the append only mode, and the stored
+	// keys are left untouched on any error.
+	MergePubKeys(pubKeys map[string][]byte) (changed bool, err error)
+	// Diff compares the stored public keys to the desired ones, indexed by hex encoded ID, returning the keys
+	// to add, new or changed, and the ones to remove, allowing to reconcile the store with the minimal changes.
+	// Both are empty when the store already holds the desired keys.
+	Diff(desired map[string][]byte) (toAdd, toRemove map[string][]byte)
+	// VerifyChallenge verifies the signature of the given challenge under the public key stored for the ID,
+	// confirming its owner holds the matching private key, such as when pinning a signer on onboarding.
+	// ErrPubKeyNotFound is returned when no key is stored for the ID, and crypto.ErrInvalidSignature
+	// when the signature doesn't verify.
+	VerifyChallenge(id, challenge, signature []byte) error
+	// Validate checks the consistency of the stored public keys, returning an error
+	// identifying the first invalid entry. It is useful after loading an untrusted file.
+	Validate() error
+	// LoadPubKeysFromDir adds to the store the public key of each file found in dir.
+	// See LoadPubKeysFromDir function for the expected file format.
+	// It returns the count of loaded keys, and an error describing every file which failed to load.
+	LoadPubKeysFromDir(dir string) (int, error)
+}
+
+// KDFProvenance records the key derivation function and parameters used to derive a key from a password.
+// The password itself is never recorded.
+type KDFProvenance struct {
+	// Algorithm is the name of the key derivation function (see crypto.Argon2Algorithm)
+	Algorithm string `json:"algorithm"`
+	// Params are the key derivation function parameters
+	Params e4crypto.Argon2Params `json:"params"`
+}
+
+// NewArgon2Provenance returns a KDFProvenance for keys derived with crypto.DeriveKey and the given parameters
+func NewArgon2Provenance(params e4crypto.Argon2Params) *KDFProvenance {
+	return &KDFProvenance{
+		Algorithm: e4crypto.Argon2Algorithm,
+		Params:    params,
+	}
+}
+
+// PubKeyInfo holds a public key and its metadata
+type PubKeyInfo struct {
+	// Key is the ed25519 public key
+	Key ed25519.PublicKey
+	// AddedAt is the time the key has been added to the store,
+	// or the zero time when unknown (keys stored by previous versions)
+	AddedAt time.Time
+}
+
+// clockNow returns the current time from the given clock,
+// falling back on the system time when the clock is nil
+// creationTime returns the current time from the given clock, as stored in key materials
+// creation timestamps: in UTC, truncated to the second.
+func creationTime(clock e4crypto.Clock) time.Time {
+	return clockNow(clock).UTC().Truncate(time.Second)
+}
+
+func clockNow(clock e4crypto.Clock) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+
+	return clock.Now()
 }
@@ -0,0 +1,104 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+	"github.com/teserakt-io/e4go/keys"
+)
+
+// FailureReason classifies why a protect or unprotect operation failed, for metrics
+type FailureReason string
+
+// List of failure reasons reported to Metrics
+const (
+	// FailureTopicKeyNotFound is reported when the client has no key for the topic
+	FailureTopicKeyNotFound FailureReason = "topic_key_not_found"
+	// FailureAuthentication is reported when a message fails to authenticate,
+	// either its ciphertext or its signature
+	FailureAuthentication FailureReason = "authentication"
+	// FailureTimestampTooOld is reported when a message is older than the accepted delay
+	FailureTimestampTooOld FailureReason = "timestamp_too_old"
+	// FailureTimestampInFuture is reported when a message timestamp is in the future
+	FailureTimestampInFuture FailureReason = "timestamp_in_future"
+	// FailureUnknownSigner is reported when the client lacks the public key of a message signer
+	FailureUnknownSigner FailureReason = "unknown_signer"
+	// FailureOther is reported for any other failure, such as malformed messages or commands
+	FailureOther FailureReason = "other"
+)
+
+// Metrics receives the outcome of each client protect and unprotect operation,
+// allowing to expose them to a monitoring system without the client depending on it.
+// Commands unprotected by the client are reported as unprotect operations.
+// Implementations must be safe for concurrent use, and should return quickly
+// as they are called synchronously.
+type Metrics interface {
+	// ProtectSucceeded is called when a message has been protected
+	ProtectSucceeded()
+	// ProtectFailed is called when a message failed to be protected
+	ProtectFailed(reason FailureReason)
+	// UnprotectSucceeded is called when a message or a command has been unprotected
+	UnprotectSucceeded()
+	// UnprotectFailed is called when a message or a command failed to be unprotected
+	UnprotectFailed(reason FailureReason)
+}
+
+// noopMetrics implements Metrics, ignoring all the operations outcomes
+type noopMetrics struct{}
+
+var _ Metrics = noopMetrics{}
+
+func (noopMetrics) ProtectSucceeded()             {}
+func (noopMetrics) ProtectFailed(FailureReason)   {}
+func (noopMetrics) UnprotectSucceeded()           {}
+func (noopMetrics) UnprotectFailed(FailureReason) {}
+
+// failureReasonOf returns the failure reason of the given error
+func failureReasonOf(err error) FailureReason {
+	switch errorCause(err) {
+	case ErrTopicKeyNotFound:
+		return FailureTopicKeyNotFound
+	case e4crypto.ErrNotAuthentic, e4crypto.ErrInvalidSignature:
+		return FailureAuthentication
+	case e4crypto.ErrTimestampTooOld:
+		return FailureTimestampTooOld
+	case e4crypto.ErrTimestampInFuture:
+		return FailureTimestampInFuture
+	case keys.ErrPubKeyNotFound:
+		return FailureUnknownSigner
+	default:
+		return FailureOther
+	}
+}
+
+// recordProtect reports the outcome of a protect operation to the client metrics
+func (c *client) recordProtect(err error) {
+	if err != nil {
+		c.metrics.ProtectFailed(failureReasonOf(err))
+		return
+	}
+
+	c.metrics.ProtectSucceeded()
+}
+
+// recordUnprotect reports the outcome of an unprotect operation to the client metrics
+func (c *client) recordUnprotect(err error) {
+	if err != nil {
+		c.metrics.UnprotectFailed(failureReasonOf(err))
+		return
+	}
+
+	c.metrics.UnprotectSucceeded()
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+// fakeMetrics implements Metrics, counting the reported outcomes
+type fakeMetrics struct {
+	protectSucceeded   int
+	protectFailed      map[FailureReason]int
+	unprotectSucceeded int
+	unprotectFailed    map[FailureReason]int
+
+	lock sync.Mutex
+}
+
+var _ Metrics = (*fakeMetrics)(nil)
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{
+		protectFailed:   make(map[FailureReason]int),
+		unprotectFailed: make(map[FailureReason]int),
+	}
+}
+
+func (m *fakeMetrics) ProtectSucceeded() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.protectSucceeded++
+}
+
+func (m *fakeMetrics) ProtectFailed(reason FailureReason) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.protectFailed[reason]++
+}
+
+func (m *fakeMetrics) UnprotectSucceeded() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.unprotectSucceeded++
+}
+
+func (m *fakeMetrics) UnprotectFailed(reason FailureReason) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.unprotectFailed[reason]++
+}
+
+func TestWithMetrics(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	metrics := newFakeMetrics()
+
+	senderPubKey, senderPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	_, receiverPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	senderID := e4crypto.HashIDAlias("sender")
+	sender, err := NewClient(&PubIDAndKey{ID: senderID, Key: senderPrivKey, C2PubKey: generateCurve25519PubKey(t)}, "./test/data/clienttestmetricssender", WithClock(clock))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	receiver, err := NewClient(&PubIDAndKey{Key: receiverPrivKey, C2PubKey: generateCurve25519PubKey(t)}, "./test/data/clienttestmetricsreceiver", WithClock(clock), WithMetrics(metrics))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	topicKey := e4crypto.RandomKey()
+	for _, c := range []Client{sender, receiver} {
+		if err := c.SetTopicKeyByName(topicKey, topic); err != nil {
+			t.Fatalf("Failed to set topic key: %v", err)
+		}
+	}
+
+	protected, err := sender.ProtectMessage([]byte("payload"), topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+
+	// Unknown signer
+	if _, err := receiver.Unprotect(protected, topic); err == nil {
+		t.Fatal("Expected an error when unprotecting a message from an unknown signer")
+	}
+	if err := receiver.setPubKey(senderPubKey, senderID); err != nil {
+		t.Fatalf("Failed to set pubkey: %v", err)
+	}
+
+	// Success
+	if _, err := receiver.Unprotect(protected, topic); err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+
+	// Authentication failure
+	tampered := make([]byte, len(protected))
+	copy(tampered, protected)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, err := receiver.Unprotect(tampered, topic); err == nil {
+		t.Fatal("Expected an error when unprotecting a tampered message")
+	}
+
+	// Missing topic key
+	if _, err := receiver.Unprotect(protected, "unknown"); err == nil {
+		t.Fatal("Expected an error when unprotecting a message without topic key")
+	}
+	if _, err := receiver.ProtectMessage([]byte("payload"), "unknown"); err == nil {
+		t.Fatal("Expected an error when protecting a message without topic key")
+	}
+	if _, err := receiver.ProtectMessageMulti([]byte("payload"), []string{topic, "unknown"}); errorCause(err) != ErrTopicKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrTopicKeyNotFound)
+	}
+	if _, err := receiver.ProtectMessage([]byte("payload"), topic); err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+
+	// Too old and future timestamps
+	clock.Advance(e4crypto.MaxDelayDuration + time.Second)
+	if _, err := receiver.Unprotect(protected, topic); err == nil {
+		t.Fatal("Expected an error when unprotecting a too old message")
+	}
+	futureProtected, err := sender.ProtectMessage([]byte("payload"), topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+	clock.Advance(-time.Hour)
+	if _, err := receiver.Unprotect(futureProtected, topic); err == nil {
+		t.Fatal("Expected an error when unprotecting a message from the future")
+	}
+
+	// Malformed message
+	if _, err := receiver.Unprotect([]byte("short"), topic); err == nil {
+		t.Fatal("Expected an error when unprotecting a malformed message")
+	}
+
+	if g, w := metrics.protectSucceeded, 1; g != w {
+		t.Fatalf("Invalid protect succeeded count: got %d, wanted %d", g, w)
+	}
+	if g, w := metrics.unprotectSucceeded, 1; g != w {
+		t.Fatalf("Invalid unprotect succeeded count: got %d, wanted %d", g, w)
+	}
+
+	expectedProtectFailed := map[FailureReason]int{
+		FailureTopicKeyNotFound: 2,
+	}
+	for reason, count := range expectedProtectFailed {
+		if g, w := metrics.protectFailed[reason], count; g != w {
+			t.Fatalf("Invalid protect failed count for %s: got %d, wanted %d", reason, g, w)
+		}
+	}
+
+	expectedUnprotectFailed := map[FailureReason]int{
+		FailureUnknownSigner:     1,
+		FailureAuthentication:    1,
+		FailureTopicKeyNotFound:  1,
+		FailureTimestampTooOld:   1,
+		FailureTimestampInFuture: 1,
+		FailureOther:             1,
+	}
+	for reason, count := range expectedUnprotectFailed {
+		if g, w := metrics.unprotectFailed[reason], count; g != w {
+			t.Fatalf("Invalid unprotect failed count for %s: got %d, wanted %d", reason, g, w)
+		}
+	}
+
+	if _, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestmetricsnil", WithMetrics(nil)); err == nil {
+		t.Fatal("Expected an error when creating a client with nil metrics")
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+// Clock defines an interface providing the current time to the client
+type Clock = e4crypto.Clock
+
+// clientOptions holds the settings customized by the ClientOption
+type clientOptions struct {
+	clock                  Clock
+	unknownSignerHandler   func(signerID []byte)
+	unsignedPubKeyMessages bool
+	rand                   io.Reader
+	topicHasher            func(topic string) []byte
+	metrics                Metrics
+	maxPayloadBytes        int
+	signedCommandsOnly     bool
+	initialTopicKeys       map[string][]byte
+	commandRateLimit       int
+	commandRatePeriod      time.Duration
+	deferredPersistence    bool
+	appendOnlyPubKeys      bool
+	strictPubKeyBundles    bool
+	keyEntropyCheck        bool
+	kek                    []byte
+}
+
+// ClientOption defines a function allowing to customize a client on creation
+type ClientOption func(o *clientOptions) error
+
+// newClientOptions returns the default client settings, customized by the given options
+func newClientOptions(opts ...ClientOption) (*clientOptions, error) {
+	o := &clientOptions{
+		clock:   e4crypto.SystemClock(),
+		rand:    rand.Reader,
+		metrics: noopMetrics{},
+	}
+
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+
+	return o, nil
+}
+
+// WithClock sets the clock used by the client to stamp protected messages
+// and to validate the freshness of received ones. Defaults to the system time.
+func WithClock(clock Clock) ClientOption {
+	return func(o *clientOptions) error {
+		if clock == nil {
+			return errors.New("clock must not be nil")
+		}
+
+		o.clock = clock
+
+		return nil
+	}
+}
+
+// WithUnknownSignerHandler sets a handler invoked with the signer ID of received messages
+// which can't be verified because the client doesn't hold the signer public key.
+// It allows for example to request the missing key from the C2.
+// Unprotect still returns keys.ErrPubKeyNotFound for such messages.
+func WithUnknownSignerHandler(handler func(signerID []byte)) ClientOption {
+	return func(o *clientOptions) error {
+		o.unknownSignerHandler = handler
+
+		return nil
+	}
+}
+
+// WithUnsignedPubKeyMessages makes a public key client protect messages without signing them,
+// relying on the topic key for their integrity, and accept unsigned messages.
+// It saves the signature and signer ID bandwidth on constrained links, at the cost of
+// the sender authentication. Commands are still authenticated. It is an error on symmetric key clients.
+func WithUnsignedPubKeyMessages() ClientOption {
+	return func(o *clientOptions) error {
+		o.unsignedPubKeyMessages = true
+
+		return nil
+	}
+}
+
+// WithRand sets the source of all the randomness used by the client, such as when generating
+// a random ID on creation. It allows to use a hardware random generator, or a deterministic
+// source in tests. Defaults to crypto/rand.
+func WithRand(r io.Reader) ClientOption {
+	return func(o *clientOptions) error {
+		if r == nil {
+			return errors.New("random source must not be nil")
+		}
+
+		o.rand = r
+
+		return nil
+	}
+}
+
+// WithTopicHasher overrides the function mapping topics to the topic hashes identifying their keys,
+// to interoperate with infrastructures identifying topics by another hash. Defaults to crypto.HashTopic.
+// The hasher must always return HashLen bytes. As it isn't persisted, the same option must be given
+// when loading the client back. Commands, which only carry topic hashes, are not affected.
+func WithTopicHasher(hasher func(topic string) []byte) ClientOption {
+	return func(o *clientOptions) error {
+		if hasher == nil {
+			return errors.New("topic hasher must not be nil")
+		}
+
+		if g, w := len(hasher("")), e4crypto.HashLen; g != w {
+			return fmt.Errorf("invalid topic hasher, it produces %d bytes hashes, expected %d", g, w)
+		}
+
+		o.topicHasher = hasher
+
+		return nil
+	}
+}
+
+// WithMetrics sets the Metrics receiving the outcome of each protect and unprotect operation.
+// Defaults to ignoring them.
+func WithMetrics(m Metrics) ClientOption {
+	return func(o *clientOptions) error {
+		if m == nil {
+			return errors.New("metrics must not be nil")
+		}
+
+		o.metrics = m
+
+		return nil
+	}
+}
+
+// WithMaxPayloadBytes limits the size of the payloads the client protects to n bytes.
+// Larger payloads are rejected with ErrPayloadTooLarge before any encryption, which is cheaper
+// than having them rejected by a broker enforcing a message size limit. Defaults to no limit.
+func WithMaxPayloadBytes(n int) ClientOption {
+	return func(o *clientOptions) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid max payload bytes %d, must be positive", n)
+		}
+
+		o.maxPayloadBytes = n
+
+		return nil
+	}
+}
+
+// WithSignedCommandsOnly makes the client reject the commands which aren't authenticated by the C2 key pair,
+// with ErrUnauthenticatedCommand. Commands received by symmetric key clients are only protected with the client
+// symmetric key, so anyone obtaining it, such as from a compromised device backup, can forge them. Public key
+// clients only accept commands protected with a key derived from the C2 private key, which never leaves the C2.
+// In mixed deployments, it ensures a client mistakenly provisioned with a symmetric key can't be controlled that way.
+func WithSignedCommandsOnly() ClientOption {
+	return func(o *clientOptions) error {
+		o.signedCommandsOnly = true
+
+		return nil
+	}
+}
+
+// WithInitialTopicKeys provisions a new client with the given topic keys, indexed by topic name,
+// like ReplaceAllTopicKeys, and persists it once. The topics and keys are validated when creating
+// the client, which fails on any invalid one. It is ignored when loading an existing client.
+func WithInitialTopicKeys(topicKeys map[string][]byte) ClientOption {
+	return func(o *clientOptions) error {
+		initialTopicKeys := make(map[string][]byte, len(topicKeys))
+		for topic, key := range topicKeys {
+			if err := e4crypto.ValidateTopic(topic); err != nil {
+				return fmt.Errorf("invalid topic %q: %v", topic, err)
+			}
+			if err := e4crypto.ValidateSymKey(key); err != nil {
+				return fmt.Errorf("invalid key for topic %q: %v", topic, err)
+			}
+
+			initialTopicKeys[topic] = key
+		}
+
+		o.initialTopicKeys = initialTopicKeys
+
+		return nil
+	}
+}
+
+// WithCommandRateLimit limits the client to processing n commands per period, rejecting the commands
+// exceeding this rate with ErrCommandRateLimited. It protects the device storage and CPU from a flood of
+// commands, each of them persisting the client. Bursts of up to n commands are allowed, and the limit
+// replenishes continuously over the period. Only authenticated commands are counted, so forged commands
+// can't prevent the C2 ones from being processed. Defaults to no limit.
+func WithCommandRateLimit(n int, per time.Duration) ClientOption {
+	return func(o *clientOptions) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid command rate limit %d, must be positive", n)
+		}
+		if per <= 0 {
+			return fmt.Errorf("invalid command rate limit period %v, must be positive", per)
+		}
+
+		o.commandRateLimit = n
+		o.commandRatePeriod = per
+
+		return nil
+	}
+}
+
+// WithDeferredPersistence makes the client only persist its state when Flush is called, instead of after
+// every change, sparing the device storage on write-heavy gateways. Changes, such as the ones made by commands,
+// are then only held in memory, and are lost if the process stops before they are flushed, which Close also does.
+// Reload refuses to discard them, returning ErrUnflushedChanges until they are flushed.
+// Defaults to persisting each change.
+func WithDeferredPersistence() ClientOption {
+	return func(o *clientOptions) error {
+		o.deferredPersistence = true
+
+		return nil
+	}
+}
+
+// WithAppendOnlyPubKeys prevents the client from replacing the public keys it holds, as required by
+// compliance setups where every change of a trusted key must be auditable. Adding a key for an ID which
+// already has a different one, such as with a SetPubKey command or ImportPubKeyBundle, then fails with
+// keys.ErrPubKeyExists, and the key must first be explicitly removed. It is persisted with the key material,
+// and is an error on symmetric key clients.
+func WithAppendOnlyPubKeys() ClientOption {
+	return func(o *clientOptions) error {
+		o.appendOnlyPubKeys = true
+
+		return nil
+	}
+}
+
+// WithStrictPubKeyBundles makes ImportPubKeyBundle only import authenticated bundles, rejecting
+// with ErrUnverifiedBundle the unsigned ones and the ones signed by a client whose public key isn't held.
+// By default, such bundles are imported unverified, so their origin must be trusted by other means.
+func WithStrictPubKeyBundles() ClientOption {
+	return func(o *clientOptions) error {
+		o.strictPubKeyBundles = true
+
+		return nil
+	}
+}
+
+// WithKeyEntropyCheck makes NewClient reject the symmetric keys given with SymIDAndKey which have an obviously
+// low entropy, such as a key filled with the same byte or a counter, with crypto.ValidateKeyEntropy.
+// It is a guardrail against provisioning mistakes, not a security boundary. Defaults to only rejecting all zero keys.
+func WithKeyEntropyCheck() ClientOption {
+	return func(o *clientOptions) error {
+		o.keyEntropyCheck = true
+
+		return nil
+	}
+}
+
+// WithKEK makes the client encrypt its persisted file with crypto.ProtectSymKey under the given key encryption key,
+// such as one derived from a device passphrase or a TPM secret, instead of storing its keys in clear.
+// The same option must be given when loading the client back, which fails with ErrInvalidKEK when the key
+// doesn't decrypt the file. Defaults to storing the client file unencrypted.
+func WithKEK(kek []byte) ClientOption {
+	return func(o *clientOptions) error {
+		if err := e4crypto.ValidateSymKey(kek); err != nil {
+			return fmt.Errorf("invalid key encryption key: %v", err)
+		}
+
+		o.kek = make([]byte, len(kek))
+		copy(o.kek, kek)
+
+		return nil
+	}
+}
@@ -0,0 +1,794 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+	"github.com/teserakt-io/e4go/keys"
+)
+
+// fakeClock implements Clock, returning a fixed time which can be advanced
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestWithClock(t *testing.T) {
+	topic := "topic"
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	configs := map[string]ClientConfig{
+		"symClient": &SymIDAndKey{Key: e4crypto.RandomKey()},
+		"pubClient": &PubIDAndKey{Key: privateKey, C2PubKey: generateCurve25519PubKey(t)},
+	}
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Now().Add(-24 * time.Hour)}
+			c, err := NewClient(config, "./test/data/clienttestwithclock", WithClock(clock))
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+
+			if err := c.setTopicKey(e4crypto.RandomKey(), e4crypto.HashTopic(topic)); err != nil {
+				t.Fatalf("SetTopicKey failed: %v", err)
+			}
+
+			if pubKeyMaterial, ok := c.(*client).Key.(keys.PubKeyMaterial); ok {
+				if err := c.setPubKey(pubKeyMaterial.PublicKey(), c.(*client).ID); err != nil {
+					t.Fatalf("SetPubKey failed: %v", err)
+				}
+			}
+
+			protected, err := c.ProtectMessage([]byte("payload"), topic)
+			if err != nil {
+				t.Fatalf("Protect failed: %v", err)
+			}
+
+			if _, err := c.Unprotect(protected, topic); err != nil {
+				t.Fatalf("Unprotect failed: %v", err)
+			}
+
+			_, protectedAt, err := c.UnprotectMessageWithTime(protected, topic)
+			if err != nil {
+				t.Fatalf("UnprotectMessageWithTime failed: %v", err)
+			}
+			if g, w := protectedAt, time.Unix(clock.Now().Unix(), 0); !g.Equal(w) {
+				t.Fatalf("Invalid protected time: got %v, wanted %v", g, w)
+			}
+
+			clock.Advance(e4crypto.MaxDelayDuration + time.Second)
+
+			if _, err := c.Unprotect(protected, topic); err != e4crypto.ErrTimestampTooOld {
+				t.Fatalf("Invalid error: got %v, wanted %v", err, e4crypto.ErrTimestampTooOld)
+			}
+		})
+	}
+
+	if _, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestwithclock", WithClock(nil)); err == nil {
+		t.Fatal("Expected an error when creating a client with a nil clock")
+	}
+}
+
+func TestWithUnknownSignerHandler(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	var handledSignerIDs [][]byte
+	handler := func(signerID []byte) {
+		handledSignerIDs = append(handledSignerIDs, signerID)
+	}
+
+	signerID := e4crypto.RandomID()
+	c, err := NewClient(
+		&PubIDAndKey{ID: signerID, Key: privateKey, C2PubKey: generateCurve25519PubKey(t)},
+		"./test/data/clienttestunknownsigner",
+		WithUnknownSignerHandler(handler),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	if err := c.setTopicKey(e4crypto.RandomKey(), e4crypto.HashTopic(topic)); err != nil {
+		t.Fatalf("SetTopicKey failed: %v", err)
+	}
+
+	protected, err := c.ProtectMessage([]byte("payload"), topic)
+	if err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+
+	if _, err := c.Unprotect(protected, topic); err != keys.ErrPubKeyNotFound {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, keys.ErrPubKeyNotFound)
+	}
+
+	if len(handledSignerIDs) != 1 {
+		t.Fatalf("Invalid handler calls count: got %d, wanted 1", len(handledSignerIDs))
+	}
+	if !bytes.Equal(handledSignerIDs[0], signerID) {
+		t.Fatalf("Invalid signer ID: got %v, wanted %v", handledSignerIDs[0], signerID)
+	}
+
+	if err := c.setPubKey(ed25519.PrivateKey(privateKey).Public().(ed25519.PublicKey), signerID); err != nil {
+		t.Fatalf("SetPubKey failed: %v", err)
+	}
+
+	if _, err := c.Unprotect(protected, topic); err != nil {
+		t.Fatalf("Unprotect failed: %v", err)
+	}
+
+	if len(handledSignerIDs) != 1 {
+		t.Fatalf("Invalid handler calls count: got %d, wanted 1", len(handledSignerIDs))
+	}
+}
+
+func TestWithUnsignedPubKeyMessages(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	c, err := NewClient(
+		&PubIDAndKey{ID: e4crypto.RandomID(), Key: privateKey, C2PubKey: generateCurve25519PubKey(t)},
+		"./test/data/clienttestunsignedmessages",
+		WithUnsignedPubKeyMessages(),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	if err := c.setTopicKey(e4crypto.RandomKey(), e4crypto.HashTopic(topic)); err != nil {
+		t.Fatalf("SetTopicKey failed: %v", err)
+	}
+
+	payload := []byte("payload")
+	protected, err := c.ProtectMessage(payload, topic)
+	if err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+	if g, w := len(protected), e4crypto.TaggedHeaderLen+len(payload)+e4crypto.TagLen; g != w {
+		t.Fatalf("Invalid protected length: got %d, wanted %d", g, w)
+	}
+
+	// No signer public key is needed to unprotect unsigned messages
+	unprotected, err := c.Unprotect(protected, topic)
+	if err != nil {
+		t.Fatalf("Unprotect failed: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+
+	_, err = NewClient(
+		&SymIDAndKey{Key: e4crypto.RandomKey()},
+		"./test/data/clienttestunsignedmessages",
+		WithUnsignedPubKeyMessages(),
+	)
+	if err != ErrUnsupportedOperation {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+	}
+}
+
+func TestWithRand(t *testing.T) {
+	key := e4crypto.RandomKey()
+
+	newSeededClient := func(t *testing.T) *client {
+		c, err := NewClient(
+			&SymIDAndKey{Key: key},
+			"./test/data/clienttestwithrand",
+			WithRand(rand.New(rand.NewSource(42))),
+		)
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		return c.(*client)
+	}
+
+	c1 := newSeededClient(t)
+	c2 := newSeededClient(t)
+
+	if !bytes.Equal(c1.ID, c2.ID) {
+		t.Fatalf("Expected clients created from the same seed to have the same ID, got %v and %v", c1.ID, c2.ID)
+	}
+	if g, w := c1.GetReceivingTopic(), c2.GetReceivingTopic(); g != w {
+		t.Fatalf("Invalid receiving topic: got %s, wanted %s", g, w)
+	}
+
+	k1, err := e4crypto.RandomKeyFrom(c1.rand)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	k2, err := e4crypto.RandomKeyFrom(c2.rand)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	if !bytes.Equal(k1, k2) {
+		t.Fatalf("Expected keys generated from the same seed to be identical, got %v and %v", k1, k2)
+	}
+
+	c3, err := NewClient(&SymIDAndKey{Key: key}, "./test/data/clienttestwithrand")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if bytes.Equal(c3.(*client).ID, c1.ID) {
+		t.Fatal("Expected client created with the default random source to have a different ID")
+	}
+
+	if _, err := NewClient(&SymIDAndKey{Key: key}, "./test/data/clienttestwithrand", WithRand(nil)); err == nil {
+		t.Fatal("Expected an error when creating a client with a nil random source")
+	}
+	if _, err := NewClient(&SymIDAndKey{Key: key}, "./test/data/clienttestwithrand", WithRand(bytes.NewReader(nil))); err == nil {
+		t.Fatal("Expected an error when creating a client with an exhausted random source")
+	}
+}
+
+func TestWithTopicHasher(t *testing.T) {
+	// customHasher mimics a partner infrastructure hashing topics with sha3 on a prefixed topic
+	customHasher := func(topic string) []byte {
+		return e4crypto.Sha3Sum256([]byte("partner/" + topic))[:e4crypto.HashLen]
+	}
+
+	topic := "topic"
+	topicKey := e4crypto.RandomKey()
+	payload := []byte("payload")
+
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestwithtopichasher", WithTopicHasher(customHasher))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	// The key set for the custom hash must be used for the topic
+	if err := c.setTopicKey(topicKey, customHasher(topic)); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	if !c.HasTopicKey(topic) {
+		t.Fatal("Expected the client to hold a key for the custom topic hash")
+	}
+
+	protected, err := c.ProtectMessage(payload, topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+	unprotected, err := e4crypto.UnprotectSymKey(protected, topicKey)
+	if err != nil {
+		t.Fatalf("Failed to unprotect message with the custom topic hash key: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+
+	unprotected, err = c.Unprotect(protected, topic)
+	if err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+
+	// The default path is unchanged
+	defaultClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestwithtopichasherdefault")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := defaultClient.setTopicKey(topicKey, customHasher(topic)); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	if defaultClient.HasTopicKey(topic) {
+		t.Fatal("Expected the default client to not use the custom topic hash")
+	}
+	if err := defaultClient.setTopicKey(topicKey, e4crypto.HashTopic(topic)); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	if _, err := defaultClient.Unprotect(protected, topic); err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+
+	invalidHashers := []func(string) []byte{
+		nil,
+		func(topic string) []byte { return e4crypto.Sha3Sum256([]byte(topic)) },
+	}
+	for _, invalidHasher := range invalidHashers {
+		if _, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestwithtopichasherinvalid", WithTopicHasher(invalidHasher)); err == nil {
+			t.Fatal("Expected an error when creating a client with an invalid topic hasher")
+		}
+	}
+}
+
+func TestWithMaxPayloadBytes(t *testing.T) {
+	maxPayloadBytes := 64
+
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestwithmaxpayloadbytes", WithMaxPayloadBytes(maxPayloadBytes))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+
+	if _, err := c.ProtectMessage(make([]byte, maxPayloadBytes+1), topic); err != ErrPayloadTooLarge {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPayloadTooLarge)
+	}
+	if _, err := c.ProtectMessageMulti(make([]byte, maxPayloadBytes+1), []string{topic}); err != ErrPayloadTooLarge {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPayloadTooLarge)
+	}
+
+	// The size is checked before the topic key lookup
+	if _, err := c.ProtectMessage(make([]byte, maxPayloadBytes+1), "unknown"); err != ErrPayloadTooLarge {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrPayloadTooLarge)
+	}
+
+	payload := make([]byte, maxPayloadBytes-1)
+	protected, err := c.ProtectMessage(payload, topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+	unprotected, err := c.Unprotect(protected, topic)
+	if err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+
+	for _, n := range []int{0, -1} {
+		if _, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestwithmaxpayloadbytesinvalid", WithMaxPayloadBytes(n)); err == nil {
+			t.Fatalf("Expected an error when creating a client with max payload bytes %d", n)
+		}
+	}
+}
+
+func TestWithSignedCommandsOnly(t *testing.T) {
+	command, err := CmdResetTopics()
+	if err != nil {
+		t.Fatalf("Failed to create command: %v", err)
+	}
+
+	symKey := e4crypto.RandomKey()
+	symClient, err := NewClient(&SymIDAndKey{Key: symKey}, "./test/data/clienttestsignedcommandsonlysym", WithSignedCommandsOnly())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topic := "topic"
+	if err := symClient.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+
+	protectedCommand, err := e4crypto.ProtectSymKey(command, symKey)
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+	if _, err := symClient.Unprotect(protectedCommand, symClient.GetReceivingTopic()); err != ErrUnauthenticatedCommand {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnauthenticatedCommand)
+	}
+	if !symClient.HasTopicKey(topic) {
+		t.Fatal("Expected the command to not be processed")
+	}
+
+	// Messages are not affected
+	protected, err := symClient.ProtectMessage([]byte("payload"), topic)
+	if err != nil {
+		t.Fatalf("Failed to protect message: %v", err)
+	}
+	if _, err := symClient.Unprotect(protected, topic); err != nil {
+		t.Fatalf("Failed to unprotect message: %v", err)
+	}
+
+	// Public key clients still accept commands from their C2
+	clientPubKey, clientPrivKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	c2PrivKey := e4crypto.RandomKey()
+	c2PubKey, err := curve25519.X25519(c2PrivKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("Failed to generate curve25519 keys: %v", err)
+	}
+
+	pubClient, err := NewClient(&PubIDAndKey{Key: clientPrivKey, C2PubKey: c2PubKey}, "./test/data/clienttestsignedcommandsonlypub", WithSignedCommandsOnly())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	protectedCommand, err = e4crypto.ProtectCommandPubKey(command, e4crypto.Ed25519PubKey(clientPubKey), c2PrivKey)
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+	if _, err := pubClient.Unprotect(protectedCommand, pubClient.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to process command: %v", err)
+	}
+}
+
+func TestWithInitialTopicKeys(t *testing.T) {
+	topicKeys := map[string][]byte{
+		"topic1": e4crypto.RandomKey(),
+		"topic2": e4crypto.RandomKey(),
+	}
+
+	filePath := "./test/data/clienttestwithinitialtopickeys"
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath, WithInitialTopicKeys(topicKeys))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	for topic, key := range topicKeys {
+		protected, err := c.ProtectMessage([]byte("payload"), topic)
+		if err != nil {
+			t.Fatalf("Failed to protect message on %s: %v", topic, err)
+		}
+		if _, err := e4crypto.UnprotectSymKey(protected, key); err != nil {
+			t.Fatalf("Failed to unprotect message on %s with its initial key: %v", topic, err)
+		}
+	}
+
+	if g, w := c.TopicNames(), []string{"topic1", "topic2"}; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid topic names: got %v, wanted %v", g, w)
+	}
+
+	// The initial keys are persisted
+	loaded, err := LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	for topic := range topicKeys {
+		if !loaded.HasTopicKey(topic) {
+			t.Fatalf("Expected the loaded client to have a key for %s", topic)
+		}
+	}
+
+	invalidTopicKeys := []map[string][]byte{
+		{"topic": []byte("short")},
+		{"": e4crypto.RandomKey()},
+	}
+	for _, invalid := range invalidTopicKeys {
+		if _, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestwithinitialtopickeysinvalid", WithInitialTopicKeys(invalid)); err == nil {
+			t.Fatalf("Expected an error when creating a client with initial topic keys %v", invalid)
+		}
+	}
+}
+
+func TestWithCommandRateLimit(t *testing.T) {
+	if _, err := newClientOptions(WithCommandRateLimit(0, time.Minute)); err == nil {
+		t.Fatal("Expected an error with a zero command rate limit")
+	}
+	if _, err := newClientOptions(WithCommandRateLimit(1, 0)); err == nil {
+		t.Fatal("Expected an error with a zero command rate limit period")
+	}
+
+	clientKey := e4crypto.RandomKey()
+	clock := &fakeClock{now: time.Now()}
+	c, err := NewClient(&SymIDAndKey{Key: clientKey}, "./test/data/clienttestcommandratelimit", WithClock(clock), WithCommandRateLimit(2, time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	// Each command is distinct, so it isn't rejected as a duplicate
+	processCommand := func() error {
+		command, err := CmdSetTopicKey(e4crypto.RandomKey(), "topic")
+		if err != nil {
+			t.Fatalf("Failed to create command: %v", err)
+		}
+		protectedCommand, err := e4crypto.ProtectSymKeyAt(command, clientKey, clock.Now())
+		if err != nil {
+			t.Fatalf("Failed to protect command: %v", err)
+		}
+
+		_, err = c.Unprotect(protectedCommand, c.GetReceivingTopic())
+
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := processCommand(); err != nil {
+			t.Fatalf("Failed to process command %d: %v", i, err)
+		}
+	}
+	if err := processCommand(); err != ErrCommandRateLimited {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrCommandRateLimited)
+	}
+
+	// Half of the period replenishes a single command
+	clock.Advance(30 * time.Second)
+	if err := processCommand(); err != nil {
+		t.Fatalf("Failed to process command: %v", err)
+	}
+	if err := processCommand(); err != ErrCommandRateLimited {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrCommandRateLimited)
+	}
+
+	// Forged commands don't consume the limit
+	clock.Advance(time.Minute)
+	forgedCommand, err := e4crypto.ProtectSymKeyAt([]byte{ResetTopics}, e4crypto.RandomKey(), clock.Now())
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.Unprotect(forgedCommand, c.GetReceivingTopic()); err == nil || err == ErrCommandRateLimited {
+			t.Fatalf("Invalid error: got %v, wanted an authentication error", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := processCommand(); err != nil {
+			t.Fatalf("Failed to process command %d: %v", i, err)
+		}
+	}
+}
+
+func TestWithDeferredPersistence(t *testing.T) {
+	filePath := "./test/data/clienttestdeferredpersistence"
+	os.Remove(filePath)
+
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath, WithDeferredPersistence())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topics := []string{"topic1", "topic2"}
+	for _, topic := range topics {
+		if err := c.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != nil {
+			t.Fatalf("Failed to set topic key: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fatalf("Expected the client to not be persisted before Flush, got %v", err)
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Failed to flush client: %v", err)
+	}
+
+	loaded, err := LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	if g, w := loaded.TopicNames(), topics; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid loaded topics: got %v, wanted %v", g, w)
+	}
+
+	// Changes made after a flush are not persisted until the next one
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic3"); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	loaded, err = LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	if g, w := loaded.TopicNames(), topics; !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid loaded topics: got %v, wanted %v", g, w)
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Failed to flush client: %v", err)
+	}
+	loaded, err = LoadClient(filePath)
+	if err != nil {
+		t.Fatalf("Failed to load client: %v", err)
+	}
+	if g, w := loaded.TopicNames(), append(topics, "topic3"); !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid loaded topics: got %v, wanted %v", g, w)
+	}
+
+	// Reloading must not discard the changes which haven't been flushed
+	if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic4"); err != nil {
+		t.Fatalf("Failed to set topic key: %v", err)
+	}
+	if err := c.Reload(); err != ErrUnflushedChanges {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnflushedChanges)
+	}
+	if !c.HasTopicKey("topic4") {
+		t.Fatal("Expected the unflushed topic key to be kept")
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Failed to flush client: %v", err)
+	}
+	if err := c.Reload(); err != nil {
+		t.Fatalf("Failed to reload client: %v", err)
+	}
+	if g, w := c.TopicNames(), append(topics, "topic3", "topic4"); !reflect.DeepEqual(g, w) {
+		t.Fatalf("Invalid reloaded topics: got %v, wanted %v", g, w)
+	}
+}
+
+func TestWithAppendOnlyPubKeys(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	c, err := NewClient(
+		&PubIDAndKey{ID: e4crypto.RandomID(), Key: privateKey, C2PubKey: generateCurve25519PubKey(t)},
+		"./test/data/clienttestappendonlypubkeys",
+		WithAppendOnlyPubKeys(),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	id := e4crypto.RandomID()
+	pk1, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+	pk2, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	if err := c.setPubKey(pk1, id); err != nil {
+		t.Fatalf("Failed to set pubKey: %v", err)
+	}
+	if err := c.setPubKey(pk2, id); err != keys.ErrPubKeyExists {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, keys.ErrPubKeyExists)
+	}
+
+	if err := c.removePubKey(id); err != nil {
+		t.Fatalf("Failed to remove pubKey: %v", err)
+	}
+	if err := c.setPubKey(pk2, id); err != nil {
+		t.Fatalf("Failed to set pubKey after removal: %v", err)
+	}
+
+	// A bundle replacing a key must not be partially imported
+	newID := e4crypto.RandomID()
+	bundle, err := json.Marshal(&pubKeyBundle{PubKeys: map[string][]byte{
+		hex.EncodeToString(newID): pk1,
+		hex.EncodeToString(id):    pk1,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to marshal pubkey bundle: %v", err)
+	}
+	if _, err := c.ImportPubKeyBundle(bundle); err != keys.ErrPubKeyExists {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, keys.ErrPubKeyExists)
+	}
+	pubKeys, err := c.getPubKeys()
+	if err != nil {
+		t.Fatalf("Failed to get pubKeys: %v", err)
+	}
+	if _, ok := pubKeys[hex.EncodeToString(newID)]; ok {
+		t.Fatal("Expected the bundle keys to not be imported")
+	}
+
+	_, err = NewClient(
+		&SymIDAndKey{Key: e4crypto.RandomKey()},
+		"./test/data/clienttestappendonlypubkeys",
+		WithAppendOnlyPubKeys(),
+	)
+	if err != ErrUnsupportedOperation {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+	}
+}
+
+func TestWithKeyEntropyCheck(t *testing.T) {
+	lowEntropyKey := bytes.Repeat([]byte{0xFF}, e4crypto.KeyLen)
+
+	// Low entropy keys are accepted by default
+	if _, err := NewClient(&SymIDAndKey{Key: lowEntropyKey}, "./test/data/clienttestkeyentropy"); err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if _, err := NewClient(&SymIDAndKey{Key: lowEntropyKey}, "./test/data/clienttestkeyentropy", WithKeyEntropyCheck()); err == nil {
+		t.Fatal("Expected an error when creating a client with a low entropy key")
+	}
+
+	if _, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestkeyentropy", WithKeyEntropyCheck()); err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+}
+
+func TestWithKEK(t *testing.T) {
+	filePath := "./test/data/clienttestkek"
+	kek := e4crypto.RandomKey()
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate ed25519 key: %v", err)
+	}
+
+	configs := map[string]ClientConfig{
+		"symmetric": &SymIDAndKey{Key: e4crypto.RandomKey()},
+		"pubkey":    &PubIDAndKey{Key: privateKey, C2PubKey: generateCurve25519PubKey(t)},
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewClient(config, filePath, WithKEK(kek))
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+
+			topicKey := e4crypto.RandomKey()
+			if err := c.SetTopicKeyByName(topicKey, "topic"); err != nil {
+				t.Fatalf("Failed to set topic key: %v", err)
+			}
+
+			raw, err := ioutil.ReadFile(filePath)
+			if err != nil {
+				t.Fatalf("Failed to read client file: %v", err)
+			}
+			if json.Valid(raw) {
+				t.Fatal("Expected the client file to be encrypted")
+			}
+
+			loaded, err := LoadClient(filePath, WithKEK(kek))
+			if err != nil {
+				t.Fatalf("Failed to load client: %v", err)
+			}
+			if !loaded.(*client).Key.EqualCrypto(c.(*client).Key) {
+				t.Fatal("Invalid loaded key material")
+			}
+			if g, w := loaded.(*client).TopicKeys, c.(*client).TopicKeys; !reflect.DeepEqual(g, w) {
+				t.Fatalf("Invalid loaded topic keys: got %v, wanted %v", g, w)
+			}
+			if err := loaded.Reload(); err != nil {
+				t.Fatalf("Failed to reload client: %v", err)
+			}
+
+			if _, err := LoadClient(filePath, WithKEK(e4crypto.RandomKey())); err != ErrInvalidKEK {
+				t.Fatalf("Invalid error: got %v, wanted %v", err, ErrInvalidKEK)
+			}
+			if _, err := LoadClient(filePath); err == nil {
+				t.Fatal("Expected an error when loading an encrypted client file without its KEK")
+			}
+
+			// The client file doesn't depend on the protocol timestamps byte order
+			e4crypto.SetTimestampByteOrder(binary.BigEndian)
+			defer e4crypto.SetTimestampByteOrder(nil)
+			if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic"); err != nil {
+				t.Fatalf("Failed to set topic key: %v", err)
+			}
+			e4crypto.SetTimestampByteOrder(nil)
+
+			if _, err := LoadClient(filePath, WithKEK(kek)); err != nil {
+				t.Fatalf("Failed to load client: %v", err)
+			}
+		})
+	}
+
+	if _, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, filePath, WithKEK(make([]byte, e4crypto.KeyLen))); err == nil {
+		t.Fatal("Expected an error when creating a client with an all zero KEK")
+	}
+}
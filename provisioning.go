@@ -0,0 +1,186 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/curve25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+	"github.com/teserakt-io/e4go/keys"
+)
+
+// stagingC2KeySeed is the seed of the well known staging C2 key pair
+const stagingC2KeySeed = "e4 staging c2 key"
+
+var (
+	// ErrStagingC2Key is returned by Validate when an otherwise valid client trusts the staging C2 public key.
+	// It is a warning rather than a failure, which staging pipelines can tolerate, while production ones reject it.
+	ErrStagingC2Key = errors.New("client trusts the staging c2 public key")
+)
+
+// StagingC2PrivateKey returns the private key of the well known C2 key pair which can be used as a placeholder
+// when provisioning clients in staging environments. As anyone can derive it, anyone can send commands to the
+// clients trusting its public key: they must never be deployed in production (see Client.HasDefaultC2Key).
+func StagingC2PrivateKey() e4crypto.Curve25519PrivateKey {
+	return e4crypto.Sha3Sum256([]byte(stagingC2KeySeed))[:e4crypto.Curve25519PrivKeyLen]
+}
+
+// StagingC2PubKey returns the public key of the well known staging C2 key pair (see StagingC2PrivateKey)
+func StagingC2PubKey() e4crypto.Curve25519PublicKey {
+	var privateKey, publicKey [e4crypto.Curve25519PubKeyLen]byte
+	copy(privateKey[:], StagingC2PrivateKey())
+	curve25519.ScalarBaseMult(&publicKey, &privateKey)
+
+	return publicKey[:]
+}
+
+// ProvisioningStatus summarizes the material a client has been provisioned with,
+// allowing for example to report whether a device is ready to communicate.
+type ProvisioningStatus struct {
+	// HasPrivateKey is true when the client holds the key needed to protect messages:
+	// its ed25519 private key for public key clients, or its symmetric key.
+	HasPrivateKey bool
+	// HasC2Key is true when a public key client holds at least one C2 public key.
+	// It is always false for symmetric key clients, which share their key with the C2.
+	HasC2Key bool
+	// HasStagingC2Key is true when a public key client trusts the staging C2 public key,
+	// and must thus not be deployed in production (see StagingC2PubKey).
+	HasStagingC2Key bool
+	// TopicKeyCount is the number of topic keys held by the client
+	TopicKeyCount int
+	// TrustedSignerCount is the number of public keys a public key client verifies messages with.
+	// It is always 0 for symmetric key clients.
+	TrustedSignerCount int
+}
+
+// ProvisioningStatus returns a summary of the material the client has been provisioned with.
+// A wiped or closed client reports an empty status.
+func (c *client) ProvisioningStatus() ProvisioningStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.stateErr() != nil {
+		return ProvisioningStatus{}
+	}
+
+	status := ProvisioningStatus{
+		HasPrivateKey: c.Key.CanProtect(),
+		TopicKeyCount: len(c.TopicKeys),
+	}
+
+	if pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial); ok {
+		status.HasC2Key = len(pubKeyMaterial.C2PubKeys()) > 0
+		status.TrustedSignerCount = len(pubKeyMaterial.GetPubKeys())
+		status.HasStagingC2Key = c.hasStagingC2Key()
+	}
+
+	return status
+}
+
+// Validate checks that the client is well formed, returning an error describing the first problem found.
+// It checks its ID, its private or symmetric key, its C2 public keys, its trusted public keys, and its
+// topic keys, in topic hash order, allowing to catch a bad provisioning before the device goes live.
+// Once all the checks pass, ErrStagingC2Key is returned as a warning when the client trusts the staging
+// C2 public key (see HasDefaultC2Key), so staging pipelines can tolerate it by comparing the error against it.
+func (c *client) Validate() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if err := c.stateErr(); err != nil {
+		return err
+	}
+
+	if err := e4crypto.ValidateID(c.ID); err != nil {
+		return fmt.Errorf("invalid id: %v", err)
+	}
+
+	if err := keys.ValidateKeyMaterial(c.Key); err != nil {
+		return fmt.Errorf("invalid key material: %v", err)
+	}
+
+	if pubKeyStore, ok := c.Key.(keys.PubKeyStore); ok {
+		if err := pubKeyStore.Validate(); err != nil {
+			return fmt.Errorf("invalid public keys: %v", err)
+		}
+	}
+
+	topicHashes := make([]string, 0, len(c.TopicKeys))
+	for topicHash := range c.TopicKeys {
+		topicHashes = append(topicHashes, topicHash)
+	}
+	sort.Strings(topicHashes)
+
+	for _, topicHash := range topicHashes {
+		rawTopicHash, err := hex.DecodeString(topicHash)
+		if err != nil {
+			return fmt.Errorf("invalid topic hash %s: %v", topicHash, err)
+		}
+		if err := e4crypto.ValidateTopicHash(rawTopicHash); err != nil {
+			return fmt.Errorf("invalid topic hash %s: %v", topicHash, err)
+		}
+
+		topicKey := c.TopicKeys[topicHash]
+		// Previous topic keys are kept for the key transition along with their replacement timestamp
+		if len(topicKey) == e4crypto.KeyLen+e4crypto.TimestampLen {
+			topicKey = topicKey[:e4crypto.KeyLen]
+		}
+		if err := e4crypto.ValidateSymKey(topicKey); err != nil {
+			return fmt.Errorf("invalid topic key for topic hash %s: %v", topicHash, err)
+		}
+	}
+
+	if c.hasStagingC2Key() {
+		return ErrStagingC2Key
+	}
+
+	return nil
+}
+
+// HasDefaultC2Key returns true when the client trusts the staging C2 public key, such as when it has been
+// provisioned with it as a placeholder, and must thus not be deployed in production
+func (c *client) HasDefaultC2Key() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.stateErr() != nil {
+		return false
+	}
+
+	return c.hasStagingC2Key()
+}
+
+// hasStagingC2Key returns true when any of the client trusted C2 public keys is the staging one.
+// The client lock must be held by the caller.
+func (c *client) hasStagingC2Key() bool {
+	pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial)
+	if !ok {
+		return false
+	}
+
+	stagingC2PubKey := StagingC2PubKey()
+	for _, c2PubKey := range pubKeyMaterial.C2PubKeys() {
+		if bytes.Equal(c2PubKey, stagingC2PubKey) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,247 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+	"github.com/teserakt-io/e4go/keys"
+)
+
+func TestProvisioningStatus(t *testing.T) {
+	t.Run("fresh symmetric key client", func(t *testing.T) {
+		c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestprovisioningsym")
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		want := ProvisioningStatus{HasPrivateKey: true}
+		if got := c.ProvisioningStatus(); got != want {
+			t.Fatalf("Invalid provisioning status: got %+v, wanted %+v", got, want)
+		}
+	})
+
+	t.Run("fresh public key client", func(t *testing.T) {
+		_, privKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+
+		c, err := NewClient(&PubIDAndKey{Key: privKey, C2PubKey: generateCurve25519PubKey(t)}, "./test/data/clienttestprovisioningpubfresh")
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		want := ProvisioningStatus{HasPrivateKey: true, HasC2Key: true}
+		if got := c.ProvisioningStatus(); got != want {
+			t.Fatalf("Invalid provisioning status: got %+v, wanted %+v", got, want)
+		}
+
+		if err := c.DropPrivateKey(); err != nil {
+			t.Fatalf("Failed to drop private key: %v", err)
+		}
+		want.HasPrivateKey = false
+		if got := c.ProvisioningStatus(); got != want {
+			t.Fatalf("Invalid provisioning status: got %+v, wanted %+v", got, want)
+		}
+	})
+
+	t.Run("fully provisioned public key client", func(t *testing.T) {
+		_, privKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+
+		c, err := NewClient(&PubIDAndKey{Key: privKey, C2PubKey: generateCurve25519PubKey(t)}, "./test/data/clienttestprovisioningpubfull")
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		for _, topic := range []string{"topic1", "topic2"} {
+			if err := c.SetTopicKeyByName(e4crypto.RandomKey(), topic); err != nil {
+				t.Fatalf("Failed to set topic key: %v", err)
+			}
+		}
+
+		signerPubKey, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+		if err := c.setPubKey(signerPubKey, e4crypto.HashIDAlias("signer")); err != nil {
+			t.Fatalf("Failed to set public key: %v", err)
+		}
+
+		want := ProvisioningStatus{HasPrivateKey: true, HasC2Key: true, TopicKeyCount: 2, TrustedSignerCount: 1}
+		if got := c.ProvisioningStatus(); got != want {
+			t.Fatalf("Invalid provisioning status: got %+v, wanted %+v", got, want)
+		}
+
+		if err := c.Wipe(false); err != nil {
+			t.Fatalf("Failed to wipe client: %v", err)
+		}
+		if got, want := c.ProvisioningStatus(), (ProvisioningStatus{}); got != want {
+			t.Fatalf("Invalid provisioning status: got %+v, wanted %+v", got, want)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	newPubClient := func(t *testing.T) *client {
+		_, privKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+
+		c, err := NewClient(&PubIDAndKey{Key: privKey, C2PubKey: generateCurve25519PubKey(t)}, "./test/data/clienttestvalidate")
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		// Set the topic key twice, to also hold the previous key kept for the key transition
+		for i := 0; i < 2; i++ {
+			if err := c.SetTopicKeyByName(e4crypto.RandomKey(), "topic"); err != nil {
+				t.Fatalf("Failed to set topic key: %v", err)
+			}
+		}
+
+		signerPubKey, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+		if err := c.setPubKey(signerPubKey, e4crypto.HashIDAlias("signer")); err != nil {
+			t.Fatalf("Failed to set public key: %v", err)
+		}
+
+		return c.(*client)
+	}
+
+	t.Run("valid client", func(t *testing.T) {
+		c := newPubClient(t)
+		if err := c.Validate(); err != nil {
+			t.Fatalf("Expected client to be valid, got %v", err)
+		}
+
+		symClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestvalidatesym")
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		if err := symClient.Validate(); err != nil {
+			t.Fatalf("Expected client to be valid, got %v", err)
+		}
+	})
+
+	t.Run("corrupt topic key", func(t *testing.T) {
+		c := newPubClient(t)
+		c.TopicKeys[hex.EncodeToString(e4crypto.HashTopic("topic"))] = make([]byte, e4crypto.KeyLen)
+
+		if err := c.Validate(); err == nil {
+			t.Fatal("Expected an error when validating a client with a corrupt topic key")
+		}
+	})
+
+	t.Run("corrupt public key", func(t *testing.T) {
+		c := newPubClient(t)
+		pubKeys := c.Key.(keys.PubKeyMaterial).GetPubKeys()
+		pubKeys[hex.EncodeToString(e4crypto.HashIDAlias("signer"))] = make(ed25519.PublicKey, ed25519.PublicKeySize)
+
+		if err := c.Validate(); err == nil {
+			t.Fatal("Expected an error when validating a client with a corrupt public key")
+		}
+	})
+
+	t.Run("invalid id", func(t *testing.T) {
+		c := newPubClient(t)
+		c.ID = []byte("short")
+
+		if err := c.Validate(); err == nil {
+			t.Fatal("Expected an error when validating a client with an invalid id")
+		}
+	})
+}
+
+func TestHasDefaultC2Key(t *testing.T) {
+	newPubClient := func(t *testing.T, c2PubKey e4crypto.Curve25519PublicKey) Client {
+		_, privKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+
+		c, err := NewClient(&PubIDAndKey{Key: privKey, C2PubKey: c2PubKey}, "./test/data/clienttestdefaultc2key")
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		return c
+	}
+
+	stagingClient := newPubClient(t, StagingC2PubKey())
+	if !stagingClient.HasDefaultC2Key() {
+		t.Fatal("Expected a client provisioned with the staging C2 key to be flagged")
+	}
+	if err := stagingClient.Validate(); err != ErrStagingC2Key {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrStagingC2Key)
+	}
+	if !stagingClient.ProvisioningStatus().HasStagingC2Key {
+		t.Fatal("Expected the provisioning status of a staging client to report its staging C2 key")
+	}
+
+	c := newPubClient(t, generateCurve25519PubKey(t))
+	if c.HasDefaultC2Key() {
+		t.Fatal("Expected a client provisioned with a real C2 key to not be flagged")
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected client to be valid, got %v", err)
+	}
+	if c.ProvisioningStatus().HasStagingC2Key {
+		t.Fatal("Expected the provisioning status of a client with a real C2 key to not report a staging C2 key")
+	}
+
+	// The staging key is also detected as a failover C2 key
+	if err := c.AddC2Key(StagingC2PubKey()); err != nil {
+		t.Fatalf("Failed to add C2 key: %v", err)
+	}
+	if !c.HasDefaultC2Key() {
+		t.Fatal("Expected a client trusting the staging C2 key as failover to be flagged")
+	}
+	if err := c.Validate(); err != ErrStagingC2Key {
+		t.Fatalf("Invalid error: got %v, wanted %v", err, ErrStagingC2Key)
+	}
+
+	// The staging private key must match its public key, allowing to send commands from a staging C2
+	command, err := CmdResetTopics()
+	if err != nil {
+		t.Fatalf("Failed to create command: %v", err)
+	}
+	clientPubKey := stagingClient.(*client).Key.(keys.PubKeyMaterial).PublicKey()
+	protected, err := e4crypto.ProtectCommandPubKey(command, e4crypto.Ed25519PubKey(clientPubKey), StagingC2PrivateKey())
+	if err != nil {
+		t.Fatalf("Failed to protect command: %v", err)
+	}
+	if _, err := stagingClient.Unprotect(protected, stagingClient.GetReceivingTopic()); err != nil {
+		t.Fatalf("Failed to unprotect command: %v", err)
+	}
+
+	symClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestdefaultc2keysym")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if symClient.HasDefaultC2Key() {
+		t.Fatal("Expected a symmetric key client to not be flagged")
+	}
+}
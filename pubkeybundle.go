@@ -0,0 +1,174 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ed25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+	"github.com/teserakt-io/e4go/keys"
+)
+
+// pubKeyBundleSignaturePrefix prefixes the data signed in a pubkey bundle,
+// so its signature can't be mistaken for the one of another kind of data
+const pubKeyBundleSignaturePrefix = "e4 pubkey bundle"
+
+var (
+	// ErrInvalidBundleSignature occurs when importing a pubkey bundle whose signature doesn't verify
+	ErrInvalidBundleSignature = errors.New("invalid pubkey bundle signature")
+	// ErrUnverifiedBundle occurs when importing an unsigned pubkey bundle, or one from an unknown signer,
+	// with the WithStrictPubKeyBundles option
+	ErrUnverifiedBundle = errors.New("pubkey bundle can't be verified")
+)
+
+// pubKeyBundle is the serialized form of a pubkey store, as exported by ExportPubKeyBundle
+type pubKeyBundle struct {
+	// PubKeys holds the public keys, indexed by hex encoded ID.
+	// Its json encoding is canonical, as encoding/json sorts the map keys.
+	PubKeys map[string][]byte `json:"pubKeys"`
+	// SignerID identifies the client having signed the bundle, if it is signed
+	SignerID []byte `json:"signerID,omitempty"`
+	// Signature is the SignerID ed25519 signature of the bundle signed data
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// signedData returns the bundle data covered by its signature
+func (b *pubKeyBundle) signedData() ([]byte, error) {
+	encodedPubKeys, err := json.Marshal(b.PubKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(pubKeyBundleSignaturePrefix), encodedPubKeys...), nil
+}
+
+// ExportPubKeyBundle serializes all the public keys held by the client into a bundle, which can be
+// imported by another client with ImportPubKeyBundle. The bundle is signed by the client
+// when it holds a private key. ErrUnsupportedOperation is returned for symmetric key clients.
+func (c *client) ExportPubKeyBundle() ([]byte, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if err := c.stateErr(); err != nil {
+		return nil, err
+	}
+
+	pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial)
+	if !ok {
+		return nil, ErrUnsupportedOperation
+	}
+
+	bundle := &pubKeyBundle{
+		PubKeys: make(map[string][]byte),
+	}
+	for sid, pubKey := range pubKeyMaterial.GetPubKeys() {
+		bundle.PubKeys[sid] = pubKey
+	}
+
+	if pubKeyMaterial.CanProtect() {
+		data, err := bundle.signedData()
+		if err != nil {
+			return nil, err
+		}
+
+		bundle.Signature, err = pubKeyMaterial.SignData(data)
+		if err != nil {
+			return nil, err
+		}
+		bundle.SignerID = c.ID
+	}
+
+	return json.Marshal(bundle)
+}
+
+// ImportPubKeyBundle validates the given bundle, as exported by ExportPubKeyBundle, and merges its public keys
+// into the client ones, replacing the keys with the same ID. It returns how many keys have been imported.
+// The bundle signature is verified when the client holds the signer public key, and ErrInvalidBundleSignature
+// is returned when it doesn't match. By default, the import is unauthenticated for bundles from unknown signers
+// and unsigned ones, which are imported unverified: their origin must then be trusted. With the
+// WithStrictPubKeyBundles option, such bundles are rejected with ErrUnverifiedBundle instead.
+// Nothing is imported when any of the bundle keys is invalid.
+func (c *client) ImportPubKeyBundle(rawBundle []byte) (int, error) {
+	bundle := &pubKeyBundle{}
+	if err := json.Unmarshal(rawBundle, bundle); err != nil {
+		return 0, fmt.Errorf("invalid pubkey bundle: %v", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.stateErr(); err != nil {
+		return 0, err
+	}
+
+	pubKeyMaterial, ok := c.Key.(keys.PubKeyMaterial)
+	if !ok {
+		return 0, ErrUnsupportedOperation
+	}
+
+	verified := false
+	if len(bundle.Signature) > 0 {
+		if signerKey, err := pubKeyMaterial.GetPubKey(bundle.SignerID); err == nil {
+			data, err := bundle.signedData()
+			if err != nil {
+				return 0, err
+			}
+
+			if !ed25519.Verify(signerKey, data, bundle.Signature) {
+				return 0, ErrInvalidBundleSignature
+			}
+
+			verified = true
+		}
+	}
+
+	if c.strictPubKeyBundles && !verified {
+		return 0, ErrUnverifiedBundle
+	}
+
+	for sid, pubKey := range bundle.PubKeys {
+		id, err := hex.DecodeString(sid)
+		if err != nil {
+			return 0, fmt.Errorf("invalid id %s in pubkey bundle: %v", sid, err)
+		}
+		if err := e4crypto.ValidateID(id); err != nil {
+			return 0, fmt.Errorf("invalid id %s in pubkey bundle: %v", sid, err)
+		}
+		if err := e4crypto.ValidateEd25519PubKey(pubKey); err != nil {
+			return 0, fmt.Errorf("invalid public key for id %s in pubkey bundle: %v", sid, err)
+		}
+	}
+
+	// All the keys are checked before any is imported, so a key rejected in append only mode
+	// doesn't leave the store partially updated
+	changed, err := pubKeyMaterial.MergePubKeys(bundle.PubKeys)
+	if err != nil {
+		return 0, err
+	}
+
+	// Skip the save when the bundle holds no new key
+	if changed {
+		if err := c.save(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(bundle.PubKeys), nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+func TestPubKeyBundle(t *testing.T) {
+	newPubClient := func(t *testing.T, name string, opts ...ClientOption) (Client, ed25519.PublicKey) {
+		pubKey, privKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+
+		c, err := NewClient(&PubIDAndKey{ID: e4crypto.HashIDAlias(name), Key: privKey, C2PubKey: generateCurve25519PubKey(t)}, "./test/data/clienttestpubkeybundle"+name, opts...)
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		return c, pubKey
+	}
+
+	exporter, exporterPubKey := newPubClient(t, "exporter")
+	for _, name := range []string{"device1", "device2", "device3"} {
+		pubKey, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+		if err := exporter.setPubKey(pubKey, e4crypto.HashIDAlias(name)); err != nil {
+			t.Fatalf("Failed to set pubkey: %v", err)
+		}
+	}
+
+	bundle, err := exporter.ExportPubKeyBundle()
+	if err != nil {
+		t.Fatalf("Failed to export pubkey bundle: %v", err)
+	}
+
+	expectedPubKeys, err := exporter.getPubKeys()
+	if err != nil {
+		t.Fatalf("Failed to get pubkeys: %v", err)
+	}
+
+	t.Run("import yields an identical store", func(t *testing.T) {
+		importer, _ := newPubClient(t, "importer")
+
+		n, err := importer.ImportPubKeyBundle(bundle)
+		if err != nil {
+			t.Fatalf("Failed to import pubkey bundle: %v", err)
+		}
+		if g, w := n, len(expectedPubKeys); g != w {
+			t.Fatalf("Invalid imported pubkeys count: got %d, wanted %d", g, w)
+		}
+
+		pubKeys, err := importer.getPubKeys()
+		if err != nil {
+			t.Fatalf("Failed to get pubkeys: %v", err)
+		}
+		if !reflect.DeepEqual(pubKeys, expectedPubKeys) {
+			t.Fatalf("Invalid imported pubkeys: got %v, wanted %v", pubKeys, expectedPubKeys)
+		}
+
+		// The export must be canonical
+		reexported, err := exporter.ExportPubKeyBundle()
+		if err != nil {
+			t.Fatalf("Failed to export pubkey bundle: %v", err)
+		}
+		if string(reexported) != string(bundle) {
+			t.Fatalf("Invalid exported pubkey bundle: got %s, wanted %s", reexported, bundle)
+		}
+	})
+
+	t.Run("tampered bundles are rejected when the signer is known", func(t *testing.T) {
+		importer, _ := newPubClient(t, "importertampered")
+		if err := importer.setPubKey(exporterPubKey, e4crypto.HashIDAlias("exporter")); err != nil {
+			t.Fatalf("Failed to set pubkey: %v", err)
+		}
+
+		tamperedBundle := &pubKeyBundle{}
+		if err := json.Unmarshal(bundle, tamperedBundle); err != nil {
+			t.Fatalf("Failed to unmarshal pubkey bundle: %v", err)
+		}
+		attackerPubKey, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate ed25519 key: %v", err)
+		}
+		for sid := range tamperedBundle.PubKeys {
+			tamperedBundle.PubKeys[sid] = attackerPubKey
+		}
+		rawTamperedBundle, err := json.Marshal(tamperedBundle)
+		if err != nil {
+			t.Fatalf("Failed to marshal pubkey bundle: %v", err)
+		}
+
+		if _, err := importer.ImportPubKeyBundle(rawTamperedBundle); err != ErrInvalidBundleSignature {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrInvalidBundleSignature)
+		}
+
+		pubKeys, err := importer.getPubKeys()
+		if err != nil {
+			t.Fatalf("Failed to get pubkeys: %v", err)
+		}
+		if g, w := len(pubKeys), 1; g != w {
+			t.Fatalf("Invalid pubkeys count: got %d, wanted %d", g, w)
+		}
+
+		if _, err := importer.ImportPubKeyBundle(bundle); err != nil {
+			t.Fatalf("Failed to import pubkey bundle: %v", err)
+		}
+	})
+
+	t.Run("strict clients only import verified bundles", func(t *testing.T) {
+		importer, _ := newPubClient(t, "importerstrict", WithStrictPubKeyBundles())
+
+		unsignedBundle := &pubKeyBundle{}
+		if err := json.Unmarshal(bundle, unsignedBundle); err != nil {
+			t.Fatalf("Failed to unmarshal pubkey bundle: %v", err)
+		}
+		unsignedBundle.SignerID = nil
+		unsignedBundle.Signature = nil
+		rawUnsignedBundle, err := json.Marshal(unsignedBundle)
+		if err != nil {
+			t.Fatalf("Failed to marshal pubkey bundle: %v", err)
+		}
+
+		for _, b := range [][]byte{bundle, rawUnsignedBundle} {
+			if _, err := importer.ImportPubKeyBundle(b); err != ErrUnverifiedBundle {
+				t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnverifiedBundle)
+			}
+		}
+
+		pubKeys, err := importer.getPubKeys()
+		if err != nil {
+			t.Fatalf("Failed to get pubkeys: %v", err)
+		}
+		if len(pubKeys) != 0 {
+			t.Fatalf("Expected no pubkeys to be imported, got %v", pubKeys)
+		}
+
+		if err := importer.setPubKey(exporterPubKey, e4crypto.HashIDAlias("exporter")); err != nil {
+			t.Fatalf("Failed to set pubkey: %v", err)
+		}
+		if _, err := importer.ImportPubKeyBundle(bundle); err != nil {
+			t.Fatalf("Failed to import pubkey bundle: %v", err)
+		}
+		if _, err := importer.ImportPubKeyBundle(rawUnsignedBundle); err != ErrUnverifiedBundle {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnverifiedBundle)
+		}
+	})
+
+	t.Run("invalid bundles are rejected", func(t *testing.T) {
+		importer, _ := newPubClient(t, "importerinvalid")
+
+		invalidBundles := []string{
+			`not json`,
+			`{"pubKeys": {"not hex": "AAAA"}}`,
+			`{"pubKeys": {"0011": "AAAA"}}`,
+		}
+		for _, invalidBundle := range invalidBundles {
+			if _, err := importer.ImportPubKeyBundle([]byte(invalidBundle)); err == nil {
+				t.Fatalf("Expected an error when importing pubkey bundle %s", invalidBundle)
+			}
+		}
+
+		pubKeys, err := importer.getPubKeys()
+		if err != nil {
+			t.Fatalf("Failed to get pubkeys: %v", err)
+		}
+		if len(pubKeys) != 0 {
+			t.Fatalf("Expected no pubkeys to be imported, got %v", pubKeys)
+		}
+	})
+
+	t.Run("symmetric clients are not supported", func(t *testing.T) {
+		symClient, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttestpubkeybundlesym")
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		if _, err := symClient.ExportPubKeyBundle(); err != ErrUnsupportedOperation {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+		}
+		if _, err := symClient.ImportPubKeyBundle(bundle); err != ErrUnsupportedOperation {
+			t.Fatalf("Invalid error: got %v, wanted %v", err, ErrUnsupportedOperation)
+		}
+	})
+}
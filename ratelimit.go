@@ -0,0 +1,66 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of events to a number of events per period, allowing bursts up to this number.
+// It holds up to capacity tokens, replenished continuously at capacity tokens per period,
+// and each allowed event consumes a token. It is safe for concurrent use.
+type tokenBucket struct {
+	capacity float64
+	// refillRate is the number of tokens replenished per second
+	refillRate float64
+	tokens     float64
+	refilledAt time.Time
+	clock      Clock
+	mutex      sync.Mutex
+}
+
+// newTokenBucket creates a full token bucket allowing n events per period, timed with the given clock
+func newTokenBucket(n int, per time.Duration, clock Clock) *tokenBucket {
+	return &tokenBucket{
+		capacity:   float64(n),
+		refillRate: float64(n) / per.Seconds(),
+		tokens:     float64(n),
+		refilledAt: clock.Now(),
+		clock:      clock,
+	}
+}
+
+// allow consumes a token and returns true when one is available, or returns false otherwise
+func (b *tokenBucket) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.clock.Now()
+	if elapsed := now.Sub(b.refilledAt); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.refillRate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+	}
+	b.refilledAt = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
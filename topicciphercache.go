@@ -0,0 +1,105 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"bytes"
+	"sync"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+	"github.com/teserakt-io/e4go/keys"
+)
+
+// topicCipherCache holds the ciphers created from the client topic keys, indexed by hex encoded topic hash.
+// It avoids creating a new cipher for each message protected under the same topic key.
+// Each entry records the key it has been created from, so a cipher is never used with a rotated key.
+// It is safe for concurrent access.
+type topicCipherCache struct {
+	entries map[string]*topicCipherCacheEntry
+
+	lock sync.Mutex
+}
+
+// topicCipherCacheEntry holds a topic key and the cipher created from it
+type topicCipherCacheEntry struct {
+	key    keys.TopicKey
+	cipher *e4crypto.Cipher
+}
+
+// newTopicCipherCache creates a new empty topicCipherCache
+func newTopicCipherCache() *topicCipherCache {
+	return &topicCipherCache{
+		entries: make(map[string]*topicCipherCacheEntry),
+	}
+}
+
+// Cipher returns the cipher for the given topic hash and key, from the cache when it
+// has been created from the same key, otherwise creating it and replacing the cached one.
+func (c *topicCipherCache) Cipher(topicHash string, key keys.TopicKey) (*e4crypto.Cipher, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry, ok := c.entries[topicHash]; ok && bytes.Equal(entry.key, key) {
+		return entry.cipher, nil
+	}
+
+	cipher, err := e4crypto.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	cachedKey := make(keys.TopicKey, len(key))
+	copy(cachedKey, key)
+	c.entries[topicHash] = &topicCipherCacheEntry{key: cachedKey, cipher: cipher}
+
+	return cipher, nil
+}
+
+// Invalidate removes the cipher of the given topic hash from the cache
+func (c *topicCipherCache) Invalidate(topicHash string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.entries, topicHash)
+}
+
+// Reset removes all the ciphers from the cache
+func (c *topicCipherCache) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = make(map[string]*topicCipherCacheEntry)
+}
+
+// Wipe zeroes the copies of the topic keys held by the cache, and removes all the ciphers from it
+func (c *topicCipherCache) Wipe() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, entry := range c.entries {
+		for i := range entry.key {
+			entry.key[i] = 0
+		}
+	}
+	c.entries = make(map[string]*topicCipherCacheEntry)
+}
+
+// Len returns the number of ciphers currently cached
+func (c *topicCipherCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.entries)
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+func TestTopicCipherCacheRotation(t *testing.T) {
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttesttopicciphercache")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	tc := c.(*client)
+
+	topic := "topic"
+	topicHash := hex.EncodeToString(e4crypto.HashTopic(topic))
+	oldKey := e4crypto.RandomKey()
+	if err := c.SetTopicKeyByName(oldKey, topic); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+
+	payload := []byte("payload")
+	if _, err := c.ProtectMessage(payload, topic); err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+	if g, w := tc.topicCiphers.Len(), 1; g != w {
+		t.Fatalf("Invalid cache length: got %d, wanted %d", g, w)
+	}
+	cachedCipher := tc.topicCiphers.entries[topicHash].cipher
+
+	if _, err := c.ProtectMessage(payload, topic); err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+	if tc.topicCiphers.entries[topicHash].cipher != cachedCipher {
+		t.Fatal("Expected cached cipher to be reused")
+	}
+
+	newKey := e4crypto.RandomKey()
+	if err := c.SetTopicKeyByName(newKey, topic); err != nil {
+		t.Fatalf("SetTopicKeyByName failed: %v", err)
+	}
+	if g, w := tc.topicCiphers.Len(), 0; g != w {
+		t.Fatalf("Invalid cache length after key rotation: got %d, wanted %d", g, w)
+	}
+
+	protected, err := c.ProtectMessage(payload, topic)
+	if err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+
+	unprotected, err := e4crypto.UnprotectSymKey(protected, newKey)
+	if err != nil {
+		t.Fatalf("Expected message to be protected with the new key, got error: %v", err)
+	}
+	if !bytes.Equal(unprotected, payload) {
+		t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+	}
+	if _, err := e4crypto.UnprotectSymKey(protected, oldKey); err == nil {
+		t.Fatal("Expected message not to be protected with the old key")
+	}
+
+	// Entries created from a stale key are never used
+	if _, err := tc.topicCiphers.Cipher(topicHash, oldKey); err != nil {
+		t.Fatalf("Failed to get cipher: %v", err)
+	}
+	protected, err = c.ProtectMessage(payload, topic)
+	if err != nil {
+		t.Fatalf("Protect failed: %v", err)
+	}
+	if _, err := e4crypto.UnprotectSymKey(protected, newKey); err != nil {
+		t.Fatalf("Expected message to be protected with the new key, got error: %v", err)
+	}
+
+	if err := c.resetTopics(); err != nil {
+		t.Fatalf("ResetTopics failed: %v", err)
+	}
+	if g, w := tc.topicCiphers.Len(), 0; g != w {
+		t.Fatalf("Invalid cache length after topics reset: got %d, wanted %d", g, w)
+	}
+}
+
+func BenchmarkProtectMessage(b *testing.B) {
+	topic := "some/sensor/topic"
+	topicKey := e4crypto.RandomKey()
+	payload := []byte("some sensor reading payload")
+
+	b.Run("uncached", func(b *testing.B) {
+		k, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clientbenchprotect")
+		if err != nil {
+			b.Fatalf("Failed to create client: %v", err)
+		}
+
+		tk := k.(*client).Key
+		for i := 0; i < b.N; i++ {
+			if _, err := tk.ProtectMessage(payload, topicKey); err != nil {
+				b.Fatalf("Protect failed: %v", err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clientbenchprotect")
+		if err != nil {
+			b.Fatalf("Failed to create client: %v", err)
+		}
+		if err := c.SetTopicKeyByName(topicKey, topic); err != nil {
+			b.Fatalf("SetTopicKeyByName failed: %v", err)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := c.ProtectMessage(payload, topic); err != nil {
+				b.Fatalf("Protect failed: %v", err)
+			}
+		}
+	})
+}
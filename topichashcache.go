@@ -0,0 +1,104 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"container/list"
+	"sync"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+const (
+	// topicHashCacheSize is the maximum number of topic hashes kept in a client cache
+	topicHashCacheSize = 64
+)
+
+// topicHashCache is a least recently used cache of topic hashes, indexed by topic.
+// It avoids computing the hash of frequently used topics on each message.
+// It is safe for concurrent access.
+type topicHashCache struct {
+	capacity int
+	hasher   func(topic string) []byte
+	entries  map[string]*list.Element
+	order    *list.List
+
+	lock sync.Mutex
+}
+
+// topicHashCacheEntry holds a topic and its hash in the cache eviction list
+type topicHashCacheEntry struct {
+	topic string
+	hash  []byte
+}
+
+// newTopicHashCache creates a new topicHashCache holding at most capacity topics,
+// hashed with e4crypto.HashTopic until another hasher is set
+func newTopicHashCache(capacity int) *topicHashCache {
+	return &topicHashCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+// Hash returns the hash of the given topic, from the cache when available,
+// otherwise computing it and adding it to the cache, evicting the least recently used topic if needed.
+// The returned hash must not be modified.
+func (c *topicHashCache) Hash(topic string) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elt, ok := c.entries[topic]; ok {
+		c.order.MoveToFront(elt)
+		return elt.Value.(*topicHashCacheEntry).hash
+	}
+
+	var hash []byte
+	if c.hasher != nil {
+		hash = c.hasher(topic)
+	} else {
+		hash = e4crypto.HashTopic(topic)
+	}
+
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*topicHashCacheEntry).topic)
+	}
+
+	c.entries[topic] = c.order.PushFront(&topicHashCacheEntry{topic: topic, hash: hash})
+
+	return hash
+}
+
+// SetHasher replaces the function computing the topic hashes, and clears the cache.
+// A nil hasher restores the default e4crypto.HashTopic.
+func (c *topicHashCache) SetHasher(hasher func(topic string) []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.hasher = hasher
+	c.entries = make(map[string]*list.Element, c.capacity)
+	c.order.Init()
+}
+
+// Len returns the number of topics currently cached
+func (c *topicHashCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
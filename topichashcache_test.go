@@ -0,0 +1,97 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	e4crypto "github.com/teserakt-io/e4go/crypto"
+)
+
+func TestTopicHashCache(t *testing.T) {
+	cache := newTopicHashCache(2)
+
+	topics := []string{"topic1", "topic2", "topic1", "topic3", "topic2", "topic1"}
+	for _, topic := range topics {
+		if g, w := cache.Hash(topic), e4crypto.HashTopic(topic); !bytes.Equal(g, w) {
+			t.Fatalf("Invalid hash for topic %s: got %v, wanted %v", topic, g, w)
+		}
+
+		if cache.Len() > 2 {
+			t.Fatalf("Invalid cache length: got %d, wanted at most 2", cache.Len())
+		}
+	}
+
+	// topic3 must have been evicted by topic2 and topic1
+	if _, ok := cache.entries["topic3"]; ok {
+		t.Fatal("Expected topic3 to have been evicted from the cache")
+	}
+}
+
+func TestTopicHashCacheEviction(t *testing.T) {
+	c, err := NewClient(&SymIDAndKey{Key: e4crypto.RandomKey()}, "./test/data/clienttesttopichashcache")
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	topicCount := topicHashCacheSize * 2
+	for i := 0; i < topicCount; i++ {
+		topic := fmt.Sprintf("topic%d", i)
+		if err := c.setTopicKey(e4crypto.RandomKey(), e4crypto.HashTopic(topic)); err != nil {
+			t.Fatalf("SetTopicKey failed: %v", err)
+		}
+	}
+
+	// Loop twice over all the topics, so every topic gets evicted at least once
+	for j := 0; j < 2; j++ {
+		for i := 0; i < topicCount; i++ {
+			topic := fmt.Sprintf("topic%d", i)
+			payload := []byte(topic)
+
+			protected, err := c.ProtectMessage(payload, topic)
+			if err != nil {
+				t.Fatalf("Protect failed: %v", err)
+			}
+
+			unprotected, err := c.Unprotect(protected, topic)
+			if err != nil {
+				t.Fatalf("Unprotect failed: %v", err)
+			}
+
+			if !bytes.Equal(unprotected, payload) {
+				t.Fatalf("Invalid unprotected message: got %v, wanted %v", unprotected, payload)
+			}
+		}
+	}
+}
+
+func BenchmarkHashTopic(b *testing.B) {
+	topic := "some/sensor/topic/with/a/rather/long/name"
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			e4crypto.HashTopic(topic)
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		cache := newTopicHashCache(topicHashCacheSize)
+		for i := 0; i < b.N; i++ {
+			cache.Hash(topic)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Teserakt AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e4
+
+import (
+	"sync"
+	"time"
+)
+
+// topicUsage records when the client topic keys have last been used, indexed by hex encoded topic hash.
+// It is only held in memory, to avoid persisting the client on every message.
+// It is safe for concurrent access.
+type topicUsage struct {
+	lastUsed map[string]time.Time
+
+	lock sync.Mutex
+}
+
+// newTopicUsage creates a new empty topicUsage
+func newTopicUsage() *topicUsage {
+	return &topicUsage{
+		lastUsed: make(map[string]time.Time),
+	}
+}
+
+// Touch records that the key of the given topic hash has been used at the given time
+func (u *topicUsage) Touch(topicHash string, t time.Time) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.lastUsed[topicHash] = t
+}
+
+// LastUsed returns when the key of the given topic hash has last been used,
+// and false when it hasn't been used since it has been set
+func (u *topicUsage) LastUsed(topicHash string) (time.Time, bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	t, ok := u.lastUsed[topicHash]
+
+	return t, ok
+}
+
+// Forget removes the usage of the given topic hash, such as when its key is replaced
+func (u *topicUsage) Forget(topicHash string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	delete(u.lastUsed, topicHash)
+}
+
+// Reset removes the usage of all the topics
+func (u *topicUsage) Reset() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.lastUsed = make(map[string]time.Time)
+}